@@ -16,12 +16,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"math/rand"
 	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
 	"time"
 
 	"k8s.io/klog"
 
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
 	driver "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-pd-csi-driver"
@@ -33,9 +38,60 @@ func init() {
 }
 
 var (
-	endpoint          = flag.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint")
+	endpoint          = flag.String("endpoint", "unix:/tmp/csi.sock", "CSI endpoint, either a unix socket (unix:/path/to/socket) or a TCP address (tcp://host:port)")
 	gceConfigFilePath = flag.String("cloud-config", "", "Path to GCE cloud provider config")
-	vendorVersion     string
+	quotaProject      = flag.String("quota-project", "", "Project that the usage of GCE APIs is billed to. If unset it is billed to the project of the credentials")
+	clusterID         = flag.String("cluster-id", "", "Identifier of the cluster written to the description of created disks. If unset it is omitted")
+	resourceTags      = flag.String("resource-tags", "", "Comma separated list of resource manager tags of the form parentID/tagKey/tagValue bound to every created disk. Tags of the resource-tags StorageClass parameter take precedence")
+
+	socketMode = flag.Uint("socket-mode", 0, "File mode of the unix socket endpoint in octal, e.g. 0660. If unset the mode is determined by the umask")
+	socketUID  = flag.Int("socket-uid", -1, "Owning user id of the unix socket endpoint. If unset the socket is owned by the user running the driver")
+	socketGID  = flag.Int("socket-gid", -1, "Owning group id of the unix socket endpoint. If unset the socket is owned by the group running the driver")
+
+	maxConcurrentRPCs       = flag.Int("max-concurrent-rpcs", 0, "Maximum number of RPCs served concurrently, further RPCs are rejected with Aborted. 0 means unlimited")
+	methodConcurrencyLimits = flag.String("max-concurrent-rpcs-per-method", "", "Comma separated list of method=limit pairs limiting the number of concurrent RPCs of a method, e.g. NodeStageVolume=10")
+
+	rpcTimeout = flag.Duration("rpc-timeout", 0, "Maximum duration of a single RPC, RPCs exceeding it fail with DeadlineExceeded. Deadlines set by the caller are always enforced. 0 means no additional limit")
+
+	operationPollInterval      = flag.Duration("operation-poll-interval", gce.DefaultOperationPollConfig().Interval, "Initial interval at which zonal, regional and global GCE operations are polled until they are done")
+	operationPollBackoffFactor = flag.Float64("operation-poll-backoff-factor", gce.DefaultOperationPollConfig().Factor, "Factor by which the interval between polls of a GCE operation grows after each poll. 1 polls at a constant interval")
+	operationPollMaxInterval   = flag.Duration("operation-poll-max-interval", gce.DefaultOperationPollConfig().MaxInterval, "Maximum interval between polls of a GCE operation")
+	operationTimeout           = flag.Duration("operation-timeout", gce.DefaultOperationPollConfig().Timeout, "Maximum time to wait for a GCE operation to complete")
+
+	// For testing only, must not be set in production
+	faultInjection = flag.String("fault-injection", "", "For testing only. Semicolon separated list of rules injecting failures and latencies into RPCs, e.g. ControllerPublishVolume:code=Unavailable,every=3;NodeStageVolume:latency=5s")
+
+	orphanedDiskGCInterval = flag.Duration("orphaned-disk-gc-interval", 0, "Interval at which disks created by the driver whose PersistentVolume no longer exists, and that no other PersistentVolume references, are looked for and logged. Orphaned disks are never deleted. Requires --cluster-id and the disk description to contain the PV name, i.e. the external-provisioner to run with --extra-create-metadata. 0 disables the collection")
+	orphanedDiskGCMinAge   = flag.Duration("orphaned-disk-gc-min-age", time.Hour, "Minimum age of a disk before it is considered orphaned, so that disks whose PersistentVolume is still being created are skipped")
+
+	emitEvents = flag.Bool("emit-events", false, "If set, Kubernetes warning events are posted when provisioning, attaching or mounting a volume fails: on the PersistentVolumeClaim, which requires the external-provisioner to run with --extra-create-metadata, on the Pod, which requires podInfoOnMount in the CSIDriver object, or on the Node. Requires running in-cluster with permission to create events and get persistentvolumeclaims, pods and nodes")
+
+	allowFsTypeMismatch = flag.Bool("allow-fstype-mismatch", false, "If set, devices that already contain a filesystem other than the requested fstype are mounted as the requested fstype instead of failing NodeStageVolume with FailedPrecondition")
+
+	repairFilesystemOnMountFailure = flag.Bool("repair-filesystem-on-mount-failure", false, "If set, the ext2, ext3, ext4 or xfs filesystem of a device that fails to mount is repaired once with e2fsck -y or xfs_repair before mounting it again, e.g. after an unclean detach. Repairs may discard corrupted data")
+
+	enableEphemeralVolumes = flag.Bool("enable-ephemeral-volumes", false, "If set, the node service provisions CSI ephemeral inline volumes: a disk is created in the zone of the node and attached to it when the volume is published, and deleted when it is unpublished. The volume attributes \"type\" and \"size\", e.g. 10Gi, set the disk type and size. Requires the Ephemeral volume lifecycle mode in the CSIDriver object and permission to create, attach, detach and delete disks on the node")
+
+	checkXFSFilesystems  = flag.Bool("check-xfs-filesystems", false, "If set, the xfs filesystems of volumes staged read-write are checked with xfs_repair -n before they are mounted, as fsck checks ext4 filesystems. Staging fails for corrupted filesystems unless --repair-xfs-filesystems is set")
+	repairXFSFilesystems = flag.Bool("repair-xfs-filesystems", false, "If set together with --check-xfs-filesystems, corrupted xfs filesystems are repaired with xfs_repair before they are mounted. Repairs may discard corrupted data")
+
+	maxVolumesPerNode = flag.Int64("max-volumes-per-node", 0, "Maximum number of volumes attached to the node reported to the CO, if lower than the limit of the machine type, so that attachments are left for disks not managed by the driver. 0 reports the limit of the machine type")
+
+	readAheadKB = flag.Int64("read-ahead-kb", 0, "read_ahead_kb set on the devices of staged volumes, unless overridden by the read-ahead-kb volume attribute. 0 keeps the kernel default")
+	fsckTimeout = flag.Duration("fsck-timeout", 0, "Maximum duration of the fsck of a volume's filesystem when staging it, after which staging fails with DeadlineExceeded and is retried. 0 only limits the check by the deadline of the NodeStageVolume call")
+
+	runControllerService = flag.Bool("run-controller-service", true, "If set to false then the CSI driver does not activate its controller service (default: true)")
+	runNodeService       = flag.Bool("run-node-service", true, "If set to false then the CSI driver does not activate its node service (default: true)")
+
+	// Kept below the default Kubernetes pod termination grace period of 30s
+	// so that the drain completes before the kubelet sends SIGKILL
+	shutdownGracePeriod = flag.Duration("shutdown-grace-period", 25*time.Second, "Maximum time to wait for in-flight operations to complete after receiving SIGTERM or SIGINT before forcefully stopping the driver")
+	printVersion        = flag.Bool("version", false, "Print the driver version and build metadata and exit")
+
+	// The following are set at compile time with -ldflags "-X main.<name>=<value>"
+	vendorVersion string
+	gitCommit     string
+	buildDate     string
 )
 
 const (
@@ -48,6 +104,11 @@ func init() {
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Printf("%s version: %s, git commit: %s, build date: %s, go version: %s, platform: %s/%s\n",
+			driverName, vendorVersion, gitCommit, buildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		os.Exit(0)
+	}
 	rand.Seed(time.Now().UnixNano())
 	handle()
 	os.Exit(0)
@@ -57,28 +118,151 @@ func handle() {
 	if vendorVersion == "" {
 		klog.Fatalf("vendorVersion must be set at compile time")
 	}
-	klog.V(4).Infof("Driver vendor version %v", vendorVersion)
-
-	gceDriver := driver.GetGCEDriver()
-
-	//Initialize GCE Driver (Move setup to main?)
-	cloudProvider, err := gce.CreateCloudProvider(vendorVersion, *gceConfigFilePath)
+	if *socketMode > uint(os.ModePerm) {
+		klog.Fatalf("Invalid socket mode %#o, must be at most %#o", *socketMode, os.ModePerm)
+	}
+	methodLimits, err := driver.ParseMethodLimits(*methodConcurrencyLimits)
 	if err != nil {
-		klog.Fatalf("Failed to get cloud provider: %v", err)
+		klog.Fatalf("Failed to parse max-concurrent-rpcs-per-method: %v", err)
+	}
+	faultRules, err := driver.ParseFaultRules(*faultInjection)
+	if err != nil {
+		klog.Fatalf("Failed to parse fault-injection: %v", err)
+	}
+	defaultResourceTags, err := common.ParseResourceTags(*resourceTags)
+	if err != nil {
+		klog.Fatalf("Failed to parse resource-tags: %v", err)
+	}
+	if *orphanedDiskGCInterval > 0 && *clusterID == "" {
+		klog.Fatalf("orphaned-disk-gc-interval requires cluster-id to be set, so that only disks of this cluster are collected")
+	}
+	if *maxVolumesPerNode < 0 {
+		klog.Fatalf("Invalid max-volumes-per-node %d, must not be negative", *maxVolumesPerNode)
 	}
+	if *readAheadKB < 0 {
+		klog.Fatalf("Invalid read-ahead-kb %d, must not be negative", *readAheadKB)
+	}
+	if *repairXFSFilesystems && !*checkXFSFilesystems {
+		klog.Fatalf("repair-xfs-filesystems requires check-xfs-filesystems to be set")
+	}
+	klog.V(4).Infof("Driver vendor version %v, git commit %v, build date %v", vendorVersion, gitCommit, buildDate)
 
-	mounter := mountmanager.NewSafeMounter()
-	deviceUtils := mountmanager.NewDeviceUtils()
+	gceDriver := driver.GetGCEDriver()
 
 	ms, err := metadataservice.NewMetadataService()
 	if err != nil {
 		klog.Fatalf("Failed to set up metadata service: %v", err)
 	}
 
-	err = gceDriver.SetupGCEDriver(cloudProvider, mounter, deviceUtils, ms, driverName, vendorVersion)
+	//Initialize identity server
+	identityServer := driver.NewIdentityServer(gceDriver)
+
+	//Initialize requirements for the controller service
+	var controllerServer *driver.GCEControllerServer
+	if *runControllerService {
+		cloudProvider := newCloudProvider()
+		controllerServer = driver.NewControllerServer(gceDriver, cloudProvider, ms)
+		controllerServer.ClusterID = *clusterID
+		controllerServer.ResourceTags = defaultResourceTags
+	} else if *gceConfigFilePath != "" && !*enableEphemeralVolumes {
+		klog.Warningf("controller service is disabled but cloud config given - it has no effect")
+	}
+
+	//Initialize requirements for the node service
+	var nodeServer *driver.GCENodeServer
+	if *runNodeService {
+		mounter := mountmanager.NewSafeMounter()
+		deviceUtils := mountmanager.NewDeviceUtils()
+		nodeServer = driver.NewNodeServer(gceDriver, mounter, deviceUtils, ms)
+		nodeServer.ReadAheadKB = *readAheadKB
+		nodeServer.FsckTimeout = *fsckTimeout
+		nodeServer.MaxVolumesPerNode = *maxVolumesPerNode
+		nodeServer.AllowFsTypeMismatch = *allowFsTypeMismatch
+		nodeServer.RepairFilesystemOnMountFailure = *repairFilesystemOnMountFailure
+		nodeServer.CheckXFSFilesystems = *checkXFSFilesystems
+		nodeServer.RepairXFSFilesystems = *repairXFSFilesystems
+		if *enableEphemeralVolumes {
+			nodeServer.CloudProvider = newCloudProvider()
+		}
+	}
+
+	manifest := map[string]string{
+		"gitCommit": gitCommit,
+		"buildDate": buildDate,
+		"goVersion": runtime.Version(),
+		"platform":  fmt.Sprintf("%s/%s", runtime.GOOS, runtime.GOARCH),
+	}
+
+	err = gceDriver.SetupGCEDriver(driverName, vendorVersion, manifest, identityServer, controllerServer, nodeServer)
 	if err != nil {
 		klog.Fatalf("Failed to initialize GCE CSI Driver: %v", err)
 	}
 
-	gceDriver.Run(*endpoint)
+	handleVerbositySignals()
+
+	stopCh := make(chan struct{})
+	if controllerServer != nil && *orphanedDiskGCInterval > 0 {
+		pvLister, err := driver.NewInClusterPVLister()
+		if err != nil {
+			klog.Fatalf("Failed to set up PersistentVolume lookups for orphaned disk collection: %v", err)
+		}
+		collector := driver.NewOrphanedDiskCollector(controllerServer, pvLister, *orphanedDiskGCMinAge)
+		go collector.Run(*orphanedDiskGCInterval, stopCh)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		klog.Infof("Received signal %v, shutting down", sig)
+		close(stopCh)
+		gceDriver.Stop(*shutdownGracePeriod)
+	}()
+
+	// Events about failed mounts are posted on the Node of the node service
+	nodeName := ""
+	if *runNodeService {
+		nodeName = ms.GetName()
+	}
+	var eventRecorder driver.EventRecorder
+	if *emitEvents {
+		eventRecorder, err = driver.NewInClusterEventRecorder(driverName, nodeName, stopCh)
+		if err != nil {
+			klog.Fatalf("Failed to set up event recording: %v", err)
+		}
+	}
+
+	serverOpts := driver.ServerOptions{
+		SocketMode: os.FileMode(*socketMode),
+		SocketUID:  *socketUID,
+		SocketGID:  *socketGID,
+
+		MaxConcurrentRPCs:       *maxConcurrentRPCs,
+		MethodConcurrencyLimits: methodLimits,
+		RPCTimeout:              *rpcTimeout,
+		FaultRules:              faultRules,
+
+		EventRecorder: eventRecorder,
+		NodeName:      nodeName,
+	}
+	gceDriver.Run(*endpoint, serverOpts)
+}
+
+// newCloudProvider creates the cloud provider of the controller service and of
+// the ephemeral volumes of the node service
+func newCloudProvider() *gce.CloudProvider {
+	cloudProvider, err := gce.CreateCloudProvider(vendorVersion, *gceConfigFilePath, *quotaProject)
+	if err != nil {
+		klog.Fatalf("Failed to get cloud provider: %v", err)
+	}
+	err = cloudProvider.SetOperationPollConfig(gce.OperationPollConfig{
+		Interval:    *operationPollInterval,
+		Factor:      *operationPollBackoffFactor,
+		MaxInterval: *operationPollMaxInterval,
+		Timeout:     *operationTimeout,
+	})
+	if err != nil {
+		klog.Fatalf("Invalid operation poll configuration: %v", err)
+	}
+	return cloudProvider
 }
@@ -0,0 +1,68 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+
+	"k8s.io/klog"
+)
+
+// maxVerbosity is the highest log level SIGUSR1 raises the verbosity to
+const maxVerbosity = 10
+
+// handleVerbositySignals adjusts the klog verbosity at runtime so that the
+// driver can be debugged without restarting it and losing the state being
+// investigated. SIGUSR1 raises the verbosity by one level, SIGUSR2 restores
+// the verbosity the driver was started with.
+func handleVerbositySignals() {
+	v := flag.Lookup("v")
+	if v == nil {
+		klog.Warningf("Log verbosity flag not registered, runtime verbosity changes are disabled")
+		return
+	}
+	initial, err := strconv.Atoi(v.Value.String())
+	if err != nil {
+		klog.Warningf("Failed to parse log verbosity %q, runtime verbosity changes are disabled: %v", v.Value.String(), err)
+		return
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		current := initial
+		for sig := range sigCh {
+			switch sig {
+			case syscall.SIGUSR1:
+				if current >= maxVerbosity {
+					klog.Infof("Log verbosity is already at the maximum level %d", current)
+					continue
+				}
+				current++
+			case syscall.SIGUSR2:
+				current = initial
+			}
+			if err := v.Value.Set(strconv.Itoa(current)); err != nil {
+				klog.Errorf("Failed to set log verbosity to %d: %v", current, err)
+				continue
+			}
+			klog.Infof("Received signal %v, log verbosity set to %d", sig, current)
+		}
+	}()
+}
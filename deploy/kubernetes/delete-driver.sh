@@ -6,12 +6,14 @@
 # Args:
 # GCE_PD_DRIVER_VERSION: The kustomize overlay to deploy (located under
 #   deploy/kubernetes/overlays). Can be one of {stable, dev}
+# GCE_PD_PKGDIR: Directory of the driver repository, defaults to its GOPATH
+#   location
 
 set -o nounset
 set -o errexit
 
 readonly DEPLOY_VERSION="${GCE_PD_DRIVER_VERSION:-stable}"
-readonly PKGDIR="${GOPATH}/src/sigs.k8s.io/gcp-compute-persistent-disk-csi-driver"
+readonly PKGDIR="${GCE_PD_PKGDIR:-${GOPATH}/src/sigs.k8s.io/gcp-compute-persistent-disk-csi-driver}"
 source "${PKGDIR}/deploy/common.sh"
 
 ensure_kustomize
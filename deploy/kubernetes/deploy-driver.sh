@@ -11,6 +11,8 @@
 # GCE_PD_SA_DIR: Directory the service account key has been saved in (generated by setup-project.sh)
 # GCE_PD_DRIVER_VERSION: The kustomize overlay (located in
 #   deploy/kubernetes/overlays) to deploy. Can be one of {stable, dev}
+# GCE_PD_PKGDIR: Directory of the driver repository, defaults to its GOPATH
+#   location
 
 set -o nounset
 set -o errexit
@@ -18,7 +20,7 @@ set -x
 
 readonly NAMESPACE="${GCE_PD_DRIVER_NAMESPACE:-default}"
 readonly DEPLOY_VERSION="${GCE_PD_DRIVER_VERSION:-stable}"
-readonly PKGDIR="${GOPATH}/src/sigs.k8s.io/gcp-compute-persistent-disk-csi-driver"
+readonly PKGDIR="${GCE_PD_PKGDIR:-${GOPATH}/src/sigs.k8s.io/gcp-compute-persistent-disk-csi-driver}"
 source "${PKGDIR}/deploy/common.sh"
 
 print_usage()
@@ -21,6 +21,49 @@ const (
 	ParameterKeyType                 = "type"
 	ParameterKeyReplicationType      = "replication-type"
 	ParameterKeyDiskEncryptionKmsKey = "disk-encryption-kms-key"
+	ParameterKeyResourceTags         = "resource-tags"
+	ParameterKeySourceImage          = "source-image"
+	ParameterKeyStoragePools         = "storage-pools"
+	ParameterKeyZones                = "zones"
+	// read_ahead_kb of the device of the staged disk
+	ParameterKeyReadAheadKB = "read-ahead-kb"
+	// Tuning of ext4 filesystems created when the disk is staged
+	ParameterKeyExt4ReservedBlocksPercentage = "ext4-reserved-blocks-percentage"
+	ParameterKeyExt4LazyInit                 = "ext4-lazy-init"
+	// Encrypts the disk with LUKS on the node, with the key of the
+	// NodeStageVolume secrets
+	ParameterKeyLUKSEncryption = "luks-encryption"
+	// Key for VolumeSnapshotClass Parameters selecting the GCE resource
+	// backing snapshots
+	ParameterKeySnapshotType = "snapshot-type"
+
+	// Values of the snapshot-type parameter
+	DiskSnapshotType = "snapshots"
+	DiskImageType    = "images"
+
+	// Enables confidential compute on the disk, requires a hyperdisk type
+	ParameterKeyEnableConfidentialCompute = "enable-confidential-compute"
+
+	// Keys for Secrets holding a customer-supplied encryption key, either the
+	// base64 encoded raw key or the RSA-wrapped key
+	SecretKeyDiskEncryptionRawKey          = "disk-encryption-raw-key"
+	SecretKeyDiskEncryptionRsaEncryptedKey = "disk-encryption-rsa-encrypted-key"
+
+	// Key for the NodeStageVolume Secret holding the LUKS passphrase
+	SecretKeyLUKSKey = "luks-key"
+
+	// Keys for Parameters the external-provisioner adds with --extra-create-metadata
+	ParameterKeyPVCName      = "csi.storage.k8s.io/pvc/name"
+	ParameterKeyPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	ParameterKeyPVName       = "csi.storage.k8s.io/pv/name"
+
+	// Keys of the JSON object written as the description of created disks
+	DiskDescriptionKeyCreatedBy     = "storage.gke.io/created-by"
+	DiskDescriptionKeyDriverVersion = "storage.gke.io/driver-version"
+	DiskDescriptionKeyClusterID     = "storage.gke.io/cluster-id"
+	DiskDescriptionKeyPVCName       = "kubernetes.io/created-for/pvc/name"
+	DiskDescriptionKeyPVCNamespace  = "kubernetes.io/created-for/pvc/namespace"
+	DiskDescriptionKeyPVName        = "kubernetes.io/created-for/pv/name"
 
 	// Keys for Topology. This key will be shared amongst drivers from GCP
 	TopologyKeyZone = "topology.gke.io/zone"
@@ -28,5 +71,23 @@ const (
 	// VolumeAttributes for Partition
 	VolumeAttributePartition = "partition"
 
+	// VolumeAttributes for disks with confidential compute enabled
+	VolumeAttributeEnableConfidentialCompute = "enable-confidential-compute"
+
+	// VolumeAttributes for the read_ahead_kb of the device, overriding the
+	// default of the node
+	VolumeAttributeReadAheadKB = "read-ahead-kb"
+
+	// VolumeAttributes for the tuning of ext4 filesystems created on the disk
+	VolumeAttributeExt4ReservedBlocksPercentage = "ext4-reserved-blocks-percentage"
+	VolumeAttributeExt4LazyInit                 = "ext4-lazy-init"
+
+	// VolumeAttributes for disks encrypted with LUKS on the node
+	VolumeAttributeLUKSEncryption = "luks-encryption"
+
+	// PublishContext of volumes whose disk is attached read only, which are
+	// staged read only as well
+	PublishContextKeyReadOnly = "readonly"
+
 	UnspecifiedValue = "UNSPECIFIED"
 )
@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// ResponseCache remembers the responses of recent successful create
+// operations by name so that retries of an identical request can be answered
+// without querying GCE again. Entries expire after the TTL and the oldest
+// entry is evicted once the cache is full.
+type ResponseCache struct {
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*responseCacheEntry
+	mux        sync.Mutex
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+type responseCacheEntry struct {
+	// fingerprint identifies the request the response was returned for
+	fingerprint string
+	response    interface{}
+	added       time.Time
+}
+
+func NewResponseCache(ttl time.Duration, maxEntries int) *ResponseCache {
+	return &ResponseCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]*responseCacheEntry{},
+		now:        time.Now,
+	}
+}
+
+// Get returns the response cached for name. found is false if there is no
+// unexpired response for name, matches is false if the cached response was
+// returned for a request with a different fingerprint.
+func (c *ResponseCache) Get(name, fingerprint string) (response interface{}, found bool, matches bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry, ok := c.entries[name]
+	if !ok {
+		return nil, false, false
+	}
+	if c.now().Sub(entry.added) > c.ttl {
+		delete(c.entries, name)
+		return nil, false, false
+	}
+	if entry.fingerprint != fingerprint {
+		return nil, true, false
+	}
+	return entry.response, true, true
+}
+
+// Add caches the response for the request with the given name and
+// fingerprint
+func (c *ResponseCache) Add(name, fingerprint string, response interface{}) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.maxEntries <= 0 {
+		return
+	}
+	if _, ok := c.entries[name]; !ok && len(c.entries) >= c.maxEntries {
+		c.evictOldest()
+	}
+	c.entries[name] = &responseCacheEntry{
+		fingerprint: fingerprint,
+		response:    response,
+		added:       c.now(),
+	}
+}
+
+// Remove removes the response cached for name. It is called when the
+// resource with that name is deleted or modified.
+func (c *ResponseCache) Remove(name string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.entries, name)
+}
+
+func (c *ResponseCache) evictOldest() {
+	var oldestName string
+	var oldest *responseCacheEntry
+	for name, entry := range c.entries {
+		if oldest == nil || entry.added.Before(oldest.added) {
+			oldestName, oldest = name, entry
+		}
+	}
+	if oldest != nil {
+		delete(c.entries, oldestName)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	now := time.Now()
+	c := NewResponseCache(time.Minute, 2)
+	c.now = func() time.Time { return now }
+
+	if _, found, _ := c.Get("vol1", "fp1"); found {
+		t.Fatalf("Expected no response in empty cache")
+	}
+
+	c.Add("vol1", "fp1", "resp1")
+	resp, found, matches := c.Get("vol1", "fp1")
+	if !found || !matches || resp != "resp1" {
+		t.Fatalf("Expected matching response resp1, got %v (found %v, matches %v)", resp, found, matches)
+	}
+
+	_, found, matches = c.Get("vol1", "fp2")
+	if !found || matches {
+		t.Fatalf("Expected mismatching response, got found %v, matches %v", found, matches)
+	}
+
+	// Evicts the oldest entry once full
+	now = now.Add(time.Second)
+	c.Add("vol2", "fp2", "resp2")
+	now = now.Add(time.Second)
+	c.Add("vol3", "fp3", "resp3")
+	if _, found, _ := c.Get("vol1", "fp1"); found {
+		t.Errorf("Expected oldest response to be evicted")
+	}
+	if _, found, _ := c.Get("vol3", "fp3"); !found {
+		t.Errorf("Expected newest response to be cached")
+	}
+
+	// Removes responses by name
+	c.Remove("vol2")
+	if _, found, _ := c.Get("vol2", "fp2"); found {
+		t.Errorf("Expected response to be removed")
+	}
+
+	// Expires responses
+	now = now.Add(2 * time.Minute)
+	if _, found, _ := c.Get("vol3", "fp3"); found {
+		t.Errorf("Expected response to expire")
+	}
+}
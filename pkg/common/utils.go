@@ -18,6 +18,8 @@ package common
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
@@ -38,6 +40,7 @@ const (
 	// Snapshot ID
 	snapshotTotalElements = 5
 	snapshotTopologyKey   = 2
+	snapshotTypeKey       = 3
 
 	// Node ID Expected Format
 	// "projects/{projectName}/zones/{zoneName}/disks/{diskName}"
@@ -47,6 +50,9 @@ const (
 	nodeIDTotalElements = 6
 
 	regionalDeviceNameSuffix = "_regional"
+
+	// Maximum number of resource manager tags bound to a single resource
+	maxResourceTags = 50
 )
 
 func BytesToGb(bytes int64) int64 {
@@ -59,29 +65,24 @@ func GbToBytes(Gb int64) int64 {
 	return Gb * 1024 * 1024 * 1024
 }
 
+// VolumeIDToKey returns the key of the disk of the volume ID, see
+// ParseVolumeID
 func VolumeIDToKey(id string) (*meta.Key, error) {
-	splitId := strings.Split(id, "/")
-	if len(splitId) != volIDTotalElements {
-		return nil, fmt.Errorf("failed to get id components. Expected projects/{project}/zones/{zone}/disks/{name}. Got: %s", id)
-	}
-	if splitId[volIDToplogyKey] == "zones" {
-		return meta.ZonalKey(splitId[volIDDiskNameValue], splitId[volIDToplogyValue]), nil
-	} else if splitId[volIDToplogyKey] == "regions" {
-		return meta.RegionalKey(splitId[volIDDiskNameValue], splitId[volIDToplogyValue]), nil
-	} else {
-		return nil, fmt.Errorf("could not get id components, expected either zones or regions, got: %v", splitId[volIDToplogyKey])
+	volID, err := ParseVolumeID(id)
+	if err != nil {
+		return nil, err
 	}
+	return volID.Key, nil
 }
 
+// KeyToVolumeID returns the ID of the volume of the disk with the key in the
+// project
 func KeyToVolumeID(volKey *meta.Key, project string) (string, error) {
-	switch volKey.Type() {
-	case meta.Zonal:
-		return fmt.Sprintf(volIDZonalFmt, project, volKey.Zone, volKey.Zone), nil
-	case meta.Regional:
-		return fmt.Sprintf(volIDZonalFmt, project, volKey.Region, volKey.Zone), nil
-	default:
-		return "", fmt.Errorf("volume key %v neither zonal nor regional", volKey.Name)
+	volID, err := NewVolumeID(project, volKey)
+	if err != nil {
+		return "", err
 	}
+	return volID.String(), nil
 }
 
 func GenerateUnderspecifiedVolumeID(diskName string, isZonal bool) string {
@@ -91,15 +92,21 @@ func GenerateUnderspecifiedVolumeID(diskName string, isZonal bool) string {
 	return fmt.Sprintf(volIDRegionalFmt, UnspecifiedValue, UnspecifiedValue, diskName)
 }
 
-func SnapshotIDToKey(id string) (string, error) {
+// SnapshotIDToKey returns the type, DiskSnapshotType or DiskImageType, and the
+// name of the GCE resource backing the snapshot with the given ID
+func SnapshotIDToKey(id string) (string, string, error) {
 	splitId := strings.Split(id, "/")
 	if len(splitId) != snapshotTotalElements {
-		return "", fmt.Errorf("failed to get id components. Expected projects/{project}/global/snapshot/{name}. Got: %s", id)
+		return "", "", fmt.Errorf("failed to get id components. Expected projects/{project}/global/{snapshots|images}/{name}. Got: %s", id)
 	}
-	if splitId[snapshotTopologyKey] == "global" {
-		return splitId[snapshotTotalElements-1], nil
-	} else {
-		return "", fmt.Errorf("could not get id components, expected global, got: %v", splitId[snapshotTopologyKey])
+	if splitId[snapshotTopologyKey] != "global" {
+		return "", "", fmt.Errorf("could not get id components, expected global, got: %v", splitId[snapshotTopologyKey])
+	}
+	switch splitId[snapshotTypeKey] {
+	case DiskSnapshotType, DiskImageType:
+		return splitId[snapshotTypeKey], splitId[snapshotTotalElements-1], nil
+	default:
+		return "", "", fmt.Errorf("could not get id components, expected %s or %s, got: %v", DiskSnapshotType, DiskImageType, splitId[snapshotTypeKey])
 	}
 }
 
@@ -144,3 +151,119 @@ func GetDeviceName(volKey *meta.Key) (string, error) {
 func CreateNodeID(project, zone, name string) string {
 	return fmt.Sprintf(nodeIDFmt, project, zone, name)
 }
+
+// ParseEndpoint splits a CSI endpoint of the form unix:/path/to/socket or
+// tcp://host:port into the network and address to listen on
+func ParseEndpoint(endpoint string) (string, string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("could not parse endpoint %q: %v", endpoint, err)
+	}
+
+	var addr string
+	switch u.Scheme {
+	case "unix":
+		addr = u.Path
+		if addr == "" {
+			addr = u.Opaque
+		}
+		if u.Host != "" {
+			// unix://relative/path puts the first path element in the host
+			addr = u.Host + addr
+		}
+	case "tcp":
+		addr = u.Host
+	default:
+		return "", "", fmt.Errorf("%v endpoint scheme not supported", u.Scheme)
+	}
+
+	if addr == "" {
+		return "", "", fmt.Errorf("endpoint %q has no address", endpoint)
+	}
+	return u.Scheme, addr, nil
+}
+
+// ParseResourceTags parses a comma separated list of resource manager tags of
+// the form parentID/tagKey/tagValue into a map from the namespaced tag key,
+// parentID/tagKey, to the tag value
+func ParseResourceTags(str string) (map[string]string, error) {
+	tags := map[string]string{}
+	if str == "" {
+		return tags, nil
+	}
+	for _, tag := range strings.Split(str, ",") {
+		parts := strings.Split(strings.TrimSpace(tag), "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("resource tag %q must be of the form parentID/tagKey/tagValue", tag)
+		}
+		key := parts[0] + "/" + parts[1]
+		if _, ok := tags[key]; ok {
+			return nil, fmt.Errorf("resource tag key %q is specified more than once", key)
+		}
+		tags[key] = parts[2]
+	}
+	if len(tags) > maxResourceTags {
+		return nil, fmt.Errorf("at most %d resource tags may be specified, got %d", maxResourceTags, len(tags))
+	}
+	return tags, nil
+}
+
+// ParseStoragePools parses a comma separated list of storage pool resource
+// names of the form projects/{project}/zones/{zone}/storagePools/{name} into
+// a map from zone to storage pool
+func ParseStoragePools(str string) (map[string]string, error) {
+	pools := map[string]string{}
+	for _, pool := range strings.Split(str, ",") {
+		pool = strings.TrimSpace(pool)
+		parts := strings.Split(pool, "/")
+		if len(parts) != 6 || parts[0] != "projects" || parts[2] != "zones" || parts[4] != "storagePools" || parts[1] == "" || parts[3] == "" || parts[5] == "" {
+			return nil, fmt.Errorf("storage pool %q must be of the form projects/{project}/zones/{zone}/storagePools/{name}", pool)
+		}
+		zone := parts[3]
+		if _, ok := pools[zone]; ok {
+			return nil, fmt.Errorf("more than one storage pool specified in zone %s", zone)
+		}
+		pools[zone] = pool
+	}
+	return pools, nil
+}
+
+// ParseZones parses a comma separated list of zones into a sorted list
+// without duplicates
+func ParseZones(str string) ([]string, error) {
+	zones := sets.NewString()
+	for _, zone := range strings.Split(str, ",") {
+		zone = strings.TrimSpace(zone)
+		if zone == "" {
+			return nil, fmt.Errorf("zones %q contain an empty zone", str)
+		}
+		zones.Insert(zone)
+	}
+	return zones.List(), nil
+}
+
+// ParseReadAheadKB parses a read_ahead_kb value, which must be a
+// non-negative integer
+func ParseReadAheadKB(str string) (int64, error) {
+	kb, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid read_ahead_kb %q: %v", str, err)
+	}
+	if kb < 0 {
+		return 0, fmt.Errorf("invalid read_ahead_kb %q: must not be negative", str)
+	}
+	return kb, nil
+}
+
+// ParseReservedBlocksPercentage parses the percentage of filesystem blocks
+// reserved for the super-user, which mkfs limits to 50
+func ParseReservedBlocksPercentage(str string) (int64, error) {
+	percentage, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid reserved blocks percentage %q: %v", str, err)
+	}
+	if percentage < 0 || percentage > 50 {
+		return 0, fmt.Errorf("invalid reserved blocks percentage %q: must be between 0 and 50", str)
+	}
+	return percentage, nil
+}
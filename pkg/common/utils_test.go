@@ -152,6 +152,61 @@ func TestVolumeIDToKey(t *testing.T) {
 
 }
 
+func TestSnapshotIDToKey(t *testing.T) {
+	testCases := []struct {
+		name       string
+		snapshotID string
+		expType    string
+		expName    string
+		expErr     bool
+	}{
+		{
+			name:       "snapshot",
+			snapshotID: "projects/test-project/global/snapshots/test-name",
+			expType:    DiskSnapshotType,
+			expName:    "test-name",
+		},
+		{
+			name:       "image",
+			snapshotID: "projects/test-project/global/images/test-name",
+			expType:    DiskImageType,
+			expName:    "test-name",
+		},
+		{
+			name:       "unknown type",
+			snapshotID: "projects/test-project/global/disks/test-name",
+			expErr:     true,
+		},
+		{
+			name:       "not global",
+			snapshotID: "projects/test-project/zones/snapshots/test-name",
+			expErr:     true,
+		},
+		{
+			name:       "malformed",
+			snapshotID: "wrong",
+			expErr:     true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		snapshotType, name, err := SnapshotIDToKey(tc.snapshotID)
+		if err == nil && tc.expErr {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expErr {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			continue
+		}
+
+		if !(snapshotType == tc.expType && name == tc.expName) {
+			t.Errorf("got wrong type/name %s/%s, expected %s/%s", snapshotType, name, tc.expType, tc.expName)
+		}
+	}
+}
+
 func TestNodeIDToZoneAndName(t *testing.T) {
 	testProject := "test-project"
 	testName := "test-name"
@@ -247,3 +302,348 @@ func TestGetRegionFromZones(t *testing.T) {
 
 	}
 }
+
+func TestParseEndpoint(t *testing.T) {
+	testCases := []struct {
+		name        string
+		endpoint    string
+		expNetwork  string
+		expAddr     string
+		expectError bool
+	}{
+		{
+			name:       "unix socket",
+			endpoint:   "unix:/csi/csi.sock",
+			expNetwork: "unix",
+			expAddr:    "/csi/csi.sock",
+		},
+		{
+			name:       "unix socket with empty host",
+			endpoint:   "unix:///csi/csi.sock",
+			expNetwork: "unix",
+			expAddr:    "/csi/csi.sock",
+		},
+		{
+			name:       "unix socket relative path",
+			endpoint:   "unix:csi.sock",
+			expNetwork: "unix",
+			expAddr:    "csi.sock",
+		},
+		{
+			name:       "tcp with host",
+			endpoint:   "tcp://127.0.0.1:10000",
+			expNetwork: "tcp",
+			expAddr:    "127.0.0.1:10000",
+		},
+		{
+			name:       "tcp all interfaces",
+			endpoint:   "tcp://:10000",
+			expNetwork: "tcp",
+			expAddr:    ":10000",
+		},
+		{
+			name:        "tcp without address",
+			endpoint:    "tcp://",
+			expectError: true,
+		},
+		{
+			name:        "unsupported scheme",
+			endpoint:    "http://127.0.0.1:10000",
+			expectError: true,
+		},
+		{
+			name:        "no scheme",
+			endpoint:    "/csi/csi.sock",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		network, addr, err := ParseEndpoint(tc.endpoint)
+		if err == nil && tc.expectError {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expectError {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			continue
+		}
+
+		if network != tc.expNetwork || addr != tc.expAddr {
+			t.Errorf("Got network %v, addr %v, expected network %v, addr %v", network, addr, tc.expNetwork, tc.expAddr)
+		}
+	}
+}
+
+func TestParseResourceTags(t *testing.T) {
+	testCases := []struct {
+		name        string
+		tags        string
+		expTags     map[string]string
+		expectError bool
+	}{
+		{
+			name:    "empty",
+			tags:    "",
+			expTags: map[string]string{},
+		},
+		{
+			name:    "single tag",
+			tags:    "123456/env/prod",
+			expTags: map[string]string{"123456/env": "prod"},
+		},
+		{
+			name: "multiple tags",
+			tags: "123456/env/prod, my-project/team/storage",
+			expTags: map[string]string{
+				"123456/env":      "prod",
+				"my-project/team": "storage",
+			},
+		},
+		{
+			name:        "missing value",
+			tags:        "123456/env",
+			expectError: true,
+		},
+		{
+			name:        "empty key",
+			tags:        "123456//prod",
+			expectError: true,
+		},
+		{
+			name:        "too many parts",
+			tags:        "123456/env/prod/extra",
+			expectError: true,
+		},
+		{
+			name:        "duplicate key",
+			tags:        "123456/env/prod,123456/env/dev",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		tags, err := ParseResourceTags(tc.tags)
+		if err == nil && tc.expectError {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expectError {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(tags, tc.expTags) {
+			t.Errorf("Got tags %v, expected %v", tags, tc.expTags)
+		}
+	}
+}
+
+func TestParseStoragePools(t *testing.T) {
+	testCases := []struct {
+		name        string
+		pools       string
+		expPools    map[string]string
+		expectError bool
+	}{
+		{
+			name:     "single pool",
+			pools:    "projects/test-project/zones/us-central1-a/storagePools/pool-a",
+			expPools: map[string]string{"us-central1-a": "projects/test-project/zones/us-central1-a/storagePools/pool-a"},
+		},
+		{
+			name:  "pools in multiple zones",
+			pools: "projects/test-project/zones/us-central1-a/storagePools/pool-a, projects/test-project/zones/us-central1-b/storagePools/pool-b",
+			expPools: map[string]string{
+				"us-central1-a": "projects/test-project/zones/us-central1-a/storagePools/pool-a",
+				"us-central1-b": "projects/test-project/zones/us-central1-b/storagePools/pool-b",
+			},
+		},
+		{
+			name:        "empty",
+			pools:       "",
+			expectError: true,
+		},
+		{
+			name:        "pool name only",
+			pools:       "pool-a",
+			expectError: true,
+		},
+		{
+			name:        "regional pool",
+			pools:       "projects/test-project/regions/us-central1/storagePools/pool-a",
+			expectError: true,
+		},
+		{
+			name:        "multiple pools in one zone",
+			pools:       "projects/test-project/zones/us-central1-a/storagePools/pool-a,projects/test-project/zones/us-central1-a/storagePools/pool-b",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		pools, err := ParseStoragePools(tc.pools)
+		if err == nil && tc.expectError {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expectError {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(pools, tc.expPools) {
+			t.Errorf("Got pools %v, expected %v", pools, tc.expPools)
+		}
+	}
+}
+
+func TestParseZones(t *testing.T) {
+	testCases := []struct {
+		name        string
+		zones       string
+		expZones    []string
+		expectError bool
+	}{
+		{
+			name:     "single zone",
+			zones:    "us-central1-a",
+			expZones: []string{"us-central1-a"},
+		},
+		{
+			name:     "multiple zones",
+			zones:    "us-central1-c, us-central1-a",
+			expZones: []string{"us-central1-a", "us-central1-c"},
+		},
+		{
+			name:     "duplicate zones",
+			zones:    "us-central1-a,us-central1-a",
+			expZones: []string{"us-central1-a"},
+		},
+		{
+			name:        "empty",
+			zones:       "",
+			expectError: true,
+		},
+		{
+			name:        "empty zone",
+			zones:       "us-central1-a,,us-central1-b",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		zones, err := ParseZones(tc.zones)
+		if err == nil && tc.expectError {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expectError {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(zones, tc.expZones) {
+			t.Errorf("Got zones %v, expected %v", zones, tc.expZones)
+		}
+	}
+}
+
+func TestParseReadAheadKB(t *testing.T) {
+	testCases := []struct {
+		name        string
+		readAheadKB string
+		expKB       int64
+		expectError bool
+	}{
+		{
+			name:        "valid",
+			readAheadKB: "4096",
+			expKB:       4096,
+		},
+		{
+			name:        "zero",
+			readAheadKB: "0",
+		},
+		{
+			name:        "negative",
+			readAheadKB: "-1",
+			expectError: true,
+		},
+		{
+			name:        "not a number",
+			readAheadKB: "4M",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		kb, err := ParseReadAheadKB(tc.readAheadKB)
+		if err == nil && tc.expectError {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expectError {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			continue
+		}
+		if kb != tc.expKB {
+			t.Errorf("Expected %d KB, got: %d", tc.expKB, kb)
+		}
+	}
+}
+
+func TestParseReservedBlocksPercentage(t *testing.T) {
+	testCases := []struct {
+		name          string
+		percentage    string
+		expPercentage int64
+		expectError   bool
+	}{
+		{
+			name:          "valid",
+			percentage:    "1",
+			expPercentage: 1,
+		},
+		{
+			name:       "zero",
+			percentage: "0",
+		},
+		{
+			name:        "above maximum",
+			percentage:  "51",
+			expectError: true,
+		},
+		{
+			name:        "negative",
+			percentage:  "-1",
+			expectError: true,
+		},
+		{
+			name:        "fraction",
+			percentage:  "0.5",
+			expectError: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		percentage, err := ParseReservedBlocksPercentage(tc.percentage)
+		if err == nil && tc.expectError {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expectError {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			continue
+		}
+		if percentage != tc.expPercentage {
+			t.Errorf("Expected percentage %d, got: %d", tc.expPercentage, percentage)
+		}
+	}
+}
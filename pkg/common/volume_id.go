@@ -0,0 +1,126 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+)
+
+const (
+	volIDProjectsValue = "projects"
+	volIDZonesValue    = "zones"
+	volIDRegionsValue  = "regions"
+	volIDDisksValue    = "disks"
+)
+
+var (
+	// Prefix of the self links of disks of the compute APIs, e.g.
+	// https://www.googleapis.com/compute/v1/
+	selfLinkPrefixRegex = regexp.MustCompile(`^https://(www|compute)\.googleapis\.com/compute/(v1|beta|alpha)/`)
+	// Project IDs, optionally scoped to a domain as in example.com:project,
+	// or project numbers
+	projectIDRegex = regexp.MustCompile(`^(([a-z0-9][-a-z0-9.]*[a-z0-9]:)?[a-z][-a-z0-9]{4,28}[a-z0-9]|[0-9]+)$`)
+	// Names of zones and regions
+	locationRegex = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	// Names of disks. GCE only allows up to 63 lower case letters, but the
+	// names of volumes created by other means, e.g. the CSI sanity tests, are
+	// only rejected by GCE.
+	diskNameRegex = regexp.MustCompile(`^[a-zA-Z]([-a-zA-Z0-9]*[a-zA-Z0-9])?$`)
+)
+
+// VolumeID is the ID of a volume backed by a zonal or regional disk, of the
+// form projects/{project}/zones/{zone}/disks/{name} or
+// projects/{project}/regions/{region}/disks/{name}. The project and location
+// are UnspecifiedValue in underspecified IDs.
+type VolumeID struct {
+	Project string
+	Key     *meta.Key
+}
+
+// ParseVolumeID parses and validates a volume ID. Self links of disks are
+// accepted as well, as hand-crafted PersistentVolumes of existing disks may
+// use them.
+func ParseVolumeID(id string) (*VolumeID, error) {
+	trimmed := selfLinkPrefixRegex.ReplaceAllString(id, "")
+	splitID := strings.Split(trimmed, "/")
+	if len(splitID) != volIDTotalElements || splitID[0] != volIDProjectsValue || splitID[volIDTotalElements-2] != volIDDisksValue {
+		return nil, fmt.Errorf("failed to get id components. Expected projects/{project}/zones/{zone}/disks/{name} or projects/{project}/regions/{region}/disks/{name}. Got: %q", id)
+	}
+	project, location, name := splitID[1], splitID[volIDToplogyValue], splitID[volIDDiskNameValue]
+	var key *meta.Key
+	switch splitID[volIDToplogyKey] {
+	case volIDZonesValue:
+		key = meta.ZonalKey(name, location)
+	case volIDRegionsValue:
+		key = meta.RegionalKey(name, location)
+	default:
+		return nil, fmt.Errorf("could not get id components of %q, expected either zones or regions, got: %q", id, splitID[volIDToplogyKey])
+	}
+	volID := &VolumeID{Project: project, Key: key}
+	if err := volID.validate(); err != nil {
+		return nil, fmt.Errorf("invalid volume ID %q: %v", id, err)
+	}
+	return volID, nil
+}
+
+// IsVolumeIDPath returns true if id has the form of a volume ID or a disk self
+// link, i.e. starts with projects/, regardless of whether it is valid
+func IsVolumeIDPath(id string) bool {
+	return strings.HasPrefix(selfLinkPrefixRegex.ReplaceAllString(id, ""), volIDProjectsValue+"/")
+}
+
+// NewVolumeID returns the ID of the volume of the zonal or regional disk
+// with the key in the project
+func NewVolumeID(project string, key *meta.Key) (*VolumeID, error) {
+	volID := &VolumeID{Project: project, Key: key}
+	if err := volID.validate(); err != nil {
+		return nil, err
+	}
+	return volID, nil
+}
+
+func (v *VolumeID) validate() error {
+	if v.Project != UnspecifiedValue && !projectIDRegex.MatchString(v.Project) {
+		return fmt.Errorf("invalid project %q", v.Project)
+	}
+	var location string
+	switch v.Key.Type() {
+	case meta.Zonal:
+		location = v.Key.Zone
+	case meta.Regional:
+		location = v.Key.Region
+	default:
+		return fmt.Errorf("volume key %v neither zonal nor regional", v.Key)
+	}
+	if location != UnspecifiedValue && !locationRegex.MatchString(location) {
+		return fmt.Errorf("invalid location %q", location)
+	}
+	if !diskNameRegex.MatchString(v.Key.Name) {
+		return fmt.Errorf("invalid disk name %q", v.Key.Name)
+	}
+	return nil
+}
+
+// String returns the volume ID, which ParseVolumeID parses to v
+func (v *VolumeID) String() string {
+	if v.Key.Type() == meta.Regional {
+		return fmt.Sprintf(volIDRegionalFmt, v.Project, v.Key.Region, v.Key.Name)
+	}
+	return fmt.Sprintf(volIDZonalFmt, v.Project, v.Key.Zone, v.Key.Name)
+}
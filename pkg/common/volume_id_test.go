@@ -0,0 +1,240 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+)
+
+func TestParseVolumeID(t *testing.T) {
+	testCases := []struct {
+		name       string
+		volID      string
+		expProject string
+		expKey     *meta.Key
+		expID      string
+		expErr     bool
+	}{
+		{
+			name:       "zonal",
+			volID:      "projects/test-project/zones/us-central1-c/disks/test-disk",
+			expProject: "test-project",
+			expKey:     meta.ZonalKey("test-disk", "us-central1-c"),
+		},
+		{
+			name:       "regional",
+			volID:      "projects/test-project/regions/us-central1/disks/test-disk",
+			expProject: "test-project",
+			expKey:     meta.RegionalKey("test-disk", "us-central1"),
+		},
+		{
+			name:       "domain scoped project",
+			volID:      "projects/example.com:test-project/zones/us-central1-c/disks/test-disk",
+			expProject: "example.com:test-project",
+			expKey:     meta.ZonalKey("test-disk", "us-central1-c"),
+		},
+		{
+			name:       "project number",
+			volID:      "projects/123456789012/zones/us-central1-c/disks/test-disk",
+			expProject: "123456789012",
+			expKey:     meta.ZonalKey("test-disk", "us-central1-c"),
+		},
+		{
+			name:       "underspecified",
+			volID:      GenerateUnderspecifiedVolumeID("test-disk", true),
+			expProject: UnspecifiedValue,
+			expKey:     meta.ZonalKey("test-disk", UnspecifiedValue),
+		},
+		{
+			name:       "v1 self link",
+			volID:      "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-c/disks/test-disk",
+			expProject: "test-project",
+			expKey:     meta.ZonalKey("test-disk", "us-central1-c"),
+			expID:      "projects/test-project/zones/us-central1-c/disks/test-disk",
+		},
+		{
+			name:       "beta self link",
+			volID:      "https://www.googleapis.com/compute/beta/projects/test-project/regions/us-central1/disks/test-disk",
+			expProject: "test-project",
+			expKey:     meta.RegionalKey("test-disk", "us-central1"),
+			expID:      "projects/test-project/regions/us-central1/disks/test-disk",
+		},
+		{
+			name:   "self link of other host",
+			volID:  "https://example.com/compute/v1/projects/test-project/zones/us-central1-c/disks/test-disk",
+			expErr: true,
+		},
+		{
+			name:   "project instead of projects",
+			volID:  "project/test-project/zones/us-central1-c/disks/test-disk",
+			expErr: true,
+		},
+		{
+			name:   "instances instead of disks",
+			volID:  "projects/test-project/zones/us-central1-c/instances/test-disk",
+			expErr: true,
+		},
+		{
+			name:   "global",
+			volID:  "projects/test-project/global/disks/test-disk",
+			expErr: true,
+		},
+		{
+			name:   "empty zone",
+			volID:  "projects/test-project/zones//disks/test-disk",
+			expErr: true,
+		},
+		{
+			name:   "empty name",
+			volID:  "projects/test-project/zones/us-central1-c/disks/",
+			expErr: true,
+		},
+		{
+			name:   "trailing slash",
+			volID:  "projects/test-project/zones/us-central1-c/disks/test-disk/",
+			expErr: true,
+		},
+		{
+			name:   "invalid project",
+			volID:  "projects/Test Project/zones/us-central1-c/disks/test-disk",
+			expErr: true,
+		},
+		{
+			name:   "invalid zone",
+			volID:  "projects/test-project/zones/US-CENTRAL1-C/disks/test-disk",
+			expErr: true,
+		},
+		{
+			name:   "invalid name",
+			volID:  "projects/test-project/zones/us-central1-c/disks/test_disk",
+			expErr: true,
+		},
+		{
+			name:   "whitespace",
+			volID:  " projects/test-project/zones/us-central1-c/disks/test-disk",
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		volID, err := ParseVolumeID(tc.volID)
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if volID.Project != tc.expProject || !reflect.DeepEqual(volID.Key, tc.expKey) {
+			t.Errorf("Expected project %s and key %v, got: %s, %v", tc.expProject, tc.expKey, volID.Project, volID.Key)
+		}
+		expID := tc.expID
+		if expID == "" {
+			expID = tc.volID
+		}
+		if volID.String() != expID {
+			t.Errorf("Expected ID %s, got: %s", expID, volID.String())
+		}
+	}
+}
+
+func TestKeyToVolumeID(t *testing.T) {
+	testCases := []struct {
+		name    string
+		key     *meta.Key
+		project string
+		expID   string
+		expErr  bool
+	}{
+		{
+			name:    "zonal",
+			key:     meta.ZonalKey("test-disk", "us-central1-c"),
+			project: "test-project",
+			expID:   "projects/test-project/zones/us-central1-c/disks/test-disk",
+		},
+		{
+			name:    "regional",
+			key:     meta.RegionalKey("test-disk", "us-central1"),
+			project: "test-project",
+			expID:   "projects/test-project/regions/us-central1/disks/test-disk",
+		},
+		{
+			name:    "global",
+			key:     meta.GlobalKey("test-disk"),
+			project: "test-project",
+			expErr:  true,
+		},
+		{
+			name:    "invalid project",
+			key:     meta.ZonalKey("test-disk", "us-central1-c"),
+			project: "",
+			expErr:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		id, err := KeyToVolumeID(tc.key, tc.project)
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		if id != tc.expID {
+			t.Errorf("Expected ID %s, got: %s", tc.expID, id)
+		}
+		key, err := VolumeIDToKey(id)
+		if err != nil || !reflect.DeepEqual(key, tc.key) {
+			t.Errorf("Expected ID %s to parse to key %v, got: %v, %v", id, tc.key, key, err)
+		}
+	}
+}
+
+func TestIsVolumeIDPath(t *testing.T) {
+	testCases := []struct {
+		name  string
+		id    string
+		expIs bool
+	}{
+		{
+			name:  "valid",
+			id:    "projects/test-project/zones/us-central1-c/disks/test-disk",
+			expIs: true,
+		},
+		{
+			name:  "malformed",
+			id:    "projects/test-project/zones/us-central1-c/disks/test-disk/foo",
+			expIs: true,
+		},
+		{
+			name:  "self link",
+			id:    "https://www.googleapis.com/compute/v1/projects/Test Project/zones/us-central1-c/disks/test-disk",
+			expIs: true,
+		},
+		{
+			name:  "not a path",
+			id:    "reallyfakevolumeid",
+			expIs: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		if is := IsVolumeIDPath(tc.id); is != tc.expIs {
+			t.Errorf("Expected IsVolumeIDPath(%q) to be %v, got: %v", tc.id, tc.expIs, is)
+		}
+	}
+}
@@ -22,6 +22,17 @@ import (
 type CloudDisk struct {
 	ZonalDisk    *compute.Disk
 	RegionalDisk *computebeta.Disk
+	// EnableConfidentialCompute is whether confidential compute is enabled
+	// on the disk, which the vendored disk types do not support
+	EnableConfidentialCompute bool
+}
+
+// CloudInstance is an instance with the fields that the vendored instance
+// type does not support
+type CloudInstance struct {
+	*compute.Instance
+	// EnableConfidentialCompute is whether the instance is a Confidential VM
+	EnableConfidentialCompute bool
 }
 
 type CloudDiskType string
@@ -80,6 +91,28 @@ func (d *CloudDisk) GetName() string {
 	}
 }
 
+func (d *CloudDisk) GetID() uint64 {
+	switch d.Type() {
+	case Zonal:
+		return d.ZonalDisk.Id
+	case Regional:
+		return d.RegionalDisk.Id
+	default:
+		return 0
+	}
+}
+
+func (d *CloudDisk) GetDescription() string {
+	switch d.Type() {
+	case Zonal:
+		return d.ZonalDisk.Description
+	case Regional:
+		return d.RegionalDisk.Description
+	default:
+		return ""
+	}
+}
+
 func (d *CloudDisk) GetKind() string {
 	switch d.Type() {
 	case Zonal:
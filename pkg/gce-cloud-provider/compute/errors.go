@@ -0,0 +1,184 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	diskResource     = "disk"
+	instanceResource = "instance"
+
+	// Code of operations failing because a quota is exceeded
+	quotaExceededCode = "QUOTA_EXCEEDED"
+)
+
+// wrappedError adds context to an error while keeping it available to the
+// error predicates
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e *wrappedError) Error() string {
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+// WrapError adds context to err like fmt.Errorf with a trailing ": %v", but
+// keeps err available to IsGCEError and the other error predicates
+func WrapError(err error, format string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return &wrappedError{msg: fmt.Sprintf(format, args...), err: err}
+}
+
+// resourceNotFoundError records which resource a notFound error of a GCE API
+// call refers to, as calls such as attaching a disk reference several
+type resourceNotFoundError struct {
+	resource string
+	err      error
+}
+
+func (e *resourceNotFoundError) Error() string {
+	return e.err.Error()
+}
+
+func (e *resourceNotFoundError) Unwrap() error {
+	return e.err
+}
+
+// asResourceNotFound marks err as a missing resource if it is a notFound
+// error, and returns it unchanged otherwise
+func asResourceNotFound(resource string, err error) error {
+	if !IsGCEError(err, "notFound") {
+		return err
+	}
+	return &resourceNotFoundError{resource: resource, err: err}
+}
+
+// OperationError is returned when a GCE operation completes with an error
+type OperationError struct {
+	// Name of the operation
+	Name string
+	// Code of the first error of the operation, e.g. "QUOTA_EXCEEDED"
+	Code string
+	// Message of the first error of the operation
+	Message string
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("operation %v failed (%v): %v", e.Name, e.Code, e.Message)
+}
+
+// OperationTimeoutError is returned when a GCE operation does not complete
+// within its timeout. The operation may still complete afterwards.
+type OperationTimeoutError struct {
+	// Name of the operation
+	Name string
+	// Timeout waited for the operation
+	Timeout time.Duration
+}
+
+func (e *OperationTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v waiting for operation %v", e.Timeout, e.Name)
+}
+
+// findError returns the first error of the chain of err for which match
+// returns true, or nil
+func findError(err error, match func(error) bool) error {
+	for err != nil {
+		if match(err) {
+			return err
+		}
+		u, ok := err.(interface{ Unwrap() error })
+		if !ok {
+			return nil
+		}
+		err = u.Unwrap()
+	}
+	return nil
+}
+
+func isResourceNotFound(err error, resource string) bool {
+	return findError(err, func(err error) bool {
+		e, ok := err.(*resourceNotFoundError)
+		return ok && e.resource == resource
+	}) != nil
+}
+
+// IsGCEDiskNotFound returns true if the error is caused by a disk that does
+// not exist
+func IsGCEDiskNotFound(err error) bool {
+	return isResourceNotFound(err, diskResource)
+}
+
+// IsInstanceNotFound returns true if the error is caused by an instance that
+// does not exist
+func IsInstanceNotFound(err error) bool {
+	return isResourceNotFound(err, instanceResource)
+}
+
+// IsDiskInUse returns true if the error is caused by deleting a disk that is
+// still attached to an instance
+func IsDiskInUse(err error) bool {
+	return IsGCEError(err, "resourceInUseByAnotherResource")
+}
+
+// IsQuotaExceeded returns true if the error is caused by an exceeded quota,
+// whether the API call or its operation failed
+func IsQuotaExceeded(err error) bool {
+	if IsGCEError(err, "quotaExceeded") {
+		return true
+	}
+	return findError(err, func(err error) bool {
+		e, ok := err.(*OperationError)
+		return ok && e.Code == quotaExceededCode
+	}) != nil
+}
+
+// IsOperationTimeout returns true if the error is caused by a GCE operation
+// that did not complete in time
+func IsOperationTimeout(err error) bool {
+	return findError(err, func(err error) bool {
+		_, ok := err.(*OperationTimeoutError)
+		return ok
+	}) != nil
+}
+
+// ContextError returns context.Canceled or context.DeadlineExceeded if the
+// error is caused by the context of the call ending, and nil otherwise
+func ContextError(err error) error {
+	return findError(err, func(err error) bool {
+		return err == context.Canceled || err == context.DeadlineExceeded
+	})
+}
+
+func findGCEError(err error) *googleapi.Error {
+	apiErr, _ := findError(err, func(err error) bool {
+		_, ok := err.(*googleapi.Error)
+		return ok
+	}).(*googleapi.Error)
+	return apiErr
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func gceError(reason string) *googleapi.Error {
+	return &googleapi.Error{
+		Errors: []googleapi.ErrorItem{
+			{
+				Reason: reason,
+			},
+		},
+	}
+}
+
+func TestErrorPredicates(t *testing.T) {
+	testCases := []struct {
+		name                string
+		err                 error
+		expDiskNotFound     bool
+		expInstanceNotFound bool
+		expQuotaExceeded    bool
+		expTimeout          bool
+		expGCEReason        string
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name: "other error",
+			err:  fmt.Errorf("notFound"),
+		},
+		{
+			name:         "untyped not found",
+			err:          gceError("notFound"),
+			expGCEReason: "notFound",
+		},
+		{
+			name:            "disk not found",
+			err:             asResourceNotFound(diskResource, gceError("notFound")),
+			expDiskNotFound: true,
+			expGCEReason:    "notFound",
+		},
+		{
+			name:                "wrapped instance not found",
+			err:                 WrapError(asResourceNotFound(instanceResource, gceError("notFound")), "failed to attach"),
+			expInstanceNotFound: true,
+			expGCEReason:        "notFound",
+		},
+		{
+			name:         "resource not found of another error",
+			err:          asResourceNotFound(diskResource, gceError("invalid")),
+			expGCEReason: "invalid",
+		},
+		{
+			name:             "quota exceeded API call",
+			err:              WrapError(gceError("quotaExceeded"), "failed to insert disk"),
+			expQuotaExceeded: true,
+			expGCEReason:     "quotaExceeded",
+		},
+		{
+			name:             "quota exceeded operation",
+			err:              WrapError(&OperationError{Name: "op", Code: "QUOTA_EXCEEDED", Message: "Quota 'SSD_TOTAL_GB' exceeded"}, "failed to insert disk"),
+			expQuotaExceeded: true,
+		},
+		{
+			name: "failed operation",
+			err:  &OperationError{Name: "op", Code: "RESOURCE_IN_USE_BY_ANOTHER_RESOURCE", Message: "in use"},
+		},
+		{
+			name:       "operation timeout",
+			err:        WrapError(WrapError(&OperationTimeoutError{Name: "op", Timeout: time.Minute}, "waiting for op"), "failed to resize"),
+			expTimeout: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		if got := IsGCEDiskNotFound(tc.err); got != tc.expDiskNotFound {
+			t.Errorf("Expected IsGCEDiskNotFound %v, got: %v", tc.expDiskNotFound, got)
+		}
+		if got := IsInstanceNotFound(tc.err); got != tc.expInstanceNotFound {
+			t.Errorf("Expected IsInstanceNotFound %v, got: %v", tc.expInstanceNotFound, got)
+		}
+		if got := IsQuotaExceeded(tc.err); got != tc.expQuotaExceeded {
+			t.Errorf("Expected IsQuotaExceeded %v, got: %v", tc.expQuotaExceeded, got)
+		}
+		if got := IsOperationTimeout(tc.err); got != tc.expTimeout {
+			t.Errorf("Expected IsOperationTimeout %v, got: %v", tc.expTimeout, got)
+		}
+		for _, reason := range []string{"notFound", "invalid", "quotaExceeded"} {
+			if got := IsGCEError(tc.err, reason); got != (reason == tc.expGCEReason) {
+				t.Errorf("Expected IsGCEError %v for reason %s, got: %v", reason == tc.expGCEReason, reason, got)
+			}
+		}
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	if err := WrapError(nil, "failed"); err != nil {
+		t.Errorf("Expected no error wrapping nil, got: %v", err)
+	}
+	err := WrapError(&OperationError{Name: "op", Code: "QUOTA_EXCEEDED", Message: "exceeded"}, "failed to insert disk %s", "disk")
+	if exp := "failed to insert disk disk: operation op failed (QUOTA_EXCEEDED): exceeded"; err.Error() != exp {
+		t.Errorf("Expected error message %q, got: %q", exp, err.Error())
+	}
+}
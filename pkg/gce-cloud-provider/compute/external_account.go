@@ -0,0 +1,310 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	externalAccountType = "external_account"
+
+	tokenExchangeGrantType    = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType           = "urn:ietf:params:oauth:token-type:access_token"
+	impersonatedTokenLifetime = "3600s"
+
+	// Timeout of the requests of an external account token source
+	externalAccountRequestTimeout = 30 * time.Second
+)
+
+// externalAccountCredentials is the credentials file of an external account
+// of workload identity federation, which exchanges a token of another
+// identity provider for a GCP access token
+type externalAccountCredentials struct {
+	Type                           string                   `json:"type"`
+	Audience                       string                   `json:"audience"`
+	SubjectTokenType               string                   `json:"subject_token_type"`
+	TokenURL                       string                   `json:"token_url"`
+	ServiceAccountImpersonationURL string                   `json:"service_account_impersonation_url"`
+	ClientID                       string                   `json:"client_id"`
+	ClientSecret                   string                   `json:"client_secret"`
+	CredentialSource               externalCredentialSource `json:"credential_source"`
+}
+
+// externalCredentialSource is where the token of the other identity provider
+// is read from, either a file or a URL
+type externalCredentialSource struct {
+	File    string            `json:"file"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	// EnvironmentID is set for AWS credentials, which are not supported
+	EnvironmentID string `json:"environment_id"`
+	Format        struct {
+		// Type is "text" or "json"
+		Type                  string `json:"type"`
+		SubjectTokenFieldName string `json:"subject_token_field_name"`
+	} `json:"format"`
+}
+
+func (c *externalAccountCredentials) validate() error {
+	if c.Audience == "" {
+		return fmt.Errorf("external account credentials must have an audience")
+	}
+	if c.SubjectTokenType == "" {
+		return fmt.Errorf("external account credentials must have a subject token type")
+	}
+	if c.TokenURL == "" {
+		return fmt.Errorf("external account credentials must have a token URL")
+	}
+	source := c.CredentialSource
+	if source.EnvironmentID != "" {
+		return fmt.Errorf("external account credentials of environment %q are not supported", source.EnvironmentID)
+	}
+	if (source.File == "") == (source.URL == "") {
+		return fmt.Errorf("external account credentials must have exactly one of a credential source file or URL")
+	}
+	switch source.Format.Type {
+	case "", "text":
+	case "json":
+		if source.Format.SubjectTokenFieldName == "" {
+			return fmt.Errorf("external account credentials of json format must have a subject token field name")
+		}
+	default:
+		return fmt.Errorf("external account credential source format %q is not supported", source.Format.Type)
+	}
+	return nil
+}
+
+// externalAccountTokenSource exchanges the token of an external account for a
+// GCP access token with the Security Token Service, and optionally for a
+// token of an impersonated service account
+type externalAccountTokenSource struct {
+	client      *http.Client
+	credentials *externalAccountCredentials
+	scopes      []string
+}
+
+// newCredentialsFileTokenSource returns a token source of the credentials
+// file, which is a service account key, user credentials or external account
+// credentials
+func newCredentialsFileTokenSource(path string, scopes ...string) (oauth2.TokenSource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file %s: %v", path, err)
+	}
+	var f struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file %s: %v", path, err)
+	}
+	if f.Type != externalAccountType {
+		creds, err := google.CredentialsFromJSON(context.Background(), data, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse credentials file %s: %v", path, err)
+		}
+		return creds.TokenSource, nil
+	}
+	credentials := &externalAccountCredentials{}
+	if err := json.Unmarshal(data, credentials); err != nil {
+		return nil, fmt.Errorf("failed to parse external account credentials file %s: %v", path, err)
+	}
+	if err := credentials.validate(); err != nil {
+		return nil, fmt.Errorf("invalid external account credentials file %s: %v", path, err)
+	}
+	return oauth2.ReuseTokenSource(nil, &externalAccountTokenSource{
+		client:      &http.Client{Timeout: externalAccountRequestTimeout},
+		credentials: credentials,
+		scopes:      scopes,
+	}), nil
+}
+
+// Token returns a GCP access token of the external account
+func (e *externalAccountTokenSource) Token() (*oauth2.Token, error) {
+	subjectToken, err := e.subjectToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read subject token: %v", err)
+	}
+	token, err := e.exchangeToken(subjectToken)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange subject token: %v", err)
+	}
+	if e.credentials.ServiceAccountImpersonationURL == "" {
+		return token, nil
+	}
+	token, err = e.impersonate(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate service account: %v", err)
+	}
+	return token, nil
+}
+
+// subjectToken reads the token of the other identity provider
+func (e *externalAccountTokenSource) subjectToken() (string, error) {
+	source := e.credentials.CredentialSource
+	var data []byte
+	if source.File != "" {
+		var err error
+		data, err = ioutil.ReadFile(source.File)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		req, err := http.NewRequest("GET", source.URL, nil)
+		if err != nil {
+			return "", err
+		}
+		for key, value := range source.Headers {
+			req.Header.Set(key, value)
+		}
+		res, err := e.client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		if err := googleapi.CheckResponse(res); err != nil {
+			return "", err
+		}
+		data, err = ioutil.ReadAll(res.Body)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if source.Format.Type != "json" {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("subject token is empty")
+		}
+		return token, nil
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+	token, ok := fields[source.Format.SubjectTokenFieldName].(string)
+	if !ok || token == "" {
+		return "", fmt.Errorf("subject token field %q not found", source.Format.SubjectTokenFieldName)
+	}
+	return token, nil
+}
+
+// exchangeToken exchanges the subject token for a GCP access token with the
+// Security Token Service
+func (e *externalAccountTokenSource) exchangeToken(subjectToken string) (*oauth2.Token, error) {
+	form := url.Values{}
+	form.Set("grant_type", tokenExchangeGrantType)
+	form.Set("audience", e.credentials.Audience)
+	form.Set("requested_token_type", accessTokenType)
+	form.Set("subject_token", subjectToken)
+	form.Set("subject_token_type", e.credentials.SubjectTokenType)
+	if e.credentials.ServiceAccountImpersonationURL == "" {
+		form.Set("scope", strings.Join(e.scopes, " "))
+	} else {
+		// The STS token is only used to impersonate the service account
+		form.Set("scope", compute.CloudPlatformScope)
+	}
+	req, err := http.NewRequest("POST", e.credentials.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if e.credentials.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(e.credentials.ClientID), url.QueryEscape(e.credentials.ClientSecret))
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+	if tok.AccessToken == "" {
+		return nil, fmt.Errorf("response has no access token")
+	}
+	token := &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		TokenType:   tok.TokenType,
+	}
+	if tok.ExpiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
+
+// impersonate exchanges the STS token for an access token of the service
+// account of the impersonation URL
+func (e *externalAccountTokenSource) impersonate(token *oauth2.Token) (*oauth2.Token, error) {
+	body, err := json.Marshal(struct {
+		Scope    []string `json:"scope"`
+		Lifetime string   `json:"lifetime"`
+	}{
+		Scope:    e.scopes,
+		Lifetime: impersonatedTokenLifetime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", e.credentials.ServiceAccountImpersonationURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	token.SetAuthHeader(req)
+	res, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+	var tok struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+	if tok.AccessToken == "" {
+		return nil, fmt.Errorf("response has no access token")
+	}
+	return &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		Expiry:      tok.ExpireTime,
+	}, nil
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testSubjectToken     = "subject-token"
+	testSTSToken         = "sts-token"
+	testImpersonateToken = "impersonated-token"
+)
+
+// newFakeExternalAccountServer serves the subject token, the Security Token
+// Service and the service account impersonation under /subject, /sts and
+// /impersonate
+func newFakeExternalAccountServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/subject", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, `{"id_token": %q}`, testSubjectToken)
+	})
+	mux.HandleFunc("/sts", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("Failed to parse STS request: %v", err)
+		}
+		if r.PostForm.Get("grant_type") != tokenExchangeGrantType ||
+			r.PostForm.Get("subject_token") != testSubjectToken ||
+			r.PostForm.Get("audience") != "audience" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": %q, "token_type": "Bearer", "expires_in": 3600}`, testSTSToken)
+	})
+	mux.HandleFunc("/impersonate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testSTSToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"accessToken": %q, "expireTime": %q}`, testImpersonateToken, time.Now().Add(time.Hour).Format(time.RFC3339))
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestExternalAccountTokenSource(t *testing.T) {
+	server := newFakeExternalAccountServer(t)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "external-account")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	subjectFile := filepath.Join(dir, "subject")
+	if err := ioutil.WriteFile(subjectFile, []byte(testSubjectToken+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write subject token file: %v", err)
+	}
+
+	testCases := []struct {
+		name        string
+		credentials map[string]interface{}
+		expToken    string
+		expErr      bool
+		expTokenErr bool
+	}{
+		{
+			name: "file source",
+			credentials: map[string]interface{}{
+				"credential_source": map[string]interface{}{"file": subjectFile},
+			},
+			expToken: testSTSToken,
+		},
+		{
+			name: "url source with json format",
+			credentials: map[string]interface{}{
+				"credential_source": map[string]interface{}{
+					"url":     server.URL + "/subject",
+					"headers": map[string]string{"Metadata": "true"},
+					"format":  map[string]string{"type": "json", "subject_token_field_name": "id_token"},
+				},
+			},
+			expToken: testSTSToken,
+		},
+		{
+			name: "service account impersonation",
+			credentials: map[string]interface{}{
+				"credential_source":                 map[string]interface{}{"file": subjectFile},
+				"service_account_impersonation_url": server.URL + "/impersonate",
+			},
+			expToken: testImpersonateToken,
+		},
+		{
+			name: "missing json field",
+			credentials: map[string]interface{}{
+				"credential_source": map[string]interface{}{
+					"url":     server.URL + "/subject",
+					"headers": map[string]string{"Metadata": "true"},
+					"format":  map[string]string{"type": "json", "subject_token_field_name": "access_token"},
+				},
+			},
+			expTokenErr: true,
+		},
+		{
+			name: "rejected token exchange",
+			credentials: map[string]interface{}{
+				"audience":          "other-audience",
+				"credential_source": map[string]interface{}{"file": subjectFile},
+			},
+			expTokenErr: true,
+		},
+		{
+			name: "aws source",
+			credentials: map[string]interface{}{
+				"credential_source": map[string]interface{}{"environment_id": "aws1"},
+			},
+			expErr: true,
+		},
+		{
+			name: "file and url source",
+			credentials: map[string]interface{}{
+				"credential_source": map[string]interface{}{"file": subjectFile, "url": server.URL + "/subject"},
+			},
+			expErr: true,
+		},
+		{
+			name: "missing audience",
+			credentials: map[string]interface{}{
+				"audience":          "",
+				"credential_source": map[string]interface{}{"file": subjectFile},
+			},
+			expErr: true,
+		},
+	}
+	for i, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		credentials := map[string]interface{}{
+			"type":               externalAccountType,
+			"audience":           "audience",
+			"subject_token_type": "urn:ietf:params:oauth:token-type:jwt",
+			"token_url":          server.URL + "/sts",
+		}
+		for key, value := range tc.credentials {
+			credentials[key] = value
+		}
+		data, err := json.Marshal(credentials)
+		if err != nil {
+			t.Fatalf("Failed to marshal credentials: %v", err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("credentials-%d.json", i))
+		if err := ioutil.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write credentials file: %v", err)
+		}
+
+		ts, err := newCredentialsFileTokenSource(path, "scope")
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+		if err != nil {
+			continue
+		}
+		token, err := ts.Token()
+		if (err != nil) != tc.expTokenErr {
+			t.Errorf("Expected token error: %v, got: %v", tc.expTokenErr, err)
+		}
+		if err == nil && token.AccessToken != tc.expToken {
+			t.Errorf("Expected token %s, got: %s", tc.expToken, token.AccessToken)
+		}
+	}
+}
+
+func TestCredentialsFileTokenSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials-file")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name     string
+		contents string
+		expErr   bool
+	}{
+		{
+			name:     "user credentials",
+			contents: `{"type": "authorized_user", "client_id": "id", "client_secret": "secret", "refresh_token": "token"}`,
+		},
+		{
+			name:     "unknown type",
+			contents: `{"type": "other"}`,
+			expErr:   true,
+		},
+		{
+			name:     "invalid json",
+			contents: `type = external_account`,
+			expErr:   true,
+		},
+	}
+	for i, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		path := filepath.Join(dir, fmt.Sprintf("credentials-%d.json", i))
+		if err := ioutil.WriteFile(path, []byte(tc.contents), 0600); err != nil {
+			t.Fatalf("Failed to write credentials file: %v", err)
+		}
+		_, err := newCredentialsFileTokenSource(path, "scope")
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+	}
+	if _, err := newCredentialsFileTokenSource(filepath.Join(dir, "missing.json"), "scope"); err == nil {
+		t.Errorf("Expected error for a missing credentials file")
+	}
+}
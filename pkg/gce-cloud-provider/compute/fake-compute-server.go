@@ -0,0 +1,866 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	beta "google.golang.org/api/compute/v0.beta"
+	compute "google.golang.org/api/compute/v1"
+)
+
+const (
+	fakeComputePath     = "/compute/v1/projects/"
+	fakeComputeBetaPath = "/compute/beta/projects/"
+
+	fakeOperationPollInterval = 10 * time.Millisecond
+)
+
+var fakeFilterRegexp = regexp.MustCompile(`^(\w+) eq (.*)$`)
+
+// fakeError is an error of the compute API, returned either in the response
+// to a request or in the operation of the request
+type fakeError struct {
+	code    int
+	reason  string
+	message string
+}
+
+// fakeOperation is an operation of the fake compute server. The operation
+// advances from PENDING to RUNNING to DONE each time it is polled and its
+// mutation is applied when it is done, like GCE operations which only take
+// effect once they complete.
+type fakeOperation struct {
+	op    *compute.Operation
+	apply func() *fakeError
+}
+
+// FakeComputeServer is an in-memory fake of the subset of the compute API that
+// the driver uses: zonal and regional disks, instances, zonal, regional and
+// global operations and snapshots. Unlike FakeCloudProvider it is served over
+// HTTP, so the requests of the real CloudProvider, including the waits for its
+// operations, can be tested hermetically. Regional disks can only be created,
+// resized and deleted.
+type FakeComputeServer struct {
+	server *httptest.Server
+
+	mux           sync.Mutex
+	project       string
+	zonesByRegion map[string][]string
+	// disks and instances are keyed by zone/name
+	disks     map[string]*compute.Disk
+	instances map[string]*compute.Instance
+	// regionalDisks are keyed by region/name
+	regionalDisks map[string]*compute.Disk
+	snapshots     map[string]*compute.Snapshot
+	operations    map[string]*fakeOperation
+	opCount       int
+}
+
+// NewFakeComputeServer starts a fake compute server for the project with the
+// given zones in each region. It must be closed once it is no longer used.
+func NewFakeComputeServer(project string, zonesByRegion map[string][]string) *FakeComputeServer {
+	s := &FakeComputeServer{
+		project:       project,
+		zonesByRegion: zonesByRegion,
+		disks:         map[string]*compute.Disk{},
+		instances:     map[string]*compute.Instance{},
+		regionalDisks: map[string]*compute.Disk{},
+		snapshots:     map[string]*compute.Snapshot{},
+		operations:    map[string]*fakeOperation{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close shuts the server down
+func (s *FakeComputeServer) Close() {
+	s.server.Close()
+}
+
+// CloudProvider returns a CloudProvider sending its requests to the server,
+// with its default zone being the first zone of the server
+func (s *FakeComputeServer) CloudProvider() (*CloudProvider, error) {
+	client := s.server.Client()
+	svc, err := compute.New(client)
+	if err != nil {
+		return nil, err
+	}
+	svc.BasePath = s.server.URL + fakeComputePath
+	betaSvc, err := beta.New(client)
+	if err != nil {
+		return nil, err
+	}
+	betaSvc.BasePath = s.server.URL + fakeComputeBetaPath
+	return &CloudProvider{
+		service:     svc,
+		betaService: betaSvc,
+		httpClient:  client,
+		project:     s.project,
+		zone:        s.firstZone(),
+		zonesCache:  make(map[string]([]string)),
+		operationPoll: OperationPollConfig{
+			Interval:    fakeOperationPollInterval,
+			Factor:      1,
+			MaxInterval: fakeOperationPollInterval,
+			Timeout:     defaultOperationTimeout,
+		},
+	}, nil
+}
+
+// AddInstance adds a running instance without disks to the zone
+func (s *FakeComputeServer) AddInstance(zone, name string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.instances[zone+"/"+name] = &compute.Instance{
+		Name:     name,
+		Zone:     s.zoneURI(zone),
+		Status:   "RUNNING",
+		SelfLink: s.zoneURI(zone) + "/instances/" + name,
+	}
+}
+
+// GetDisk returns a copy of the disk, or nil if it does not exist
+func (s *FakeComputeServer) GetDisk(zone, name string) *compute.Disk {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	disk, ok := s.disks[zone+"/"+name]
+	if !ok {
+		return nil
+	}
+	diskCopy := *disk
+	diskCopy.Users = append([]string{}, disk.Users...)
+	return &diskCopy
+}
+
+// GetRegionalDisk returns a copy of the regional disk, or nil if it does not
+// exist
+func (s *FakeComputeServer) GetRegionalDisk(region, name string) *compute.Disk {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	disk, ok := s.regionalDisks[region+"/"+name]
+	if !ok {
+		return nil
+	}
+	diskCopy := *disk
+	diskCopy.ReplicaZones = append([]string{}, disk.ReplicaZones...)
+	return &diskCopy
+}
+
+func (s *FakeComputeServer) firstZone() string {
+	regions := []string{}
+	for region := range s.zonesByRegion {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		if len(s.zonesByRegion[region]) > 0 {
+			return s.zonesByRegion[region][0]
+		}
+	}
+	return ""
+}
+
+// projectURI returns the URI of the project, which is the base of the self
+// links of its resources. Like GCE, self links refer to the public endpoint
+// whatever the endpoint of the request.
+func (s *FakeComputeServer) projectURI() string {
+	return GCEComputeAPIEndpoint + "projects/" + s.project
+}
+
+func (s *FakeComputeServer) zoneURI(zone string) string {
+	return s.projectURI() + "/zones/" + zone
+}
+
+func (s *FakeComputeServer) regionURI(region string) string {
+	return s.projectURI() + "/regions/" + region
+}
+
+func (s *FakeComputeServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, fakeComputePath):
+		path = strings.TrimPrefix(path, fakeComputePath)
+	case strings.HasPrefix(path, fakeComputeBetaPath):
+		path = strings.TrimPrefix(path, fakeComputeBetaPath)
+	default:
+		writeFakeError(w, &fakeError{http.StatusNotFound, "notFound", fmt.Sprintf("unknown path %s", r.URL.Path)})
+		return
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if parts[0] != s.project {
+		writeFakeError(w, &fakeError{http.StatusForbidden, "forbidden", fmt.Sprintf("unknown project %s", parts[0])})
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	resp, ferr := s.route(r, parts[1:])
+	if ferr != nil {
+		writeFakeError(w, ferr)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// route handles the request for the resource path relative to the project
+func (s *FakeComputeServer) route(r *http.Request, parts []string) (interface{}, *fakeError) {
+	method := r.Method
+	switch {
+	case method == http.MethodGet && matchPath(parts, "zones"):
+		return s.listZones(r.URL.Query().Get("filter"))
+	case method == http.MethodGet && matchPath(parts, "aggregated", "disks"):
+		return s.aggregatedListDisks(r.URL.Query().Get("filter"))
+	case method == http.MethodGet && matchPath(parts, "regions", "*", "disks"):
+		return s.listRegionalDisks(parts[1]), nil
+	case method == http.MethodPost && matchPath(parts, "regions", "*", "disks"):
+		disk := &compute.Disk{}
+		if err := json.NewDecoder(r.Body).Decode(disk); err != nil {
+			return nil, fakeInvalidError(err.Error())
+		}
+		return s.insertRegionalDisk(parts[1], disk)
+	case method == http.MethodGet && matchPath(parts, "regions", "*", "disks", "*"):
+		return s.getRegionalDisk(parts[1], parts[3])
+	case method == http.MethodDelete && matchPath(parts, "regions", "*", "disks", "*"):
+		return s.deleteRegionalDisk(parts[1], parts[3])
+	case method == http.MethodPost && matchPath(parts, "regions", "*", "disks", "*", "resize"):
+		req := &compute.RegionDisksResizeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, fakeInvalidError(err.Error())
+		}
+		return s.resizeRegionalDisk(parts[1], parts[3], req.SizeGb)
+	case method == http.MethodGet && matchPath(parts, "regions", "*", "operations", "*"):
+		return s.getOperation(parts[3])
+	case method == http.MethodGet && matchPath(parts, "zones", "*", "disks"):
+		return s.listDisks(parts[1]), nil
+	case method == http.MethodPost && matchPath(parts, "zones", "*", "disks"):
+		disk := &compute.Disk{}
+		if err := json.NewDecoder(r.Body).Decode(disk); err != nil {
+			return nil, fakeInvalidError(err.Error())
+		}
+		return s.insertDisk(parts[1], disk)
+	case method == http.MethodGet && matchPath(parts, "zones", "*", "disks", "*"):
+		return s.getDisk(parts[1], parts[3])
+	case method == http.MethodDelete && matchPath(parts, "zones", "*", "disks", "*"):
+		return s.deleteDisk(parts[1], parts[3])
+	case method == http.MethodPost && matchPath(parts, "zones", "*", "disks", "*", "resize"):
+		req := &compute.DisksResizeRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			return nil, fakeInvalidError(err.Error())
+		}
+		return s.resizeDisk(parts[1], parts[3], req.SizeGb)
+	case method == http.MethodPost && matchPath(parts, "zones", "*", "disks", "*", "createSnapshot"):
+		snapshot := &compute.Snapshot{}
+		if err := json.NewDecoder(r.Body).Decode(snapshot); err != nil {
+			return nil, fakeInvalidError(err.Error())
+		}
+		return s.createSnapshot(parts[1], parts[3], snapshot)
+	case method == http.MethodGet && matchPath(parts, "zones", "*", "instances", "*"):
+		return s.getInstance(parts[1], parts[3])
+	case method == http.MethodPost && matchPath(parts, "zones", "*", "instances", "*", "attachDisk"):
+		attachedDisk := &compute.AttachedDisk{}
+		if err := json.NewDecoder(r.Body).Decode(attachedDisk); err != nil {
+			return nil, fakeInvalidError(err.Error())
+		}
+		return s.attachDisk(parts[1], parts[3], attachedDisk)
+	case method == http.MethodPost && matchPath(parts, "zones", "*", "instances", "*", "detachDisk"):
+		return s.detachDisk(parts[1], parts[3], r.URL.Query().Get("deviceName"))
+	case method == http.MethodGet && matchPath(parts, "zones", "*", "operations", "*"):
+		return s.getOperation(parts[3])
+	case method == http.MethodGet && matchPath(parts, "global", "operations", "*"):
+		return s.getOperation(parts[2])
+	case method == http.MethodGet && matchPath(parts, "global", "snapshots"):
+		query := r.URL.Query()
+		return s.listSnapshots(query.Get("filter"), query.Get("maxResults"), query.Get("pageToken"))
+	case method == http.MethodGet && matchPath(parts, "global", "snapshots", "*"):
+		return s.getSnapshot(parts[2])
+	case method == http.MethodDelete && matchPath(parts, "global", "snapshots", "*"):
+		return s.deleteSnapshot(parts[2])
+	}
+	return nil, &fakeError{http.StatusNotFound, "notFound", fmt.Sprintf("%s %s is not supported by the fake compute server", method, r.URL.Path)}
+}
+
+// matchPath returns whether the path parts match the pattern, where "*"
+// matches any single part
+func matchPath(parts []string, pattern ...string) bool {
+	if len(parts) != len(pattern) {
+		return false
+	}
+	for i, p := range pattern {
+		if p != "*" && p != parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *FakeComputeServer) listZones(filter string) (interface{}, *fakeError) {
+	list := &compute.ZoneList{}
+	for region, zones := range s.zonesByRegion {
+		for _, zone := range zones {
+			z := &compute.Zone{
+				Name:     zone,
+				Region:   s.regionURI(region),
+				Status:   "UP",
+				SelfLink: s.zoneURI(zone),
+			}
+			match, ferr := matchFilter(filter, map[string]string{"name": z.Name, "region": z.Region})
+			if ferr != nil {
+				return nil, ferr
+			}
+			if match {
+				list.Items = append(list.Items, z)
+			}
+		}
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Name < list.Items[j].Name })
+	return list, nil
+}
+
+func (s *FakeComputeServer) listDisks(zone string) *compute.DiskList {
+	list := &compute.DiskList{}
+	for _, disk := range s.sortedDisks() {
+		if disk.Zone == s.zoneURI(zone) {
+			list.Items = append(list.Items, disk)
+		}
+	}
+	return list
+}
+
+func (s *FakeComputeServer) aggregatedListDisks(filter string) (interface{}, *fakeError) {
+	list := &compute.DiskAggregatedList{Items: map[string]compute.DisksScopedList{}}
+	add := func(scope string, disk *compute.Disk) *fakeError {
+		match, ferr := matchFilter(filter, map[string]string{"name": disk.Name, "status": disk.Status})
+		if ferr != nil || !match {
+			return ferr
+		}
+		scoped := list.Items[scope]
+		scoped.Disks = append(scoped.Disks, disk)
+		list.Items[scope] = scoped
+		return nil
+	}
+	for _, disk := range s.sortedDisks() {
+		if ferr := add("zones/"+lastPathPart(disk.Zone), disk); ferr != nil {
+			return nil, ferr
+		}
+	}
+	for _, disk := range sortDisks(s.regionalDisks) {
+		if ferr := add("regions/"+lastPathPart(disk.Region), disk); ferr != nil {
+			return nil, ferr
+		}
+	}
+	return list, nil
+}
+
+func (s *FakeComputeServer) sortedDisks() []*compute.Disk {
+	return sortDisks(s.disks)
+}
+
+func sortDisks(disksByKey map[string]*compute.Disk) []*compute.Disk {
+	keys := []string{}
+	for key := range disksByKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	disks := []*compute.Disk{}
+	for _, key := range keys {
+		disks = append(disks, disksByKey[key])
+	}
+	return disks
+}
+
+func (s *FakeComputeServer) getDisk(zone, name string) (interface{}, *fakeError) {
+	disk, ok := s.disks[zone+"/"+name]
+	if !ok {
+		return nil, fakeNotFoundError("disk", name)
+	}
+	return disk, nil
+}
+
+// insertDisk adds the disk right away in the CREATING state, so that
+// concurrent inserts of the same disk fail, and makes it READY once the
+// operation is done
+func (s *FakeComputeServer) insertDisk(zone string, disk *compute.Disk) (interface{}, *fakeError) {
+	key := zone + "/" + disk.Name
+	if _, ok := s.disks[key]; ok {
+		return nil, fakeAlreadyExistsError("disk", disk.Name)
+	}
+	if ferr := s.validateSourceSnapshot(disk); ferr != nil {
+		return nil, ferr
+	}
+	disk.Zone = s.zoneURI(zone)
+	disk.SelfLink = disk.Zone + "/disks/" + disk.Name
+	disk.Status = "CREATING"
+	disk.CreationTimestamp = time.Now().Format(time.RFC3339)
+	s.disks[key] = disk
+	return s.newZonalOperation(zone, "insert", disk.SelfLink, func() *fakeError {
+		disk.Status = "READY"
+		return nil
+	}), nil
+}
+
+// validateSourceSnapshot returns an error if the disk is created from a
+// snapshot that is missing, not ready or larger than the disk
+func (s *FakeComputeServer) validateSourceSnapshot(disk *compute.Disk) *fakeError {
+	if disk.SourceSnapshot == "" {
+		return nil
+	}
+	snapshot, ok := s.snapshots[lastPathPart(disk.SourceSnapshot)]
+	if !ok {
+		return fakeNotFoundError("snapshot", disk.SourceSnapshot)
+	}
+	if snapshot.Status != "READY" {
+		return &fakeError{http.StatusBadRequest, "resourceNotReady", fmt.Sprintf("snapshot %s is not ready", snapshot.Name)}
+	}
+	if disk.SizeGb < snapshot.DiskSizeGb {
+		return fakeInvalidError(fmt.Sprintf("disk size %d GB is smaller than the snapshot size %d GB", disk.SizeGb, snapshot.DiskSizeGb))
+	}
+	return nil
+}
+
+func (s *FakeComputeServer) deleteDisk(zone, name string) (interface{}, *fakeError) {
+	key := zone + "/" + name
+	disk, ok := s.disks[key]
+	if !ok {
+		return nil, fakeNotFoundError("disk", name)
+	}
+	if len(disk.Users) > 0 {
+		return nil, &fakeError{http.StatusBadRequest, "resourceInUseByAnotherResource", fmt.Sprintf("disk %s is already being used by %s", name, disk.Users[0])}
+	}
+	return s.newZonalOperation(zone, "delete", disk.SelfLink, func() *fakeError {
+		delete(s.disks, key)
+		return nil
+	}), nil
+}
+
+func (s *FakeComputeServer) resizeDisk(zone, name string, sizeGb int64) (interface{}, *fakeError) {
+	disk, ok := s.disks[zone+"/"+name]
+	if !ok {
+		return nil, fakeNotFoundError("disk", name)
+	}
+	if sizeGb <= disk.SizeGb {
+		return nil, fakeInvalidError(fmt.Sprintf("requested disk size %d GB must be larger than the current size %d GB", sizeGb, disk.SizeGb))
+	}
+	return s.newZonalOperation(zone, "resize", disk.SelfLink, func() *fakeError {
+		disk.SizeGb = sizeGb
+		return nil
+	}), nil
+}
+
+func (s *FakeComputeServer) listRegionalDisks(region string) *compute.DiskList {
+	list := &compute.DiskList{}
+	for _, disk := range sortDisks(s.regionalDisks) {
+		if disk.Region == s.regionURI(region) {
+			list.Items = append(list.Items, disk)
+		}
+	}
+	return list
+}
+
+func (s *FakeComputeServer) getRegionalDisk(region, name string) (interface{}, *fakeError) {
+	disk, ok := s.regionalDisks[region+"/"+name]
+	if !ok {
+		return nil, fakeNotFoundError("disk", name)
+	}
+	return disk, nil
+}
+
+// insertRegionalDisk adds the disk right away in the CREATING state and makes
+// it READY once the operation is done, like insertDisk. The disk must be
+// replicated in two zones of the region.
+func (s *FakeComputeServer) insertRegionalDisk(region string, disk *compute.Disk) (interface{}, *fakeError) {
+	key := region + "/" + disk.Name
+	if _, ok := s.regionalDisks[key]; ok {
+		return nil, fakeAlreadyExistsError("disk", disk.Name)
+	}
+	if len(disk.ReplicaZones) != 2 {
+		return nil, fakeInvalidError(fmt.Sprintf("regional disk %s must have 2 replica zones, got %v", disk.Name, disk.ReplicaZones))
+	}
+	for _, zone := range disk.ReplicaZones {
+		if !containsString(s.zonesByRegion[region], lastPathPart(zone)) {
+			return nil, fakeInvalidError(fmt.Sprintf("replica zone %s is not in region %s", zone, region))
+		}
+	}
+	if ferr := s.validateSourceSnapshot(disk); ferr != nil {
+		return nil, ferr
+	}
+	disk.Region = s.regionURI(region)
+	disk.SelfLink = disk.Region + "/disks/" + disk.Name
+	disk.Status = "CREATING"
+	disk.CreationTimestamp = time.Now().Format(time.RFC3339)
+	s.regionalDisks[key] = disk
+	return s.newRegionalOperation(region, "insert", disk.SelfLink, func() *fakeError {
+		disk.Status = "READY"
+		return nil
+	}), nil
+}
+
+func (s *FakeComputeServer) deleteRegionalDisk(region, name string) (interface{}, *fakeError) {
+	key := region + "/" + name
+	disk, ok := s.regionalDisks[key]
+	if !ok {
+		return nil, fakeNotFoundError("disk", name)
+	}
+	return s.newRegionalOperation(region, "delete", disk.SelfLink, func() *fakeError {
+		delete(s.regionalDisks, key)
+		return nil
+	}), nil
+}
+
+func (s *FakeComputeServer) resizeRegionalDisk(region, name string, sizeGb int64) (interface{}, *fakeError) {
+	disk, ok := s.regionalDisks[region+"/"+name]
+	if !ok {
+		return nil, fakeNotFoundError("disk", name)
+	}
+	if sizeGb <= disk.SizeGb {
+		return nil, fakeInvalidError(fmt.Sprintf("requested disk size %d GB must be larger than the current size %d GB", sizeGb, disk.SizeGb))
+	}
+	return s.newRegionalOperation(region, "resize", disk.SelfLink, func() *fakeError {
+		disk.SizeGb = sizeGb
+		return nil
+	}), nil
+}
+
+// createSnapshot adds the snapshot right away in the CREATING state. The
+// snapshot then advances to UPLOADING and to READY each time it is gotten.
+func (s *FakeComputeServer) createSnapshot(zone, diskName string, snapshot *compute.Snapshot) (interface{}, *fakeError) {
+	disk, ok := s.disks[zone+"/"+diskName]
+	if !ok {
+		return nil, fakeNotFoundError("disk", diskName)
+	}
+	if _, ok := s.snapshots[snapshot.Name]; ok {
+		return nil, fakeAlreadyExistsError("snapshot", snapshot.Name)
+	}
+	snapshot.SourceDisk = disk.SelfLink
+	snapshot.DiskSizeGb = disk.SizeGb
+	snapshot.StorageBytes = disk.SizeGb * 1024 * 1024 * 1024
+	snapshot.Status = "CREATING"
+	snapshot.SelfLink = s.projectURI() + "/global/snapshots/" + snapshot.Name
+	snapshot.CreationTimestamp = time.Now().Format(time.RFC3339)
+	s.snapshots[snapshot.Name] = snapshot
+	return s.newZonalOperation(zone, "createSnapshot", disk.SelfLink, func() *fakeError { return nil }), nil
+}
+
+func (s *FakeComputeServer) getSnapshot(name string) (interface{}, *fakeError) {
+	snapshot, ok := s.snapshots[name]
+	if !ok {
+		return nil, fakeNotFoundError("snapshot", name)
+	}
+	switch snapshot.Status {
+	case "CREATING":
+		snapshot.Status = "UPLOADING"
+	case "UPLOADING":
+		snapshot.Status = "READY"
+	}
+	return snapshot, nil
+}
+
+func (s *FakeComputeServer) deleteSnapshot(name string) (interface{}, *fakeError) {
+	snapshot, ok := s.snapshots[name]
+	if !ok {
+		return nil, fakeNotFoundError("snapshot", name)
+	}
+	return s.newGlobalOperation("delete", snapshot.SelfLink, func() *fakeError {
+		delete(s.snapshots, name)
+		return nil
+	}), nil
+}
+
+func (s *FakeComputeServer) listSnapshots(filter, maxResults, pageToken string) (interface{}, *fakeError) {
+	names := []string{}
+	for name := range s.snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	matching := []*compute.Snapshot{}
+	for _, name := range names {
+		snapshot := s.snapshots[name]
+		match, ferr := matchFilter(filter, map[string]string{"name": snapshot.Name, "sourceDisk": snapshot.SourceDisk, "status": snapshot.Status})
+		if ferr != nil {
+			return nil, ferr
+		}
+		if match {
+			matching = append(matching, snapshot)
+		}
+	}
+
+	start := 0
+	if pageToken != "" {
+		var err error
+		start, err = strconv.Atoi(pageToken)
+		if err != nil || start < 0 || start > len(matching) {
+			return nil, fakeInvalidError(fmt.Sprintf("invalid page token %q", pageToken))
+		}
+	}
+	end := len(matching)
+	if maxResults != "" {
+		max, err := strconv.Atoi(maxResults)
+		if err != nil || max < 0 {
+			return nil, fakeInvalidError(fmt.Sprintf("invalid max results %q", maxResults))
+		}
+		if max > 0 && start+max < end {
+			end = start + max
+		}
+	}
+	list := &compute.SnapshotList{Items: matching[start:end]}
+	if end < len(matching) {
+		list.NextPageToken = strconv.Itoa(end)
+	}
+	return list, nil
+}
+
+func (s *FakeComputeServer) getInstance(zone, name string) (interface{}, *fakeError) {
+	instance, ok := s.instances[zone+"/"+name]
+	if !ok {
+		return nil, fakeNotFoundError("instance", name)
+	}
+	return instance, nil
+}
+
+// attachDisk attaches the disk once the operation is done. Like GCE, the
+// operation fails if the disk is attached read-write to another instance, or
+// attached to another instance at all for a read-write attachment.
+func (s *FakeComputeServer) attachDisk(zone, instanceName string, attachedDisk *compute.AttachedDisk) (interface{}, *fakeError) {
+	instance, ok := s.instances[zone+"/"+instanceName]
+	if !ok {
+		return nil, fakeNotFoundError("instance", instanceName)
+	}
+	diskKey, ok := diskKeyFromURI(attachedDisk.Source)
+	if !ok {
+		return nil, fakeInvalidError(fmt.Sprintf("invalid disk source %q", attachedDisk.Source))
+	}
+	disk, ok := s.disks[diskKey]
+	if !ok {
+		return nil, fakeNotFoundError("disk", attachedDisk.Source)
+	}
+	mode := attachedDisk.Mode
+	if mode == "" {
+		mode = "READ_WRITE"
+	}
+	deviceName := attachedDisk.DeviceName
+	if deviceName == "" {
+		deviceName = disk.Name
+	}
+	return s.newZonalOperation(zone, "attachDisk", instance.SelfLink, func() *fakeError {
+		for _, d := range instance.Disks {
+			if d.DeviceName == deviceName || d.Source == disk.SelfLink {
+				return &fakeError{http.StatusBadRequest, "RESOURCE_ALREADY_EXISTS", fmt.Sprintf("disk %s is already attached to %s", disk.Name, instanceName)}
+			}
+		}
+		for _, user := range disk.Users {
+			if mode == "READ_WRITE" || s.attachedMode(user, disk.SelfLink) == "READ_WRITE" {
+				return &fakeError{http.StatusBadRequest, "RESOURCE_IN_USE_BY_ANOTHER_RESOURCE", fmt.Sprintf("disk %s is already being used by %s", disk.Name, user)}
+			}
+		}
+		instance.Disks = append(instance.Disks, &compute.AttachedDisk{
+			DeviceName: deviceName,
+			Index:      int64(len(instance.Disks)),
+			Kind:       attachedDisk.Kind,
+			Mode:       mode,
+			Source:     disk.SelfLink,
+			Type:       "PERSISTENT",
+		})
+		disk.Users = append(disk.Users, instance.SelfLink)
+		return nil
+	}), nil
+}
+
+// attachedMode returns the mode of the disk attached to the instance
+func (s *FakeComputeServer) attachedMode(instanceURI, diskURI string) string {
+	for _, instance := range s.instances {
+		if instance.SelfLink != instanceURI {
+			continue
+		}
+		for _, d := range instance.Disks {
+			if d.Source == diskURI {
+				return d.Mode
+			}
+		}
+	}
+	return ""
+}
+
+func (s *FakeComputeServer) detachDisk(zone, instanceName, deviceName string) (interface{}, *fakeError) {
+	instance, ok := s.instances[zone+"/"+instanceName]
+	if !ok {
+		return nil, fakeNotFoundError("instance", instanceName)
+	}
+	return s.newZonalOperation(zone, "detachDisk", instance.SelfLink, func() *fakeError {
+		for i, d := range instance.Disks {
+			if d.DeviceName != deviceName {
+				continue
+			}
+			instance.Disks = append(instance.Disks[:i], instance.Disks[i+1:]...)
+			if diskKey, ok := diskKeyFromURI(d.Source); ok {
+				if disk, ok := s.disks[diskKey]; ok {
+					disk.Users = removeString(disk.Users, instance.SelfLink)
+				}
+			}
+			return nil
+		}
+		return &fakeError{http.StatusBadRequest, "INVALID_USAGE", fmt.Sprintf("no attached disk found with device name %s", deviceName)}
+	}), nil
+}
+
+func (s *FakeComputeServer) newZonalOperation(zone, opType, targetLink string, apply func() *fakeError) *compute.Operation {
+	op := s.newOperation(opType, targetLink, apply)
+	op.Zone = s.zoneURI(zone)
+	op.SelfLink = op.Zone + "/operations/" + op.Name
+	return op
+}
+
+func (s *FakeComputeServer) newRegionalOperation(region, opType, targetLink string, apply func() *fakeError) *compute.Operation {
+	op := s.newOperation(opType, targetLink, apply)
+	op.Region = s.regionURI(region)
+	op.SelfLink = op.Region + "/operations/" + op.Name
+	return op
+}
+
+func (s *FakeComputeServer) newGlobalOperation(opType, targetLink string, apply func() *fakeError) *compute.Operation {
+	op := s.newOperation(opType, targetLink, apply)
+	op.SelfLink = s.projectURI() + "/global/operations/" + op.Name
+	return op
+}
+
+func (s *FakeComputeServer) newOperation(opType, targetLink string, apply func() *fakeError) *compute.Operation {
+	s.opCount++
+	op := &compute.Operation{
+		Name:          fmt.Sprintf("operation-%d", s.opCount),
+		OperationType: opType,
+		TargetLink:    targetLink,
+		Status:        "PENDING",
+	}
+	s.operations[op.Name] = &fakeOperation{op: op, apply: apply}
+	return op
+}
+
+// getOperation advances the operation by one state, applying its mutation
+// when it becomes DONE
+func (s *FakeComputeServer) getOperation(name string) (interface{}, *fakeError) {
+	fakeOp, ok := s.operations[name]
+	if !ok {
+		return nil, fakeNotFoundError("operation", name)
+	}
+	op := fakeOp.op
+	switch op.Status {
+	case "PENDING":
+		op.Status = "RUNNING"
+	case "RUNNING":
+		op.Status = operationStatusDone
+		if ferr := fakeOp.apply(); ferr != nil {
+			op.HttpErrorStatusCode = int64(ferr.code)
+			op.Error = &compute.OperationError{
+				Errors: []*compute.OperationErrorErrors{{Code: ferr.reason, Message: ferr.message}},
+			}
+		}
+	}
+	return op, nil
+}
+
+// matchFilter returns whether the fields match a "<field> eq <regexp>" filter,
+// the only form of filter that the driver uses. Like GCE, the regular
+// expression must match the whole field.
+func matchFilter(filter string, fields map[string]string) (bool, *fakeError) {
+	if filter == "" {
+		return true, nil
+	}
+	match := fakeFilterRegexp.FindStringSubmatch(filter)
+	if match == nil {
+		return false, fakeInvalidError(fmt.Sprintf("unsupported filter %q", filter))
+	}
+	value, ok := fields[match[1]]
+	if !ok {
+		return false, fakeInvalidError(fmt.Sprintf("unsupported filter field %q", match[1]))
+	}
+	re, err := regexp.Compile("^(?:" + match[2] + ")$")
+	if err != nil {
+		return false, fakeInvalidError(fmt.Sprintf("invalid filter %q: %v", filter, err))
+	}
+	return re.MatchString(value), nil
+}
+
+// diskKeyFromURI returns the zone/name key of a zonal disk URI
+func diskKeyFromURI(uri string) (string, bool) {
+	parts := strings.Split(uri, "/")
+	n := len(parts)
+	if n < 4 || parts[n-4] != "zones" || parts[n-2] != "disks" {
+		return "", false
+	}
+	return parts[n-3] + "/" + parts[n-1], true
+}
+
+func lastPathPart(uri string) string {
+	return uri[strings.LastIndex(uri, "/")+1:]
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(list []string, s string) []string {
+	result := []string{}
+	for _, item := range list {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func fakeNotFoundError(kind, name string) *fakeError {
+	return &fakeError{http.StatusNotFound, "notFound", fmt.Sprintf("the %s %s was not found", kind, name)}
+}
+
+func fakeAlreadyExistsError(kind, name string) *fakeError {
+	return &fakeError{http.StatusConflict, "alreadyExists", fmt.Sprintf("the %s %s already exists", kind, name)}
+}
+
+func fakeInvalidError(message string) *fakeError {
+	return &fakeError{http.StatusBadRequest, "invalid", message}
+}
+
+// writeFakeError writes the error in the format of the Google APIs, which the
+// API clients parse into a googleapi.Error
+func writeFakeError(w http.ResponseWriter, ferr *fakeError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ferr.code)
+	body := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    ferr.code,
+			"message": ferr.message,
+			"errors": []map[string]string{
+				{"reason": ferr.reason, "message": ferr.message},
+			},
+		},
+	}
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,490 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+)
+
+const (
+	testProject = "test-project"
+	testRegion  = "us-central1"
+	testZone    = "us-central1-c"
+	testDisk    = "test-disk"
+)
+
+func newTestCloudProvider(t *testing.T) (*FakeComputeServer, *CloudProvider) {
+	server := NewFakeComputeServer(testProject, map[string][]string{
+		testRegion: {"us-central1-b", testZone},
+	})
+	cloud, err := server.CloudProvider()
+	if err != nil {
+		server.Close()
+		t.Fatalf("Failed to create cloud provider: %v", err)
+	}
+	return server, cloud
+}
+
+func insertTestDisk(t *testing.T, cloud *CloudProvider, volKey *meta.Key, sizeGb int64, snapshotID string) {
+	capBytes := common.GbToBytes(sizeGb)
+	err := cloud.InsertDisk(context.Background(), volKey, "pd-standard", capBytes, &csi.CapacityRange{RequiredBytes: capBytes}, nil, snapshotID, "", "", nil, false, "")
+	if err != nil {
+		t.Fatalf("Failed to insert disk %v: %v", volKey, err)
+	}
+}
+
+func TestFakeComputeServerDisks(t *testing.T) {
+	server, cloud := newTestCloudProvider(t)
+	defer server.Close()
+	ctx := context.Background()
+	volKey := meta.ZonalKey(testDisk, testZone)
+
+	insertTestDisk(t, cloud, volKey, 10, "")
+	disk, err := cloud.GetDisk(ctx, volKey)
+	if err != nil {
+		t.Fatalf("Failed to get disk: %v", err)
+	}
+	if disk.GetSizeGb() != 10 || disk.ZonalDisk.Status != "READY" {
+		t.Errorf("Expected a READY disk of 10 GB, got: %+v", disk.ZonalDisk)
+	}
+	// Inserting the same disk again reuses it
+	insertTestDisk(t, cloud, volKey, 10, "")
+
+	repairedKey, err := cloud.RepairUnderspecifiedVolumeKey(ctx, meta.ZonalKey(testDisk, common.UnspecifiedValue))
+	if err != nil {
+		t.Fatalf("Failed to repair volume key: %v", err)
+	}
+	if repairedKey.Zone != testZone {
+		t.Errorf("Expected repaired zone %s, got: %s", testZone, repairedKey.Zone)
+	}
+
+	counts, err := cloud.CountDisksInZones(ctx, testRegion, []string{"us-central1-b", testZone})
+	if err != nil {
+		t.Fatalf("Failed to count disks: %v", err)
+	}
+	expCounts := map[string]int{"us-central1-b": 0, testZone: 1}
+	if !reflect.DeepEqual(counts, expCounts) {
+		t.Errorf("Expected disk counts %v, got: %v", expCounts, counts)
+	}
+
+	sizeGb, err := cloud.ResizeDisk(ctx, volKey, common.GbToBytes(20))
+	if err != nil {
+		t.Fatalf("Failed to resize disk: %v", err)
+	}
+	if sizeGb != 20 || server.GetDisk(testZone, testDisk).SizeGb != 20 {
+		t.Errorf("Expected disk size of 20 GB after resize, got: %d", server.GetDisk(testZone, testDisk).SizeGb)
+	}
+
+	if err := cloud.DeleteDisk(ctx, volKey); err != nil {
+		t.Fatalf("Failed to delete disk: %v", err)
+	}
+	if _, err := cloud.GetDisk(ctx, volKey); !IsGCEError(err, "notFound") || !IsGCEDiskNotFound(err) {
+		t.Errorf("Expected notFound error getting deleted disk, got: %v", err)
+	}
+	// Deleting a deleted disk succeeds
+	if err := cloud.DeleteDisk(ctx, volKey); err != nil {
+		t.Errorf("Failed to delete deleted disk: %v", err)
+	}
+}
+
+func TestRepairUnderspecifiedVolumeKey(t *testing.T) {
+	server := NewFakeComputeServer(testProject, map[string][]string{
+		testRegion: {"us-central1-b", testZone},
+		"us-east1": {"us-east1-b"},
+	})
+	defer server.Close()
+	cloud, err := server.CloudProvider()
+	if err != nil {
+		t.Fatalf("Failed to create cloud provider: %v", err)
+	}
+	ctx := context.Background()
+	// Disks of the same name outside the region of the driver are ignored
+	insertTestDisk(t, cloud, meta.ZonalKey(testDisk, "us-east1-b"), 10, "")
+	insertTestDisk(t, cloud, meta.ZonalKey(testDisk, testZone), 10, "")
+	insertTestDisk(t, cloud, meta.ZonalKey("other-disk", "us-east1-b"), 10, "")
+
+	testCases := []struct {
+		name   string
+		key    *meta.Key
+		expKey *meta.Key
+		expErr bool
+	}{
+		{
+			name:   "zonal disk",
+			key:    meta.ZonalKey(testDisk, common.UnspecifiedValue),
+			expKey: meta.ZonalKey(testDisk, testZone),
+		},
+		{
+			name:   "zone already specified",
+			key:    meta.ZonalKey(testDisk, "us-central1-b"),
+			expKey: meta.ZonalKey(testDisk, "us-central1-b"),
+		},
+		{
+			name:   "disk in another region",
+			key:    meta.ZonalKey("other-disk", common.UnspecifiedValue),
+			expErr: true,
+		},
+		{
+			name:   "missing disk",
+			key:    meta.ZonalKey("missing-disk", common.UnspecifiedValue),
+			expErr: true,
+		},
+		{
+			name:   "regional disk",
+			key:    meta.RegionalKey(testDisk, common.UnspecifiedValue),
+			expKey: meta.RegionalKey(testDisk, testRegion),
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		key, err := cloud.RepairUnderspecifiedVolumeKey(ctx, tc.key)
+		if err != nil {
+			if !tc.expErr {
+				t.Errorf("got unexpected error: %v", err)
+			}
+			continue
+		}
+		if tc.expErr {
+			t.Errorf("expected error, got none")
+		}
+		if !reflect.DeepEqual(key, tc.expKey) {
+			t.Errorf("Expected key %v, got: %v", tc.expKey, key)
+		}
+	}
+}
+
+func TestFakeComputeServerRegionalDisks(t *testing.T) {
+	server, cloud := newTestCloudProvider(t)
+	defer server.Close()
+	ctx := context.Background()
+	volKey := meta.RegionalKey(testDisk, testRegion)
+	capBytes := common.GbToBytes(200)
+	replicaZones := []string{
+		cloud.service.BasePath + testProject + "/zones/us-central1-b",
+		cloud.service.BasePath + testProject + "/zones/" + testZone,
+	}
+
+	err := cloud.InsertDisk(ctx, volKey, "pd-standard", capBytes, &csi.CapacityRange{RequiredBytes: capBytes}, replicaZones, "", "", "", nil, false, "")
+	if err != nil {
+		t.Fatalf("Failed to insert regional disk: %v", err)
+	}
+	disk, err := cloud.GetDisk(ctx, volKey)
+	if err != nil {
+		t.Fatalf("Failed to get regional disk: %v", err)
+	}
+	if disk.GetSizeGb() != 200 || disk.RegionalDisk.Status != "READY" {
+		t.Errorf("Expected a READY disk of 200 GB, got: %+v", disk.RegionalDisk)
+	}
+
+	repairedKey, err := cloud.RepairUnderspecifiedVolumeKey(ctx, meta.RegionalKey(testDisk, common.UnspecifiedValue))
+	if err != nil {
+		t.Fatalf("Failed to repair volume key: %v", err)
+	}
+	if repairedKey.Region != testRegion {
+		t.Errorf("Expected repaired region %s, got: %s", testRegion, repairedKey.Region)
+	}
+
+	sizeGb, err := cloud.ResizeDisk(ctx, volKey, common.GbToBytes(300))
+	if err != nil {
+		t.Fatalf("Failed to resize regional disk: %v", err)
+	}
+	if sizeGb != 300 || server.GetRegionalDisk(testRegion, testDisk).SizeGb != 300 {
+		t.Errorf("Expected disk size of 300 GB after resize, got: %d", server.GetRegionalDisk(testRegion, testDisk).SizeGb)
+	}
+
+	if err := cloud.DeleteDisk(ctx, volKey); err != nil {
+		t.Fatalf("Failed to delete regional disk: %v", err)
+	}
+	if _, err := cloud.GetDisk(ctx, volKey); !IsGCEDiskNotFound(err) {
+		t.Errorf("Expected notFound error getting deleted regional disk, got: %v", err)
+	}
+
+	// A disk must be replicated in zones of its region
+	err = cloud.InsertDisk(ctx, volKey, "pd-standard", capBytes, &csi.CapacityRange{RequiredBytes: capBytes}, []string{replicaZones[0], "us-east1-b"}, "", "", "", nil, false, "")
+	if !IsGCEError(err, "invalid") {
+		t.Errorf("Expected invalid error inserting a disk replicated outside its region, got: %v", err)
+	}
+}
+
+func TestFakeComputeServerAttachDisk(t *testing.T) {
+	server, cloud := newTestCloudProvider(t)
+	defer server.Close()
+	ctx := context.Background()
+	volKey := meta.ZonalKey(testDisk, testZone)
+	deviceName, err := common.GetDeviceName(volKey)
+	if err != nil {
+		t.Fatalf("Failed to get device name: %v", err)
+	}
+	server.AddInstance(testZone, "node-1")
+	server.AddInstance(testZone, "node-2")
+	insertTestDisk(t, cloud, volKey, 10, "")
+
+	testCases := []struct {
+		name     string
+		attach   bool
+		mode     string
+		instance string
+		expUsers int
+		expErr   bool
+	}{
+		{
+			name:     "attach read-write",
+			attach:   true,
+			mode:     "READ_WRITE",
+			instance: "node-1",
+			expUsers: 1,
+		},
+		{
+			name:     "attach again",
+			attach:   true,
+			mode:     "READ_WRITE",
+			instance: "node-1",
+			expUsers: 1,
+			expErr:   true,
+		},
+		{
+			name:     "attach read-only to another instance while attached read-write",
+			attach:   true,
+			mode:     "READ_ONLY",
+			instance: "node-2",
+			expUsers: 1,
+			expErr:   true,
+		},
+		{
+			name:     "detach",
+			instance: "node-1",
+		},
+		{
+			name:     "detach detached disk",
+			instance: "node-1",
+			expErr:   true,
+		},
+		{
+			name:     "attach read-only",
+			attach:   true,
+			mode:     "READ_ONLY",
+			instance: "node-1",
+			expUsers: 1,
+		},
+		{
+			name:     "attach read-only to another instance",
+			attach:   true,
+			mode:     "READ_ONLY",
+			instance: "node-2",
+			expUsers: 2,
+		},
+		{
+			name:     "attach to missing instance",
+			attach:   true,
+			mode:     "READ_ONLY",
+			instance: "node-3",
+			expUsers: 2,
+			expErr:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		if tc.attach {
+			err = cloud.AttachDisk(ctx, volKey, tc.mode, "PERSISTENT", testZone, tc.instance, nil)
+		} else {
+			err = cloud.DetachDisk(ctx, deviceName, testZone, tc.instance)
+		}
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+		if users := server.GetDisk(testZone, testDisk).Users; len(users) != tc.expUsers {
+			t.Errorf("Expected %d users, got: %v", tc.expUsers, users)
+		}
+	}
+
+	if _, err := cloud.GetInstanceOrError(ctx, testZone, "node-3"); !IsInstanceNotFound(err) {
+		t.Errorf("Expected instance notFound error getting missing instance, got: %v", err)
+	}
+	if err := cloud.DeleteDisk(ctx, volKey); !IsGCEError(err, "resourceInUseByAnotherResource") {
+		t.Errorf("Expected resourceInUseByAnotherResource error deleting attached disk, got: %v", err)
+	}
+	instance, err := cloud.GetInstanceOrError(ctx, testZone, "node-2")
+	if err != nil {
+		t.Fatalf("Failed to get instance: %v", err)
+	}
+	if len(instance.Disks) != 1 || instance.Disks[0].DeviceName != deviceName || instance.Disks[0].Mode != "READ_ONLY" {
+		t.Errorf("Expected the disk attached read-only as %s, got: %+v", deviceName, instance.Disks)
+	}
+}
+
+func TestFakeComputeServerSnapshots(t *testing.T) {
+	server, cloud := newTestCloudProvider(t)
+	defer server.Close()
+	ctx := context.Background()
+	volKey := meta.ZonalKey(testDisk, testZone)
+	insertTestDisk(t, cloud, volKey, 10, "")
+
+	snapshot, err := cloud.CreateSnapshot(ctx, volKey, "snapshot-1")
+	if err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+	if snapshot.Status != "UPLOADING" {
+		t.Errorf("Expected snapshot UPLOADING after creation, got: %s", snapshot.Status)
+	}
+	if _, err := cloud.CreateSnapshot(ctx, volKey, "snapshot-1"); !IsGCEError(err, "alreadyExists") {
+		t.Errorf("Expected alreadyExists error creating the snapshot again, got: %v", err)
+	}
+	// Restoring from a snapshot before it is ready fails
+	restoredKey := meta.ZonalKey("restored-disk", testZone)
+	capBytes := common.GbToBytes(10)
+	err = cloud.InsertDisk(ctx, restoredKey, "pd-standard", capBytes, &csi.CapacityRange{RequiredBytes: capBytes}, nil, snapshot.SelfLink, "", "", nil, false, "")
+	if err == nil {
+		t.Errorf("Expected error restoring from an uploading snapshot")
+	}
+	snapshot, err = cloud.GetSnapshot(ctx, "snapshot-1")
+	if err != nil {
+		t.Fatalf("Failed to get snapshot: %v", err)
+	}
+	if snapshot.Status != "READY" {
+		t.Errorf("Expected snapshot READY, got: %s", snapshot.Status)
+	}
+	insertTestDisk(t, cloud, restoredKey, 10, snapshot.SelfLink)
+
+	if _, err := cloud.CreateSnapshot(ctx, restoredKey, "snapshot-2"); err != nil {
+		t.Fatalf("Failed to create snapshot: %v", err)
+	}
+
+	testCases := []struct {
+		name         string
+		filter       string
+		maxEntries   int64
+		pageToken    string
+		expSnapshots []string
+		expToken     string
+	}{
+		{
+			name:         "all",
+			expSnapshots: []string{"snapshot-1", "snapshot-2"},
+		},
+		{
+			name:         "by source disk",
+			filter:       "sourceDisk eq .*/zones/" + testZone + "/disks/restored-disk$",
+			expSnapshots: []string{"snapshot-2"},
+		},
+		{
+			name:         "first page",
+			maxEntries:   1,
+			expSnapshots: []string{"snapshot-1"},
+			expToken:     "1",
+		},
+		{
+			name:         "last page",
+			maxEntries:   1,
+			pageToken:    "1",
+			expSnapshots: []string{"snapshot-2"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		snapshots, token, err := cloud.ListSnapshots(ctx, tc.filter, tc.maxEntries, tc.pageToken)
+		if err != nil {
+			t.Errorf("Failed to list snapshots: %v", err)
+			continue
+		}
+		names := []string{}
+		for _, s := range snapshots {
+			names = append(names, s.Name)
+		}
+		if !reflect.DeepEqual(names, tc.expSnapshots) {
+			t.Errorf("Expected snapshots %v, got: %v", tc.expSnapshots, names)
+		}
+		if token != tc.expToken {
+			t.Errorf("Expected next page token %q, got: %q", tc.expToken, token)
+		}
+	}
+
+	if err := cloud.DeleteSnapshot(ctx, "snapshot-1"); err != nil {
+		t.Fatalf("Failed to delete snapshot: %v", err)
+	}
+	if _, err := cloud.GetSnapshot(ctx, "snapshot-1"); !IsGCEError(err, "notFound") {
+		t.Errorf("Expected notFound error getting deleted snapshot, got: %v", err)
+	}
+}
+
+func TestCloudProviderCancelledContext(t *testing.T) {
+	server, cloud := newTestCloudProvider(t)
+	defer server.Close()
+	volKey := meta.ZonalKey(testDisk, testZone)
+	server.AddInstance(testZone, "node-1")
+	insertTestDisk(t, cloud, volKey, 10, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	testCases := []struct {
+		name string
+		call func() error
+	}{
+		{
+			name: "list zones",
+			call: func() error {
+				_, err := cloud.ListZones(ctx, testRegion)
+				return err
+			},
+		},
+		{
+			name: "list snapshots",
+			call: func() error {
+				_, _, err := cloud.ListSnapshots(ctx, "", 10, "")
+				return err
+			},
+		},
+		{
+			name: "get instance",
+			call: func() error {
+				_, err := cloud.GetInstanceOrError(ctx, testZone, "node-1")
+				return err
+			},
+		},
+		{
+			name: "get disk",
+			call: func() error {
+				_, err := cloud.GetDisk(ctx, volKey)
+				return err
+			},
+		},
+		{
+			name: "resize disk",
+			call: func() error {
+				_, err := cloud.ResizeDisk(ctx, volKey, common.GbToBytes(20))
+				return err
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		err := tc.call()
+		if ContextError(err) != context.Canceled {
+			t.Errorf("Expected context error, got: %v", err)
+		}
+	}
+	disk, err := cloud.GetDisk(context.Background(), volKey)
+	if err != nil {
+		t.Fatalf("Failed to get disk: %v", err)
+	}
+	if disk.GetSizeGb() != 10 {
+		t.Errorf("Expected the disk to not be resized, got size %d", disk.GetSizeGb())
+	}
+}
@@ -36,6 +36,7 @@ const (
 	Timestamp                 = "2018-09-05T15:17:08.270-07:00"
 	BasePath                  = "https://www.googleapis.com/compute/v1/projects/"
 	snapshotURITemplateGlobal = "%s/global/snapshots/%s" //{gce.projectID}/global/snapshots/{snapshot.Name}"
+	imageURITemplateGlobal    = "%s/global/images/%s"    //{gce.projectID}/global/images/{image.Name}"
 )
 
 type FakeCloudProvider struct {
@@ -45,17 +46,29 @@ type FakeCloudProvider struct {
 	disks     map[string]*CloudDisk
 	instances map[string]*compute.Instance
 	snapshots map[string]*compute.Snapshot
+	images    map[string]*compute.Image
+	// resourceTags holds the resource manager tags bound to each disk by name
+	resourceTags map[string]map[string]string
+	// storagePools holds the storage pool of each disk created in one by name
+	storagePools map[string]string
+	// confidentialInstances holds the names of the instances that are
+	// Confidential VMs
+	confidentialInstances map[string]bool
 }
 
 var _ GCECompute = &FakeCloudProvider{}
 
 func CreateFakeCloudProvider(project, zone string, cloudDisks []*CloudDisk) (*FakeCloudProvider, error) {
 	fcp := &FakeCloudProvider{
-		project:   project,
-		zone:      zone,
-		disks:     map[string]*CloudDisk{},
-		instances: map[string]*compute.Instance{},
-		snapshots: map[string]*compute.Snapshot{},
+		project:               project,
+		zone:                  zone,
+		disks:                 map[string]*CloudDisk{},
+		instances:             map[string]*compute.Instance{},
+		snapshots:             map[string]*compute.Snapshot{},
+		images:                map[string]*compute.Image{},
+		resourceTags:          map[string]map[string]string{},
+		storagePools:          map[string]string{},
+		confidentialInstances: map[string]bool{},
 	}
 	for _, d := range cloudDisks {
 		fcp.disks[d.GetName()] = d
@@ -95,6 +108,26 @@ func (cloud *FakeCloudProvider) ListZones(ctx context.Context, region string) ([
 	return []string{cloud.zone, "country-region-fakesecondzone"}, nil
 }
 
+func (cloud *FakeCloudProvider) CountDisksInZones(ctx context.Context, region string, zones []string) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, zone := range zones {
+		counts[zone] = 0
+	}
+	for _, disk := range cloud.disks {
+		diskZones := []string{disk.GetZone()}
+		if disk.Type() == Regional {
+			diskZones = disk.RegionalDisk.ReplicaZones
+		}
+		for _, zone := range diskZones {
+			zone = zone[strings.LastIndex(zone, "/")+1:]
+			if _, ok := counts[zone]; ok {
+				counts[zone]++
+			}
+		}
+	}
+	return counts, nil
+}
+
 func (cloud *FakeCloudProvider) ListSnapshots(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*compute.Snapshot, string, error) {
 	var sourceDisk string
 	snapshots := []*compute.Snapshot{}
@@ -159,7 +192,7 @@ func (cloud *FakeCloudProvider) ListSnapshots(ctx context.Context, filter string
 func (cloud *FakeCloudProvider) GetDisk(ctx context.Context, volKey *meta.Key) (*CloudDisk, error) {
 	disk, ok := cloud.disks[volKey.Name]
 	if !ok {
-		return nil, notFoundError()
+		return nil, asResourceNotFound(diskResource, notFoundError())
 	}
 	return disk, nil
 }
@@ -172,8 +205,8 @@ func (cloud *FakeCloudProvider) ValidateExistingDisk(ctx context.Context, resp *
 	responseValid := common.GbToBytes(resp.GetSizeGb()) <= limBytes || limBytes == 0
 	if !requestValid || !responseValid {
 		return fmt.Errorf(
-			"disk already exists with incompatible capacity. Need %v (Required) < %v (Existing) < %v (Limit)",
-			reqBytes, common.GbToBytes(resp.GetSizeGb()), limBytes)
+			"disk already exists with incompatible capacity of %v bytes. Need %v (Required) <= %v (Existing) <= %v (Limit)",
+			common.GbToBytes(resp.GetSizeGb()), reqBytes, common.GbToBytes(resp.GetSizeGb()), limBytes)
 	}
 
 	respType := strings.Split(resp.GetType(), "/")
@@ -187,7 +220,7 @@ func (cloud *FakeCloudProvider) ValidateExistingDisk(ctx context.Context, resp *
 	return nil
 }
 
-func (cloud *FakeCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, diskEncryptionKmsKey string) error {
+func (cloud *FakeCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, sourceImage, description string, diskEncryptionKey *computebeta.CustomerEncryptionKey, enableConfidentialCompute bool, storagePool string) error {
 	if disk, ok := cloud.disks[volKey.Name]; ok {
 		err := cloud.ValidateExistingDisk(ctx, disk, diskType,
 			int64(capacityRange.GetRequiredBytes()),
@@ -203,70 +236,122 @@ func (cloud *FakeCloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key
 		diskToCreateGA := &compute.Disk{
 			Name:             volKey.Name,
 			SizeGb:           common.BytesToGb(capBytes),
-			Description:      "Disk created by GCE-PD CSI Driver",
+			Description:      description,
 			Type:             cloud.GetDiskTypeURI(volKey, diskType),
 			SelfLink:         fmt.Sprintf("projects/%s/zones/%s/disks/%s", cloud.project, volKey.Zone, volKey.Name),
 			SourceSnapshotId: snapshotID,
+			SourceImage:      sourceImage,
 		}
-		if diskEncryptionKmsKey != "" {
-			diskToCreateGA.DiskEncryptionKey = &compute.CustomerEncryptionKey{
-				KmsKeyName: diskEncryptionKmsKey,
-			}
-		}
+		diskToCreateGA.DiskEncryptionKey = toV1CustomerEncryptionKey(diskEncryptionKey)
 		diskToCreate = ZonalCloudDisk(diskToCreateGA)
 	case meta.Regional:
+		if storagePool != "" {
+			return fmt.Errorf("storage pools are only supported for zonal disks")
+		}
 		diskToCreateBeta := &computebeta.Disk{
 			Name:             volKey.Name,
 			SizeGb:           common.BytesToGb(capBytes),
-			Description:      "Regional disk created by GCE-PD CSI Driver",
+			Description:      description,
 			Type:             cloud.GetDiskTypeURI(volKey, diskType),
 			SelfLink:         fmt.Sprintf("projects/%s/regions/%s/disks/%s", cloud.project, volKey.Region, volKey.Name),
+			ReplicaZones:     replicaZones,
 			SourceSnapshotId: snapshotID,
+			SourceImage:      sourceImage,
 		}
-		if diskEncryptionKmsKey != "" {
-			diskToCreateBeta.DiskEncryptionKey = &computebeta.CustomerEncryptionKey{
-				KmsKeyName: diskEncryptionKmsKey,
-			}
-		}
+		diskToCreateBeta.DiskEncryptionKey = diskEncryptionKey
 		diskToCreate = RegionalCloudDisk(diskToCreateBeta)
 	default:
 		return fmt.Errorf("could not create disk, key was neither zonal nor regional, instead got: %v", volKey.String())
 	}
 
+	diskToCreate.EnableConfidentialCompute = enableConfidentialCompute
 	cloud.disks[volKey.Name] = diskToCreate
+	if storagePool != "" {
+		cloud.storagePools[volKey.Name] = storagePool
+	}
 	return nil
 }
 
+func (cloud *FakeCloudProvider) ListDisks(ctx context.Context) ([]*compute.Disk, error) {
+	disks := []*compute.Disk{}
+	for _, disk := range cloud.disks {
+		switch disk.Type() {
+		case Zonal:
+			disks = append(disks, disk.ZonalDisk)
+		case Regional:
+			disks = append(disks, &compute.Disk{
+				Name:              disk.RegionalDisk.Name,
+				Region:            disk.RegionalDisk.Region,
+				Description:       disk.RegionalDisk.Description,
+				Users:             disk.RegionalDisk.Users,
+				CreationTimestamp: disk.RegionalDisk.CreationTimestamp,
+				SelfLink:          disk.RegionalDisk.SelfLink,
+			})
+		}
+	}
+	return disks, nil
+}
+
 func (cloud *FakeCloudProvider) DeleteDisk(ctx context.Context, volKey *meta.Key) error {
-	if _, ok := cloud.disks[volKey.Name]; !ok {
-		return notFoundError()
+	disk, ok := cloud.disks[volKey.Name]
+	if !ok {
+		return asResourceNotFound(diskResource, notFoundError())
+	}
+	if len(disk.GetUsers()) > 0 {
+		return resourceInUseError()
 	}
 	delete(cloud.disks, volKey.Name)
+	delete(cloud.resourceTags, volKey.Name)
+	delete(cloud.storagePools, volKey.Name)
 	return nil
 }
 
-func (cloud *FakeCloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string) error {
+func (cloud *FakeCloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string, diskEncryptionKey *computebeta.CustomerEncryptionKey) error {
 	source := cloud.GetDiskSourceURI(volKey)
 
 	attachedDiskV1 := &compute.AttachedDisk{
-		DeviceName: volKey.Name,
-		Kind:       diskKind,
-		Mode:       readWrite,
-		Source:     source,
-		Type:       diskType,
+		DeviceName:        volKey.Name,
+		Kind:              diskKind,
+		Mode:              readWrite,
+		Source:            source,
+		Type:              diskType,
+		DiskEncryptionKey: toV1CustomerEncryptionKey(diskEncryptionKey),
 	}
 	instance, ok := cloud.instances[instanceName]
 	if !ok {
-		return fmt.Errorf("Failed to get instance %v", instanceName)
+		return asResourceNotFound(instanceResource, notFoundError())
 	}
 	instance.Disks = append(instance.Disks, attachedDiskV1)
 	return nil
 }
 
+func (cloud *FakeCloudProvider) AttachResourceTags(ctx context.Context, volKey *meta.Key, tags map[string]string) error {
+	if _, ok := cloud.disks[volKey.Name]; !ok {
+		return notFoundError()
+	}
+	if cloud.resourceTags[volKey.Name] == nil {
+		cloud.resourceTags[volKey.Name] = map[string]string{}
+	}
+	for k, v := range tags {
+		cloud.resourceTags[volKey.Name][k] = v
+	}
+	return nil
+}
+
+// GetStoragePool returns the storage pool the disk was created in
+func (cloud *FakeCloudProvider) GetStoragePool(volKey *meta.Key) string {
+	return cloud.storagePools[volKey.Name]
+}
+
+// GetResourceTags returns the resource manager tags bound to the disk
+func (cloud *FakeCloudProvider) GetResourceTags(volKey *meta.Key) map[string]string {
+	return cloud.resourceTags[volKey.Name]
+}
+
 func (cloud *FakeCloudProvider) DetachDisk(ctx context.Context, deviceName, instanceZone, instanceName string) error {
 	instance, ok := cloud.instances[instanceName]
 	if !ok {
-		return fmt.Errorf("Failed to get instance %v", instanceName)
+		return asResourceNotFound(instanceResource, notFoundError())
 	}
 	found := -1
 	for i, disk := range instance.Disks {
@@ -314,12 +399,17 @@ func (cloud *FakeCloudProvider) InsertInstance(instance *compute.Instance, insta
 	return
 }
 
-func (cloud *FakeCloudProvider) GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*compute.Instance, error) {
+func (cloud *FakeCloudProvider) GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*CloudInstance, error) {
 	instance, ok := cloud.instances[instanceName]
 	if !ok {
-		return nil, notFoundError()
+		return nil, asResourceNotFound(instanceResource, notFoundError())
 	}
-	return instance, nil
+	return &CloudInstance{Instance: instance, EnableConfidentialCompute: cloud.confidentialInstances[instanceName]}, nil
+}
+
+// SetConfidentialCompute sets whether the instance is a Confidential VM
+func (cloud *FakeCloudProvider) SetConfidentialCompute(instanceName string, enabled bool) {
+	cloud.confidentialInstances[instanceName] = enabled
 }
 
 // Snapshot Methods
@@ -370,12 +460,12 @@ func (cloud *FakeCloudProvider) CreateSnapshot(ctx context.Context, volKey *meta
 func (cloud *FakeCloudProvider) ResizeDisk(ctx context.Context, volKey *meta.Key, requestBytes int64) (int64, error) {
 	disk, ok := cloud.disks[volKey.Name]
 	if !ok {
-		return -1, notFoundError()
+		return -1, asResourceNotFound(diskResource, notFoundError())
 	}
 
 	disk.setSizeGb(common.BytesToGb(requestBytes))
 
-	return requestBytes, nil
+	return common.BytesToGb(requestBytes), nil
 
 }
 
@@ -385,6 +475,37 @@ func (cloud *FakeCloudProvider) DeleteSnapshot(ctx context.Context, snapshotName
 	return nil
 }
 
+// Image Methods
+func (cloud *FakeCloudProvider) GetImage(ctx context.Context, imageName string) (*compute.Image, error) {
+	image, ok := cloud.images[imageName]
+	if !ok {
+		return nil, notFoundError()
+	}
+	return image, nil
+}
+
+func (cloud *FakeCloudProvider) CreateImage(ctx context.Context, volKey *meta.Key, imageName string) (*compute.Image, error) {
+	if image, ok := cloud.images[imageName]; ok {
+		return image, nil
+	}
+
+	image := &compute.Image{
+		Name:              imageName,
+		DiskSizeGb:        int64(DiskSizeGb),
+		CreationTimestamp: Timestamp,
+		Status:            "READY",
+		SelfLink:          cloud.getGlobalImageURI(imageName),
+		SourceDisk:        cloud.GetDiskSourceURI(volKey),
+	}
+	cloud.images[imageName] = image
+	return image, nil
+}
+
+func (cloud *FakeCloudProvider) DeleteImage(ctx context.Context, imageName string) error {
+	delete(cloud.images, imageName)
+	return nil
+}
+
 func (cloud *FakeCloudProvider) ValidateExistingSnapshot(resp *compute.Snapshot, volKey *meta.Key) error {
 	if resp == nil {
 		return fmt.Errorf("disk does not exist")
@@ -433,6 +554,13 @@ func (cloud *FakeCloudProvider) getGlobalSnapshotURI(snapshotName string) string
 		snapshotName)
 }
 
+func (cloud *FakeCloudProvider) getGlobalImageURI(imageName string) string {
+	return BasePath + fmt.Sprintf(
+		imageURITemplateGlobal,
+		cloud.project,
+		imageName)
+}
+
 type FakeBlockingCloudProvider struct {
 	*FakeCloudProvider
 	ReadyToExecute chan chan struct{}
@@ -459,6 +587,16 @@ func notFoundError() *googleapi.Error {
 	}
 }
 
+func resourceInUseError() *googleapi.Error {
+	return &googleapi.Error{
+		Errors: []googleapi.ErrorItem{
+			{
+				Reason: "resourceInUseByAnotherResource",
+			},
+		},
+	}
+}
+
 func invalidError() *googleapi.Error {
 	return &googleapi.Error{
 		Errors: []googleapi.ErrorItem{
@@ -15,7 +15,12 @@ limitations under the License.
 package gcecloudprovider
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -25,46 +30,56 @@ import (
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
+	"google.golang.org/api/googleapi"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 )
 
 const (
-	operationStatusDone            = "DONE"
-	waitForSnapshotCreationTimeOut = 2 * time.Minute
-	diskKind                       = "compute#disk"
+	operationStatusDone             = "DONE"
+	defaultOperationPollInterval    = 3 * time.Second
+	defaultOperationPollFactor      = 1.5
+	defaultOperationPollMaxInterval = 15 * time.Second
+	defaultOperationTimeout         = 5 * time.Minute
+	waitForSnapshotCreationTimeOut  = 2 * time.Minute
+	diskKind                        = "compute#disk"
 )
 
 type GCECompute interface {
 	// Disk Methods
+	ListDisks(ctx context.Context) ([]*compute.Disk, error)
 	GetDisk(ctx context.Context, volumeKey *meta.Key) (*CloudDisk, error)
 	RepairUnderspecifiedVolumeKey(ctx context.Context, volumeKey *meta.Key) (*meta.Key, error)
 	ValidateExistingDisk(ctx context.Context, disk *CloudDisk, diskType string, reqBytes, limBytes int64) error
-	InsertDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, diskEncryptionKmsKey string) error
+	InsertDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, sourceImage, description string, diskEncryptionKey *computebeta.CustomerEncryptionKey, enableConfidentialCompute bool, storagePool string) error
 	DeleteDisk(ctx context.Context, volumeKey *meta.Key) error
-	AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string) error
+	AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string, diskEncryptionKey *computebeta.CustomerEncryptionKey) error
 	DetachDisk(ctx context.Context, deviceName string, instanceZone, instanceName string) error
 	GetDiskSourceURI(volKey *meta.Key) string
 	GetDiskTypeURI(volKey *meta.Key, diskType string) string
 	WaitForAttach(ctx context.Context, volKey *meta.Key, instanceZone, instanceName string) error
 	ResizeDisk(ctx context.Context, volKey *meta.Key, requestBytes int64) (int64, error)
+	AttachResourceTags(ctx context.Context, volKey *meta.Key, tags map[string]string) error
 	// Regional Disk Methods
 	GetReplicaZoneURI(zone string) string
 	// Instance Methods
-	GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*compute.Instance, error)
+	GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*CloudInstance, error)
 	// Zone Methods
 	ListZones(ctx context.Context, region string) ([]string, error)
+	CountDisksInZones(ctx context.Context, region string, zones []string) (map[string]int, error)
 	ListSnapshots(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*compute.Snapshot, string, error)
 	GetSnapshot(ctx context.Context, snapshotName string) (*compute.Snapshot, error)
 	CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string) (*compute.Snapshot, error)
 	DeleteSnapshot(ctx context.Context, snapshotName string) error
+	// Image Methods
+	GetImage(ctx context.Context, imageName string) (*compute.Image, error)
+	CreateImage(ctx context.Context, volKey *meta.Key, imageName string) (*compute.Image, error)
+	DeleteImage(ctx context.Context, imageName string) error
 }
 
-// RepairUnderspecifiedVolumeKey will query the cloud provider and check each zone for the disk specified
-// by the volume key and return a volume key with a correct zone
+// RepairUnderspecifiedVolumeKey will query the cloud provider for the disk specified by the volume key
+// in the zones of the region of the driver and return a volume key with a correct zone
 func (cloud *CloudProvider) RepairUnderspecifiedVolumeKey(ctx context.Context, volumeKey *meta.Key) (*meta.Key, error) {
 	region, err := common.GetRegionFromZones([]string{cloud.zone})
 	if err != nil {
@@ -73,20 +88,18 @@ func (cloud *CloudProvider) RepairUnderspecifiedVolumeKey(ctx context.Context, v
 	switch volumeKey.Type() {
 	case meta.Zonal:
 		if volumeKey.Zone == common.UnspecifiedValue {
-			// list all zones, try to get disk in each zone
-			zones, err := cloud.ListZones(ctx, region)
+			zones, err := cloud.findDiskZones(ctx, region, volumeKey.Name)
 			if err != nil {
 				return nil, err
 			}
-			for _, zone := range zones {
-				_, err := cloud.getZonalDiskOrError(ctx, zone, volumeKey.Name)
-				if err == nil {
-					// If there is no error we have found a disk
-					volumeKey.Zone = zone
-					return volumeKey, nil
-				}
+			if len(zones) == 0 {
+				return nil, fmt.Errorf("volume zone unspecified and unable to find in any zone of region %s", region)
+			}
+			if len(zones) > 1 {
+				klog.Warningf("Disk %s exists in zones %v, using zone %s", volumeKey.Name, zones, zones[0])
 			}
-			return nil, fmt.Errorf("volume zone unspecified and unable to find in any of these zones %v", zones)
+			volumeKey.Zone = zones[0]
+			return volumeKey, nil
 		}
 		return volumeKey, nil
 	case meta.Regional:
@@ -99,14 +112,41 @@ func (cloud *CloudProvider) RepairUnderspecifiedVolumeKey(ctx context.Context, v
 	}
 }
 
+// findDiskZones returns the sorted zones of the region with a zonal disk of the
+// given name. The disks of all zones are looked up with a single aggregated
+// list instead of getting the disk in each zone.
+func (cloud *CloudProvider) findDiskZones(ctx context.Context, region, name string) ([]string, error) {
+	zones := []string{}
+	err := cloud.service.Disks.AggregatedList(cloud.project).Filter(fmt.Sprintf("name eq %s", name)).Pages(ctx, func(page *compute.DiskAggregatedList) error {
+		for _, scopedList := range page.Items {
+			for _, disk := range scopedList.Disks {
+				if disk.Name != name || disk.Zone == "" {
+					continue
+				}
+				zone := disk.Zone[strings.LastIndex(disk.Zone, "/")+1:]
+				diskRegion, err := common.GetRegionFromZones([]string{zone})
+				if err == nil && diskRegion == region {
+					zones = append(zones, zone)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list disks named %s: %v", name, err)
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
 func (cloud *CloudProvider) ListZones(ctx context.Context, region string) ([]string, error) {
 	if len(cloud.zonesCache[region]) > 0 {
 		return cloud.zonesCache[region], nil
 	}
 	zones := []string{}
-	zoneList, err := cloud.service.Zones.List(cloud.project).Filter(fmt.Sprintf("region eq .*%s$", region)).Do()
+	zoneList, err := cloud.service.Zones.List(cloud.project).Filter(fmt.Sprintf("region eq .*%s$", region)).Context(ctx).Do()
 	if err != nil {
-		return nil, fmt.Errorf("failed to list zones in region %s: %v", region, err)
+		return nil, WrapError(err, "failed to list zones in region %s", region)
 	}
 	for _, zone := range zoneList.Items {
 		zones = append(zones, zone.Name)
@@ -116,9 +156,40 @@ func (cloud *CloudProvider) ListZones(ctx context.Context, region string) ([]str
 
 }
 
+// CountDisksInZones returns the number of disks in each of the zones of the
+// region, counting a regional disk in both of its replica zones
+func (cloud *CloudProvider) CountDisksInZones(ctx context.Context, region string, zones []string) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, zone := range zones {
+		counts[zone] = 0
+		err := cloud.service.Disks.List(cloud.project, zone).Pages(ctx, func(page *compute.DiskList) error {
+			counts[zone] += len(page.Items)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list disks in zone %s: %v", zone, err)
+		}
+	}
+	err := cloud.betaService.RegionDisks.List(cloud.project, region).Pages(ctx, func(page *computebeta.DiskList) error {
+		for _, disk := range page.Items {
+			for _, replicaZone := range disk.ReplicaZones {
+				zone := replicaZone[strings.LastIndex(replicaZone, "/")+1:]
+				if _, ok := counts[zone]; ok {
+					counts[zone]++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list regional disks in region %s: %v", region, err)
+	}
+	return counts, nil
+}
+
 func (cloud *CloudProvider) ListSnapshots(ctx context.Context, filter string, maxEntries int64, pageToken string) ([]*compute.Snapshot, string, error) {
 	snapshots := []*compute.Snapshot{}
-	snapshotList, err := cloud.service.Snapshots.List(cloud.project).Filter(filter).MaxResults(maxEntries).PageToken(pageToken).Do()
+	snapshotList, err := cloud.service.Snapshots.List(cloud.project).Filter(filter).MaxResults(maxEntries).PageToken(pageToken).Context(ctx).Do()
 	if err != nil {
 		return snapshots, "", err
 	}
@@ -129,40 +200,103 @@ func (cloud *CloudProvider) ListSnapshots(ctx context.Context, filter string, ma
 
 }
 
+// ListDisks returns the zonal and regional disks in all locations of the
+// project
+func (cloud *CloudProvider) ListDisks(ctx context.Context) ([]*compute.Disk, error) {
+	disks := []*compute.Disk{}
+	err := cloud.service.Disks.AggregatedList(cloud.project).Pages(ctx, func(page *compute.DiskAggregatedList) error {
+		for _, scopedList := range page.Items {
+			disks = append(disks, scopedList.Disks...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disks, nil
+}
+
+// diskExtraFields are the fields of a disk that the vendored API clients do
+// not support
+type diskExtraFields struct {
+	EnableConfidentialCompute bool `json:"enableConfidentialCompute"`
+}
+
+// instanceExtraFields are the fields of an instance that the vendored API
+// clients do not support
+type instanceExtraFields struct {
+	ConfidentialInstanceConfig *struct {
+		EnableConfidentialCompute bool `json:"enableConfidentialCompute"`
+	} `json:"confidentialInstanceConfig"`
+}
+
 func (cloud *CloudProvider) GetDisk(ctx context.Context, key *meta.Key) (*CloudDisk, error) {
 	switch key.Type() {
 	case meta.Zonal:
-		disk, err := cloud.getZonalDiskOrError(ctx, key.Zone, key.Name)
-		return ZonalCloudDisk(disk), err
+		disk, extraFields, err := cloud.getZonalDiskOrError(ctx, key.Zone, key.Name)
+		cloudDisk := ZonalCloudDisk(disk)
+		cloudDisk.EnableConfidentialCompute = extraFields.EnableConfidentialCompute
+		return cloudDisk, err
 	case meta.Regional:
-		disk, err := cloud.getRegionalDiskOrError(ctx, key.Region, key.Name)
-		return RegionalCloudDisk(disk), err
+		disk, extraFields, err := cloud.getRegionalDiskOrError(ctx, key.Region, key.Name)
+		cloudDisk := RegionalCloudDisk(disk)
+		cloudDisk.EnableConfidentialCompute = extraFields.EnableConfidentialCompute
+		return cloudDisk, err
 	default:
 		return nil, fmt.Errorf("key was neither zonal nor regional, got: %v", key.String())
 	}
 }
 
-func (cloud *CloudProvider) getZonalDiskOrError(ctx context.Context, volumeZone, volumeName string) (*compute.Disk, error) {
-	svc := cloud.service
-	project := cloud.project
+func (cloud *CloudProvider) getZonalDiskOrError(ctx context.Context, volumeZone, volumeName string) (*compute.Disk, diskExtraFields, error) {
 	klog.V(4).Infof("Getting disk %v from zone %v", volumeName, volumeZone)
-	disk, err := svc.Disks.Get(project, volumeZone, volumeName).Context(ctx).Do()
-	if err != nil {
-		return nil, err
+	disk := &compute.Disk{}
+	extraFields := diskExtraFields{}
+	url := cloud.service.BasePath + fmt.Sprintf("%s/zones/%s/disks/%s", cloud.project, volumeZone, volumeName)
+	if err := cloud.getJSON(ctx, url, disk, &extraFields); err != nil {
+		return nil, extraFields, asResourceNotFound(diskResource, err)
 	}
 	klog.V(4).Infof("Got disk %v from zone %v", volumeName, volumeZone)
-	return disk, nil
+	return disk, extraFields, nil
 }
 
-func (cloud *CloudProvider) getRegionalDiskOrError(ctx context.Context, volumeRegion, volumeName string) (*computebeta.Disk, error) {
-	project := cloud.project
+func (cloud *CloudProvider) getRegionalDiskOrError(ctx context.Context, volumeRegion, volumeName string) (*computebeta.Disk, diskExtraFields, error) {
 	klog.V(4).Infof("Getting disk %v from region %v", volumeName, volumeRegion)
-	disk, err := cloud.betaService.RegionDisks.Get(project, volumeRegion, volumeName).Context(ctx).Do()
-	if err != nil {
-		return nil, err
+	disk := &computebeta.Disk{}
+	extraFields := diskExtraFields{}
+	url := cloud.betaService.BasePath + fmt.Sprintf("%s/regions/%s/disks/%s", cloud.project, volumeRegion, volumeName)
+	if err := cloud.getJSON(ctx, url, disk, &extraFields); err != nil {
+		return nil, extraFields, asResourceNotFound(diskResource, err)
 	}
 	klog.V(4).Infof("Got disk %v from region %v", volumeName, volumeRegion)
-	return disk, nil
+	return disk, extraFields, nil
+}
+
+// getJSON gets the resource at the URL and decodes it into each of v. The
+// vendored API clients drop the fields they do not support, so resources
+// with such fields are requested directly.
+func (cloud *CloudProvider) getJSON(ctx context.Context, url string, v ...interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cloud.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer googleapi.CloseBody(resp)
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	for _, target := range v {
+		if err := json.Unmarshal(body, target); err != nil {
+			return fmt.Errorf("failed to decode %s: %v", url, err)
+		}
+	}
+	return nil
 }
 
 func (cloud *CloudProvider) GetReplicaZoneURI(zone string) string {
@@ -187,8 +321,8 @@ func (cloud *CloudProvider) ValidateExistingDisk(ctx context.Context, resp *Clou
 	responseValid := common.GbToBytes(resp.GetSizeGb()) <= limBytes || limBytes == 0
 	if !requestValid || !responseValid {
 		return fmt.Errorf(
-			"disk already exists with incompatible capacity. Need %v (Required) < %v (Existing) < %v (Limit)",
-			reqBytes, common.GbToBytes(resp.GetSizeGb()), limBytes)
+			"disk already exists with incompatible capacity of %v bytes. Need %v (Required) <= %v (Existing) <= %v (Limit)",
+			common.GbToBytes(resp.GetSizeGb()), reqBytes, common.GbToBytes(resp.GetSizeGb()), limBytes)
 	}
 
 	respType := strings.Split(resp.GetType(), "/")
@@ -204,37 +338,48 @@ func (cloud *CloudProvider) ValidateExistingDisk(ctx context.Context, resp *Clou
 	return nil
 }
 
-func (cloud *CloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, diskEncryptionKmsKey string) error {
+func (cloud *CloudProvider) InsertDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, sourceImage, description string, diskEncryptionKey *computebeta.CustomerEncryptionKey, enableConfidentialCompute bool, storagePool string) error {
 	switch volKey.Type() {
 	case meta.Zonal:
-		return cloud.insertZonalDisk(ctx, volKey, diskType, capBytes, capacityRange, snapshotID, diskEncryptionKmsKey)
+		return cloud.insertZonalDisk(ctx, volKey, diskType, capBytes, capacityRange, snapshotID, sourceImage, description, diskEncryptionKey, enableConfidentialCompute, storagePool)
 	case meta.Regional:
-		return cloud.insertRegionalDisk(ctx, volKey, diskType, capBytes, capacityRange, replicaZones, snapshotID, diskEncryptionKmsKey)
+		return cloud.insertRegionalDisk(ctx, volKey, diskType, capBytes, capacityRange, replicaZones, snapshotID, sourceImage, description, diskEncryptionKey, enableConfidentialCompute, storagePool)
 	default:
 		return fmt.Errorf("could not insert disk, key was neither zonal nor regional, instead got: %v", volKey.String())
 	}
 }
 
-func (cloud *CloudProvider) insertRegionalDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, diskEncryptionKmsKey string) error {
+func (cloud *CloudProvider) insertRegionalDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, replicaZones []string, snapshotID, sourceImage, description string, diskEncryptionKey *computebeta.CustomerEncryptionKey, enableConfidentialCompute bool, storagePool string) error {
 	diskToCreateBeta := &computebeta.Disk{
 		Name:        volKey.Name,
 		SizeGb:      common.BytesToGb(capBytes),
-		Description: "Regional disk created by GCE-PD CSI Driver",
+		Description: description,
 		Type:        cloud.GetDiskTypeURI(volKey, diskType),
 	}
 	if snapshotID != "" {
 		diskToCreateBeta.SourceSnapshot = snapshotID
 	}
+	if sourceImage != "" {
+		diskToCreateBeta.SourceImage = sourceImage
+	}
 	if len(replicaZones) != 0 {
 		diskToCreateBeta.ReplicaZones = replicaZones
 	}
-	if diskEncryptionKmsKey != "" {
-		diskToCreateBeta.DiskEncryptionKey = &computebeta.CustomerEncryptionKey{
-			KmsKeyName: diskEncryptionKmsKey,
-		}
+	diskToCreateBeta.DiskEncryptionKey = diskEncryptionKey
+
+	if storagePool != "" {
+		return fmt.Errorf("storage pools are only supported for zonal disks")
 	}
 
-	insertOp, err := cloud.betaService.RegionDisks.Insert(cloud.project, volKey.Region, diskToCreateBeta).Context(ctx).Do()
+	var insertOp *computebeta.Operation
+	var err error
+	if extraFields := extraDiskFields(enableConfidentialCompute, storagePool); len(extraFields) > 0 {
+		var opName string
+		opName, err = cloud.insertDiskWithExtraFields(ctx, cloud.betaService.BasePath+fmt.Sprintf("%s/regions/%s/disks", cloud.project, volKey.Region), diskToCreateBeta, extraFields)
+		insertOp = &computebeta.Operation{Name: opName}
+	} else {
+		insertOp, err = cloud.betaService.RegionDisks.Insert(cloud.project, volKey.Region, diskToCreateBeta).Context(ctx).Do()
+	}
 	if err != nil {
 		if IsGCEError(err, "alreadyExists") {
 			disk, err := cloud.GetDisk(ctx, volKey)
@@ -250,7 +395,7 @@ func (cloud *CloudProvider) insertRegionalDisk(ctx context.Context, volKey *meta
 			klog.Warningf("GCE PD %s already exists, reusing", volKey.Name)
 			return nil
 		}
-		return status.Error(codes.Internal, fmt.Sprintf("unkown Insert disk error: %v", err))
+		return WrapError(err, "unkown Insert disk error")
 	}
 
 	err = cloud.waitForRegionalOp(ctx, insertOp, volKey.Region)
@@ -269,30 +414,27 @@ func (cloud *CloudProvider) insertRegionalDisk(ctx context.Context, volKey *meta
 			klog.Warningf("GCE PD %s already exists after wait, reusing", volKey.Name)
 			return nil
 		}
-		return fmt.Errorf("unkown Insert disk operation error: %v", err)
+		return WrapError(err, "unkown Insert disk operation error")
 	}
 	return nil
 }
 
-func (cloud *CloudProvider) insertZonalDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, snapshotID, diskEncryptionKmsKey string) error {
+func (cloud *CloudProvider) insertZonalDisk(ctx context.Context, volKey *meta.Key, diskType string, capBytes int64, capacityRange *csi.CapacityRange, snapshotID, sourceImage, description string, diskEncryptionKey *computebeta.CustomerEncryptionKey, enableConfidentialCompute bool, storagePool string) error {
 	diskToCreate := &compute.Disk{
 		Name:        volKey.Name,
 		SizeGb:      common.BytesToGb(capBytes),
-		Description: "Disk created by GCE-PD CSI Driver",
+		Description: description,
 		Type:        cloud.GetDiskTypeURI(volKey, diskType),
 	}
 
 	if snapshotID != "" {
 		diskToCreate.SourceSnapshot = snapshotID
 	}
-
-	if diskEncryptionKmsKey != "" {
-		diskToCreate.DiskEncryptionKey = &compute.CustomerEncryptionKey{
-			KmsKeyName: diskEncryptionKmsKey,
-		}
+	if sourceImage != "" {
+		diskToCreate.SourceImage = sourceImage
 	}
 
-	op, err := cloud.service.Disks.Insert(cloud.project, volKey.Zone, diskToCreate).Context(ctx).Do()
+	op, err := cloud.doInsertZonalDisk(ctx, volKey.Zone, diskToCreate, diskEncryptionKey, extraDiskFields(enableConfidentialCompute, storagePool))
 
 	if err != nil {
 		if IsGCEError(err, "alreadyExists") {
@@ -309,7 +451,7 @@ func (cloud *CloudProvider) insertZonalDisk(ctx context.Context, volKey *meta.Ke
 			klog.Warningf("GCE PD %s already exists, reusing", volKey.Name)
 			return nil
 		}
-		return fmt.Errorf("unkown Insert disk error: %v", err)
+		return WrapError(err, "unkown Insert disk error")
 	}
 
 	err = cloud.waitForZonalOp(ctx, op, volKey.Zone)
@@ -329,11 +471,120 @@ func (cloud *CloudProvider) insertZonalDisk(ctx context.Context, volKey *meta.Ke
 			klog.Warningf("GCE PD %s already exists after wait, reusing", volKey.Name)
 			return nil
 		}
-		return fmt.Errorf("unkown Insert disk operation error: %v", err)
+		return WrapError(err, "unkown Insert disk operation error")
 	}
 	return nil
 }
 
+// doInsertZonalDisk inserts the disk encrypted with the given key. The v1 API
+// client does not support RSA-wrapped keys, so disks using one are inserted
+// with the beta API.
+func (cloud *CloudProvider) doInsertZonalDisk(ctx context.Context, zone string, disk *compute.Disk, key *computebeta.CustomerEncryptionKey, extraFields map[string]interface{}) (*compute.Operation, error) {
+	if len(extraFields) == 0 && (key == nil || key.RsaEncryptedKey == "") {
+		disk.DiskEncryptionKey = toV1CustomerEncryptionKey(key)
+		return cloud.service.Disks.Insert(cloud.project, zone, disk).Context(ctx).Do()
+	}
+	diskBeta := &computebeta.Disk{
+		Name:              disk.Name,
+		SizeGb:            disk.SizeGb,
+		Description:       disk.Description,
+		Type:              disk.Type,
+		SourceSnapshot:    disk.SourceSnapshot,
+		SourceImage:       disk.SourceImage,
+		DiskEncryptionKey: key,
+	}
+	// Zone operations are the same resource in both APIs
+	if len(extraFields) > 0 {
+		opName, err := cloud.insertDiskWithExtraFields(ctx, cloud.betaService.BasePath+fmt.Sprintf("%s/zones/%s/disks", cloud.project, zone), diskBeta, extraFields)
+		if err != nil {
+			return nil, err
+		}
+		return &compute.Operation{Name: opName}, nil
+	}
+	op, err := cloud.betaService.Disks.Insert(cloud.project, zone, diskBeta).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return &compute.Operation{Name: op.Name}, nil
+}
+
+// extraDiskFields returns the fields of a disk insert request that the
+// vendored API clients do not support
+func extraDiskFields(enableConfidentialCompute bool, storagePool string) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if enableConfidentialCompute {
+		fields["enableConfidentialCompute"] = true
+	}
+	if storagePool != "" {
+		fields["storagePool"] = storagePool
+	}
+	return fields
+}
+
+// insertDiskWithExtraFields inserts the disk with the extra fields into the
+// disks collection at disksURL and returns the name of the insert operation.
+// The vendored API clients cannot send fields they do not support, so the
+// request is sent directly.
+func (cloud *CloudProvider) insertDiskWithExtraFields(ctx context.Context, disksURL string, disk *computebeta.Disk, extraFields map[string]interface{}) (string, error) {
+	diskJSON, err := json.Marshal(disk)
+	if err != nil {
+		return "", err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(diskJSON, &fields); err != nil {
+		return "", err
+	}
+	for k, v := range extraFields {
+		fields[k] = v
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, disksURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cloud.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer googleapi.CloseBody(resp)
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return "", err
+	}
+	op := &computebeta.Operation{}
+	if err := json.NewDecoder(resp.Body).Decode(op); err != nil {
+		return "", fmt.Errorf("failed to decode insert disk operation: %v", err)
+	}
+	return op.Name, nil
+}
+
+// IsStoragePoolCapacityError returns true if the disk could not be created
+// because its storage pool has insufficient capacity. GCE has no dedicated
+// error reason for it, so the message is matched.
+func IsStoragePoolCapacityError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "storage pool") && strings.Contains(msg, "capacity")
+}
+
+// toV1CustomerEncryptionKey converts a disk encryption key for use with the
+// v1 API, which does not support RSA-wrapped keys
+func toV1CustomerEncryptionKey(key *computebeta.CustomerEncryptionKey) *compute.CustomerEncryptionKey {
+	if key == nil {
+		return nil
+	}
+	return &compute.CustomerEncryptionKey{
+		KmsKeyName: key.KmsKeyName,
+		RawKey:     key.RawKey,
+	}
+}
+
 func (cloud *CloudProvider) DeleteDisk(ctx context.Context, volKey *meta.Key) error {
 	switch volKey.Type() {
 	case meta.Zonal:
@@ -377,28 +628,49 @@ func (cloud *CloudProvider) deleteRegionalDisk(ctx context.Context, region, name
 	return nil
 }
 
-func (cloud *CloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string) error {
+func (cloud *CloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, readWrite, diskType, instanceZone, instanceName string, diskEncryptionKey *computebeta.CustomerEncryptionKey) error {
 	source := cloud.GetDiskSourceURI(volKey)
 
 	deviceName, err := common.GetDeviceName(volKey)
 	if err != nil {
 		return fmt.Errorf("failed to get device name: %v", err)
 	}
-	attachedDiskV1 := &compute.AttachedDisk{
-		DeviceName: deviceName,
-		Kind:       diskKind,
-		Mode:       readWrite,
-		Source:     source,
-		Type:       diskType,
+	var op *compute.Operation
+	if diskEncryptionKey == nil || diskEncryptionKey.RsaEncryptedKey == "" {
+		attachedDiskV1 := &compute.AttachedDisk{
+			DeviceName: deviceName,
+			Kind:       diskKind,
+			Mode:       readWrite,
+			Source:     source,
+			Type:       diskType,
+			// Only a customer-supplied key is needed to attach, GCE holds KMS keys
+			DiskEncryptionKey: toV1CustomerEncryptionKey(diskEncryptionKey),
+		}
+		op, err = cloud.service.Instances.AttachDisk(cloud.project, instanceZone, instanceName, attachedDiskV1).Context(ctx).Do()
+	} else {
+		// The v1 API client does not support RSA-wrapped keys
+		attachedDiskBeta := &computebeta.AttachedDisk{
+			DeviceName:        deviceName,
+			Kind:              diskKind,
+			Mode:              readWrite,
+			Source:            source,
+			Type:              diskType,
+			DiskEncryptionKey: diskEncryptionKey,
+		}
+		var opBeta *computebeta.Operation
+		opBeta, err = cloud.betaService.Instances.AttachDisk(cloud.project, instanceZone, instanceName, attachedDiskBeta).Context(ctx).Do()
+		if opBeta != nil {
+			op = &compute.Operation{Name: opBeta.Name}
+		}
 	}
-
-	op, err := cloud.service.Instances.AttachDisk(cloud.project, instanceZone, instanceName, attachedDiskV1).Context(ctx).Do()
 	if err != nil {
-		return fmt.Errorf("failed cloud service attach disk call: %v", err)
+		// The disk was looked up before attaching, so a missing resource is
+		// the instance
+		return WrapError(asResourceNotFound(instanceResource, err), "failed cloud service attach disk call")
 	}
 	err = cloud.waitForZonalOp(ctx, op, instanceZone)
 	if err != nil {
-		return fmt.Errorf("failed when waiting for zonal op: %v", err)
+		return WrapError(err, "failed when waiting for zonal op")
 	}
 	return nil
 }
@@ -406,7 +678,7 @@ func (cloud *CloudProvider) AttachDisk(ctx context.Context, volKey *meta.Key, re
 func (cloud *CloudProvider) DetachDisk(ctx context.Context, deviceName, instanceZone, instanceName string) error {
 	op, err := cloud.service.Instances.DetachDisk(cloud.project, instanceZone, instanceName, deviceName).Context(ctx).Do()
 	if err != nil {
-		return err
+		return asResourceNotFound(instanceResource, err)
 	}
 	err = cloud.waitForZonalOp(ctx, op, instanceZone)
 	if err != nil {
@@ -461,48 +733,82 @@ func (cloud *CloudProvider) getRegionalDiskTypeURI(region, diskType string) stri
 	return cloud.betaService.BasePath + fmt.Sprintf(diskTypeURITemplateRegional, cloud.project, region, diskType)
 }
 
+// pollWithContext polls the condition every interval until it returns true or
+// an error, the timeout expires or the context is done. If the context is done
+// first its error is returned so that callers can tell a cancelled request
+// apart from an operation that timed out.
+func pollWithContext(ctx context.Context, interval, timeout time.Duration, condition wait.ConditionFunc) error {
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := wait.PollUntil(interval, condition, pollCtx.Done())
+	if err == wait.ErrWaitTimeout && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// waitForOp polls the operation with the operation poll configuration of the
+// cloud provider until it is done. If the context is done first its error is
+// returned, and an OperationTimeoutError if the operation timed out.
+func (cloud *CloudProvider) waitForOp(ctx context.Context, name string, poll func() (bool, error)) error {
+	config := cloud.operationPoll
+	timeout := time.NewTimer(config.Timeout)
+	defer timeout.Stop()
+	interval := config.Interval
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return &OperationTimeoutError{Name: name, Timeout: config.Timeout}
+		case <-time.After(interval):
+		}
+		done, err := poll()
+		if err != nil || done {
+			return err
+		}
+		interval = time.Duration(float64(interval) * config.Factor)
+		if interval > config.MaxInterval {
+			interval = config.MaxInterval
+		}
+	}
+}
+
 func (cloud *CloudProvider) waitForZonalOp(ctx context.Context, op *compute.Operation, zone string) error {
-	svc := cloud.service
-	project := cloud.project
-	return wait.Poll(3*time.Second, 5*time.Minute, func() (bool, error) {
-		pollOp, err := svc.ZoneOperations.Get(project, zone, op.Name).Context(ctx).Do()
+	return cloud.waitForOp(ctx, op.Name, func() (bool, error) {
+		pollOp, err := cloud.service.ZoneOperations.Get(cloud.project, zone, op.Name).Context(ctx).Do()
 		if err != nil {
 			klog.Errorf("WaitForOp(op: %#v, zone: %#v) failed to poll the operation", op, zone)
 			return false, err
 		}
-		done, err := opIsDone(pollOp)
-		return done, err
+		return opIsDone(pollOp)
 	})
 }
 
 func (cloud *CloudProvider) waitForRegionalOp(ctx context.Context, op *computebeta.Operation, region string) error {
-	return wait.Poll(3*time.Second, 5*time.Minute, func() (bool, error) {
+	return cloud.waitForOp(ctx, op.Name, func() (bool, error) {
 		pollOp, err := cloud.betaService.RegionOperations.Get(cloud.project, region, op.Name).Context(ctx).Do()
 		if err != nil {
 			klog.Errorf("WaitForOp(op: %#v, region: %#v) failed to poll the operation", op, region)
 			return false, err
 		}
-		done, err := regionalOpIsDone(pollOp)
-		return done, err
+		return regionalOpIsDone(pollOp)
 	})
 }
 
 func (cloud *CloudProvider) waitForGlobalOp(ctx context.Context, op *compute.Operation) error {
-	svc := cloud.service
-	project := cloud.project
-	return wait.Poll(3*time.Second, 5*time.Minute, func() (bool, error) {
-		pollOp, err := svc.GlobalOperations.Get(project, op.Name).Context(ctx).Do()
+	return cloud.waitForOp(ctx, op.Name, func() (bool, error) {
+		pollOp, err := cloud.service.GlobalOperations.Get(cloud.project, op.Name).Context(ctx).Do()
 		if err != nil {
 			klog.Errorf("waitForGlobalOp(op: %#v) failed to poll the operation", op)
 			return false, err
 		}
-		done, err := opIsDone(pollOp)
-		return done, err
+		return opIsDone(pollOp)
 	})
 }
 
 func (cloud *CloudProvider) WaitForAttach(ctx context.Context, volKey *meta.Key, instanceZone, instanceName string) error {
-	return wait.Poll(5*time.Second, 2*time.Minute, func() (bool, error) {
+	return pollWithContext(ctx, 5*time.Second, 2*time.Minute, func() (bool, error) {
 		disk, err := cloud.GetDisk(ctx, volKey)
 		if err != nil {
 			klog.Errorf("GetDisk failed to get disk: %v", err)
@@ -527,7 +833,7 @@ func opIsDone(op *compute.Operation) (bool, error) {
 		return false, nil
 	}
 	if op.Error != nil && len(op.Error.Errors) > 0 && op.Error.Errors[0] != nil {
-		return true, fmt.Errorf("operation %v failed (%v): %v", op.Name, op.Error.Errors[0].Code, op.Error.Errors[0].Message)
+		return true, &OperationError{Name: op.Name, Code: op.Error.Errors[0].Code, Message: op.Error.Errors[0].Message}
 	}
 	return true, nil
 }
@@ -537,22 +843,24 @@ func regionalOpIsDone(op *computebeta.Operation) (bool, error) {
 		return false, nil
 	}
 	if op.Error != nil && len(op.Error.Errors) > 0 && op.Error.Errors[0] != nil {
-		return true, fmt.Errorf("operation %v failed (%v): %v", op.Name, op.Error.Errors[0].Code, op.Error.Errors[0].Message)
+		return true, &OperationError{Name: op.Name, Code: op.Error.Errors[0].Code, Message: op.Error.Errors[0].Message}
 	}
 	return true, nil
 }
 
-func (cloud *CloudProvider) GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*compute.Instance, error) {
-	svc := cloud.service
-	project := cloud.project
+func (cloud *CloudProvider) GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*CloudInstance, error) {
 	klog.V(4).Infof("Getting instance %v from zone %v", instanceName, instanceZone)
-
-	instance, err := svc.Instances.Get(project, instanceZone, instanceName).Do()
-	if err != nil {
-		return nil, err
+	instance := &compute.Instance{}
+	extraFields := instanceExtraFields{}
+	url := cloud.service.BasePath + fmt.Sprintf("%s/zones/%s/instances/%s", cloud.project, instanceZone, instanceName)
+	if err := cloud.getJSON(ctx, url, instance, &extraFields); err != nil {
+		return nil, asResourceNotFound(instanceResource, err)
 	}
 	klog.V(4).Infof("Got instance %v from zone %v", instanceName, instanceZone)
-	return instance, nil
+	return &CloudInstance{
+		Instance:                  instance,
+		EnableConfidentialCompute: extraFields.ConfidentialInstanceConfig != nil && extraFields.ConfidentialInstanceConfig.EnableConfidentialCompute,
+	}, nil
 }
 
 func (cloud *CloudProvider) GetSnapshot(ctx context.Context, snapshotName string) (*compute.Snapshot, error) {
@@ -594,10 +902,53 @@ func (cloud *CloudProvider) CreateSnapshot(ctx context.Context, volKey *meta.Key
 	}
 }
 
+func (cloud *CloudProvider) GetImage(ctx context.Context, imageName string) (*compute.Image, error) {
+	klog.V(4).Infof("Getting image %v", imageName)
+	image, err := cloud.service.Images.Get(cloud.project, imageName).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	klog.V(4).Infof("Got image %v", imageName)
+	return image, nil
+}
+
+// CreateImage creates an image of the disk and waits until it is created
+func (cloud *CloudProvider) CreateImage(ctx context.Context, volKey *meta.Key, imageName string) (*compute.Image, error) {
+	imageToCreate := &compute.Image{
+		Name:       imageName,
+		SourceDisk: cloud.GetDiskSourceURI(volKey),
+	}
+
+	// The source disk is usually attached to a running instance, which
+	// requires forcing the image creation
+	op, err := cloud.service.Images.Insert(cloud.project, imageToCreate).ForceCreate(true).Context(ctx).Do()
+	if err != nil {
+		// The image does not exist yet, so a missing resource is the disk
+		return nil, asResourceNotFound(diskResource, err)
+	}
+	err = cloud.waitForGlobalOp(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	return cloud.GetImage(ctx, imageName)
+}
+
+func (cloud *CloudProvider) DeleteImage(ctx context.Context, imageName string) error {
+	op, err := cloud.service.Images.Delete(cloud.project, imageName).Context(ctx).Do()
+	if err != nil {
+		if IsGCEError(err, "notFound") {
+			// Already deleted
+			return nil
+		}
+		return err
+	}
+	return cloud.waitForGlobalOp(ctx, op)
+}
+
 func (cloud *CloudProvider) ResizeDisk(ctx context.Context, volKey *meta.Key, requestBytes int64) (int64, error) {
 	cloudDisk, err := cloud.GetDisk(ctx, volKey)
 	if err != nil {
-		return -1, fmt.Errorf("failed to get disk: %v", err)
+		return -1, WrapError(err, "failed to get disk")
 	}
 
 	sizeGb := cloudDisk.GetSizeGb()
@@ -605,7 +956,7 @@ func (cloud *CloudProvider) ResizeDisk(ctx context.Context, volKey *meta.Key, re
 
 	// If disk is already of size equal or greater than requested size, we simply return
 	if sizeGb >= requestGb {
-		return requestBytes, nil
+		return sizeGb, nil
 	}
 
 	switch volKey.Type() {
@@ -624,12 +975,12 @@ func (cloud *CloudProvider) resizeZonalDisk(ctx context.Context, volKey *meta.Ke
 	}
 	op, err := cloud.service.Disks.Resize(cloud.project, volKey.Zone, volKey.Name, resizeReq).Context(ctx).Do()
 	if err != nil {
-		return -1, fmt.Errorf("failed to resize zonal volume %v: %v", volKey.String(), err)
+		return -1, WrapError(err, "failed to resize zonal volume %v", volKey.String())
 	}
 
 	err = cloud.waitForZonalOp(ctx, op, volKey.Zone)
 	if err != nil {
-		return -1, fmt.Errorf("failed waiting for op for zonal resize for %s: %v", volKey.String(), err)
+		return -1, WrapError(err, "failed waiting for op for zonal resize for %s", volKey.String())
 	}
 
 	return requestGb, nil
@@ -642,12 +993,12 @@ func (cloud *CloudProvider) resizeRegionalDisk(ctx context.Context, volKey *meta
 
 	op, err := cloud.betaService.RegionDisks.Resize(cloud.project, volKey.Region, volKey.Name, resizeReq).Context(ctx).Do()
 	if err != nil {
-		return -1, fmt.Errorf("failed to resize regional volume %v: %v", volKey.String(), err)
+		return -1, WrapError(err, "failed to resize regional volume %v", volKey.String())
 	}
 
 	err = cloud.waitForRegionalOp(ctx, op, volKey.Region)
 	if err != nil {
-		return -1, fmt.Errorf("failed waiting for op for regional resize for %s: %v", volKey.String(), err)
+		return -1, WrapError(err, "failed waiting for op for regional resize for %s", volKey.String())
 	}
 
 	return requestGb, nil
@@ -661,7 +1012,7 @@ func (cloud *CloudProvider) createZonalDiskSnapshot(ctx context.Context, volKey
 	_, err := cloud.service.Disks.CreateSnapshot(cloud.project, volKey.Zone, volKey.Name, snapshotToCreate).Context(ctx).Do()
 
 	if err != nil {
-		return nil, err
+		return nil, asResourceNotFound(diskResource, err)
 	}
 
 	return cloud.waitForSnapshotCreation(ctx, snapshotName)
@@ -674,13 +1025,16 @@ func (cloud *CloudProvider) createRegionalDiskSnapshot(ctx context.Context, volK
 
 	_, err := cloud.betaService.RegionDisks.CreateSnapshot(cloud.project, volKey.Region, volKey.Name, snapshotToCreate).Context(ctx).Do()
 	if err != nil {
-		return nil, err
+		return nil, asResourceNotFound(diskResource, err)
 	}
 
 	return cloud.waitForSnapshotCreation(ctx, snapshotName)
 
 }
 
+// waitForSnapshotCreation waits until the snapshot has been cut from its
+// source disk, i.e. it is no longer CREATING. The snapshot may still be
+// UPLOADING when it is returned.
 func (cloud *CloudProvider) waitForSnapshotCreation(ctx context.Context, snapshotName string) (*compute.Snapshot, error) {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
@@ -688,22 +1042,25 @@ func (cloud *CloudProvider) waitForSnapshotCreation(ctx context.Context, snapsho
 	defer timer.Stop()
 
 	for {
+		klog.V(5).Infof("Checking GCE Snapshot %s.", snapshotName)
+		snapshot, err := cloud.GetSnapshot(ctx, snapshotName)
+		if err != nil {
+			klog.Warningf("Error in getting snapshot %s, %v", snapshotName, err)
+		} else if snapshot != nil {
+			if snapshot.Status != "CREATING" {
+				klog.V(5).Infof("Snapshot %s status is %s", snapshotName, snapshot.Status)
+				return snapshot, nil
+			} else {
+				klog.V(5).Infof("Snapshot %s is still creating ...", snapshotName)
+			}
+		}
+
 		select {
 		case <-ticker.C:
-			klog.V(5).Infof("Checking GCE Snapshot %s.", snapshotName)
-			snapshot, err := cloud.GetSnapshot(ctx, snapshotName)
-			if err != nil {
-				klog.Warningf("Error in getting snapshot %s, %v", snapshotName, err)
-			} else if snapshot != nil {
-				if snapshot.Status != "CREATING" {
-					klog.V(5).Infof("Snapshot %s status is %s", snapshotName, snapshot.Status)
-					return snapshot, nil
-				} else {
-					klog.V(5).Infof("Snapshot %s is still creating ...", snapshotName)
-				}
-			}
 		case <-timer.C:
 			return nil, fmt.Errorf("Timeout waiting for snapshot %s to be created.", snapshotName)
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
 }
@@ -0,0 +1,232 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	computebeta "google.golang.org/api/compute/v0.beta"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestWaitForOp(t *testing.T) {
+	testCases := []struct {
+		name       string
+		config     OperationPollConfig
+		doneAfter  int
+		pollErr    error
+		cancel     bool
+		expPolls   int
+		expErr     bool
+		expTimeout bool
+	}{
+		{
+			name:      "done after several polls",
+			config:    OperationPollConfig{Interval: time.Millisecond, Factor: 2, MaxInterval: 4 * time.Millisecond, Timeout: time.Minute},
+			doneAfter: 5,
+			expPolls:  5,
+		},
+		{
+			name:     "poll error",
+			config:   OperationPollConfig{Interval: time.Millisecond, Factor: 1, MaxInterval: time.Millisecond, Timeout: time.Minute},
+			pollErr:  &OperationError{Name: "op", Code: "QUOTA_EXCEEDED", Message: "exceeded"},
+			expPolls: 1,
+			expErr:   true,
+		},
+		{
+			name:       "timeout",
+			config:     OperationPollConfig{Interval: time.Millisecond, Factor: 2, MaxInterval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond},
+			doneAfter:  -1,
+			expErr:     true,
+			expTimeout: true,
+		},
+		{
+			name:      "cancelled context",
+			config:    OperationPollConfig{Interval: time.Millisecond, Factor: 1, MaxInterval: time.Millisecond, Timeout: time.Minute},
+			doneAfter: 5,
+			cancel:    true,
+			expErr:    true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		cloud := &CloudProvider{operationPoll: tc.config}
+		ctx, cancel := context.WithCancel(context.Background())
+		if tc.cancel {
+			cancel()
+		}
+		polls := 0
+		err := cloud.waitForOp(ctx, "op", func() (bool, error) {
+			polls++
+			if tc.pollErr != nil {
+				return true, tc.pollErr
+			}
+			return polls == tc.doneAfter, nil
+		})
+		cancel()
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+		if IsOperationTimeout(err) != tc.expTimeout {
+			t.Errorf("Expected operation timeout: %v, got: %v", tc.expTimeout, err)
+		}
+		if tc.cancel && err != context.Canceled {
+			t.Errorf("Expected context error, got: %v", err)
+		}
+		if tc.expPolls > 0 && polls != tc.expPolls {
+			t.Errorf("Expected %d polls, got: %d", tc.expPolls, polls)
+		}
+	}
+}
+
+func TestOperationPollConfigValidate(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config OperationPollConfig
+		expErr bool
+	}{
+		{
+			name:   "default",
+			config: DefaultOperationPollConfig(),
+		},
+		{
+			name:   "constant interval",
+			config: OperationPollConfig{Interval: time.Second, Factor: 1, MaxInterval: time.Second, Timeout: time.Minute},
+		},
+		{
+			name:   "zero interval",
+			config: OperationPollConfig{Factor: 1, MaxInterval: time.Second, Timeout: time.Minute},
+			expErr: true,
+		},
+		{
+			name:   "shrinking interval",
+			config: OperationPollConfig{Interval: time.Second, Factor: 0.5, MaxInterval: time.Second, Timeout: time.Minute},
+			expErr: true,
+		},
+		{
+			name:   "maximum interval less than interval",
+			config: OperationPollConfig{Interval: time.Second, Factor: 2, MaxInterval: time.Millisecond, Timeout: time.Minute},
+			expErr: true,
+		},
+		{
+			name:   "zero timeout",
+			config: OperationPollConfig{Interval: time.Second, Factor: 2, MaxInterval: time.Minute},
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		err := tc.config.Validate()
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+	}
+	cloud := &CloudProvider{operationPoll: DefaultOperationPollConfig()}
+	if err := cloud.SetOperationPollConfig(OperationPollConfig{}); err == nil {
+		t.Errorf("Expected error setting an invalid configuration")
+	}
+	if cloud.operationPoll != DefaultOperationPollConfig() {
+		t.Errorf("Expected the configuration to be unchanged after an error, got: %+v", cloud.operationPoll)
+	}
+}
+
+func TestConfidentialComputeFields(t *testing.T) {
+	testCases := []struct {
+		name         string
+		diskJSON     string
+		instanceJSON string
+		expDisk      bool
+		expInstance  bool
+	}{
+		{
+			name:         "not confidential",
+			diskJSON:     `{"name": "test-disk", "sizeGb": "10"}`,
+			instanceJSON: `{"name": "test-instance"}`,
+		},
+		{
+			name:         "confidential",
+			diskJSON:     `{"name": "test-disk", "sizeGb": "10", "enableConfidentialCompute": true}`,
+			instanceJSON: `{"name": "test-instance", "confidentialInstanceConfig": {"enableConfidentialCompute": true}}`,
+			expDisk:      true,
+			expInstance:  true,
+		},
+		{
+			name:         "confidential compute disabled",
+			diskJSON:     `{"name": "test-disk", "sizeGb": "10", "enableConfidentialCompute": false}`,
+			instanceJSON: `{"name": "test-instance", "confidentialInstanceConfig": {"enableConfidentialCompute": false}}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/compute/v1/projects/test-project/zones/us-central1-c/disks/test-disk",
+				"/compute/beta/projects/test-project/regions/us-central1/disks/test-disk":
+				w.Write([]byte(tc.diskJSON))
+			case "/compute/v1/projects/test-project/zones/us-central1-c/instances/test-instance":
+				w.Write([]byte(tc.instanceJSON))
+			default:
+				http.Error(w, `{"error": {"code": 404, "message": "The resource was not found", "errors": [{"domain": "global", "reason": "notFound", "message": "The resource was not found"}]}}`, http.StatusNotFound)
+			}
+		}))
+		cloud := &CloudProvider{
+			service:     &compute.Service{BasePath: server.URL + "/compute/v1/projects/"},
+			betaService: &computebeta.Service{BasePath: server.URL + "/compute/beta/projects/"},
+			httpClient:  server.Client(),
+			project:     "test-project",
+		}
+
+		for _, key := range []*meta.Key{meta.ZonalKey("test-disk", "us-central1-c"), meta.RegionalKey("test-disk", "us-central1")} {
+			disk, err := cloud.GetDisk(context.Background(), key)
+			if err != nil {
+				t.Errorf("Failed to get disk %v: %v", key, err)
+				continue
+			}
+			if disk.GetName() != "test-disk" || disk.GetSizeGb() != 10 {
+				t.Errorf("Expected disk test-disk of 10GB, got: %s of %dGB", disk.GetName(), disk.GetSizeGb())
+			}
+			if disk.EnableConfidentialCompute != tc.expDisk {
+				t.Errorf("Expected confidential compute of disk %v to be %v, got: %v", key, tc.expDisk, disk.EnableConfidentialCompute)
+			}
+		}
+
+		instance, err := cloud.GetInstanceOrError(context.Background(), "us-central1-c", "test-instance")
+		if err != nil {
+			t.Errorf("Failed to get instance: %v", err)
+		} else {
+			if instance.Name != "test-instance" {
+				t.Errorf("Expected instance test-instance, got: %s", instance.Name)
+			}
+			if instance.EnableConfidentialCompute != tc.expInstance {
+				t.Errorf("Expected confidential compute of instance to be %v, got: %v", tc.expInstance, instance.EnableConfidentialCompute)
+			}
+		}
+
+		_, err = cloud.GetDisk(context.Background(), meta.ZonalKey("other-disk", "us-central1-c"))
+		if !IsGCEDiskNotFound(err) {
+			t.Errorf("Expected disk not found error, got: %v", err)
+		}
+		_, err = cloud.GetInstanceOrError(context.Background(), "us-central1-c", "other-instance")
+		if !IsInstanceNotFound(err) {
+			t.Errorf("Expected instance not found error, got: %v", err)
+		}
+		server.Close()
+	}
+}
@@ -28,7 +28,6 @@ import (
 	"golang.org/x/oauth2"
 	beta "google.golang.org/api/compute/v0.beta"
 	"google.golang.org/api/compute/v1"
-	"google.golang.org/api/googleapi"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 )
@@ -51,14 +50,77 @@ const (
 type CloudProvider struct {
 	service     *compute.Service
 	betaService *beta.Service
-	project     string
-	zone        string
+	// httpClient is an authenticated client for APIs and fields that the
+	// vendored client libraries do not support
+	httpClient *http.Client
+	project    string
+	zone       string
 
 	zonesCache map[string]([]string)
+	// operationPoll configures how zonal, regional and global operations are
+	// polled until they are done
+	operationPoll OperationPollConfig
+}
+
+// OperationPollConfig configures how GCE operations are polled until they are
+// done. The interval between polls starts at Interval and is multiplied by
+// Factor after each poll, up to MaxInterval.
+type OperationPollConfig struct {
+	// Interval before the first poll
+	Interval time.Duration
+	// Factor by which the interval grows after each poll, 1 keeps the
+	// interval constant
+	Factor float64
+	// MaxInterval caps the interval between polls
+	MaxInterval time.Duration
+	// Timeout after which waiting for an operation fails with an
+	// OperationTimeoutError
+	Timeout time.Duration
+}
+
+// DefaultOperationPollConfig returns the configuration used to poll operations
+// unless set with SetOperationPollConfig
+func DefaultOperationPollConfig() OperationPollConfig {
+	return OperationPollConfig{
+		Interval:    defaultOperationPollInterval,
+		Factor:      defaultOperationPollFactor,
+		MaxInterval: defaultOperationPollMaxInterval,
+		Timeout:     defaultOperationTimeout,
+	}
+}
+
+// Validate returns an error if the configuration cannot be used
+func (c OperationPollConfig) Validate() error {
+	if c.Interval <= 0 {
+		return fmt.Errorf("operation poll interval must be positive, got %v", c.Interval)
+	}
+	if c.Factor < 1 {
+		return fmt.Errorf("operation poll backoff factor must be at least 1, got %v", c.Factor)
+	}
+	if c.MaxInterval < c.Interval {
+		return fmt.Errorf("maximum operation poll interval %v must not be less than the interval %v", c.MaxInterval, c.Interval)
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("operation timeout must be positive, got %v", c.Timeout)
+	}
+	return nil
+}
+
+// SetOperationPollConfig sets how the operations of the cloud provider are
+// polled
+func (cloud *CloudProvider) SetOperationPollConfig(config OperationPollConfig) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	cloud.operationPoll = config
+	return nil
 }
 
 var _ GCECompute = &CloudProvider{}
 
+// Header setting the project that API usage is billed to
+const quotaProjectHeader = "X-Goog-User-Project"
+
 type ConfigFile struct {
 	Global ConfigGlobal `gcfg:"global"`
 }
@@ -67,9 +129,18 @@ type ConfigGlobal struct {
 	TokenURL  string `gcfg:"token-url"`
 	TokenBody string `gcfg:"token-body"`
 	ProjectId string `gcfg:"project-id"`
+	// Zone of the driver, needed when the metadata server is unavailable,
+	// e.g. when running outside of GCE
+	Zone string `gcfg:"zone"`
+	// CredentialsFile is a service account key or external account
+	// credentials file used instead of GOOGLE_APPLICATION_CREDENTIALS
+	CredentialsFile string `gcfg:"credentials-file"`
 }
 
-func CreateCloudProvider(vendorVersion string, configPath string) (*CloudProvider, error) {
+// CreateCloudProvider creates a cloud provider with the config file at
+// configPath, which may be empty. If quotaProject is set, the API usage of the
+// cloud provider is billed to it instead of the project of the credentials.
+func CreateCloudProvider(vendorVersion string, configPath string, quotaProject string) (*CloudProvider, error) {
 	configFile, err := readConfig(configPath)
 	if err != nil {
 		return nil, err
@@ -84,12 +155,17 @@ func CreateCloudProvider(vendorVersion string, configPath string) (*CloudProvide
 		return nil, err
 	}
 
-	svc, err := createCloudService(vendorVersion, tokenSource)
+	svc, err := createCloudService(vendorVersion, tokenSource, quotaProject)
+	if err != nil {
+		return nil, err
+	}
+
+	betasvc, err := createBetaCloudService(vendorVersion, tokenSource, quotaProject)
 	if err != nil {
 		return nil, err
 	}
 
-	betasvc, err := createBetaCloudService(vendorVersion, tokenSource)
+	httpClient, err := newOauthClient(tokenSource, quotaProject)
 	if err != nil {
 		return nil, err
 	}
@@ -100,11 +176,13 @@ func CreateCloudProvider(vendorVersion string, configPath string) (*CloudProvide
 	}
 
 	return &CloudProvider{
-		service:     svc,
-		betaService: betasvc,
-		project:     project,
-		zone:        zone,
-		zonesCache:  make(map[string]([]string)),
+		service:       svc,
+		betaService:   betasvc,
+		httpClient:    httpClient,
+		project:       project,
+		zone:          zone,
+		zonesCache:    make(map[string]([]string)),
+		operationPoll: DefaultOperationPollConfig(),
 	}, nil
 
 }
@@ -115,27 +193,45 @@ func generateTokenSource(configFile *ConfigFile) (oauth2.TokenSource, error) {
 		// configFile.Global.TokenURL is defined
 		// Use AltTokenSource
 
-		tokenSource := NewAltTokenSource(configFile.Global.TokenURL, configFile.Global.TokenBody)
-		klog.V(4).Infof("Using AltTokenSource %#v", tokenSource)
-		return tokenSource, nil
+		klog.V(4).Infof("Using AltTokenSource with token URL %s", configFile.Global.TokenURL)
+		return newRefreshingTokenSource(func() (oauth2.TokenSource, error) {
+			return NewAltTokenSource(configFile.Global.TokenURL, configFile.Global.TokenBody), nil
+		}, "")
 	}
 
-	// Use DefaultTokenSource
+	if configFile != nil && configFile.Global.CredentialsFile != "" {
+		credentialsFile := configFile.Global.CredentialsFile
+		klog.V(4).Infof("Using credentials file %v of the GCE provider config", credentialsFile)
+		return newRefreshingTokenSource(func() (oauth2.TokenSource, error) {
+			return newCredentialsFileTokenSource(credentialsFile, compute.CloudPlatformScope, compute.ComputeScope)
+		}, credentialsFile)
+	}
 
-	tokenSource, err := google.DefaultTokenSource(
-		context.Background(),
-		compute.CloudPlatformScope,
-		compute.ComputeScope)
+	// Use DefaultTokenSource
 
 	// DefaultTokenSource relies on GOOGLE_APPLICATION_CREDENTIALS env var being set.
-	if gac, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); ok {
+	gac, ok := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS")
+	if ok {
 		klog.V(4).Infof("GOOGLE_APPLICATION_CREDENTIALS env var set %v", gac)
 	} else {
 		klog.Warningf("GOOGLE_APPLICATION_CREDENTIALS env var not set")
 	}
-	klog.V(4).Infof("Using DefaultTokenSource %#v", tokenSource)
-
-	return tokenSource, err
+	if gac != "" {
+		// DefaultTokenSource does not support external account credentials.
+		// The file is read again when the source is re-created, so that a
+		// rotated key is used.
+		return newRefreshingTokenSource(func() (oauth2.TokenSource, error) {
+			return newCredentialsFileTokenSource(gac, compute.CloudPlatformScope, compute.ComputeScope)
+		}, gac)
+	}
+	klog.V(4).Infof("Using DefaultTokenSource")
+
+	return newRefreshingTokenSource(func() (oauth2.TokenSource, error) {
+		return google.DefaultTokenSource(
+			context.Background(),
+			compute.CloudPlatformScope,
+			compute.ComputeScope)
+	}, "")
 }
 
 func readConfig(configPath string) (*ConfigFile, error) {
@@ -156,8 +252,8 @@ func readConfig(configPath string) (*ConfigFile, error) {
 	return cfg, nil
 }
 
-func createBetaCloudService(vendorVersion string, tokenSource oauth2.TokenSource) (*beta.Service, error) {
-	client, err := newOauthClient(tokenSource)
+func createBetaCloudService(vendorVersion string, tokenSource oauth2.TokenSource, quotaProject string) (*beta.Service, error) {
+	client, err := newOauthClient(tokenSource, quotaProject)
 	if err != nil {
 		return nil, err
 	}
@@ -169,13 +265,13 @@ func createBetaCloudService(vendorVersion string, tokenSource oauth2.TokenSource
 	return service, nil
 }
 
-func createCloudService(vendorVersion string, tokenSource oauth2.TokenSource) (*compute.Service, error) {
-	svc, err := createCloudServiceWithDefaultServiceAccount(vendorVersion, tokenSource)
+func createCloudService(vendorVersion string, tokenSource oauth2.TokenSource, quotaProject string) (*compute.Service, error) {
+	svc, err := createCloudServiceWithDefaultServiceAccount(vendorVersion, tokenSource, quotaProject)
 	return svc, err
 }
 
-func createCloudServiceWithDefaultServiceAccount(vendorVersion string, tokenSource oauth2.TokenSource) (*compute.Service, error) {
-	client, err := newOauthClient(tokenSource)
+func createCloudServiceWithDefaultServiceAccount(vendorVersion string, tokenSource oauth2.TokenSource, quotaProject string) (*compute.Service, error) {
+	client, err := newOauthClient(tokenSource, quotaProject)
 	if err != nil {
 		return nil, err
 	}
@@ -187,7 +283,7 @@ func createCloudServiceWithDefaultServiceAccount(vendorVersion string, tokenSour
 	return service, nil
 }
 
-func newOauthClient(tokenSource oauth2.TokenSource) (*http.Client, error) {
+func newOauthClient(tokenSource oauth2.TokenSource, quotaProject string) (*http.Client, error) {
 	if err := wait.PollImmediate(5*time.Second, 30*time.Second, func() (bool, error) {
 		if _, err := tokenSource.Token(); err != nil {
 			klog.Errorf("error fetching initial token: %v", err)
@@ -198,15 +294,56 @@ func newOauthClient(tokenSource oauth2.TokenSource) (*http.Client, error) {
 		return nil, err
 	}
 
-	return oauth2.NewClient(context.Background(), tokenSource), nil
+	var client *http.Client
+	if source, ok := tokenSource.(*refreshingTokenSource); ok {
+		// The source caches its tokens itself. oauth2.NewClient would cache
+		// them again and keep sending rejected tokens after the source was
+		// invalidated.
+		client = &http.Client{
+			Transport: &unauthorizedTransport{
+				base:   &oauth2.Transport{Source: source, Base: http.DefaultTransport},
+				source: source,
+			},
+		}
+	} else {
+		client = oauth2.NewClient(context.Background(), tokenSource)
+	}
+	if quotaProject != "" {
+		client.Transport = &quotaProjectTransport{base: client.Transport, project: quotaProject}
+	}
+	return client, nil
+}
+
+// quotaProjectTransport sets the project that the usage of the APIs called
+// with it is billed to
+type quotaProjectTransport struct {
+	base    http.RoundTripper
+	project string
+}
+
+func (q *quotaProjectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request
+	reqCopy := req.WithContext(req.Context())
+	reqCopy.Header = make(http.Header, len(req.Header)+1)
+	for key, values := range req.Header {
+		reqCopy.Header[key] = values
+	}
+	reqCopy.Header.Set(quotaProjectHeader, q.project)
+	return q.base.RoundTrip(reqCopy)
 }
 
 func getProjectAndZone(config *ConfigFile) (string, string, error) {
 	var err error
 
-	zone, err := metadata.Zone()
-	if err != nil {
-		return "", "", err
+	var zone string
+	if config == nil || config.Global.Zone == "" {
+		zone, err = metadata.Zone()
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		zone = config.Global.Zone
+		klog.V(4).Infof("Using zone from the local GCE cloud provider config file: %q", zone)
 	}
 
 	var projectID string
@@ -227,11 +364,11 @@ func getProjectAndZone(config *ConfigFile) (string, string, error) {
 	return projectID, zone, nil
 }
 
-// isGCEError returns true if given error is a googleapi.Error with given
-// reason (e.g. "resourceInUseByAnotherResource")
+// isGCEError returns true if given error is, or is caused by, a
+// googleapi.Error with given reason (e.g. "resourceInUseByAnotherResource")
 func IsGCEError(err error, reason string) bool {
-	apiErr, ok := err.(*googleapi.Error)
-	if !ok {
+	apiErr := findGCEError(err)
+	if apiErr == nil {
 		return false
 	}
 
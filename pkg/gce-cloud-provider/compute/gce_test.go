@@ -0,0 +1,73 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestOauthClientQuotaProject(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name         string
+		quotaProject string
+	}{
+		{
+			name: "no quota project",
+		},
+		{
+			name:         "quota project",
+			quotaProject: "billing-project",
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token", Expiry: time.Now().Add(time.Hour)})
+		client, err := newOauthClient(ts, tc.quotaProject)
+		if err != nil {
+			t.Errorf("Unexpected error creating the client: %v", err)
+			continue
+		}
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if got := header.Get(quotaProjectHeader); got != tc.quotaProject {
+			t.Errorf("Expected quota project header %q, got: %q", tc.quotaProject, got)
+		}
+		if got := header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Expected authorization header of the token, got: %q", got)
+		}
+		if got := req.Header.Get(quotaProjectHeader); got != "" {
+			t.Errorf("Expected the request to be unmodified, got quota project header %q", got)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"k8s.io/klog"
+)
+
+// Tag bindings of zonal and regional resources are created, and their
+// operations polled, at the resource manager endpoint of their location
+var resourceManagerURLTemplate = "https://%s-cloudresourcemanager.googleapis.com/v3/" // {location}
+
+const (
+	diskFullResourceNameTemplateZonal    = "//compute.googleapis.com/projects/%s/zones/%s/disks/%d"   // {project}/zones/{zone}/disks/{disk.Id}
+	diskFullResourceNameTemplateRegional = "//compute.googleapis.com/projects/%s/regions/%s/disks/%d" // {project}/regions/{region}/disks/{disk.Id}
+)
+
+// tagBinding is the request body of the resource manager v3 CreateTagBinding
+// call
+type tagBinding struct {
+	Parent                 string `json:"parent"`
+	TagValueNamespacedName string `json:"tagValueNamespacedName"`
+}
+
+// tagBindingOperation is the long-running operation returned by the
+// CreateTagBinding call
+type tagBindingOperation struct {
+	Name  string `json:"name"`
+	Done  bool   `json:"done"`
+	Error *struct {
+		Code    int32  `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func tagBindingOpIsDone(op *tagBindingOperation) (bool, error) {
+	if !op.Done {
+		return false, nil
+	}
+	if op.Error != nil {
+		return true, &OperationError{Name: op.Name, Code: codes.Code(op.Error.Code).String(), Message: op.Error.Message}
+	}
+	return true, nil
+}
+
+// AttachResourceTags binds the resource manager tags, given as a map from
+// namespaced tag key to tag value, to the disk. Tags that are already bound
+// are skipped.
+func (cloud *CloudProvider) AttachResourceTags(ctx context.Context, volKey *meta.Key, tags map[string]string) error {
+	disk, err := cloud.GetDisk(ctx, volKey)
+	if err != nil {
+		return err
+	}
+
+	var location, parent string
+	switch volKey.Type() {
+	case meta.Zonal:
+		location = volKey.Zone
+		parent = fmt.Sprintf(diskFullResourceNameTemplateZonal, cloud.project, volKey.Zone, disk.GetID())
+	case meta.Regional:
+		location = volKey.Region
+		parent = fmt.Sprintf(diskFullResourceNameTemplateRegional, cloud.project, volKey.Region, disk.GetID())
+	default:
+		return fmt.Errorf("could not attach tags, key was neither zonal nor regional, instead got: %v", volKey.String())
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		binding := tagBinding{
+			Parent:                 parent,
+			TagValueNamespacedName: fmt.Sprintf("%s/%s", k, tags[k]),
+		}
+		klog.V(4).Infof("Binding tag %s to disk %s", binding.TagValueNamespacedName, volKey.Name)
+		if err := cloud.createTagBinding(ctx, location, binding); err != nil {
+			return fmt.Errorf("failed to bind tag %s to disk %s: %v", binding.TagValueNamespacedName, volKey.Name, err)
+		}
+	}
+	return nil
+}
+
+func (cloud *CloudProvider) createTagBinding(ctx context.Context, location string, binding tagBinding) error {
+	body, err := json.Marshal(binding)
+	if err != nil {
+		return err
+	}
+	baseURL := fmt.Sprintf(resourceManagerURLTemplate, location)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"tagBindings", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := cloud.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer googleapi.CloseBody(resp)
+	if resp.StatusCode == http.StatusConflict {
+		// The binding already exists, e.g. from a previous CreateVolume attempt
+		return nil
+	}
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return err
+	}
+	op := &tagBindingOperation{}
+	if err := json.NewDecoder(resp.Body).Decode(op); err != nil {
+		return fmt.Errorf("failed to decode tag binding operation: %v", err)
+	}
+	if done, err := tagBindingOpIsDone(op); done {
+		return err
+	}
+	return cloud.waitForOp(ctx, op.Name, func() (bool, error) {
+		pollOp := &tagBindingOperation{}
+		if err := cloud.getJSON(ctx, baseURL+op.Name, pollOp); err != nil {
+			klog.Errorf("createTagBinding(op: %v, location: %v) failed to poll the operation", op.Name, location)
+			return false, err
+		}
+		return tagBindingOpIsDone(pollOp)
+	})
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestAttachResourceTags(t *testing.T) {
+	defer func(template string) { resourceManagerURLTemplate = template }(resourceManagerURLTemplate)
+	testCases := []struct {
+		name       string
+		createCode int
+		createJSON string
+		pollJSON   []string
+		expPolls   int
+		expErr     bool
+	}{
+		{
+			name:       "done immediately",
+			createCode: http.StatusOK,
+			createJSON: `{"name": "operations/rctb.1", "done": true, "response": {}}`,
+		},
+		{
+			name:       "done after polling",
+			createCode: http.StatusOK,
+			createJSON: `{"name": "operations/rctb.1"}`,
+			pollJSON:   []string{`{"name": "operations/rctb.1", "done": false}`, `{"name": "operations/rctb.1", "done": true, "response": {}}`},
+			expPolls:   2,
+		},
+		{
+			name:       "operation failed",
+			createCode: http.StatusOK,
+			createJSON: `{"name": "operations/rctb.1"}`,
+			pollJSON:   []string{`{"name": "operations/rctb.1", "done": true, "error": {"code": 7, "message": "Permission denied on tag value"}}`},
+			expPolls:   1,
+			expErr:     true,
+		},
+		{
+			name:       "binding already exists",
+			createCode: http.StatusConflict,
+			createJSON: `{"error": {"code": 409, "message": "A binding already exists"}}`,
+		},
+		{
+			name:       "create failed",
+			createCode: http.StatusForbidden,
+			createJSON: `{"error": {"code": 403, "message": "Permission denied"}}`,
+			expErr:     true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		polls := 0
+		var bindings []tagBinding
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/compute/v1/projects/test-project/zones/us-central1-c/disks/test-disk":
+				w.Write([]byte(`{"id": "1234", "name": "test-disk"}`))
+			case r.URL.Path == "/us-central1-c/v3/tagBindings" && r.Method == http.MethodPost:
+				binding := tagBinding{}
+				if err := json.NewDecoder(r.Body).Decode(&binding); err != nil {
+					t.Errorf("Failed to decode tag binding: %v", err)
+				}
+				bindings = append(bindings, binding)
+				w.WriteHeader(tc.createCode)
+				w.Write([]byte(tc.createJSON))
+			case r.URL.Path == "/us-central1-c/v3/operations/rctb.1" && polls < len(tc.pollJSON):
+				w.Write([]byte(tc.pollJSON[polls]))
+				polls++
+			default:
+				http.Error(w, `{"error": {"code": 404, "message": "The resource was not found"}}`, http.StatusNotFound)
+			}
+		}))
+		resourceManagerURLTemplate = server.URL + "/%s/v3/"
+		cloud := &CloudProvider{
+			service:       &compute.Service{BasePath: server.URL + "/compute/v1/projects/"},
+			httpClient:    server.Client(),
+			project:       "test-project",
+			operationPoll: OperationPollConfig{Interval: time.Millisecond, Factor: 1, MaxInterval: time.Millisecond, Timeout: time.Minute},
+		}
+
+		err := cloud.AttachResourceTags(context.Background(), meta.ZonalKey("test-disk", "us-central1-c"), map[string]string{"test-project/env": "prod"})
+		if tc.expErr && err == nil {
+			t.Errorf("Expected error, got none")
+		}
+		if !tc.expErr && err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if polls != tc.expPolls {
+			t.Errorf("Expected %d polls of the operation, got: %d", tc.expPolls, polls)
+		}
+		expBinding := tagBinding{
+			Parent:                 "//compute.googleapis.com/projects/test-project/zones/us-central1-c/disks/1234",
+			TagValueNamespacedName: "test-project/env/prod",
+		}
+		if len(bindings) != 1 || bindings[0] != expBinding {
+			t.Errorf("Expected binding %+v, got: %+v", expBinding, bindings)
+		}
+		server.Close()
+	}
+}
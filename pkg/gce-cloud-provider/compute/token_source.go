@@ -18,11 +18,15 @@ package gcecloudprovider
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -34,6 +38,16 @@ const (
 	tokenURLQPS = .05 // back off to once every 20 seconds when failing
 	// Maximum burst of requests to token URL before limiting.
 	tokenURLBurst = 3
+
+	// Minimum interval between re-creations of a token source, so that
+	// persistent credential errors don't re-read the credentials for each
+	// request
+	minTokenSourceRecreateInterval = 10 * time.Second
+	// Cached tokens are refreshed this long before they expire
+	tokenExpiryDelta = 10 * time.Second
+	// Tokens expiring sooner than this when fetched indicate that the
+	// credentials are not being refreshed
+	tokenExpiryWarning = 2 * time.Minute
 )
 
 // TODO(#276) add metrics around token requests once the driver integrates with Prometheus.
@@ -89,3 +103,145 @@ func NewAltTokenSource(tokenURL, tokenBody string) oauth2.TokenSource {
 	}
 	return oauth2.ReuseTokenSource(nil, a)
 }
+
+// refreshingTokenSource caches the tokens of a token source that it re-creates
+// when fetching a token fails, when a request was rejected as unauthorized and
+// when the service account key file changes, so that rotated or renewed
+// credentials are picked up without restarting the driver.
+type refreshingTokenSource struct {
+	mux       sync.Mutex
+	newSource func() (oauth2.TokenSource, error)
+	source    oauth2.TokenSource
+	token     *oauth2.Token
+	// stale is set when the source must be re-created before its next token
+	stale bool
+	// keyFile is the service account key file the source reads, if any, and
+	// keyFileModTime its modification time when the source was created
+	keyFile        string
+	keyFileModTime time.Time
+	lastRecreate   time.Time
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+var _ oauth2.TokenSource = &refreshingTokenSource{}
+
+// newRefreshingTokenSource creates the token source with newSource, which is
+// called again whenever the source is re-created
+func newRefreshingTokenSource(newSource func() (oauth2.TokenSource, error), keyFile string) (*refreshingTokenSource, error) {
+	t := &refreshingTokenSource{
+		newSource: newSource,
+		keyFile:   keyFile,
+		now:       time.Now,
+	}
+	t.keyFileModTime = t.keyFileModified()
+	source, err := newSource()
+	if err != nil {
+		return nil, err
+	}
+	t.source = source
+	t.lastRecreate = t.now()
+	return t, nil
+}
+
+// Token returns the cached token while it is valid, and otherwise fetches a
+// new token, re-creating the source if fetching fails
+func (t *refreshingTokenSource) Token() (*oauth2.Token, error) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if modTime := t.keyFileModified(); !modTime.Equal(t.keyFileModTime) {
+		klog.Infof("Service account key file %s changed, re-creating the token source", t.keyFile)
+		t.stale = true
+	}
+	if !t.stale && t.tokenValid() {
+		return t.token, nil
+	}
+	if t.stale {
+		if err := t.recreate(); err != nil {
+			klog.Warningf("Failed to re-create the token source, using the previous one: %v", err)
+		}
+	}
+	token, err := t.source.Token()
+	if err != nil {
+		klog.Warningf("Failed to fetch token, re-creating the token source: %v", err)
+		if rerr := t.recreate(); rerr != nil {
+			return nil, fmt.Errorf("failed to fetch token: %v, and to re-create the token source: %v", err, rerr)
+		}
+		token, err = t.source.Token()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !token.Expiry.IsZero() && token.Expiry.Sub(t.now()) < tokenExpiryWarning {
+		klog.Warningf("Fetched token expires at %v, the credentials may not be refreshed", token.Expiry)
+	}
+	t.token = token
+	return token, nil
+}
+
+// tokenValid returns true if the cached token does not expire within
+// tokenExpiryDelta, like oauth2.Token.Valid
+func (t *refreshingTokenSource) tokenValid() bool {
+	if t.token == nil || t.token.AccessToken == "" {
+		return false
+	}
+	return t.token.Expiry.IsZero() || t.token.Expiry.Add(-tokenExpiryDelta).After(t.now())
+}
+
+// invalidate drops the cached token and re-creates the source before fetching
+// the next token
+func (t *refreshingTokenSource) invalidate() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.token = nil
+	t.stale = true
+}
+
+func (t *refreshingTokenSource) recreate() error {
+	if t.now().Sub(t.lastRecreate) < minTokenSourceRecreateInterval {
+		return fmt.Errorf("token source was re-created less than %v ago", minTokenSourceRecreateInterval)
+	}
+	t.lastRecreate = t.now()
+	modTime := t.keyFileModified()
+	source, err := t.newSource()
+	if err != nil {
+		return err
+	}
+	t.source = source
+	t.token = nil
+	t.stale = false
+	t.keyFileModTime = modTime
+	return nil
+}
+
+// keyFileModified returns the modification time of the key file, or the zero
+// time if there is none
+func (t *refreshingTokenSource) keyFileModified() time.Time {
+	if t.keyFile == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(t.keyFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// unauthorizedTransport invalidates the token of the source when a request is
+// rejected as unauthorized, e.g. after the credentials were revoked or
+// rotated, so that the next request fetches a token with the current
+// credentials
+type unauthorizedTransport struct {
+	base   http.RoundTripper
+	source *refreshingTokenSource
+}
+
+func (u *unauthorizedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := u.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		klog.Warningf("Request %s %s was rejected as unauthorized, invalidating the token", req.Method, req.URL.Path)
+		u.source.invalidate()
+	}
+	return resp, err
+}
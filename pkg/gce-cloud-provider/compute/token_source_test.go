@@ -0,0 +1,247 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gcecloudprovider
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeTokenSource returns tokens named after the source, or err
+type fakeTokenSource struct {
+	name   string
+	expiry time.Time
+	err    error
+	calls  int
+}
+
+func (f *fakeTokenSource) Token() (*oauth2.Token, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &oauth2.Token{AccessToken: fmt.Sprintf("%s-%d", f.name, f.calls), Expiry: f.expiry}, nil
+}
+
+func TestRefreshingTokenSource(t *testing.T) {
+	testCases := []struct {
+		name string
+		// sources are returned by consecutive re-creations of the source
+		sources []*fakeTokenSource
+		// setup runs after a first token was fetched successfully, unless
+		// the first source fails
+		setup       func(ts *refreshingTokenSource, now *time.Time)
+		expToken    string
+		expErr      bool
+		expCreated  int
+		skipInitial bool
+	}{
+		{
+			name:       "cached token",
+			sources:    []*fakeTokenSource{{name: "a"}},
+			expToken:   "a-1",
+			expCreated: 1,
+		},
+		{
+			name:       "expired token",
+			sources:    []*fakeTokenSource{{name: "a"}},
+			setup:      func(ts *refreshingTokenSource, now *time.Time) { *now = now.Add(2 * time.Hour) },
+			expToken:   "a-2",
+			expCreated: 1,
+		},
+		{
+			name:    "invalidated token",
+			sources: []*fakeTokenSource{{name: "a"}, {name: "b"}},
+			setup: func(ts *refreshingTokenSource, now *time.Time) {
+				*now = now.Add(time.Minute)
+				ts.invalidate()
+			},
+			expToken:   "b-1",
+			expCreated: 2,
+		},
+		{
+			name:        "token error re-creates source",
+			sources:     []*fakeTokenSource{{name: "a", err: fmt.Errorf("invalid_grant")}, {name: "b"}},
+			setup:       func(ts *refreshingTokenSource, now *time.Time) { *now = now.Add(time.Minute) },
+			expToken:    "b-1",
+			expCreated:  2,
+			skipInitial: true,
+		},
+		{
+			name:        "token error of re-created source",
+			sources:     []*fakeTokenSource{{name: "a", err: fmt.Errorf("invalid_grant")}, {name: "b", err: fmt.Errorf("invalid_grant")}},
+			setup:       func(ts *refreshingTokenSource, now *time.Time) { *now = now.Add(time.Minute) },
+			expErr:      true,
+			expCreated:  2,
+			skipInitial: true,
+		},
+		{
+			name:        "re-creation throttled",
+			sources:     []*fakeTokenSource{{name: "a", err: fmt.Errorf("invalid_grant")}, {name: "b"}},
+			expErr:      true,
+			expCreated:  1,
+			skipInitial: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		now := time.Now()
+		created := 0
+		newSource := func() (oauth2.TokenSource, error) {
+			source := tc.sources[created]
+			created++
+			if source.expiry.IsZero() {
+				source.expiry = now.Add(time.Hour)
+			}
+			return source, nil
+		}
+		ts, err := newRefreshingTokenSource(newSource, "")
+		if err != nil {
+			t.Errorf("Unexpected error creating the token source: %v", err)
+			continue
+		}
+		ts.now = func() time.Time { return now }
+		ts.lastRecreate = now
+		if !tc.skipInitial {
+			if _, err := ts.Token(); err != nil {
+				t.Errorf("Unexpected error fetching the first token: %v", err)
+				continue
+			}
+		}
+		if tc.setup != nil {
+			tc.setup(ts, &now)
+		}
+
+		token, err := ts.Token()
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+		if err == nil && token.AccessToken != tc.expToken {
+			t.Errorf("Expected token %s, got: %s", tc.expToken, token.AccessToken)
+		}
+		if created != tc.expCreated {
+			t.Errorf("Expected the source to be created %d times, got: %d", tc.expCreated, created)
+		}
+	}
+}
+
+func TestRefreshingTokenSourceKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "token-source")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key.json")
+	if err := ioutil.WriteFile(keyFile, []byte("key-1"), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	now := time.Now()
+	created := 0
+	ts, err := newRefreshingTokenSource(func() (oauth2.TokenSource, error) {
+		created++
+		return &fakeTokenSource{name: fmt.Sprintf("key-%d", created), expiry: now.Add(time.Hour)}, nil
+	}, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error creating the token source: %v", err)
+	}
+	ts.now = func() time.Time { return now }
+
+	if token, err := ts.Token(); err != nil || token.AccessToken != "key-1-1" {
+		t.Fatalf("Expected token key-1-1, got: %v, %v", token, err)
+	}
+	// Rotate the key
+	now = now.Add(time.Minute)
+	if err := os.Chtimes(keyFile, now, now); err != nil {
+		t.Fatalf("Failed to change the key file: %v", err)
+	}
+	if token, err := ts.Token(); err != nil || token.AccessToken != "key-2-1" {
+		t.Errorf("Expected token key-2-1 after rotating the key, got: %v, %v", token, err)
+	}
+	if token, err := ts.Token(); err != nil || token.AccessToken != "key-2-1" {
+		t.Errorf("Expected cached token key-2-1, got: %v, %v", token, err)
+	}
+}
+
+func TestUnauthorizedTransport(t *testing.T) {
+	status := http.StatusUnauthorized
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	created := 0
+	ts, err := newRefreshingTokenSource(func() (oauth2.TokenSource, error) {
+		created++
+		return &fakeTokenSource{name: fmt.Sprintf("source-%d", created), expiry: now.Add(time.Hour)}, nil
+	}, "")
+	if err != nil {
+		t.Fatalf("Unexpected error creating the token source: %v", err)
+	}
+	ts.now = func() time.Time { return now }
+	client, err := newOauthClient(ts, "")
+	if err != nil {
+		t.Fatalf("Unexpected error creating the client: %v", err)
+	}
+
+	for _, tc := range []struct {
+		status   int
+		expStale bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusForbidden},
+		{status: http.StatusUnauthorized, expStale: true},
+	} {
+		t.Logf("test case: status %d", tc.status)
+		status = tc.status
+		ts.stale = false
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if authorization != "Bearer source-1-1" {
+			t.Errorf("Expected the token of the first source, got: %q", authorization)
+		}
+		if ts.stale != tc.expStale {
+			t.Errorf("Expected stale token source: %v, got: %v", tc.expStale, ts.stale)
+		}
+	}
+
+	// The request after the unauthorized one carries a token of the
+	// re-created source
+	now = now.Add(time.Minute)
+	status = http.StatusOK
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if authorization != "Bearer source-2-1" {
+		t.Errorf("Expected the token of the re-created source after an unauthorized request, got: %q", authorization)
+	}
+}
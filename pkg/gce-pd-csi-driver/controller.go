@@ -15,18 +15,23 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 
 	"context"
 
 	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -43,13 +48,36 @@ type GCEControllerServer struct {
 	CloudProvider   gce.GCECompute
 	MetadataService metadataservice.MetadataService
 
+	// ClusterID identifies the cluster in the description of created disks,
+	// it is omitted when empty
+	ClusterID string
+
+	// ResourceTags are the resource manager tags bound to every created
+	// disk, tags of the resource-tags parameter take precedence
+	ResourceTags map[string]string
+
 	// A map storing all volumes with ongoing operations so that additional operations
 	// for that same volume (as defined by Volume Key) return an Aborted error
 	volumeLocks *common.VolumeLocks
+
+	// Responses of recent successful CreateVolume and CreateSnapshot calls by
+	// name, so that retries of identical requests don't query GCE again
+	volumeResponses   *common.ResponseCache
+	snapshotResponses *common.ResponseCache
+
+	// Instances of nodes recently looked up by ControllerPublishVolume and
+	// ControllerUnpublishVolume
+	instances *instanceCache
 }
 
 var _ csi.ControllerServer = &GCEControllerServer{}
 
+var (
+	// confidentialComputeDiskTypes are the disk types that support
+	// confidential compute
+	confidentialComputeDiskTypes = sets.NewString("hyperdisk-balanced")
+)
+
 const (
 	// MaxVolumeSizeInBytes is the maximum standard and ssd size of 64TB
 	MaxVolumeSizeInBytes     int64 = 64 * 1024 * 1024 * 1024 * 1024
@@ -61,13 +89,27 @@ const (
 
 	attachableDiskTypePersistent = "PERSISTENT"
 
+	// Only hyperdisk types, e.g. hyperdisk-balanced, support storage pools
+	hyperdiskTypePrefix = "hyperdisk-"
+
 	replicationTypeNone       = "none"
 	replicationTypeRegionalPD = "regional-pd"
+
+	// Prefix of the parameters the external-snapshotter adds to CreateSnapshot
+	snapshotterParameterPrefix = "csi.storage.k8s.io/"
+
+	// Create responses are cached long enough to cover provisioner retries
+	createResponseCacheTTL     = 5 * time.Minute
+	createResponseCacheEntries = 1000
+
+	// Instances are cached briefly, long enough to cover a burst of attaches
+	// to a node being scheduled pods
+	instanceCacheTTL = 10 * time.Second
 )
 
 func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	var err error
-	klog.V(4).Infof("CreateVolume called with request %v", *req)
+	klog.V(4).Infof("CreateVolume called with request %v", protosanitizer.StripSecrets(req))
 
 	// Validate arguments
 	volumeCapabilities := req.GetVolumeCapabilities()
@@ -85,6 +127,15 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume Request Capacity is invalid: %v", err))
 	}
 
+	fingerprint := requestFingerprint(req)
+	if resp, found, matches := gceCS.volumeResponses.Get(name, fingerprint); found {
+		if !matches {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("CreateVolume disk %s was recently created with different parameters", name))
+		}
+		klog.V(4).Infof("CreateVolume returning cached response for disk %s", name)
+		return resp.(*csi.CreateVolumeResponse), nil
+	}
+
 	err = validateVolumeCapabilities(volumeCapabilities)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("VolumeCapabilities is invalid: %v", err))
@@ -96,6 +147,20 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 	// Start process for creating a new disk
 	replicationType := replicationTypeNone
 	diskEncryptionKmsKey := ""
+	// Tags identifying the PVC and PV the disk is created for
+	pvcName, pvcNamespace, pvName := "", "", ""
+	enableConfidentialCompute := false
+	sourceImage := ""
+	// Storage pools by zone
+	var storagePools map[string]string
+	// Zones the disk may be created in
+	var zonesParam []string
+	// Attributes passed to ControllerPublishVolume and NodeStageVolume
+	volumeContext := map[string]string{}
+	resourceTags := map[string]string{}
+	for k, v := range gceCS.ResourceTags {
+		resourceTags[k] = v
+	}
 	for k, v := range req.GetParameters() {
 		if k == "csiProvisionerSecretName" || k == "csiProvisionerSecretNamespace" {
 			// These are hardcoded secrets keys required to function but not needed by GCE PD
@@ -110,16 +175,118 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		case common.ParameterKeyDiskEncryptionKmsKey:
 			// Resource names (e.g. "keyRings", "cryptoKeys", etc.) are case sensitive, so do not change case
 			diskEncryptionKmsKey = v
+		case common.ParameterKeyResourceTags:
+			tags, err := common.ParseResourceTags(v)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid resource tags: %v", err))
+			}
+			for tagKey, tagValue := range tags {
+				resourceTags[tagKey] = tagValue
+			}
+		case common.ParameterKeySourceImage:
+			// Image names are case sensitive, so do not change case
+			sourceImage = v
+		case common.ParameterKeyStoragePools:
+			// Resource names are case sensitive, so do not change case
+			storagePools, err = common.ParseStoragePools(v)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid storage pools: %v", err))
+			}
+		case common.ParameterKeyZones:
+			zonesParam, err = common.ParseZones(v)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid zones: %v", err))
+			}
+		case common.ParameterKeyReadAheadKB:
+			kb, err := common.ParseReadAheadKB(v)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid value %q for parameter %q: %v", v, k, err))
+			}
+			volumeContext[common.VolumeAttributeReadAheadKB] = strconv.FormatInt(kb, 10)
+		case common.ParameterKeyExt4ReservedBlocksPercentage:
+			percentage, err := common.ParseReservedBlocksPercentage(v)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid value %q for parameter %q: %v", v, k, err))
+			}
+			volumeContext[common.VolumeAttributeExt4ReservedBlocksPercentage] = strconv.FormatInt(percentage, 10)
+		case common.ParameterKeyExt4LazyInit:
+			lazyInit, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid value %q for parameter %q: %v", v, k, err))
+			}
+			volumeContext[common.VolumeAttributeExt4LazyInit] = strconv.FormatBool(lazyInit)
+		case common.ParameterKeyLUKSEncryption:
+			luksEncryption, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid value %q for parameter %q: %v", v, k, err))
+			}
+			if luksEncryption {
+				volumeContext[common.VolumeAttributeLUKSEncryption] = "true"
+			}
+		case common.ParameterKeyEnableConfidentialCompute:
+			enableConfidentialCompute, err = strconv.ParseBool(v)
+			if err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid value %q for parameter %q: %v", v, k, err))
+			}
+		case common.ParameterKeyPVCName:
+			pvcName = v
+		case common.ParameterKeyPVCNamespace:
+			pvcNamespace = v
+		case common.ParameterKeyPVName:
+			pvName = v
 		default:
 			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid option %q", k))
 		}
 	}
+	if enableConfidentialCompute && !confidentialComputeDiskTypes.Has(diskType) {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume confidential compute is not supported for disk type %q, supported types are %v", diskType, confidentialComputeDiskTypes.List()))
+	}
+	if len(storagePools) > 0 {
+		if !strings.HasPrefix(diskType, hyperdiskTypePrefix) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume storage pools are only supported for hyperdisk types, got %q", diskType))
+		}
+		if replicationType != replicationTypeNone {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume storage pools are not supported for replication type %q", replicationType))
+		}
+	}
+	if enableConfidentialCompute {
+		// Passed to ControllerPublishVolume to validate the instance
+		volumeContext[common.VolumeAttributeEnableConfidentialCompute] = "true"
+	}
+	if len(volumeContext) == 0 {
+		volumeContext = nil
+	}
+	diskEncryptionKey, err := getDiskEncryptionKey(diskEncryptionKmsKey, req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume invalid disk encryption key: %v", err))
+	}
+	description, err := gceCS.generateDiskDescription(pvcName, pvcNamespace, pvName)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to generate disk description: %v", err))
+	}
+	top := req.GetAccessibilityRequirements()
+	if len(zonesParam) > 0 {
+		numZones := 1
+		if replicationType == replicationTypeRegionalPD {
+			numZones = 2
+		}
+		top, err = constrainTopologyToZones(top, zonesParam, numZones)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed to reconcile zones parameter with topology requirement: %v", err))
+		}
+	}
 	// Determine the zone or zones+region of the disk
 	var zones []string
 	var volKey *meta.Key
 	switch replicationType {
 	case replicationTypeNone:
-		zones, err = pickZones(gceCS, req.GetAccessibilityRequirements(), 1)
+		if len(storagePools) > 0 {
+			var zone string
+			zone, err = pickStoragePoolZone(top, storagePools)
+			zones = []string{zone}
+		} else {
+			zones, err = pickZones(ctx, gceCS, top, 1)
+		}
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed to pick zones for disk: %v", err))
 		}
@@ -129,7 +296,7 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		volKey = meta.ZonalKey(name, zones[0])
 
 	case replicationTypeRegionalPD:
-		zones, err = pickZones(gceCS, req.GetAccessibilityRequirements(), 2)
+		zones, err = pickZones(ctx, gceCS, top, 2)
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume failed to pick zones for disk: %v", err))
 		}
@@ -154,7 +321,7 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 	// Validate if disk already exists
 	existingDisk, err := gceCS.CloudProvider.GetDisk(ctx, volKey)
 	if err != nil {
-		if !gce.IsGCEError(err, "notFound") {
+		if !gce.IsGCEDiskNotFound(err) {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume unknown get disk error when validating: %v", err))
 		}
 	}
@@ -166,8 +333,16 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		if err != nil {
 			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("CreateVolume disk already exists with same name and is incompatible: %v", err))
 		}
+		if err := bindResourceTags(ctx, gceCS.CloudProvider, volKey, resourceTags); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to bind resource tags to disk %#v: %v", name, err))
+		}
 		// If there is no validation error, immediately return success
-		return generateCreateVolumeResponse(existingDisk, capBytes, zones), nil
+		resp := generateCreateVolumeResponse(existingDisk, capBytes, zones, volumeContext)
+		if source := imageSnapshotContentSource(req.GetVolumeContentSource()); source != nil {
+			resp.Volume.ContentSource = source
+		}
+		gceCS.volumeResponses.Add(name, fingerprint, resp)
+		return resp, nil
 	}
 
 	snapshotID := ""
@@ -186,6 +361,14 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 			}
 		}
 	}
+	if snapshotID != "" && sourceImage != "" {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume parameter %q cannot be combined with a snapshot volume content source", common.ParameterKeySourceImage))
+	}
+	if imageSnapshotContentSource(content) != nil {
+		// Snapshots backed by images are restored from the image
+		sourceImage = snapshotID
+		snapshotID = ""
+	}
 
 	// Create the disk
 	var disk *gce.CloudDisk
@@ -194,27 +377,39 @@ func (gceCS *GCEControllerServer) CreateVolume(ctx context.Context, req *csi.Cre
 		if len(zones) != 1 {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to get a single zone for creating zonal disk, instead got: %v", zones))
 		}
-		disk, err = createSingleZoneDisk(ctx, gceCS.CloudProvider, name, zones, diskType, capacityRange, capBytes, snapshotID, diskEncryptionKmsKey)
+		disk, err = createSingleZoneDisk(ctx, gceCS.CloudProvider, name, zones, diskType, capacityRange, capBytes, snapshotID, sourceImage, description, diskEncryptionKey, enableConfidentialCompute, storagePools[zones[0]])
+		if gce.IsStoragePoolCapacityError(err) {
+			return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("CreateVolume storage pool %s has insufficient capacity for disk %#v: %v", storagePools[zones[0]], name, err))
+		}
 		if err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to create single zonal disk %#v: %v", name, err))
+			return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("CreateVolume failed to create single zonal disk %#v: %v", name, err))
 		}
 	case replicationTypeRegionalPD:
 		if len(zones) != 2 {
 			return nil, status.Errorf(codes.Internal, fmt.Sprintf("CreateVolume failed to get a 2 zones for creating regional disk, instead got: %v", zones))
 		}
-		disk, err = createRegionalDisk(ctx, gceCS.CloudProvider, name, zones, diskType, capacityRange, capBytes, snapshotID, diskEncryptionKmsKey)
+		disk, err = createRegionalDisk(ctx, gceCS.CloudProvider, name, zones, diskType, capacityRange, capBytes, snapshotID, sourceImage, description, diskEncryptionKey, enableConfidentialCompute)
 		if err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to create regional disk %#v: %v", name, err))
+			return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("CreateVolume failed to create regional disk %#v: %v", name, err))
 		}
 	default:
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume replication type '%s' is not supported", replicationType))
 	}
-	return generateCreateVolumeResponse(disk, capBytes, zones), nil
-
+	// Tags are bound after the disk is created, so that a retry after a
+	// failure reuses the disk and binds the remaining tags
+	if err := bindResourceTags(ctx, gceCS.CloudProvider, volKey, resourceTags); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("CreateVolume failed to bind resource tags to disk %#v: %v", name, err))
+	}
+	resp := generateCreateVolumeResponse(disk, capBytes, zones, volumeContext)
+	if source := imageSnapshotContentSource(content); source != nil {
+		resp.Volume.ContentSource = source
+	}
+	gceCS.volumeResponses.Add(name, fingerprint, resp)
+	return resp, nil
 }
 
 func (gceCS *GCEControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	klog.V(4).Infof("DeleteVolume called with request %v", *req)
+	klog.V(4).Infof("DeleteVolume called with request %v", protosanitizer.StripSecrets(req))
 
 	// Validate arguments
 	volumeID := req.GetVolumeId()
@@ -224,9 +419,12 @@ func (gceCS *GCEControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 
 	volKey, err := common.VolumeIDToKey(volumeID)
 	if err != nil {
-		// Cannot find volume associated with this ID because can't even get the name or zone
-		// This is a success according to the spec
-		return &csi.DeleteVolumeResponse{}, nil
+		if !common.IsVolumeIDPath(volumeID) {
+			// The ID is not even shaped like a volume of this driver, so the
+			// volume doesn't exist. This is a success according to the spec
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("DeleteVolume Volume ID is invalid: %v", err))
 	}
 
 	volKey, err = gceCS.CloudProvider.RepairUnderspecifiedVolumeKey(ctx, volKey)
@@ -239,22 +437,42 @@ func (gceCS *GCEControllerServer) DeleteVolume(ctx context.Context, req *csi.Del
 	}
 	defer gceCS.volumeLocks.Release(volumeID)
 
+	gceCS.volumeResponses.Remove(volKey.Name)
+	// Disks still attached to instances can't be deleted, which is reported
+	// as FailedPrecondition so the provisioner retries once they are detached
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey)
+	if err != nil {
+		if gce.IsGCEDiskNotFound(err) {
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+		return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("DeleteVolume failed to get disk %s: %v", volKey.Name, err))
+	}
+	if users := disk.GetUsers(); len(users) > 0 {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("DeleteVolume disk %s is still attached to instances %v", volKey.Name, diskUserInstances(users)))
+	}
+	// Deleting a disk does not require its customer-supplied encryption key,
+	// so any secrets on the request are ignored
 	err = gceCS.CloudProvider.DeleteDisk(ctx, volKey)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Delete disk error: %v", err))
+		if gce.IsDiskInUse(err) {
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("DeleteVolume disk %s is still attached to an instance: %v", volKey.Name, err))
+		}
+		return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("unknown Delete disk error: %v", err))
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
 func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	klog.V(4).Infof("ControllerPublishVolume called with request %v", *req)
+	klog.V(4).Infof("ControllerPublishVolume called with request %v", protosanitizer.StripSecrets(req))
 
 	// Validate arguments
 	volumeID := req.GetVolumeId()
-	readOnly := req.GetReadonly()
 	nodeID := req.GetNodeId()
 	volumeCapability := req.GetVolumeCapability()
+	// Disks of read only volumes are attached read only, which allows
+	// attaching them to multiple instances
+	readOnly := req.GetReadonly() || isReadOnlyAccessMode(volumeCapability.GetAccessMode())
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume Volume ID must be provided")
 	}
@@ -291,10 +509,13 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 	pubVolResp := &csi.ControllerPublishVolumeResponse{
 		PublishContext: nil,
 	}
+	if readOnly {
+		pubVolResp.PublishContext = map[string]string{common.PublishContextKeyReadOnly: "true"}
+	}
 
-	_, err = gceCS.CloudProvider.GetDisk(ctx, volKey)
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey)
 	if err != nil {
-		if gce.IsGCEError(err, "notFound") {
+		if gce.IsGCEDiskNotFound(err) {
 			return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find disk %v: %v", volKey.String(), err))
 		}
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get disk error: %v", err))
@@ -303,12 +524,23 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 	if err != nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("could not split nodeID: %v", err))
 	}
-	instance, err := gceCS.CloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
-	if err != nil {
-		if gce.IsGCEError(err, "notFound") {
-			return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find instance %v: %v", nodeID, err))
+	getInstance := func(fresh bool) (*gce.CloudInstance, bool, error) {
+		instance, cached, err := gceCS.getInstance(ctx, nodeID, instanceZone, instanceName, fresh)
+		if err != nil {
+			if gce.IsInstanceNotFound(err) {
+				return nil, false, status.Error(codes.NotFound, fmt.Sprintf("ControllerPublishVolume instance %s in zone %s of node %v does not exist, the node may have been deleted: %v", instanceName, instanceZone, nodeID, err))
+			}
+			return nil, false, status.Error(codes.Internal, fmt.Sprintf("Unknown get instance error: %v", err))
 		}
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get instance error: %v", err))
+		return instance, cached, nil
+	}
+	instance, cached, err := getInstance(false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateConfidentialComputeInstance(disk, instance); err != nil {
+		return nil, err
 	}
 
 	readWrite := "READ_WRITE"
@@ -321,7 +553,15 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 		return nil, status.Error(codes.Internal, fmt.Sprintf("error getting device name: %v", err))
 	}
 
-	attached, err := diskIsAttachedAndCompatible(deviceName, instance, volumeCapability, readWrite)
+	attached, err := diskIsAttachedAndCompatible(deviceName, instance.Instance, volumeCapability, readWrite)
+	if cached && (attached || err != nil) {
+		// The disks of a cached instance may be stale, skipping the attach or
+		// failing is only decided on the current instance
+		if instance, _, err = getInstance(true); err != nil {
+			return nil, err
+		}
+		attached, err = diskIsAttachedAndCompatible(deviceName, instance.Instance, volumeCapability, readWrite)
+	}
 	if err != nil {
 		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Disk %v already published to node %v but incompatbile: %v", volKey.Name, nodeID, err))
 	}
@@ -334,24 +574,42 @@ func (gceCS *GCEControllerServer) ControllerPublishVolume(ctx context.Context, r
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("could not split nodeID: %v", err))
 	}
-	err = gceCS.CloudProvider.AttachDisk(ctx, volKey, readWrite, attachableDiskTypePersistent, instanceZone, instanceName)
+	// Disks encrypted with a customer-supplied key can only be attached when
+	// the key is supplied again
+	diskEncryptionKey, err := getDiskEncryptionKey("", req.GetSecrets())
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Attach error: %v", err))
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("ControllerPublishVolume invalid disk encryption key: %v", err))
+	}
+	err = gceCS.CloudProvider.AttachDisk(ctx, volKey, readWrite, attachableDiskTypePersistent, instanceZone, instanceName, diskEncryptionKey)
+	if err != nil {
+		gceCS.instances.remove(nodeID)
+		if gce.IsInstanceNotFound(err) {
+			// The instance was deleted after it was looked up
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("ControllerPublishVolume could not attach disk %v, instance %s in zone %s of node %v does not exist: %v", volKey.Name, instanceName, instanceZone, nodeID, err))
+		}
+		return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("unknown Attach error: %v", err))
 	}
 
 	klog.V(4).Infof("Waiting for attach of disk %v to instance %v to complete...", volKey.Name, nodeID)
 
 	err = gceCS.CloudProvider.WaitForAttach(ctx, volKey, instanceZone, instanceName)
 	if err != nil {
+		gceCS.instances.remove(nodeID)
 		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown WaitForAttach error: %v", err))
 	}
+	gceCS.instances.diskAttached(nodeID, &compute.AttachedDisk{
+		DeviceName: deviceName,
+		Mode:       readWrite,
+		Source:     gceCS.CloudProvider.GetDiskSourceURI(volKey),
+		Type:       attachableDiskTypePersistent,
+	})
 
 	klog.V(4).Infof("Disk %v attached to instance %v successfully", volKey.Name, nodeID)
 	return pubVolResp, nil
 }
 
 func (gceCS *GCEControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	klog.V(4).Infof("ControllerUnpublishVolume called with request %v", *req)
+	klog.V(4).Infof("ControllerUnpublishVolume called with request %v", protosanitizer.StripSecrets(req))
 
 	// Validate arguments
 	volumeID := req.GetVolumeId()
@@ -365,7 +623,7 @@ func (gceCS *GCEControllerServer) ControllerUnpublishVolume(ctx context.Context,
 
 	volKey, err := common.VolumeIDToKey(volumeID)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("ControllerUnpublishVolume Volume ID is invalid: %v", err))
 	}
 
 	// Acquires the lock for the volume on that node only, because we need to support the ability
@@ -380,17 +638,30 @@ func (gceCS *GCEControllerServer) ControllerUnpublishVolume(ctx context.Context,
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("could not split nodeID: %v", err))
 	}
-	instance, err := gceCS.CloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
-	if err != nil {
-		return nil, err
-	}
-
 	deviceName, err := common.GetDeviceName(volKey)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("error getting device name: %v", err))
 	}
 
-	attached := diskIsAttached(deviceName, instance)
+	attached := false
+	for _, fresh := range []bool{false, true} {
+		instance, cached, err := gceCS.getInstance(ctx, nodeID, instanceZone, instanceName, fresh)
+		if err != nil {
+			if gce.IsInstanceNotFound(err) {
+				// Disks are detached from deleted instances, so the volume
+				// is not attached to the node. Success!
+				klog.Warningf("Instance %s in zone %s of node %v does not exist, treating disk %v as detached", instanceName, instanceZone, nodeID, volKey.Name)
+				return &csi.ControllerUnpublishVolumeResponse{}, nil
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get instance error: %v", err))
+		}
+		attached = diskIsAttached(deviceName, instance.Instance)
+		// The disks of a cached instance may be stale, skipping the detach
+		// is only decided on the current instance
+		if attached || !cached {
+			break
+		}
+	}
 
 	if !attached {
 		// Volume is not attached to node. Success!
@@ -400,12 +671,36 @@ func (gceCS *GCEControllerServer) ControllerUnpublishVolume(ctx context.Context,
 
 	err = gceCS.CloudProvider.DetachDisk(ctx, deviceName, instanceZone, instanceName)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown detach error: %v", err))
+		gceCS.instances.remove(nodeID)
+		if gce.IsInstanceNotFound(err) {
+			// The instance was deleted after it was looked up
+			klog.Warningf("Instance %s in zone %s of node %v no longer exists, treating disk %v as detached", instanceName, instanceZone, nodeID, volKey.Name)
+			return &csi.ControllerUnpublishVolumeResponse{}, nil
+		}
+		return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("unknown detach error: %v", err))
 	}
+	gceCS.instances.diskDetached(nodeID, deviceName)
 
 	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
+// getInstance returns the instance of the node and whether it was cached. The
+// instance cache is skipped if fresh is set.
+func (gceCS *GCEControllerServer) getInstance(ctx context.Context, nodeID, instanceZone, instanceName string, fresh bool) (*gce.CloudInstance, bool, error) {
+	if !fresh {
+		if instance, ok := gceCS.instances.get(nodeID); ok {
+			return instance, true, nil
+		}
+	}
+	instance, err := gceCS.CloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
+	if err != nil {
+		gceCS.instances.remove(nodeID)
+		return nil, false, err
+	}
+	gceCS.instances.add(nodeID, instance)
+	return instance, false, nil
+}
+
 func (gceCS *GCEControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	// TODO(#162): Implement ValidateVolumeCapabilities
 
@@ -430,7 +725,7 @@ func (gceCS *GCEControllerServer) ValidateVolumeCapabilities(ctx context.Context
 
 	_, err = gceCS.CloudProvider.GetDisk(ctx, volKey)
 	if err != nil {
-		if gce.IsGCEError(err, "notFound") {
+		if gce.IsGCEDiskNotFound(err) {
 			return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find disk %v: %v", volKey.Name, err))
 		}
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get disk error: %v", err))
@@ -520,7 +815,7 @@ func (gceCS *GCEControllerServer) ControllerGetCapabilities(ctx context.Context,
 }
 
 func (gceCS *GCEControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	klog.V(4).Infof("CreateSnapshot called with request %v", *req)
+	klog.V(4).Infof("CreateSnapshot called with request %v", protosanitizer.StripSecrets(req))
 
 	// Validate arguments
 	volumeID := req.GetSourceVolumeId()
@@ -530,27 +825,79 @@ func (gceCS *GCEControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID must be provided")
 	}
+
+	// Retries of recently created snapshots are answered before anything is
+	// requested from GCE
+	fingerprint := requestFingerprint(req)
+	if resp, found, matches := gceCS.snapshotResponses.Get(req.Name, fingerprint); found {
+		if !matches {
+			return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Snapshot %s was recently created with different parameters", req.Name))
+		}
+		klog.V(4).Infof("CreateSnapshot returning cached response for snapshot %s", req.Name)
+		return resp.(*csi.CreateSnapshotResponse), nil
+	}
+
 	volKey, err := common.VolumeIDToKey(volumeID)
 	if err != nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find volume with ID %v: %v", volumeID, err))
 	}
 
+	snapshotType := common.DiskSnapshotType
+	for k, v := range req.GetParameters() {
+		if strings.HasPrefix(k, snapshotterParameterPrefix) {
+			// Parameters added by the external-snapshotter, e.g. with
+			// --extra-create-metadata, are not needed by GCE PD
+			continue
+		}
+		switch strings.ToLower(k) {
+		case common.ParameterKeySnapshotType:
+			snapshotType = strings.ToLower(v)
+			if snapshotType != common.DiskSnapshotType && snapshotType != common.DiskImageType {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateSnapshot invalid value %q for parameter %q, supported values are %q and %q", v, k, common.DiskSnapshotType, common.DiskImageType))
+			}
+		default:
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateSnapshot invalid option %q", k))
+		}
+	}
+
 	if acquired := gceCS.volumeLocks.TryAcquire(volumeID); !acquired {
 		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeID)
 	}
 	defer gceCS.volumeLocks.Release(volumeID)
 
+	var snapshot *csi.Snapshot
+	switch snapshotType {
+	case common.DiskSnapshotType:
+		snapshot, err = gceCS.createPDSnapshot(ctx, volKey, req.Name, volumeID)
+	case common.DiskImageType:
+		snapshot, err = gceCS.createImage(ctx, volKey, req.Name, volumeID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	createResp := &csi.CreateSnapshotResponse{
+		Snapshot: snapshot,
+	}
+	// Snapshots that are not ready yet are polled by the caller, so only
+	// final responses are cached
+	if snapshot.ReadyToUse {
+		gceCS.snapshotResponses.Add(req.Name, fingerprint, createResp)
+	}
+	return createResp, nil
+}
+
+func (gceCS *GCEControllerServer) createPDSnapshot(ctx context.Context, volKey *meta.Key, snapshotName, volumeID string) (*csi.Snapshot, error) {
 	// Check if snapshot already exists
-	var snapshot *compute.Snapshot
-	snapshot, err = gceCS.CloudProvider.GetSnapshot(ctx, req.Name)
+	snapshot, err := gceCS.CloudProvider.GetSnapshot(ctx, snapshotName)
 	if err != nil {
 		if !gce.IsGCEError(err, "notFound") {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get snapshot error: %v", err))
 		}
 		// If we could not find the snapshot, we create a new one
-		snapshot, err = gceCS.CloudProvider.CreateSnapshot(ctx, volKey, req.Name)
+		snapshot, err = gceCS.CloudProvider.CreateSnapshot(ctx, volKey, snapshotName)
 		if err != nil {
-			if gce.IsGCEError(err, "notFound") {
+			if gce.IsGCEDiskNotFound(err) {
 				return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find volume with ID %v: %v", volKey.String(), err))
 			}
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown create snapshot error: %v", err))
@@ -561,31 +908,71 @@ func (gceCS *GCEControllerServer) CreateSnapshot(ctx context.Context, req *csi.C
 	if err != nil {
 		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Error in creating snapshot: %v", err))
 	}
-	t, err := time.Parse(time.RFC3339, snapshot.CreationTimestamp)
+	tp, err := parseTimestamp(snapshot.CreationTimestamp)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to covert creation timestamp: %v", err))
 	}
 
-	tp, err := ptypes.TimestampProto(t)
+	ready, err := isCSISnapshotReady(snapshot.Status)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Snapshot had error checking ready status: %v", err))
+	}
+
+	return &csi.Snapshot{
+		SizeBytes:      common.GbToBytes(snapshot.DiskSizeGb),
+		SnapshotId:     cleanSelfLink(snapshot.SelfLink),
+		SourceVolumeId: volumeID,
+		CreationTime:   tp,
+		ReadyToUse:     ready,
+	}, nil
+}
+
+func (gceCS *GCEControllerServer) createImage(ctx context.Context, volKey *meta.Key, imageName, volumeID string) (*csi.Snapshot, error) {
+	// Check if image already exists
+	image, err := gceCS.CloudProvider.GetImage(ctx, imageName)
+	if err != nil {
+		if !gce.IsGCEError(err, "notFound") {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown get image error: %v", err))
+		}
+		// If we could not find the image, we create a new one
+		image, err = gceCS.CloudProvider.CreateImage(ctx, volKey, imageName)
+		if err != nil {
+			if gce.IsGCEDiskNotFound(err) {
+				return nil, status.Error(codes.NotFound, fmt.Sprintf("Could not find volume with ID %v: %v", volKey.String(), err))
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown create image error: %v", err))
+		}
+	}
+
+	err = validateSnapshotSourceDisk(image.SourceDisk, volKey)
+	if err != nil {
+		return nil, status.Error(codes.AlreadyExists, fmt.Sprintf("Error in creating image: %v", err))
+	}
+	tp, err := parseTimestamp(image.CreationTimestamp)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to covert creation timestamp: %v", err))
 	}
 
-	ready, err := isCSISnapshotReady(snapshot.Status)
+	ready, err := isImageReady(image.Status)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Snapshot had error checking ready status: %v", err))
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Image had error checking ready status: %v", err))
 	}
 
-	createResp := &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			SizeBytes:      common.GbToBytes(snapshot.DiskSizeGb),
-			SnapshotId:     cleanSelfLink(snapshot.SelfLink),
-			SourceVolumeId: volumeID,
-			CreationTime:   tp,
-			ReadyToUse:     ready,
-		},
+	return &csi.Snapshot{
+		SizeBytes:      common.GbToBytes(image.DiskSizeGb),
+		SnapshotId:     cleanSelfLink(image.SelfLink),
+		SourceVolumeId: volumeID,
+		CreationTime:   tp,
+		ReadyToUse:     ready,
+	}, nil
+}
+
+func parseTimestamp(ts string) (*timestamp.Timestamp, error) {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return nil, err
 	}
-	return createResp, nil
+	return ptypes.TimestampProto(t)
 }
 
 func (gceCS *GCEControllerServer) validateExistingSnapshot(snapshot *compute.Snapshot, volKey *meta.Key) error {
@@ -593,25 +980,38 @@ func (gceCS *GCEControllerServer) validateExistingSnapshot(snapshot *compute.Sna
 		return fmt.Errorf("disk does not exist")
 	}
 
-	sourceKey, err := common.VolumeIDToKey(cleanSelfLink(snapshot.SourceDisk))
+	if err := validateSnapshotSourceDisk(snapshot.SourceDisk, volKey); err != nil {
+		return err
+	}
+	// Snapshot exists with matching source disk.
+	klog.V(5).Infof("Compatible snapshot %s exists with source disk %s.", snapshot.Name, snapshot.SourceDisk)
+	return nil
+}
+
+func validateSnapshotSourceDisk(sourceDisk string, volKey *meta.Key) error {
+	sourceKey, err := common.VolumeIDToKey(cleanSelfLink(sourceDisk))
 	if err != nil {
-		return fmt.Errorf("fail to get source disk key %s, %v", snapshot.SourceDisk, err)
+		return fmt.Errorf("fail to get source disk key %s, %v", sourceDisk, err)
 	}
 
 	if sourceKey.String() != volKey.String() {
 		return fmt.Errorf("snapshot already exists with same name but with a different disk source %s, expected disk source %s", sourceKey.String(), volKey.String())
 	}
-	// Snapshot exists with matching source disk.
-	klog.V(5).Infof("Compatible snapshot %s exists with source disk %s.", snapshot.Name, snapshot.SourceDisk)
 	return nil
 }
 
+// isCSISnapshotReady returns whether a snapshot with the given GCE status can
+// be used to restore volumes. A snapshot is only ready once it has been
+// uploaded, a snapshot that is still CREATING or UPLOADING is not.
 func isCSISnapshotReady(status string) (bool, error) {
 	switch status {
 	case "READY":
 		return true, nil
 	case "FAILED":
 		return false, fmt.Errorf("snapshot status is FAILED")
+	case "CREATING", "UPLOADING":
+		klog.V(4).Infof("snapshot is in %s", status)
+		return false, nil
 	case "DELETING":
 		klog.V(4).Infof("snapshot is in DELETING")
 		fallthrough
@@ -620,8 +1020,22 @@ func isCSISnapshotReady(status string) (bool, error) {
 	}
 }
 
+// isImageReady returns whether an image with the given GCE status can be used
+// to restore volumes
+func isImageReady(status string) (bool, error) {
+	switch status {
+	case "READY":
+		return true, nil
+	case "FAILED":
+		return false, fmt.Errorf("image status is FAILED")
+	default:
+		klog.V(4).Infof("image is in %s", status)
+		return false, nil
+	}
+}
+
 func (gceCS *GCEControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	klog.V(4).Infof("DeleteSnapshot called with request %v", *req)
+	klog.V(4).Infof("DeleteSnapshot called with request %v", protosanitizer.StripSecrets(req))
 
 	// Validate arguments
 	snapshotID := req.GetSnapshotId()
@@ -629,7 +1043,7 @@ func (gceCS *GCEControllerServer) DeleteSnapshot(ctx context.Context, req *csi.D
 		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot Snapshot ID must be provided")
 	}
 
-	key, err := common.SnapshotIDToKey(snapshotID)
+	snapshotType, key, err := common.SnapshotIDToKey(snapshotID)
 	if err != nil {
 		// Cannot get snapshot ID from the passing request
 		// This is a success according to the spec
@@ -637,16 +1051,25 @@ func (gceCS *GCEControllerServer) DeleteSnapshot(ctx context.Context, req *csi.D
 		return &csi.DeleteSnapshotResponse{}, nil
 	}
 
-	err = gceCS.CloudProvider.DeleteSnapshot(ctx, key)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Delete snapshot error: %v", err))
+	gceCS.snapshotResponses.Remove(key)
+	switch snapshotType {
+	case common.DiskSnapshotType:
+		err = gceCS.CloudProvider.DeleteSnapshot(ctx, key)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Delete snapshot error: %v", err))
+		}
+	case common.DiskImageType:
+		err = gceCS.CloudProvider.DeleteImage(ctx, key)
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("unknown Delete image error: %v", err))
+		}
 	}
 
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (gceCS *GCEControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	klog.V(4).Infof("ListSnapshots called with request %v", *req)
+	klog.V(4).Infof("ListSnapshots called with request %v", protosanitizer.StripSecrets(req))
 
 	// case 1: SnapshotId is not empty, return snapshots that match the snapshot id.
 	if len(req.GetSnapshotId()) != 0 {
@@ -673,9 +1096,33 @@ func (gceCS *GCEControllerServer) ControllerExpandVolume(ctx context.Context, re
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("ControllerExpandVolume volume ID is invalid: %v", err))
 	}
 
+	// Disks cannot be shrunk, reject the request before passing an invalid
+	// resize to GCE
+	disk, err := gceCS.CloudProvider.GetDisk(ctx, volKey)
+	if err != nil {
+		if gce.IsGCEDiskNotFound(err) {
+			return nil, status.Error(codes.NotFound, fmt.Sprintf("ControllerExpandVolume could not find disk %v: %v", volKey.String(), err))
+		}
+		return nil, status.Error(codes.Internal, fmt.Sprintf("ControllerExpandVolume failed to get disk: %v", err))
+	}
+	currentBytes := common.GbToBytes(disk.GetSizeGb())
+	if capacityRange.GetLimitBytes() > 0 && capacityRange.GetLimitBytes() < currentBytes {
+		return nil, status.Error(codes.OutOfRange, fmt.Sprintf("ControllerExpandVolume requested capacity range %v is smaller than the current disk size of %v bytes, disks cannot be shrunk", capacityRange, currentBytes))
+	}
+	if reqBytes <= currentBytes {
+		// The disk is already large enough, e.g. because a previous request
+		// resized it. The file system may still need to be expanded.
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         currentBytes,
+			NodeExpansionRequired: true,
+		}, nil
+	}
+
+	// The capacity of a cached CreateVolume response is stale once resized
+	gceCS.volumeResponses.Remove(volKey.Name)
 	resizedGb, err := gceCS.CloudProvider.ResizeDisk(ctx, volKey, reqBytes)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("ControllerExpandVolume failed to resize disk: %v", err))
+		return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("ControllerExpandVolume failed to resize disk: %v", err))
 	}
 
 	return &csi.ControllerExpandVolumeResponse{
@@ -717,24 +1164,41 @@ func (gceCS *GCEControllerServer) getSnapshots(ctx context.Context, req *csi.Lis
 }
 
 func (gceCS *GCEControllerServer) getSnapshotByID(ctx context.Context, snapshotID string) (*csi.ListSnapshotsResponse, error) {
-	key, err := common.SnapshotIDToKey(snapshotID)
+	snapshotType, key, err := common.SnapshotIDToKey(snapshotID)
 	if err != nil {
 		// Cannot get snapshot ID from the passing request
 		klog.Warningf("invalid snapshot id format %s", snapshotID)
 		return &csi.ListSnapshotsResponse{}, nil
 	}
 
-	snapshot, err := gceCS.CloudProvider.GetSnapshot(ctx, key)
-	if err != nil {
-		if gce.IsGCEError(err, "notFound") {
-			// return empty list if no snapshot is found
-			return &csi.ListSnapshotsResponse{}, nil
+	var e *csi.ListSnapshotsResponse_Entry
+	switch snapshotType {
+	case common.DiskSnapshotType:
+		snapshot, err := gceCS.CloudProvider.GetSnapshot(ctx, key)
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				// return empty list if no snapshot is found
+				return &csi.ListSnapshotsResponse{}, nil
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list snapshot error: %v", err))
+		}
+		e, err = generateSnapshotEntry(snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate snapshot entry: %v", err)
+		}
+	case common.DiskImageType:
+		image, err := gceCS.CloudProvider.GetImage(ctx, key)
+		if err != nil {
+			if gce.IsGCEError(err, "notFound") {
+				// return empty list if no image is found
+				return &csi.ListSnapshotsResponse{}, nil
+			}
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list image error: %v", err))
+		}
+		e, err = generateImageEntry(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate image entry: %v", err)
 		}
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Unknown list snapshot error: %v", err))
-	}
-	e, err := generateSnapshotEntry(snapshot)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate snapshot entry: %v", err)
 	}
 
 	entries := []*csi.ListSnapshotsResponse_Entry{e}
@@ -770,6 +1234,29 @@ func generateSnapshotEntry(snapshot *compute.Snapshot) (*csi.ListSnapshotsRespon
 	return entry, nil
 }
 
+func generateImageEntry(image *compute.Image) (*csi.ListSnapshotsResponse_Entry, error) {
+	t, _ := time.Parse(time.RFC3339, image.CreationTimestamp)
+
+	tp, err := ptypes.TimestampProto(t)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to covert creation timestamp: %v", err)
+	}
+
+	// We ignore the error intentionally here since we are just listing images
+	ready, _ := isImageReady(image.Status)
+
+	entry := &csi.ListSnapshotsResponse_Entry{
+		Snapshot: &csi.Snapshot{
+			SizeBytes:      common.GbToBytes(image.DiskSizeGb),
+			SnapshotId:     cleanSelfLink(image.SelfLink),
+			SourceVolumeId: cleanSelfLink(image.SourceDisk),
+			CreationTime:   tp,
+			ReadyToUse:     ready,
+		},
+	}
+	return entry, nil
+}
+
 func getRequestCapacity(capRange *csi.CapacityRange) (int64, error) {
 	var capBytes int64
 	// Default case where nothing is set
@@ -895,16 +1382,36 @@ func getZoneFromSegment(seg map[string]string) (string, error) {
 	return zone, nil
 }
 
-func pickZones(gceCS *GCEControllerServer, top *csi.TopologyRequirement, numZones int) ([]string, error) {
+func pickZones(ctx context.Context, gceCS *GCEControllerServer, top *csi.TopologyRequirement, numZones int) ([]string, error) {
 	var zones []string
 	var err error
 	if top != nil {
-		zones, err = pickZonesFromTopology(top, numZones)
+		topZones, err := getUniqueZonesFromTopology(top)
 		if err != nil {
 			return nil, fmt.Errorf("failed to pick zones from topology: %v", err)
 		}
+		if numZones > 1 && len(topZones) < numZones {
+			// The topology does not have enough zones for all replicas, fill
+			// up the replica zones with the least utilized zones in the region
+			zones, err = pickLeastUtilizedZones(ctx, gceCS, topZones, numZones)
+			if err != nil {
+				return nil, fmt.Errorf("failed to pick %v replica zones for topology zones %v: %v", numZones, topZones, err)
+			}
+			klog.V(4).Infof("Topology only allows zones %v, picked replica zones %v", topZones, zones)
+		} else {
+			zones, err = pickZonesFromTopology(top, numZones)
+			if err != nil {
+				return nil, fmt.Errorf("failed to pick zones from topology: %v", err)
+			}
+		}
+	} else if numZones > 1 {
+		zones, err = pickLeastUtilizedZones(ctx, gceCS, nil, numZones)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick %v least utilized zones in region: %v", numZones, err)
+		}
+		klog.Warningf("No zones have been specified in either topology or params, picking least utilized zones: %v", zones)
 	} else {
-		zones, err = getDefaultZonesInRegion(gceCS, []string{gceCS.MetadataService.GetZone()}, numZones)
+		zones, err = getDefaultZonesInRegion(ctx, gceCS, []string{gceCS.MetadataService.GetZone()}, numZones)
 		if err != nil {
 			return nil, fmt.Errorf("failed to get default %v zones in region: %v", numZones, err)
 		}
@@ -914,13 +1421,142 @@ func pickZones(gceCS *GCEControllerServer, top *csi.TopologyRequirement, numZone
 	return zones, nil
 }
 
-func getDefaultZonesInRegion(gceCS *GCEControllerServer, existingZones []string, numZones int) ([]string, error) {
+// constrainTopologyToZones returns a topology requirement that only contains
+// the given zones, such that the zones picked from it also satisfy the
+// original topology requirement
+func constrainTopologyToZones(top *csi.TopologyRequirement, zones []string, numZones int) (*csi.TopologyRequirement, error) {
+	if len(zones) < numZones {
+		return nil, fmt.Errorf("need %v zones, only got zones %v", numZones, zones)
+	}
+	allowedZones := sets.NewString(zones...)
+	topZones, err := getUniqueZonesFromTopology(top)
+	if err != nil {
+		return nil, err
+	}
+	prefZones, err := getZonesFromTopology(top.GetPreferred())
+	if err != nil {
+		return nil, fmt.Errorf("could not get zones from preferred topology: %v", err)
+	}
+
+	// Zones that satisfy both the topology requirement and the zones
+	accessibleZones := zones
+	if len(topZones) > 0 {
+		accessibleZones = []string{}
+		for _, zone := range topZones {
+			if allowedZones.Has(zone) {
+				accessibleZones = append(accessibleZones, zone)
+			}
+		}
+		if len(accessibleZones) == 0 {
+			return nil, fmt.Errorf("none of the topology zones %v are in zones %v", topZones, zones)
+		}
+	}
+	constrainedPrefZones := []string{}
+	for _, zone := range prefZones {
+		if allowedZones.Has(zone) {
+			constrainedPrefZones = append(constrainedPrefZones, zone)
+		}
+	}
+
+	constrained := &csi.TopologyRequirement{
+		Requisite: zonesToTopology(accessibleZones),
+		Preferred: zonesToTopology(constrainedPrefZones),
+	}
+	if numZones > 1 {
+		// Only one replica has to satisfy the topology requirement, the others
+		// can be in any of the zones
+		constrained.Requisite = zonesToTopology(zones)
+		if len(constrainedPrefZones) == 0 && len(topZones) > 0 {
+			constrained.Preferred = zonesToTopology(accessibleZones)
+		}
+	}
+	return constrained, nil
+}
+
+func zonesToTopology(zones []string) []*csi.Topology {
+	tops := []*csi.Topology{}
+	for _, zone := range zones {
+		tops = append(tops, &csi.Topology{
+			Segments: map[string]string{common.TopologyKeyZone: zone},
+		})
+	}
+	return tops
+}
+
+// getUniqueZonesFromTopology returns the zones of the topology requirement
+// without duplicates, preferred zones in order first followed by the
+// remaining requisite zones
+func getUniqueZonesFromTopology(top *csi.TopologyRequirement) ([]string, error) {
+	prefZones, err := getZonesFromTopology(top.GetPreferred())
+	if err != nil {
+		return nil, fmt.Errorf("could not get zones from preferred topology: %v", err)
+	}
+	reqZones, err := getZonesFromTopology(top.GetRequisite())
+	if err != nil {
+		return nil, fmt.Errorf("could not get zones from requisite topology: %v", err)
+	}
+	sort.Strings(reqZones)
+
+	zones := []string{}
+	seen := sets.NewString()
+	for _, zone := range append(prefZones, reqZones...) {
+		if !seen.Has(zone) {
+			seen.Insert(zone)
+			zones = append(zones, zone)
+		}
+	}
+	return zones, nil
+}
+
+// pickLeastUtilizedZones completes existingZones to numZones zones with the
+// zones of their region that hold the fewest disks. Without existing zones
+// the region of the controller is used.
+func pickLeastUtilizedZones(ctx context.Context, gceCS *GCEControllerServer, existingZones []string, numZones int) ([]string, error) {
+	regionZones := existingZones
+	if len(regionZones) == 0 {
+		regionZones = []string{gceCS.MetadataService.GetZone()}
+	}
+	region, err := common.GetRegionFromZones(regionZones)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get region from zones: %v", err)
+	}
+	needToGet := numZones - len(existingZones)
+	totZones, err := gceCS.CloudProvider.ListZones(ctx, region)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list zones from cloud provider: %v", err)
+	}
+	existingSet := sets.NewString(existingZones...)
+	remainingZones := []string{}
+	for _, zone := range totZones {
+		if !existingSet.Has(zone) {
+			remainingZones = append(remainingZones, zone)
+		}
+	}
+	if len(remainingZones) < needToGet {
+		return nil, fmt.Errorf("not enough remaining zones in %v to get %v zones out", remainingZones, needToGet)
+	}
+
+	counts, err := gceCS.CloudProvider.CountDisksInZones(ctx, region, remainingZones)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count disks in zones %v: %v", remainingZones, err)
+	}
+	// Ties keep the order of the zones returned by the cloud provider
+	sort.SliceStable(remainingZones, func(i, j int) bool {
+		return counts[remainingZones[i]] < counts[remainingZones[j]]
+	})
+
+	ret := make([]string, 0, numZones)
+	ret = append(ret, existingZones...)
+	return append(ret, remainingZones[0:needToGet]...), nil
+}
+
+func getDefaultZonesInRegion(ctx context.Context, gceCS *GCEControllerServer, existingZones []string, numZones int) ([]string, error) {
 	region, err := common.GetRegionFromZones(existingZones)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get region from zones: %v", err)
 	}
 	needToGet := numZones - len(existingZones)
-	totZones, err := gceCS.CloudProvider.ListZones(context.Background(), region)
+	totZones, err := gceCS.CloudProvider.ListZones(ctx, region)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list zones from cloud provider: %v", err)
 	}
@@ -937,18 +1573,13 @@ func getDefaultZonesInRegion(gceCS *GCEControllerServer, existingZones []string,
 	return ret, nil
 }
 
-func generateCreateVolumeResponse(disk *gce.CloudDisk, capBytes int64, zones []string) *csi.CreateVolumeResponse {
-	tops := []*csi.Topology{}
-	for _, zone := range zones {
-		tops = append(tops, &csi.Topology{
-			Segments: map[string]string{common.TopologyKeyZone: zone},
-		})
-	}
+func generateCreateVolumeResponse(disk *gce.CloudDisk, capBytes int64, zones []string, volumeContext map[string]string) *csi.CreateVolumeResponse {
+	tops := zonesToTopology(zones)
 	createResp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
 			CapacityBytes:      capBytes,
 			VolumeId:           cleanSelfLink(disk.GetSelfLink()),
-			VolumeContext:      nil,
+			VolumeContext:      volumeContext,
 			AccessibleTopology: tops,
 		},
 	}
@@ -967,12 +1598,58 @@ func generateCreateVolumeResponse(disk *gce.CloudDisk, capBytes int64, zones []s
 	return createResp
 }
 
+// imageSnapshotContentSource returns the content source if it is a snapshot
+// backed by an image. Disks restored from an image have no source snapshot,
+// so the content source of the response is taken from the request instead.
+func imageSnapshotContentSource(content *csi.VolumeContentSource) *csi.VolumeContentSource {
+	if content.GetSnapshot() == nil {
+		return nil
+	}
+	snapshotType, _, err := common.SnapshotIDToKey(content.GetSnapshot().GetSnapshotId())
+	if err != nil || snapshotType != common.DiskImageType {
+		return nil
+	}
+	return content
+}
+
 func cleanSelfLink(selfLink string) string {
 	temp := strings.TrimPrefix(selfLink, gce.GCEComputeAPIEndpoint)
 	return strings.TrimPrefix(temp, gce.GCEComputeBetaAPIEndpoint)
 }
 
-func createRegionalDisk(ctx context.Context, cloudProvider gce.GCECompute, name string, zones []string, diskType string, capacityRange *csi.CapacityRange, capBytes int64, snapshotID, diskEncryptionKmsKey string) (*gce.CloudDisk, error) {
+// diskUserInstances returns the instances of the users of a disk, which are
+// the URLs of the instances it is attached to, in the format of node IDs
+func diskUserInstances(users []string) []string {
+	instances := make([]string, 0, len(users))
+	for _, user := range users {
+		if i := strings.Index(user, "projects/"); i >= 0 {
+			user = user[i:]
+		}
+		instances = append(instances, user)
+	}
+	return instances
+}
+
+// cloudErrorCode returns the status code of a failed cloud provider call:
+// Canceled or DeadlineExceeded if the context of the RPC ended,
+// ResourceExhausted if a quota is exceeded, DeadlineExceeded if its operation
+// timed out and defaultCode otherwise
+func cloudErrorCode(err error, defaultCode codes.Code) codes.Code {
+	switch {
+	case gce.ContextError(err) == context.Canceled:
+		return codes.Canceled
+	case gce.ContextError(err) == context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	case gce.IsQuotaExceeded(err):
+		return codes.ResourceExhausted
+	case gce.IsOperationTimeout(err):
+		return codes.DeadlineExceeded
+	default:
+		return defaultCode
+	}
+}
+
+func createRegionalDisk(ctx context.Context, cloudProvider gce.GCECompute, name string, zones []string, diskType string, capacityRange *csi.CapacityRange, capBytes int64, snapshotID, sourceImage, description string, diskEncryptionKey *computebeta.CustomerEncryptionKey, enableConfidentialCompute bool) (*gce.CloudDisk, error) {
 	region, err := common.GetRegionFromZones(zones)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get region from zones: %v", err)
@@ -984,9 +1661,9 @@ func createRegionalDisk(ctx context.Context, cloudProvider gce.GCECompute, name
 			fullyQualifiedReplicaZones, cloudProvider.GetReplicaZoneURI(replicaZone))
 	}
 
-	err = cloudProvider.InsertDisk(ctx, meta.RegionalKey(name, region), diskType, capBytes, capacityRange, fullyQualifiedReplicaZones, snapshotID, diskEncryptionKmsKey)
+	err = cloudProvider.InsertDisk(ctx, meta.RegionalKey(name, region), diskType, capBytes, capacityRange, fullyQualifiedReplicaZones, snapshotID, sourceImage, description, diskEncryptionKey, enableConfidentialCompute, "")
 	if err != nil {
-		return nil, fmt.Errorf("failed to insert regional disk: %v", err)
+		return nil, gce.WrapError(err, "failed to insert regional disk")
 	}
 
 	klog.V(4).Infof("Completed creation of disk %v", name)
@@ -998,14 +1675,14 @@ func createRegionalDisk(ctx context.Context, cloudProvider gce.GCECompute, name
 	return disk, nil
 }
 
-func createSingleZoneDisk(ctx context.Context, cloudProvider gce.GCECompute, name string, zones []string, diskType string, capacityRange *csi.CapacityRange, capBytes int64, snapshotID, diskEncryptionKmsKey string) (*gce.CloudDisk, error) {
+func createSingleZoneDisk(ctx context.Context, cloudProvider gce.GCECompute, name string, zones []string, diskType string, capacityRange *csi.CapacityRange, capBytes int64, snapshotID, sourceImage, description string, diskEncryptionKey *computebeta.CustomerEncryptionKey, enableConfidentialCompute bool, storagePool string) (*gce.CloudDisk, error) {
 	if len(zones) != 1 {
 		return nil, fmt.Errorf("got wrong number of zones for zonal create volume: %v", len(zones))
 	}
 	diskZone := zones[0]
-	err := cloudProvider.InsertDisk(ctx, meta.ZonalKey(name, diskZone), diskType, capBytes, capacityRange, nil, snapshotID, diskEncryptionKmsKey)
+	err := cloudProvider.InsertDisk(ctx, meta.ZonalKey(name, diskZone), diskType, capBytes, capacityRange, nil, snapshotID, sourceImage, description, diskEncryptionKey, enableConfidentialCompute, storagePool)
 	if err != nil {
-		return nil, fmt.Errorf("failed to insert zonal disk: %v", err)
+		return nil, gce.WrapError(err, "failed to insert zonal disk")
 	}
 
 	klog.V(4).Infof("Completed creation of disk %v", name)
@@ -1017,6 +1694,100 @@ func createSingleZoneDisk(ctx context.Context, cloudProvider gce.GCECompute, nam
 	return disk, nil
 }
 
+// pickStoragePoolZone picks the zone of one of the storage pools, given by
+// zone, that satisfies the topology requirement. Preferred zones are picked
+// first, then requisite zones in order.
+func pickStoragePoolZone(top *csi.TopologyRequirement, storagePools map[string]string) (string, error) {
+	poolZones := sets.StringKeySet(storagePools)
+	prefZones, err := getZonesFromTopology(top.GetPreferred())
+	if err != nil {
+		return "", fmt.Errorf("could not get zones from preferred topology: %v", err)
+	}
+	reqZones, err := getZonesFromTopology(top.GetRequisite())
+	if err != nil {
+		return "", fmt.Errorf("could not get zones from requisite topology: %v", err)
+	}
+	if len(prefZones) == 0 && len(reqZones) == 0 {
+		return poolZones.List()[0], nil
+	}
+	for _, zone := range prefZones {
+		if poolZones.Has(zone) {
+			return zone, nil
+		}
+	}
+	for _, zone := range sets.NewString(reqZones...).List() {
+		if poolZones.Has(zone) {
+			return zone, nil
+		}
+	}
+	return "", fmt.Errorf("none of the storage pool zones %v satisfy the topology requirement, accessible zones are %v", poolZones.List(), sets.NewString(append(prefZones, reqZones...)...).List())
+}
+
+// validateConfidentialComputeInstance returns a FailedPrecondition error if
+// the disk has confidential compute enabled and the instance is not a
+// Confidential VM
+func validateConfidentialComputeInstance(disk *gce.CloudDisk, instance *gce.CloudInstance) error {
+	if disk.EnableConfidentialCompute && !instance.EnableConfidentialCompute {
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("confidential compute disk %s cannot be attached to instance %s, which is not a Confidential VM", disk.GetName(), instance.Name))
+	}
+	return nil
+}
+
+// bindResourceTags binds the resource manager tags to the disk, if any
+func bindResourceTags(ctx context.Context, cloudProvider gce.GCECompute, volKey *meta.Key, tags map[string]string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	return cloudProvider.AttachResourceTags(ctx, volKey, tags)
+}
+
+// generateDiskDescription returns the JSON description of a disk created by
+// the driver, so that it can be told apart from manually created disks
+func (gceCS *GCEControllerServer) generateDiskDescription(pvcName, pvcNamespace, pvName string) (string, error) {
+	description := map[string]string{
+		common.DiskDescriptionKeyCreatedBy:     gceCS.Driver.name,
+		common.DiskDescriptionKeyDriverVersion: gceCS.Driver.vendorVersion,
+	}
+	optional := map[string]string{
+		common.DiskDescriptionKeyClusterID:    gceCS.ClusterID,
+		common.DiskDescriptionKeyPVCName:      pvcName,
+		common.DiskDescriptionKeyPVCNamespace: pvcNamespace,
+		common.DiskDescriptionKeyPVName:       pvName,
+	}
+	for k, v := range optional {
+		if v != "" {
+			description[k] = v
+		}
+	}
+	b, err := json.Marshal(description)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// getDiskEncryptionKey builds the disk encryption key from the KMS key
+// parameter and the customer-supplied key secrets, returning nil when neither
+// is set
+func getDiskEncryptionKey(kmsKey string, secrets map[string]string) (*computebeta.CustomerEncryptionKey, error) {
+	rawKey := secrets[common.SecretKeyDiskEncryptionRawKey]
+	rsaEncryptedKey := secrets[common.SecretKeyDiskEncryptionRsaEncryptedKey]
+	if rawKey != "" && rsaEncryptedKey != "" {
+		return nil, fmt.Errorf("only one of secrets %q and %q may be set", common.SecretKeyDiskEncryptionRawKey, common.SecretKeyDiskEncryptionRsaEncryptedKey)
+	}
+	if kmsKey != "" && (rawKey != "" || rsaEncryptedKey != "") {
+		return nil, fmt.Errorf("parameter %q cannot be combined with a customer-supplied encryption key", common.ParameterKeyDiskEncryptionKmsKey)
+	}
+	if kmsKey == "" && rawKey == "" && rsaEncryptedKey == "" {
+		return nil, nil
+	}
+	return &computebeta.CustomerEncryptionKey{
+		KmsKeyName:      kmsKey,
+		RawKey:          rawKey,
+		RsaEncryptedKey: rsaEncryptedKey,
+	}, nil
+}
+
 func pickRandAndConsecutive(slice []string, n int) ([]string, error) {
 	if n > len(slice) {
 		return nil, fmt.Errorf("n: %v is greater than length of provided slice: %v", n, slice)
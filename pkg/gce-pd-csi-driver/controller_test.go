@@ -15,10 +15,12 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/rand"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,6 +29,7 @@ import (
 
 	"context"
 
+	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -63,6 +66,7 @@ var (
 	region, _            = common.GetRegionFromZones([]string{zone})
 	testRegionalID       = fmt.Sprintf("projects/%s/regions/%s/disks/%s", project, region, name)
 	testSnapshotID       = fmt.Sprintf("projects/%s/global/snapshots/%s", project, name)
+	testImageSnapshotID  = fmt.Sprintf("projects/%s/global/images/%s", project, name)
 	totalSnapshotsNumber = 5
 )
 
@@ -93,6 +97,58 @@ func TestCreateSnapshotArguments(t *testing.T) {
 				ReadyToUse:     false,
 			},
 		},
+		{
+			name: "success image snapshot of zonal disk",
+			req: &csi.CreateSnapshotRequest{
+				Name:           name,
+				SourceVolumeId: testVolumeID,
+				Parameters:     map[string]string{common.ParameterKeySnapshotType: common.DiskImageType},
+			},
+			expSnapshot: &csi.Snapshot{
+				SnapshotId:     testImageSnapshotID,
+				SourceVolumeId: testVolumeID,
+				CreationTime:   tp,
+				SizeBytes:      common.GbToBytes(gce.DiskSizeGb),
+				ReadyToUse:     true,
+			},
+		},
+		{
+			name: "success with snapshotter parameters",
+			req: &csi.CreateSnapshotRequest{
+				Name:           name,
+				SourceVolumeId: testVolumeID,
+				Parameters: map[string]string{
+					common.ParameterKeySnapshotType:               common.DiskSnapshotType,
+					"csi.storage.k8s.io/volumesnapshot/name":      "snapshot",
+					"csi.storage.k8s.io/volumesnapshot/namespace": "default",
+				},
+			},
+			expSnapshot: &csi.Snapshot{
+				SnapshotId:     testSnapshotID,
+				SourceVolumeId: testVolumeID,
+				CreationTime:   tp,
+				SizeBytes:      common.GbToBytes(gce.DiskSizeGb),
+				ReadyToUse:     false,
+			},
+		},
+		{
+			name: "fail invalid snapshot type",
+			req: &csi.CreateSnapshotRequest{
+				Name:           name,
+				SourceVolumeId: testVolumeID,
+				Parameters:     map[string]string{common.ParameterKeySnapshotType: "disks"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail unknown parameter",
+			req: &csi.CreateSnapshotRequest{
+				Name:           name,
+				SourceVolumeId: testVolumeID,
+				Parameters:     map[string]string{"foo": "bar"},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
 		{
 			name: "fail no name",
 			req: &csi.CreateSnapshotRequest{
@@ -154,6 +210,92 @@ func TestCreateSnapshotArguments(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateSnapshotReadyToUse(t *testing.T) {
+	gceDriver := initGCEDriver(t, nil)
+	req := &csi.CreateSnapshotRequest{
+		Name:           name,
+		SourceVolumeId: testVolumeID,
+	}
+
+	// The fake snapshot is UPLOADING when created and READY afterwards
+	for i, expReady := range []bool{false, true, true} {
+		resp, err := gceDriver.cs.CreateSnapshot(context.Background(), req)
+		if err != nil {
+			t.Fatalf("CreateSnapshot call %d failed: %v", i, err)
+		}
+		if resp.GetSnapshot().GetReadyToUse() != expReady {
+			t.Errorf("CreateSnapshot call %d expected ready to use %v, got %v", i, expReady, resp.GetSnapshot().GetReadyToUse())
+		}
+	}
+}
+
+// cloudCallCountingCloudProvider counts the calls to the cloud made to create
+// snapshots
+type cloudCallCountingCloudProvider struct {
+	*gce.FakeCloudProvider
+	calls int
+}
+
+func (cloud *cloudCallCountingCloudProvider) GetDisk(ctx context.Context, volKey *meta.Key) (*gce.CloudDisk, error) {
+	cloud.calls++
+	return cloud.FakeCloudProvider.GetDisk(ctx, volKey)
+}
+
+func (cloud *cloudCallCountingCloudProvider) GetSnapshot(ctx context.Context, snapshotName string) (*compute.Snapshot, error) {
+	cloud.calls++
+	return cloud.FakeCloudProvider.GetSnapshot(ctx, snapshotName)
+}
+
+func (cloud *cloudCallCountingCloudProvider) CreateSnapshot(ctx context.Context, volKey *meta.Key, snapshotName string) (*compute.Snapshot, error) {
+	cloud.calls++
+	return cloud.FakeCloudProvider.CreateSnapshot(ctx, volKey, snapshotName)
+}
+
+func TestCreateSnapshotResponseCache(t *testing.T) {
+	fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createZonalCloudDisk(name)})
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	cloudProvider := &cloudCallCountingCloudProvider{FakeCloudProvider: fakeCloudProvider}
+	gceDriver := initGCEDriverWithCloudProvider(t, cloudProvider)
+	req := &csi.CreateSnapshotRequest{
+		Name:           name,
+		SourceVolumeId: testVolumeID,
+		Secrets:        map[string]string{"key": "value"},
+	}
+
+	// The fake snapshot is only ready, and its response cached, once polled
+	var resp *csi.CreateSnapshotResponse
+	for !resp.GetSnapshot().GetReadyToUse() {
+		resp, err = gceDriver.cs.CreateSnapshot(context.Background(), req)
+		if err != nil {
+			t.Fatalf("CreateSnapshot did not expect error, but got %v", err)
+		}
+	}
+
+	// An identical request returns the cached response without calling the cloud
+	cloudProvider.calls = 0
+	retryResp, err := gceDriver.cs.CreateSnapshot(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateSnapshot retry did not expect error, but got %v", err)
+	}
+	if retryResp != resp {
+		t.Errorf("Expected cached response %v, got %v", resp, retryResp)
+	}
+	if cloudProvider.calls != 0 {
+		t.Errorf("Expected no cloud calls for the cached response, got %d", cloudProvider.calls)
+	}
+
+	// A request with different secrets is not answered from the cache
+	secretsReq := *req
+	secretsReq.Secrets = map[string]string{"key": "other-value"}
+	_, err = gceDriver.cs.CreateSnapshot(context.Background(), &secretsReq)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected error code: %v, got: %v. err : %v", codes.AlreadyExists, status.Code(err), err)
+	}
+}
+
 func TestDeleteSnapshot(t *testing.T) {
 	testCases := []struct {
 		name       string
@@ -166,6 +308,12 @@ func TestDeleteSnapshot(t *testing.T) {
 				SnapshotId: testSnapshotID,
 			},
 		},
+		{
+			name: "valid image",
+			req: &csi.DeleteSnapshotRequest{
+				SnapshotId: testImageSnapshotID,
+			},
+		},
 		{
 			name: "invalid id",
 			req: &csi.DeleteSnapshotRequest{
@@ -543,7 +691,7 @@ func TestCreateVolumeArguments(t *testing.T) {
 			},
 		},
 		{
-			name: "fail not enough topology with repd",
+			name: "success with not enough topology with repd",
 			req: &csi.CreateVolumeRequest{
 				Name:               name,
 				CapacityRange:      stdCapRange,
@@ -564,7 +712,19 @@ func TestCreateVolumeArguments(t *testing.T) {
 					},
 				},
 			},
-			expErrCode: codes.InvalidArgument,
+			expVol: &csi.Volume{
+				CapacityBytes: common.GbToBytes(20),
+				VolumeId:      testRegionalID,
+				VolumeContext: nil,
+				AccessibleTopology: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: region + "-c"},
+					},
+					{
+						Segments: map[string]string{common.TopologyKeyZone: metadataservice.FakeZone},
+					},
+				},
+			},
 		},
 		{
 			name: "success with no toplogy specified with repd",
@@ -656,6 +816,162 @@ func TestCreateVolumeArguments(t *testing.T) {
 				AccessibleTopology: stdTopology,
 			},
 		},
+		{
+			name: "success with customer-supplied encryption key",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters:         stdParams,
+				Secrets: map[string]string{
+					common.SecretKeyDiskEncryptionRawKey: "SGVsbG8gZnJvbSBHb29nbGUgQ2xvdWQgUGxhdGZvcm0=",
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes:      common.GbToBytes(20),
+				VolumeId:           testVolumeID,
+				VolumeContext:      nil,
+				AccessibleTopology: stdTopology,
+			},
+		},
+		{
+			name: "success with confidential compute",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyType:                      "hyperdisk-balanced",
+					common.ParameterKeyEnableConfidentialCompute: "true",
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes:      common.GbToBytes(20),
+				VolumeId:           testVolumeID,
+				VolumeContext:      map[string]string{common.VolumeAttributeEnableConfidentialCompute: "true"},
+				AccessibleTopology: stdTopology,
+			},
+		},
+		{
+			name: "fail with confidential compute on unsupported disk type",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyType:                      DiskTypeSSD,
+					common.ParameterKeyEnableConfidentialCompute: "true",
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail with invalid confidential compute value",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyType:                      "hyperdisk-balanced",
+					common.ParameterKeyEnableConfidentialCompute: "maybe",
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "success with read ahead",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyReadAheadKB: "4096",
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes:      common.GbToBytes(20),
+				VolumeId:           testVolumeID,
+				VolumeContext:      map[string]string{common.VolumeAttributeReadAheadKB: "4096"},
+				AccessibleTopology: stdTopology,
+			},
+		},
+		{
+			name: "success with ext4 tuning",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyExt4ReservedBlocksPercentage: "0",
+					common.ParameterKeyExt4LazyInit:                 "False",
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes: common.GbToBytes(20),
+				VolumeId:      testVolumeID,
+				VolumeContext: map[string]string{
+					common.VolumeAttributeExt4ReservedBlocksPercentage: "0",
+					common.VolumeAttributeExt4LazyInit:                 "false",
+				},
+				AccessibleTopology: stdTopology,
+			},
+		},
+		{
+			name: "fail with invalid ext4 lazy init",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyExt4LazyInit: "sometimes",
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "success with luks encryption",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyLUKSEncryption: "true",
+				},
+			},
+			expVol: &csi.Volume{
+				CapacityBytes:      common.GbToBytes(20),
+				VolumeId:           testVolumeID,
+				VolumeContext:      map[string]string{common.VolumeAttributeLUKSEncryption: "true"},
+				AccessibleTopology: stdTopology,
+			},
+		},
+		{
+			name: "fail with invalid read ahead",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyReadAheadKB: "-1",
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail with disk encryption kms key and customer-supplied encryption key",
+			req: &csi.CreateVolumeRequest{
+				Name:               name,
+				CapacityRange:      stdCapRange,
+				VolumeCapabilities: stdVolCaps,
+				Parameters: map[string]string{
+					common.ParameterKeyDiskEncryptionKmsKey: "projects/KMS_PROJECT_ID/locations/REGION/keyRings/KEY_RING/cryptoKeys/KEY",
+				},
+				Secrets: map[string]string{
+					common.SecretKeyDiskEncryptionRawKey: "SGVsbG8gZnJvbSBHb29nbGUgQ2xvdWQgUGxhdGZvcm0=",
+				},
+			},
+			expErrCode: codes.InvalidArgument,
+		},
 	}
 
 	// Run test cases
@@ -709,7 +1025,9 @@ func TestCreateVolumeWithVolumeSource(t *testing.T) {
 	testCases := []struct {
 		name            string
 		volKey          *meta.Key
+		snapshotID      string
 		snapshotOnCloud bool
+		params          map[string]string
 		expErrCode      codes.Code
 	}{
 		{
@@ -717,6 +1035,27 @@ func TestCreateVolumeWithVolumeSource(t *testing.T) {
 			volKey:          meta.ZonalKey("my-disk", zone),
 			snapshotOnCloud: true,
 		},
+		{
+			name:            "success with data source of snapshot type backed by image",
+			volKey:          meta.ZonalKey("my-disk", zone),
+			snapshotID:      testImageSnapshotID,
+			snapshotOnCloud: true,
+		},
+		{
+			name:            "fail with data source of snapshot type backed by image and source image",
+			volKey:          meta.ZonalKey("my-disk", zone),
+			snapshotID:      testImageSnapshotID,
+			snapshotOnCloud: true,
+			params:          map[string]string{common.ParameterKeySourceImage: "projects/debian-cloud/global/images/family/debian-9"},
+			expErrCode:      codes.InvalidArgument,
+		},
+		{
+			name:            "fail with data source of snapshot type and source image",
+			volKey:          meta.ZonalKey("my-disk", zone),
+			snapshotOnCloud: true,
+			params:          map[string]string{common.ParameterKeySourceImage: "projects/debian-cloud/global/images/family/debian-9"},
+			expErrCode:      codes.InvalidArgument,
+		},
 		{
 			name:            "fail with data source of snapshot type that doesn't exist",
 			volKey:          meta.ZonalKey("my-disk", zone),
@@ -732,23 +1071,32 @@ func TestCreateVolumeWithVolumeSource(t *testing.T) {
 		gceDriver := initGCEDriver(t, nil)
 
 		//gceDriver.cs.CloudProvider.CreateSnapshot(context.Background, )
+		snapshotID := testSnapshotID
+		if tc.snapshotID != "" {
+			snapshotID = tc.snapshotID
+		}
 
 		// Start Test
 		req := &csi.CreateVolumeRequest{
 			Name:               "test-name",
 			CapacityRange:      stdCapRange,
 			VolumeCapabilities: stdVolCaps,
+			Parameters:         tc.params,
 			VolumeContentSource: &csi.VolumeContentSource{
 				Type: &csi.VolumeContentSource_Snapshot{
 					Snapshot: &csi.VolumeContentSource_SnapshotSource{
-						SnapshotId: testSnapshotID,
+						SnapshotId: snapshotID,
 					},
 				},
 			},
 		}
 
 		if tc.snapshotOnCloud {
-			gceDriver.cs.CloudProvider.CreateSnapshot(context.Background(), tc.volKey, name)
+			if snapshotID == testImageSnapshotID {
+				gceDriver.cs.CloudProvider.CreateImage(context.Background(), tc.volKey, name)
+			} else {
+				gceDriver.cs.CloudProvider.CreateSnapshot(context.Background(), tc.volKey, name)
+			}
 		}
 		resp, err := gceDriver.cs.CreateVolume(context.Background(), req)
 		//check response
@@ -771,7 +1119,41 @@ func TestCreateVolumeWithVolumeSource(t *testing.T) {
 		if vol.ContentSource == nil || vol.ContentSource.Type == nil || vol.ContentSource.GetSnapshot() == nil || vol.ContentSource.GetSnapshot().SnapshotId == "" {
 			t.Fatalf("Expected volume content source to have snapshot ID, got none")
 		}
+		if snapshotID == testImageSnapshotID {
+			disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), meta.ZonalKey("test-name", zone))
+			if err != nil {
+				t.Fatalf("GetDisk did not expect error, but got %v", err)
+			}
+			if disk.ZonalDisk.SourceImage != testImageSnapshotID {
+				t.Errorf("Expected disk source image %q, got %q", testImageSnapshotID, disk.ZonalDisk.SourceImage)
+			}
+		}
+
+	}
+}
+
+func TestCreateVolumeWithSourceImage(t *testing.T) {
+	sourceImage := "projects/debian-cloud/global/images/family/debian-9"
+	gceDriver := initGCEDriver(t, nil)
+
+	req := &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: stdVolCaps,
+		Parameters: map[string]string{
+			common.ParameterKeySourceImage: sourceImage,
+		},
+	}
+	if _, err := gceDriver.cs.CreateVolume(context.Background(), req); err != nil {
+		t.Fatalf("CreateVolume did not expect error, but got %v", err)
+	}
 
+	disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), meta.ZonalKey(name, zone))
+	if err != nil {
+		t.Fatalf("GetDisk did not expect error, but got %v", err)
+	}
+	if disk.ZonalDisk.SourceImage != sourceImage {
+		t.Errorf("Expected disk source image %q, got %q", sourceImage, disk.ZonalDisk.SourceImage)
 	}
 }
 
@@ -796,11 +1178,12 @@ func TestCreateVolumeRandomRequisiteTopology(t *testing.T) {
 		},
 	}
 
-	gceDriver := initGCEDriver(t, nil)
-
 	tZones := map[string]bool{}
 	// Start Test
 	for i := 0; i < 25; i++ {
+		// Use a new driver every time, identical requests to the same
+		// driver return the cached response of the first request
+		gceDriver := initGCEDriver(t, nil)
 		resp, err := gceDriver.cs.CreateVolume(context.Background(), req)
 		if err != nil {
 			t.Fatalf("CreateVolume did not expect error, but got %v", err)
@@ -823,16 +1206,305 @@ func createZonalCloudDisk(name string) *gce.CloudDisk {
 	})
 }
 
-func TestDeleteVolume(t *testing.T) {
+func TestControllerExpandVolume(t *testing.T) {
+	seedDisk := func() *gce.CloudDisk {
+		return gce.ZonalCloudDisk(&compute.Disk{
+			Name:   name,
+			SizeGb: 20,
+		})
+	}
 	testCases := []struct {
-		name      string
-		seedDisks []*gce.CloudDisk
-		req       *csi.DeleteVolumeRequest
-		expErr    bool
+		name       string
+		seedDisks  []*gce.CloudDisk
+		req        *csi.ControllerExpandVolumeRequest
+		expBytes   int64
+		expErrCode codes.Code
 	}{
 		{
-			name: "valid",
-			seedDisks: []*gce.CloudDisk{
+			name:      "grow",
+			seedDisks: []*gce.CloudDisk{seedDisk()},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      testVolumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbToBytes(30)},
+			},
+			expBytes: common.GbToBytes(30),
+		},
+		{
+			name:      "same size",
+			seedDisks: []*gce.CloudDisk{seedDisk()},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      testVolumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbToBytes(20)},
+			},
+			expBytes: common.GbToBytes(20),
+		},
+		{
+			name:      "already big enough",
+			seedDisks: []*gce.CloudDisk{seedDisk()},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      testVolumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbToBytes(10)},
+			},
+			expBytes: common.GbToBytes(20),
+		},
+		{
+			name:      "already big enough within limit",
+			seedDisks: []*gce.CloudDisk{seedDisk()},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      testVolumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbToBytes(10), LimitBytes: common.GbToBytes(25)},
+			},
+			expBytes: common.GbToBytes(20),
+		},
+		{
+			name:      "limit below current size",
+			seedDisks: []*gce.CloudDisk{seedDisk()},
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      testVolumeID,
+				CapacityRange: &csi.CapacityRange{LimitBytes: common.GbToBytes(15)},
+			},
+			expErrCode: codes.OutOfRange,
+		},
+		{
+			name: "disk not found",
+			req: &csi.ControllerExpandVolumeRequest{
+				VolumeId:      testVolumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbToBytes(30)},
+			},
+			expErrCode: codes.NotFound,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, tc.seedDisks)
+
+		resp, err := gceDriver.cs.ControllerExpandVolume(context.Background(), tc.req)
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if resp.GetCapacityBytes() != tc.expBytes {
+			t.Errorf("Expected capacity %v, got %v", tc.expBytes, resp.GetCapacityBytes())
+		}
+		if !resp.GetNodeExpansionRequired() {
+			t.Errorf("Expected node expansion to be required")
+		}
+		volKey, err := common.VolumeIDToKey(tc.req.VolumeId)
+		if err != nil {
+			t.Fatalf("Failed to get key of volume %v: %v", tc.req.VolumeId, err)
+		}
+		disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), volKey)
+		if err != nil {
+			t.Fatalf("Failed to get disk: %v", err)
+		}
+		if common.GbToBytes(disk.GetSizeGb()) != tc.expBytes {
+			t.Errorf("Expected disk size %v, got %v", tc.expBytes, common.GbToBytes(disk.GetSizeGb()))
+		}
+	}
+}
+
+func TestCreateVolumeDiskDescription(t *testing.T) {
+	testCases := []struct {
+		name           string
+		clusterID      string
+		params         map[string]string
+		expDescription map[string]string
+	}{
+		{
+			name:   "driver only",
+			params: stdParams,
+			expDescription: map[string]string{
+				common.DiskDescriptionKeyCreatedBy:     driver,
+				common.DiskDescriptionKeyDriverVersion: "test-vendor",
+			},
+		},
+		{
+			name:      "cluster and pvc metadata",
+			clusterID: "test-cluster",
+			params: map[string]string{
+				common.ParameterKeyType:         "test-type",
+				common.ParameterKeyPVCName:      "test-pvc",
+				common.ParameterKeyPVCNamespace: "test-namespace",
+				common.ParameterKeyPVName:       "test-pv",
+			},
+			expDescription: map[string]string{
+				common.DiskDescriptionKeyCreatedBy:     driver,
+				common.DiskDescriptionKeyDriverVersion: "test-vendor",
+				common.DiskDescriptionKeyClusterID:     "test-cluster",
+				common.DiskDescriptionKeyPVCName:       "test-pvc",
+				common.DiskDescriptionKeyPVCNamespace:  "test-namespace",
+				common.DiskDescriptionKeyPVName:        "test-pv",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, nil)
+		gceDriver.cs.ClusterID = tc.clusterID
+
+		req := &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         tc.params,
+		}
+		if _, err := gceDriver.cs.CreateVolume(context.Background(), req); err != nil {
+			t.Fatalf("CreateVolume did not expect error, but got %v", err)
+		}
+
+		disk, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), meta.ZonalKey(name, zone))
+		if err != nil {
+			t.Fatalf("GetDisk did not expect error, but got %v", err)
+		}
+		description := map[string]string{}
+		if err := json.Unmarshal([]byte(disk.GetDescription()), &description); err != nil {
+			t.Fatalf("Failed to unmarshal disk description %q: %v", disk.GetDescription(), err)
+		}
+		if !reflect.DeepEqual(description, tc.expDescription) {
+			t.Errorf("Expected disk description %v, got %v", tc.expDescription, description)
+		}
+	}
+}
+
+func TestCreateVolumeResourceTags(t *testing.T) {
+	testCases := []struct {
+		name        string
+		defaultTags map[string]string
+		params      map[string]string
+		expTags     map[string]string
+		expErrCode  codes.Code
+	}{
+		{
+			name:   "no tags",
+			params: stdParams,
+		},
+		{
+			name:        "default tags",
+			defaultTags: map[string]string{"123456/env": "prod"},
+			params:      stdParams,
+			expTags:     map[string]string{"123456/env": "prod"},
+		},
+		{
+			name:        "parameter tags override default tags",
+			defaultTags: map[string]string{"123456/env": "prod", "123456/team": "storage"},
+			params: map[string]string{
+				common.ParameterKeyType:         "test-type",
+				common.ParameterKeyResourceTags: "123456/env/dev,my-project/cost-center/42",
+			},
+			expTags: map[string]string{
+				"123456/env":             "dev",
+				"123456/team":            "storage",
+				"my-project/cost-center": "42",
+			},
+		},
+		{
+			name: "fail with invalid tags",
+			params: map[string]string{
+				common.ParameterKeyResourceTags: "123456/env",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, nil)
+		gceDriver.cs.ResourceTags = tc.defaultTags
+
+		req := &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         tc.params,
+		}
+		_, err := gceDriver.cs.CreateVolume(context.Background(), req)
+		if status.Code(err) != tc.expErrCode {
+			t.Fatalf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if err != nil {
+			continue
+		}
+
+		fakeCloudProvider := gceDriver.cs.CloudProvider.(*gce.FakeCloudProvider)
+		tags := fakeCloudProvider.GetResourceTags(meta.ZonalKey(name, zone))
+		if len(tags) != 0 || len(tc.expTags) != 0 {
+			if !reflect.DeepEqual(tags, tc.expTags) {
+				t.Errorf("Expected resource tags %v, got %v", tc.expTags, tags)
+			}
+		}
+	}
+}
+
+func TestCreateVolumeResponseCache(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: stdVolCaps,
+		Parameters:         stdParams,
+	}
+	mismatchedReq := &csi.CreateVolumeRequest{
+		Name: name,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: common.GbToBytes(30),
+		},
+		VolumeCapabilities: stdVolCaps,
+		Parameters:         stdParams,
+	}
+
+	gceDriver := initGCEDriver(t, nil)
+
+	resp, err := gceDriver.cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume did not expect error, but got %v", err)
+	}
+
+	// An identical request returns the cached response
+	retryResp, err := gceDriver.cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume retry did not expect error, but got %v", err)
+	}
+	if retryResp != resp {
+		t.Errorf("Expected cached response %v, got %v", resp, retryResp)
+	}
+
+	// A request with different secrets is not answered from the cache
+	secretsReq := *req
+	secretsReq.Secrets = map[string]string{"key": "value"}
+	_, err = gceDriver.cs.CreateVolume(context.Background(), &secretsReq)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected error code: %v, got: %v. err : %v", codes.AlreadyExists, status.Code(err), err)
+	}
+
+	// A request with the same name but different parameters is rejected
+	_, err = gceDriver.cs.CreateVolume(context.Background(), mismatchedReq)
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected error code: %v, got: %v. err : %v", codes.AlreadyExists, status.Code(err), err)
+	}
+
+	// Deleting the volume invalidates the cached response
+	_, err = gceDriver.cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: resp.GetVolume().GetVolumeId()})
+	if err != nil {
+		t.Fatalf("DeleteVolume did not expect error, but got %v", err)
+	}
+	_, err = gceDriver.cs.CreateVolume(context.Background(), mismatchedReq)
+	if err != nil {
+		t.Errorf("CreateVolume after delete did not expect error, but got %v", err)
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	testCases := []struct {
+		name       string
+		seedDisks  []*gce.CloudDisk
+		req        *csi.DeleteVolumeRequest
+		expErr     bool
+		expErrCode codes.Code
+	}{
+		{
+			name: "valid",
+			seedDisks: []*gce.CloudDisk{
 				createZonalCloudDisk(name),
 			},
 			req: &csi.DeleteVolumeRequest{
@@ -844,6 +1516,14 @@ func TestDeleteVolume(t *testing.T) {
 			req: &csi.DeleteVolumeRequest{
 				VolumeId: testVolumeID + "/foo",
 			},
+			expErr:     true,
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "not a volume id",
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: "reallyfakevolumeid",
+			},
 			expErr: false,
 		},
 		{
@@ -866,6 +1546,26 @@ func TestDeleteVolume(t *testing.T) {
 			},
 			expErr: true,
 		},
+		{
+			name: "disk not found",
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: testVolumeID,
+			},
+		},
+		{
+			name: "disk still attached",
+			seedDisks: []*gce.CloudDisk{
+				gce.ZonalCloudDisk(&compute.Disk{
+					Name:  name,
+					Users: []string{"https://www.googleapis.com/compute/v1/projects/test-project/zones/country-region-zone/instances/node-1"},
+				}),
+			},
+			req: &csi.DeleteVolumeRequest{
+				VolumeId: testVolumeID,
+			},
+			expErr:     true,
+			expErrCode: codes.FailedPrecondition,
+		},
 	}
 	for _, tc := range testCases {
 		t.Logf("test case: %s", tc.name)
@@ -879,6 +1579,12 @@ func TestDeleteVolume(t *testing.T) {
 		if err != nil && !tc.expErr {
 			t.Errorf("Did not expect error but got: %v", err)
 		}
+		if tc.expErrCode != codes.OK && status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if tc.expErrCode == codes.FailedPrecondition && !strings.Contains(err.Error(), "projects/test-project/zones/country-region-zone/instances/node-1") {
+			t.Errorf("Expected the error to list the attached instance, got: %v", err)
+		}
 
 		if err != nil {
 			continue
@@ -942,63 +1648,429 @@ func TestGetRequestCapacity(t *testing.T) {
 			expCap: MinimumVolumeSizeInBytes,
 		},
 		{
-			name: "success: fully specified both above min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: common.GbToBytes(20),
-				LimitBytes:    common.GbToBytes(50),
-			},
-			expCap: common.GbToBytes(20),
+			name: "success: fully specified both above min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: common.GbToBytes(20),
+				LimitBytes:    common.GbToBytes(50),
+			},
+			expCap: common.GbToBytes(20),
+		},
+		{
+			name: "success: fully specified required below min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: MinimumVolumeSizeInBytes - 1,
+				LimitBytes:    common.GbToBytes(50),
+			},
+			expCap: MinimumVolumeSizeInBytes,
+		},
+		{
+			name: "success: fully specified both below min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: MinimumVolumeSizeInBytes - 2,
+				LimitBytes:    MinimumVolumeSizeInBytes - 1,
+			},
+			expErr: true,
+		},
+		{
+			name: "fail: limit less than required",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: common.GbToBytes(50),
+				LimitBytes:    common.GbToBytes(20),
+			},
+			expErr: true,
+		},
+		{
+			name: "fail: limit less than required below min",
+			capRange: &csi.CapacityRange{
+				RequiredBytes: MinimumVolumeSizeInBytes - 2,
+				LimitBytes:    MinimumVolumeSizeInBytes - 3,
+			},
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		gotCap, err := getRequestCapacity(tc.capRange)
+		if err == nil && tc.expErr {
+			t.Fatalf("Expected error but got none")
+		}
+		if err != nil && !tc.expErr {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if gotCap != tc.expCap {
+			t.Fatalf("Got capacity: %v, expected: %v", gotCap, tc.expCap)
+		}
+	}
+}
+
+func TestGetDiskEncryptionKey(t *testing.T) {
+	testCases := []struct {
+		name    string
+		kmsKey  string
+		secrets map[string]string
+		expKey  *computebeta.CustomerEncryptionKey
+		expErr  bool
+	}{
+		{
+			name: "no key",
+		},
+		{
+			name:   "kms key",
+			kmsKey: "kms-key",
+			expKey: &computebeta.CustomerEncryptionKey{KmsKeyName: "kms-key"},
+		},
+		{
+			name:    "raw key",
+			secrets: map[string]string{common.SecretKeyDiskEncryptionRawKey: "raw-key"},
+			expKey:  &computebeta.CustomerEncryptionKey{RawKey: "raw-key"},
+		},
+		{
+			name:    "rsa encrypted key",
+			secrets: map[string]string{common.SecretKeyDiskEncryptionRsaEncryptedKey: "rsa-key"},
+			expKey:  &computebeta.CustomerEncryptionKey{RsaEncryptedKey: "rsa-key"},
+		},
+		{
+			name:    "unrelated secrets ignored",
+			secrets: map[string]string{"other": "value"},
+		},
+		{
+			name: "fail: raw and rsa encrypted key",
+			secrets: map[string]string{
+				common.SecretKeyDiskEncryptionRawKey:          "raw-key",
+				common.SecretKeyDiskEncryptionRsaEncryptedKey: "rsa-key",
+			},
+			expErr: true,
+		},
+		{
+			name:    "fail: kms and raw key",
+			kmsKey:  "kms-key",
+			secrets: map[string]string{common.SecretKeyDiskEncryptionRawKey: "raw-key"},
+			expErr:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+
+		key, err := getDiskEncryptionKey(tc.kmsKey, tc.secrets)
+		if err == nil && tc.expErr {
+			t.Fatalf("Expected error but got none")
+		}
+		if err != nil && !tc.expErr {
+			t.Fatalf("Did not expect error but got: %v", err)
+		}
+
+		if !reflect.DeepEqual(key, tc.expKey) {
+			t.Fatalf("Got key: %v, expected: %v", key, tc.expKey)
+		}
+	}
+}
+
+func TestControllerPublishUnpublishMissingInstance(t *testing.T) {
+	gceDriver := initGCEDriver(t, []*gce.CloudDisk{createZonalCloudDisk(name)})
+	nodeID := common.CreateNodeID(project, zone, "missing-instance")
+
+	_, err := gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         testVolumeID,
+		NodeId:           nodeID,
+		VolumeCapability: stdVolCap,
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("ControllerPublishVolume expected error code %v, got: %v. err : %v", codes.NotFound, status.Code(err), err)
+	}
+
+	_, err = gceDriver.cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: testVolumeID,
+		NodeId:   nodeID,
+	})
+	if err != nil {
+		t.Errorf("ControllerUnpublishVolume did not expect error, but got %v", err)
+	}
+}
+
+// instanceCountingCloudProvider counts the instances gotten from the cloud
+type instanceCountingCloudProvider struct {
+	*gce.FakeCloudProvider
+	instanceGets int
+}
+
+func (cloud *instanceCountingCloudProvider) GetInstanceOrError(ctx context.Context, instanceZone, instanceName string) (*gce.CloudInstance, error) {
+	cloud.instanceGets++
+	return cloud.FakeCloudProvider.GetInstanceOrError(ctx, instanceZone, instanceName)
+}
+
+func TestControllerPublishUnpublishInstanceCache(t *testing.T) {
+	fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createZonalCloudDisk("disk-1"), createZonalCloudDisk("disk-2")})
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	fakeCloudProvider.InsertInstance(&compute.Instance{Name: node}, zone, node)
+	cloudProvider := &instanceCountingCloudProvider{FakeCloudProvider: fakeCloudProvider}
+	gceDriver := initGCEDriverWithCloudProvider(t, cloudProvider)
+	nodeID := common.CreateNodeID(project, zone, node)
+	volumeID := func(disk string) string {
+		return fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, disk)
+	}
+
+	testCases := []struct {
+		name            string
+		publish         bool
+		disk            string
+		expInstanceGets int
+	}{
+		{
+			name:            "publish",
+			publish:         true,
+			disk:            "disk-1",
+			expInstanceGets: 1,
+		},
+		{
+			name:            "publish another disk to the same node",
+			publish:         true,
+			disk:            "disk-2",
+			expInstanceGets: 1,
+		},
+		{
+			name:            "publish a published disk again",
+			publish:         true,
+			disk:            "disk-1",
+			expInstanceGets: 2,
+		},
+		{
+			name:            "unpublish",
+			disk:            "disk-2",
+			expInstanceGets: 2,
+		},
+		{
+			name:            "unpublish an unpublished disk",
+			disk:            "disk-2",
+			expInstanceGets: 3,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		if tc.publish {
+			_, err = gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId:         volumeID(tc.disk),
+				NodeId:           nodeID,
+				VolumeCapability: stdVolCap,
+			})
+		} else {
+			_, err = gceDriver.cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+				VolumeId: volumeID(tc.disk),
+				NodeId:   nodeID,
+			})
+		}
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if cloudProvider.instanceGets != tc.expInstanceGets {
+			t.Errorf("Expected %d instance gets, got: %d", tc.expInstanceGets, cloudProvider.instanceGets)
+		}
+	}
+	instance, err := fakeCloudProvider.GetInstanceOrError(context.Background(), zone, node)
+	if err != nil {
+		t.Fatalf("Failed to get instance: %v", err)
+	}
+	if len(instance.Disks) != 1 || instance.Disks[0].DeviceName != "disk-1" {
+		t.Errorf("Expected only disk-1 attached, got: %+v", instance.Disks)
+	}
+}
+
+func TestControllerPublishReadOnly(t *testing.T) {
+	readOnlyVolCap := &csi.VolumeCapability{
+		AccessType: stdVolCap.AccessType,
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		},
+	}
+	testCases := []struct {
+		name              string
+		volumeCap         *csi.VolumeCapability
+		readOnly          bool
+		expMode           string
+		expPublishContext map[string]string
+	}{
+		{
+			name:      "read write",
+			volumeCap: stdVolCap,
+			expMode:   "READ_WRITE",
+		},
+		{
+			name:              "read only publish",
+			volumeCap:         stdVolCap,
+			readOnly:          true,
+			expMode:           "READ_ONLY",
+			expPublishContext: map[string]string{common.PublishContextKeyReadOnly: "true"},
+		},
+		{
+			name:              "read only access mode",
+			volumeCap:         readOnlyVolCap,
+			expMode:           "READ_ONLY",
+			expPublishContext: map[string]string{common.PublishContextKeyReadOnly: "true"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, []*gce.CloudDisk{createZonalCloudDisk(name)})
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
+		}
+		instances := []string{"node-1", "node-2"}
+		for _, instance := range instances {
+			fakeCloudProvider.InsertInstance(&compute.Instance{Name: instance}, zone, instance)
+		}
+		gceDriver := initGCEDriverWithCloudProvider(t, fakeCloudProvider)
+
+		// Disks attached read only can be attached to multiple instances
+		published := instances
+		if tc.expMode == "READ_WRITE" {
+			published = instances[:1]
+		}
+		for _, instance := range published {
+			resp, err := gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId:         testVolumeID,
+				NodeId:           common.CreateNodeID(project, zone, instance),
+				VolumeCapability: tc.volumeCap,
+				Readonly:         tc.readOnly,
+			})
+			if err != nil {
+				t.Errorf("Unexpected error publishing to %s: %v", instance, err)
+				continue
+			}
+			if !reflect.DeepEqual(resp.GetPublishContext(), tc.expPublishContext) {
+				t.Errorf("Expected publish context %v, got: %v", tc.expPublishContext, resp.GetPublishContext())
+			}
+			attached, err := fakeCloudProvider.GetInstanceOrError(context.Background(), zone, instance)
+			if err != nil {
+				t.Fatalf("Failed to get instance: %v", err)
+			}
+			if len(attached.Disks) != 1 || attached.Disks[0].Mode != tc.expMode {
+				t.Errorf("Expected the disk attached to %s in mode %s, got: %+v", instance, tc.expMode, attached.Disks)
+			}
+		}
+	}
+}
+
+func TestCloudErrorCode(t *testing.T) {
+	testCases := []struct {
+		name    string
+		err     error
+		expCode codes.Code
+	}{
+		{
+			name:    "unknown error",
+			err:     fmt.Errorf("quota exceeded"),
+			expCode: codes.Internal,
+		},
+		{
+			name:    "quota exceeded",
+			err:     gce.WrapError(&gce.OperationError{Name: "op", Code: "QUOTA_EXCEEDED", Message: "Quota 'SSD_TOTAL_GB' exceeded"}, "failed to insert zonal disk"),
+			expCode: codes.ResourceExhausted,
+		},
+		{
+			name:    "operation timeout",
+			err:     gce.WrapError(&gce.OperationTimeoutError{Name: "op", Timeout: time.Minute}, "failed to resize zonal volume"),
+			expCode: codes.DeadlineExceeded,
+		},
+		{
+			name:    "cancelled",
+			err:     gce.WrapError(gce.WrapError(context.Canceled, "waiting for op"), "failed to insert zonal disk"),
+			expCode: codes.Canceled,
+		},
+		{
+			name:    "deadline exceeded",
+			err:     gce.WrapError(context.DeadlineExceeded, "failed to attach disk"),
+			expCode: codes.DeadlineExceeded,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		if code := cloudErrorCode(tc.err, codes.Internal); code != tc.expCode {
+			t.Errorf("Expected code %v, got: %v", tc.expCode, code)
+		}
+	}
+}
+
+func TestControllerPublishConfidentialCompute(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		diskConfidential     bool
+		instanceConfidential bool
+		volumeContext        map[string]string
+		expErrCode           codes.Code
+	}{
+		{
+			name: "confidential compute not enabled",
 		},
 		{
-			name: "success: fully specified required below min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: MinimumVolumeSizeInBytes - 1,
-				LimitBytes:    common.GbToBytes(50),
-			},
-			expCap: MinimumVolumeSizeInBytes,
+			name:                 "confidential VM",
+			diskConfidential:     true,
+			instanceConfidential: true,
 		},
 		{
-			name: "success: fully specified both below min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: MinimumVolumeSizeInBytes - 2,
-				LimitBytes:    MinimumVolumeSizeInBytes - 1,
-			},
-			expErr: true,
+			name:             "not a confidential VM",
+			diskConfidential: true,
+			expErrCode:       codes.FailedPrecondition,
 		},
 		{
-			name: "fail: limit less than required",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: common.GbToBytes(50),
-				LimitBytes:    common.GbToBytes(20),
-			},
-			expErr: true,
+			name:             "volume context without confidential compute",
+			diskConfidential: true,
+			volumeContext:    map[string]string{},
+			expErrCode:       codes.FailedPrecondition,
 		},
 		{
-			name: "fail: limit less than required below min",
-			capRange: &csi.CapacityRange{
-				RequiredBytes: MinimumVolumeSizeInBytes - 2,
-				LimitBytes:    MinimumVolumeSizeInBytes - 3,
-			},
-			expErr: true,
+			name:          "volume context with confidential compute",
+			volumeContext: map[string]string{common.VolumeAttributeEnableConfidentialCompute: "true"},
 		},
 	}
 	for _, tc := range testCases {
 		t.Logf("test case: %s", tc.name)
-
-		gotCap, err := getRequestCapacity(tc.capRange)
-		if err == nil && tc.expErr {
-			t.Fatalf("Expected error but got none")
-		}
-		if err != nil && !tc.expErr {
-			t.Fatalf("Did not expect error but got: %v", err)
+		fakeCloudProvider, err := gce.CreateFakeCloudProvider(project, zone, nil)
+		if err != nil {
+			t.Fatalf("Failed to create fake cloud provider: %v", err)
 		}
+		fakeCloudProvider.InsertInstance(&compute.Instance{Name: node}, zone, node)
+		fakeCloudProvider.SetConfidentialCompute(node, tc.instanceConfidential)
+		cloudProvider := &instanceCountingCloudProvider{FakeCloudProvider: fakeCloudProvider}
+		gceDriver := initGCEDriverWithCloudProvider(t, cloudProvider)
 
+		params := map[string]string{common.ParameterKeyType: "hyperdisk-balanced"}
+		if tc.diskConfidential {
+			params[common.ParameterKeyEnableConfidentialCompute] = "true"
+		}
+		createResp, err := gceDriver.cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         params,
+		})
 		if err != nil {
-			continue
+			t.Fatalf("Failed to create volume: %v", err)
+		}
+		volumeContext := createResp.GetVolume().GetVolumeContext()
+		if tc.volumeContext != nil {
+			volumeContext = tc.volumeContext
 		}
 
-		if gotCap != tc.expCap {
-			t.Fatalf("Got capacity: %v, expected: %v", gotCap, tc.expCap)
+		_, err = gceDriver.cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         createResp.GetVolume().GetVolumeId(),
+			NodeId:           common.CreateNodeID(project, zone, node),
+			VolumeCapability: stdVolCap,
+			VolumeContext:    volumeContext,
+		})
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		// Confidential compute is validated on the instance looked up for
+		// the attach
+		if cloudProvider.instanceGets != 1 {
+			t.Errorf("Expected the instance to be gotten once, got: %d", cloudProvider.instanceGets)
 		}
 	}
 }
@@ -1340,6 +2412,305 @@ func TestPickZonesFromTopology(t *testing.T) {
 	}
 }
 
+func TestPickStoragePoolZone(t *testing.T) {
+	pools := map[string]string{
+		"us-central1-a": "projects/test-project/zones/us-central1-a/storagePools/pool-a",
+		"us-central1-c": "projects/test-project/zones/us-central1-c/storagePools/pool-c",
+	}
+	testCases := []struct {
+		name    string
+		top     *csi.TopologyRequirement
+		expZone string
+		expErr  bool
+	}{
+		{
+			name:    "no topology",
+			expZone: "us-central1-a",
+		},
+		{
+			name: "preferred zone with pool",
+			top: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{Segments: map[string]string{common.TopologyKeyZone: "us-central1-a"}},
+					{Segments: map[string]string{common.TopologyKeyZone: "us-central1-c"}},
+				},
+				Preferred: []*csi.Topology{
+					{Segments: map[string]string{common.TopologyKeyZone: "us-central1-c"}},
+				},
+			},
+			expZone: "us-central1-c",
+		},
+		{
+			name: "preferred zone without pool falls back to requisite",
+			top: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{Segments: map[string]string{common.TopologyKeyZone: "us-central1-b"}},
+					{Segments: map[string]string{common.TopologyKeyZone: "us-central1-c"}},
+				},
+				Preferred: []*csi.Topology{
+					{Segments: map[string]string{common.TopologyKeyZone: "us-central1-b"}},
+				},
+			},
+			expZone: "us-central1-c",
+		},
+		{
+			name: "no accessible zone with pool",
+			top: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{Segments: map[string]string{common.TopologyKeyZone: "us-central1-b"}},
+				},
+			},
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gotZone, err := pickStoragePoolZone(tc.top, pools)
+		if err != nil && !tc.expErr {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+		if err == nil && tc.expErr {
+			t.Errorf("Expected error but got none")
+		}
+		if gotZone != tc.expZone {
+			t.Errorf("Expected zone %q, got %q", tc.expZone, gotZone)
+		}
+	}
+}
+
+func TestCreateVolumeWithStoragePools(t *testing.T) {
+	pool := fmt.Sprintf("projects/%s/zones/%s/storagePools/test-pool", project, zone)
+	testCases := []struct {
+		name       string
+		params     map[string]string
+		expPool    string
+		expErrCode codes.Code
+	}{
+		{
+			name: "success with storage pool",
+			params: map[string]string{
+				common.ParameterKeyType:         "hyperdisk-balanced",
+				common.ParameterKeyStoragePools: pool,
+			},
+			expPool: pool,
+		},
+		{
+			name: "fail with non hyperdisk type",
+			params: map[string]string{
+				common.ParameterKeyType:         DiskTypeSSD,
+				common.ParameterKeyStoragePools: pool,
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail with regional disk",
+			params: map[string]string{
+				common.ParameterKeyType:            "hyperdisk-balanced",
+				common.ParameterKeyReplicationType: replicationTypeRegionalPD,
+				common.ParameterKeyStoragePools:    pool,
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "fail with invalid storage pool",
+			params: map[string]string{
+				common.ParameterKeyType:         "hyperdisk-balanced",
+				common.ParameterKeyStoragePools: "test-pool",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, nil)
+
+		req := &csi.CreateVolumeRequest{
+			Name:               name,
+			CapacityRange:      stdCapRange,
+			VolumeCapabilities: stdVolCaps,
+			Parameters:         tc.params,
+		}
+		_, err := gceDriver.cs.CreateVolume(context.Background(), req)
+		if status.Code(err) != tc.expErrCode {
+			t.Fatalf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if err != nil {
+			continue
+		}
+
+		fakeCloudProvider := gceDriver.cs.CloudProvider.(*gce.FakeCloudProvider)
+		if gotPool := fakeCloudProvider.GetStoragePool(meta.ZonalKey(name, zone)); gotPool != tc.expPool {
+			t.Errorf("Expected storage pool %q, got %q", tc.expPool, gotPool)
+		}
+	}
+}
+
+func TestPickLeastUtilizedZones(t *testing.T) {
+	secondZone := "country-region-fakesecondzone"
+	zonalDisk := func(name, diskZone string) *gce.CloudDisk {
+		return gce.ZonalCloudDisk(&compute.Disk{
+			Name: name,
+			Zone: diskZone,
+		})
+	}
+	testCases := []struct {
+		name          string
+		seedDisks     []*gce.CloudDisk
+		existingZones []string
+		numZones      int
+		expZones      []string
+		expErr        bool
+	}{
+		{
+			name:     "success with no disks",
+			numZones: 2,
+			expZones: []string{zone, secondZone},
+		},
+		{
+			name:      "success with zonal disk in controller zone",
+			seedDisks: []*gce.CloudDisk{zonalDisk("disk-1", zone)},
+			numZones:  2,
+			expZones:  []string{secondZone, zone},
+		},
+		{
+			name: "success with regional disk replicas",
+			seedDisks: []*gce.CloudDisk{
+				zonalDisk("disk-1", secondZone),
+				zonalDisk("disk-2", secondZone),
+				gce.RegionalCloudDisk(&computebeta.Disk{
+					Name:         "disk-3",
+					ReplicaZones: []string{fmt.Sprintf("projects/%s/zones/%s", project, zone), fmt.Sprintf("projects/%s/zones/%s", project, secondZone)},
+				}),
+			},
+			numZones: 2,
+			expZones: []string{zone, secondZone},
+		},
+		{
+			name:          "success with existing zone",
+			seedDisks:     []*gce.CloudDisk{zonalDisk("disk-1", zone)},
+			existingZones: []string{region + "-c"},
+			numZones:      2,
+			expZones:      []string{region + "-c", secondZone},
+		},
+		{
+			name:          "fail with not enough zones in region",
+			existingZones: []string{zone},
+			numZones:      3,
+			expErr:        true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, tc.seedDisks)
+
+		zones, err := pickLeastUtilizedZones(context.Background(), gceDriver.cs, tc.existingZones, tc.numZones)
+		if err != nil {
+			if !tc.expErr {
+				t.Errorf("got unexpected error: %v", err)
+			}
+			continue
+		}
+		if tc.expErr {
+			t.Errorf("expected error, got zones: %v", zones)
+			continue
+		}
+		if !reflect.DeepEqual(zones, tc.expZones) {
+			t.Errorf("expected zones: %v, got: %v", tc.expZones, zones)
+		}
+	}
+}
+
+func TestCreateVolumeWithZones(t *testing.T) {
+	zoneTopology := func(zones ...string) []*csi.Topology {
+		tops := []*csi.Topology{}
+		for _, z := range zones {
+			tops = append(tops, &csi.Topology{Segments: map[string]string{common.TopologyKeyZone: z}})
+		}
+		return tops
+	}
+	testCases := []struct {
+		name       string
+		params     map[string]string
+		top        *csi.TopologyRequirement
+		expZones   []string
+		expErrCode codes.Code
+	}{
+		{
+			name:     "success with zones and no topology",
+			params:   map[string]string{common.ParameterKeyZones: region + "-b"},
+			expZones: []string{region + "-b"},
+		},
+		{
+			name:   "success with zones constraining topology",
+			params: map[string]string{common.ParameterKeyZones: region + "-b," + region + "-c"},
+			top: &csi.TopologyRequirement{
+				Requisite: zoneTopology(region+"-a", region+"-c"),
+				Preferred: zoneTopology(region + "-a"),
+			},
+			expZones: []string{region + "-c"},
+		},
+		{
+			name:   "fail with no zones satisfying topology",
+			params: map[string]string{common.ParameterKeyZones: region + "-b"},
+			top: &csi.TopologyRequirement{
+				Requisite: zoneTopology(region + "-a"),
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name:       "fail with empty zone",
+			params:     map[string]string{common.ParameterKeyZones: region + "-b,"},
+			expErrCode: codes.InvalidArgument,
+		},
+		{
+			name: "success with zones for repd",
+			params: map[string]string{
+				common.ParameterKeyReplicationType: replicationTypeRegionalPD,
+				common.ParameterKeyZones:           region + "-b," + region + "-c",
+			},
+			top: &csi.TopologyRequirement{
+				Requisite: zoneTopology(region+"-a", region+"-c"),
+			},
+			expZones: []string{region + "-b", region + "-c"},
+		},
+		{
+			name: "fail with single zone for repd",
+			params: map[string]string{
+				common.ParameterKeyReplicationType: replicationTypeRegionalPD,
+				common.ParameterKeyZones:           region + "-b",
+			},
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, nil)
+
+		req := &csi.CreateVolumeRequest{
+			Name:                      name,
+			CapacityRange:             stdCapRange,
+			VolumeCapabilities:        stdVolCaps,
+			Parameters:                tc.params,
+			AccessibilityRequirements: tc.top,
+		}
+		resp, err := gceDriver.cs.CreateVolume(context.Background(), req)
+		if status.Code(err) != tc.expErrCode {
+			t.Fatalf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if err != nil {
+			continue
+		}
+
+		zones := sets.NewString()
+		for _, top := range resp.GetVolume().GetAccessibleTopology() {
+			zones.Insert(top.GetSegments()[common.TopologyKeyZone])
+		}
+		if !zones.Equal(sets.NewString(tc.expZones...)) {
+			t.Errorf("Expected zones: %v, got: %v", tc.expZones, zones.List())
+		}
+	}
+}
+
 func TestPickRandAndConsecutive(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
 	testCases := []struct {
@@ -1480,3 +2851,107 @@ func TestVolumeOperationConcurrency(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
+
+func TestVolumeLifecycleWithFakeComputeServer(t *testing.T) {
+	server := gce.NewFakeComputeServer(project, map[string][]string{
+		region: {zone, metadataservice.FakeSecondZone},
+	})
+	defer server.Close()
+	cloudProvider, err := server.CloudProvider()
+	if err != nil {
+		t.Fatalf("Failed to create cloud provider: %v", err)
+	}
+	cs := initGCEDriverWithCloudProvider(t, cloudProvider).cs
+	ctx := context.Background()
+
+	createResp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: stdVolCaps,
+		Parameters:         stdParams,
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: stdTopology,
+			Preferred: stdTopology,
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume got unexpected error: %v", err)
+	}
+	if createResp.Volume.VolumeId != testVolumeID {
+		t.Errorf("Expected volume ID %s, got: %s", testVolumeID, createResp.Volume.VolumeId)
+	}
+	if disk := server.GetDisk(zone, name); disk == nil || disk.SizeGb != 20 {
+		t.Errorf("Expected a disk of 20 GB, got: %+v", disk)
+	}
+
+	// The snapshot is uploading when it is created and ready once polled again
+	snapshotReq := &csi.CreateSnapshotRequest{
+		Name:           name,
+		SourceVolumeId: testVolumeID,
+	}
+	for _, expReady := range []bool{false, true} {
+		snapshotResp, err := cs.CreateSnapshot(ctx, snapshotReq)
+		if err != nil {
+			t.Fatalf("CreateSnapshot got unexpected error: %v", err)
+		}
+		if snapshotResp.Snapshot.SnapshotId != testSnapshotID || snapshotResp.Snapshot.ReadyToUse != expReady {
+			t.Errorf("Expected snapshot %s ready: %v, got: %+v", testSnapshotID, expReady, snapshotResp.Snapshot)
+		}
+	}
+
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               name + "-restored",
+		CapacityRange:      stdCapRange,
+		VolumeCapabilities: stdVolCaps,
+		Parameters:         stdParams,
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: stdTopology,
+		},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					SnapshotId: testSnapshotID,
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume from snapshot got unexpected error: %v", err)
+	}
+	if disk := server.GetDisk(zone, name+"-restored"); disk == nil || !strings.HasSuffix(disk.SourceSnapshot, testSnapshotID) {
+		t.Errorf("Expected a disk restored from %s, got: %+v", testSnapshotID, disk)
+	}
+
+	expandResp, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      testVolumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: common.GbToBytes(30)},
+	})
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume got unexpected error: %v", err)
+	}
+	if expandResp.CapacityBytes != common.GbToBytes(30) || server.GetDisk(zone, name).SizeGb != 30 {
+		t.Errorf("Expected the disk expanded to 30 GB, got: %d bytes", expandResp.CapacityBytes)
+	}
+
+	_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         testVolumeID,
+		NodeId:           fmt.Sprintf("projects/%s/zones/%s/instances/%s", project, zone, node),
+		VolumeCapability: stdVolCap,
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound publishing to a missing instance, got: %v", err)
+	}
+
+	if _, err := cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: testSnapshotID}); err != nil {
+		t.Fatalf("DeleteSnapshot got unexpected error: %v", err)
+	}
+	for _, diskName := range []string{name, name + "-restored"} {
+		volumeID := fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, diskName)
+		if _, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID}); err != nil {
+			t.Fatalf("DeleteVolume got unexpected error: %v", err)
+		}
+		if disk := server.GetDisk(zone, diskName); disk != nil {
+			t.Errorf("Expected disk %s deleted, got: %+v", diskName, disk)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"path/filepath"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+type deviceCacheKey struct {
+	volumeID  string
+	partition string
+}
+
+type deviceCacheEntry struct {
+	// devicePath is the verified /dev/disk/by-id path of the volume
+	devicePath string
+	// device is the device the path resolved to when it was verified
+	device string
+}
+
+// deviceCache caches the verified device paths of volumes, so that repeated
+// lookups don't refresh the devices with udevadm. A cached path is only
+// returned while it still resolves to the same device, so entries are
+// invalidated when udev removes or relinks the path, e.g. after a detach.
+type deviceCache struct {
+	mux     sync.Mutex
+	entries map[deviceCacheKey]deviceCacheEntry
+	// evalSymlinks resolves a device path, replaced in tests
+	evalSymlinks func(path string) (string, error)
+}
+
+func newDeviceCache() *deviceCache {
+	return &deviceCache{
+		entries:      map[deviceCacheKey]deviceCacheEntry{},
+		evalSymlinks: filepath.EvalSymlinks,
+	}
+}
+
+// get returns the cached device path of the volume partition, if the path
+// still resolves to the device it was verified for
+func (c *deviceCache) get(volumeID, partition string) (string, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	key := deviceCacheKey{volumeID: volumeID, partition: partition}
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	device, err := c.evalSymlinks(entry.devicePath)
+	if err != nil || device != entry.device {
+		klog.V(4).Infof("Cached device path %s of volume %s no longer resolves to %s, invalidating", entry.devicePath, volumeID, entry.device)
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.devicePath, true
+}
+
+// add caches the verified device path of the volume partition. Paths that
+// cannot be resolved are not cached.
+func (c *deviceCache) add(volumeID, partition, devicePath string) {
+	device, err := c.evalSymlinks(devicePath)
+	if err != nil {
+		klog.V(5).Infof("Not caching device path %s of volume %s: %v", devicePath, volumeID, err)
+		return
+	}
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.entries[deviceCacheKey{volumeID: volumeID, partition: partition}] = deviceCacheEntry{
+		devicePath: devicePath,
+		device:     device,
+	}
+}
+
+// remove invalidates the device paths of all partitions of the volume
+func (c *deviceCache) remove(volumeID string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for key := range c.entries {
+		if key.volumeID == volumeID {
+			delete(c.entries, key)
+		}
+	}
+}
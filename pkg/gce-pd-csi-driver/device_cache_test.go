@@ -0,0 +1,101 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeviceCache(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "device-cache-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, device := range []string{"sda", "sdb"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, device), nil, 0600); err != nil {
+			t.Fatalf("Failed to create device %s: %v", device, err)
+		}
+	}
+	link := func(devicePath, device string) {
+		os.Remove(devicePath)
+		if err := os.Symlink(filepath.Join(tmpDir, device), devicePath); err != nil {
+			t.Fatalf("Failed to link %s to %s: %v", devicePath, device, err)
+		}
+	}
+	devicePath := filepath.Join(tmpDir, "google-disk")
+
+	testCases := []struct {
+		name string
+		// setup runs after the device path was added to the cache
+		setup     func(c *deviceCache)
+		partition string
+		expCached bool
+	}{
+		{
+			name:      "cached path",
+			expCached: true,
+		},
+		{
+			name:      "other partition",
+			partition: "1",
+		},
+		{
+			name:  "path removed",
+			setup: func(c *deviceCache) { os.Remove(devicePath) },
+		},
+		{
+			name:  "path relinked to other device",
+			setup: func(c *deviceCache) { link(devicePath, "sdb") },
+		},
+		{
+			name:  "volume removed",
+			setup: func(c *deviceCache) { c.remove(testVolumeID) },
+		},
+		{
+			name:      "other volume removed",
+			setup:     func(c *deviceCache) { c.remove(testVolumeID + "-other") },
+			expCached: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		link(devicePath, "sda")
+		c := newDeviceCache()
+		c.add(testVolumeID, "", devicePath)
+		if tc.setup != nil {
+			tc.setup(c)
+		}
+
+		path, cached := c.get(testVolumeID, tc.partition)
+		if cached != tc.expCached {
+			t.Errorf("Expected cached: %v, got: %v", tc.expCached, cached)
+		}
+		if cached && path != devicePath {
+			t.Errorf("Expected cached path %s, got: %s", devicePath, path)
+		}
+	}
+}
+
+func TestDeviceCacheSkipsUnresolvablePaths(t *testing.T) {
+	c := newDeviceCache()
+	c.add(testVolumeID, "", "/dev/disk/does-not-exist")
+	if path, cached := c.get(testVolumeID, ""); cached {
+		t.Errorf("Expected unresolvable path not to be cached, got: %s", path)
+	}
+}
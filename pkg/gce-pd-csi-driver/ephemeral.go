@@ -0,0 +1,315 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+const (
+	// Key of the volume context of NodePublishVolume set by the kubelet for
+	// CSI ephemeral inline volumes
+	volumeContextKeyEphemeral = "csi.storage.k8s.io/ephemeral"
+	// Prefix of the volume context keys set by the kubelet, e.g. the pod
+	// info of podInfoOnMount
+	volumeContextKubeletPrefix = "csi.storage.k8s.io/"
+
+	// Attributes of ephemeral inline volumes, besides common.ParameterKeyType
+	ephemeralAttributeSize = "size"
+
+	defaultEphemeralSizeBytes int64 = 10 * 1024 * 1024 * 1024
+	// Prefix of the names of the disks of ephemeral inline volumes. The
+	// volume IDs generated by the kubelet are too long for disk names, the
+	// names are derived from their hash instead.
+	ephemeralDiskNamePrefix = "ephemeral-"
+	ephemeralDiskHashLength = 40
+
+	// Description key of the disks of ephemeral inline volumes
+	diskDescriptionKeyEphemeralVolumeID = "storage.gke.io/ephemeral-volume-id"
+
+	// Suffix of the marker file written next to the target path of a
+	// published ephemeral inline volume
+	ephemeralMarkerSuffix = ".gce-pd-ephemeral.json"
+)
+
+// ephemeralMarker records that the volume published at a target path is an
+// ephemeral inline volume, and which disk it owns. Only the disks recorded by
+// markers are deleted when volumes are unpublished.
+type ephemeralMarker struct {
+	VolumeID     string `json:"volumeID"`
+	DiskVolumeID string `json:"diskVolumeID"`
+}
+
+func ephemeralMarkerPath(targetPath string) string {
+	return strings.TrimSuffix(targetPath, "/") + ephemeralMarkerSuffix
+}
+
+func writeEphemeralMarker(targetPath string, marker *ephemeralMarker) error {
+	b, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(ephemeralMarkerPath(targetPath), b, 0600)
+}
+
+// readEphemeralMarker returns the marker of the ephemeral inline volume
+// published at the target path, or nil if the volume is not ephemeral
+func readEphemeralMarker(targetPath string) (*ephemeralMarker, error) {
+	b, err := ioutil.ReadFile(ephemeralMarkerPath(targetPath))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	marker := &ephemeralMarker{}
+	if err := json.Unmarshal(b, marker); err != nil {
+		return nil, fmt.Errorf("invalid ephemeral volume marker %s: %v", ephemeralMarkerPath(targetPath), err)
+	}
+	return marker, nil
+}
+
+func isEphemeralVolume(volumeContext map[string]string) bool {
+	return volumeContext[volumeContextKeyEphemeral] == "true"
+}
+
+// ephemeralDiskKey returns the key of the disk of the ephemeral inline
+// volume, which is created in the zone of the node
+func (ns *GCENodeServer) ephemeralDiskKey(volumeID string) *meta.Key {
+	hash := sha256.Sum256([]byte(volumeID))
+	name := ephemeralDiskNamePrefix + hex.EncodeToString(hash[:])[:ephemeralDiskHashLength]
+	return meta.ZonalKey(name, ns.MetadataService.GetZone())
+}
+
+// parseEphemeralSize parses sizes of the form "{n}Gi" or "{n}Ti"
+func parseEphemeralSize(size string) (int64, error) {
+	units := map[string]int64{"Gi": 1024 * 1024 * 1024, "Ti": 1024 * 1024 * 1024 * 1024}
+	for suffix, unit := range units {
+		if !strings.HasSuffix(size, suffix) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(size, suffix), 10, 64)
+		if err != nil || n <= 0 || n > MaxVolumeSizeInBytes/unit {
+			return 0, fmt.Errorf("invalid size %q", size)
+		}
+		return n * unit, nil
+	}
+	return 0, fmt.Errorf("invalid size %q, expected a number of Gi or Ti", size)
+}
+
+// publishEphemeralVolume creates the disk of the ephemeral inline volume,
+// attaches it to the instance of the node and mounts it at the target path.
+// The volume is not staged.
+func (ns *GCENodeServer) publishEphemeralVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	targetPath := req.GetTargetPath()
+	if ns.CloudProvider == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume ephemeral inline volumes are not enabled on this node")
+	}
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Target Path must be provided")
+	}
+	mnt := req.GetVolumeCapability().GetMount()
+	if mnt == nil {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume ephemeral inline volumes must have the mount access type")
+	}
+
+	diskType := DiskTypeStandard
+	sizeBytes := defaultEphemeralSizeBytes
+	for k, v := range req.GetVolumeContext() {
+		switch strings.ToLower(k) {
+		case common.ParameterKeyType:
+			diskType = v
+		case ephemeralAttributeSize:
+			var err error
+			if sizeBytes, err = parseEphemeralSize(v); err != nil {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume invalid ephemeral volume attribute %q: %v", k, err))
+			}
+		default:
+			if !strings.HasPrefix(k, volumeContextKubeletPrefix) {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume invalid ephemeral volume attribute %q", k))
+			}
+		}
+	}
+
+	if acquired := ns.volumeLocks.TryAcquire(volumeID); !acquired {
+		return nil, status.Errorf(codes.Aborted, common.VolumeOperationAlreadyExistsFmt, volumeID)
+	}
+	defer ns.volumeLocks.Release(volumeID)
+
+	notMnt, err := ns.Mounter.Interface.IsLikelyNotMountPoint(targetPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume failed to check whether target path %s is a mount point: %v", targetPath, err))
+	}
+	if err == nil && !notMnt {
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	volKey := ns.ephemeralDiskKey(volumeID)
+	description, err := ns.ephemeralDiskDescription(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume failed to generate disk description: %v", err))
+	}
+	diskVolumeID, err := common.KeyToVolumeID(volKey, ns.MetadataService.GetProject())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	// The marker is written before the disk is created, so that the disk is
+	// deleted even if publishing fails halfway
+	if err := writeEphemeralMarker(targetPath, &ephemeralMarker{VolumeID: volumeID, DiskVolumeID: diskVolumeID}); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodePublishVolume failed to record ephemeral volume %s: %v", volumeID, err))
+	}
+	capacityRange := &csi.CapacityRange{RequiredBytes: sizeBytes}
+	if err := ns.CloudProvider.InsertDisk(ctx, volKey, diskType, sizeBytes, capacityRange, nil, "", "", description, nil, false, ""); err != nil {
+		return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("NodePublishVolume failed to create disk %s of ephemeral volume %s: %v", volKey.Name, volumeID, err))
+	}
+	if err := ns.attachEphemeralDisk(ctx, volKey); err != nil {
+		return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("NodePublishVolume failed to attach disk %s of ephemeral volume %s: %v", volKey.Name, volumeID, err))
+	}
+
+	devicePath, err := ns.getDevicePath(ctx, diskVolumeID, "")
+	if err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Error when getting device path: %v", err))
+	}
+
+	fstype := mnt.FsType
+	if fstype == "" {
+		fstype = "ext4"
+	}
+	options := append([]string{}, mnt.MountFlags...)
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+	if err := ns.Mounter.Interface.MakeDir(targetPath); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to create directory (%q): %v", targetPath, err))
+	}
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	// The disk is left attached if mounting fails, the CO retries the
+	// publish or unpublishes the volume, which deletes the disk
+	if err := ns.Mounter.FormatAndMount(devicePath, targetPath, fstype, options); err != nil {
+		return nil, status.Error(codes.Internal,
+			fmt.Sprintf("Failed to format and mount device from (%q) to (%q) with fstype (%q) and options (%q): %v",
+				devicePath, targetPath, fstype, options, err))
+	}
+	klog.V(4).Infof("Published ephemeral volume %s on disk %s at %s", volumeID, volKey.Name, targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// attachEphemeralDisk attaches the disk to the instance of the node, unless
+// it is already attached
+func (ns *GCENodeServer) attachEphemeralDisk(ctx context.Context, volKey *meta.Key) error {
+	zone, name := ns.MetadataService.GetZone(), ns.MetadataService.GetName()
+	attached, err := ns.ephemeralDiskAttached(ctx, volKey)
+	if err != nil || attached {
+		return err
+	}
+	if err := ns.CloudProvider.AttachDisk(ctx, volKey, "READ_WRITE", attachableDiskTypePersistent, zone, name, nil); err != nil {
+		return err
+	}
+	return ns.CloudProvider.WaitForAttach(ctx, volKey, zone, name)
+}
+
+func (ns *GCENodeServer) ephemeralDiskAttached(ctx context.Context, volKey *meta.Key) (bool, error) {
+	instance, err := ns.CloudProvider.GetInstanceOrError(ctx, ns.MetadataService.GetZone(), ns.MetadataService.GetName())
+	if err != nil {
+		return false, err
+	}
+	for _, disk := range instance.Disks {
+		if disk.DeviceName == volKey.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// unpublishEphemeralVolume deletes the disk recorded by the marker of the
+// unmounted ephemeral inline volume, then the marker. Volumes without a
+// marker are not ephemeral and are left alone.
+func (ns *GCENodeServer) unpublishEphemeralVolume(ctx context.Context, volumeID, targetPath string) error {
+	marker, err := readEphemeralMarker(targetPath)
+	if err != nil || marker == nil {
+		return err
+	}
+	if marker.VolumeID != volumeID {
+		return fmt.Errorf("marker %s records ephemeral volume %s", ephemeralMarkerPath(targetPath), marker.VolumeID)
+	}
+	if ns.CloudProvider == nil {
+		return fmt.Errorf("ephemeral inline volumes are not enabled on this node")
+	}
+	volKey, err := common.VolumeIDToKey(marker.DiskVolumeID)
+	if err != nil {
+		return fmt.Errorf("marker %s records invalid disk: %v", ephemeralMarkerPath(targetPath), err)
+	}
+	if err := ns.deleteEphemeralDisk(ctx, volumeID, marker.DiskVolumeID, volKey); err != nil {
+		return err
+	}
+	if err := os.Remove(ephemeralMarkerPath(targetPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// deleteEphemeralDisk detaches the disk of the unmounted ephemeral inline
+// volume from the instance of the node and deletes it
+func (ns *GCENodeServer) deleteEphemeralDisk(ctx context.Context, volumeID, diskVolumeID string, volKey *meta.Key) error {
+	attached, err := ns.ephemeralDiskAttached(ctx, volKey)
+	if err != nil {
+		return err
+	}
+	if attached {
+		if err := ns.CloudProvider.DetachDisk(ctx, volKey.Name, ns.MetadataService.GetZone(), ns.MetadataService.GetName()); err != nil {
+			return fmt.Errorf("failed to detach disk %s: %v", volKey.Name, err)
+		}
+	}
+	ns.deviceCache.remove(diskVolumeID)
+	if err := ns.CloudProvider.DeleteDisk(ctx, volKey); err != nil && !gce.IsGCEDiskNotFound(err) {
+		return fmt.Errorf("failed to delete disk %s: %v", volKey.Name, err)
+	}
+	klog.V(4).Infof("Deleted disk %s of ephemeral volume %s", volKey.Name, volumeID)
+	return nil
+}
+
+// ephemeralDiskDescription returns the JSON description of the disk of an
+// ephemeral inline volume
+func (ns *GCENodeServer) ephemeralDiskDescription(volumeID string) (string, error) {
+	b, err := json.Marshal(map[string]string{
+		common.DiskDescriptionKeyCreatedBy:     ns.Driver.name,
+		common.DiskDescriptionKeyDriverVersion: ns.Driver.vendorVersion,
+		diskDescriptionKeyEphemeralVolumeID:    volumeID,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -0,0 +1,264 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
+	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
+)
+
+const ephemeralVolumeID = "csi-8e1a5b4c2f0d47b6a7e3c9d1f2b3a4c5d6e7f8091a2b3c4d5e6f708192a3b4c5"
+
+func TestParseEphemeralSize(t *testing.T) {
+	testCases := []struct {
+		size     string
+		expBytes int64
+		expErr   bool
+	}{
+		{size: "10Gi", expBytes: 10 * 1024 * 1024 * 1024},
+		{size: "1Ti", expBytes: 1024 * 1024 * 1024 * 1024},
+		{size: "10", expErr: true},
+		{size: "10G", expErr: true},
+		{size: "0Gi", expErr: true},
+		{size: "-1Gi", expErr: true},
+		{size: "1.5Gi", expErr: true},
+		{size: "65Ti", expErr: true},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.size)
+		bytes, err := parseEphemeralSize(tc.size)
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+		if err == nil && bytes != tc.expBytes {
+			t.Errorf("Expected %d bytes, got: %d", tc.expBytes, bytes)
+		}
+	}
+}
+
+func newEphemeralTestDriver(t *testing.T, fakeMounter *mount.FakeMounter) (*GCEDriver, *gce.FakeCloudProvider) {
+	cloudProvider, err := gce.CreateFakeCloudProvider(metadataservice.FakeProject, metadataservice.FakeZone, nil)
+	if err != nil {
+		t.Fatalf("Failed to create fake cloud provider: %v", err)
+	}
+	cloudProvider.InsertInstance(&compute.Instance{Name: "test-name"}, metadataservice.FakeZone, "test-name")
+	mounter := mountmanager.NewCustomFakeSafeMounter(fakeMounter, mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) { return nil, nil }))
+	gceDriver := getTestGCEDriverWithCustomMounter(t, mounter)
+	gceDriver.ns.CloudProvider = cloudProvider
+	return gceDriver, cloudProvider
+}
+
+func TestEphemeralVolumePublishUnpublish(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "ephemeral-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	targetPath := filepath.Join(tmpDir, "target")
+	if err := os.Mkdir(targetPath, 0750); err != nil {
+		t.Fatalf("Failed to create target path: %v", err)
+	}
+
+	fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+	gceDriver, cloudProvider := newEphemeralTestDriver(t, fakeMounter)
+	volKey := gceDriver.ns.ephemeralDiskKey(ephemeralVolumeID)
+	if len(volKey.Name) > 63 {
+		t.Errorf("Expected a disk name of at most 63 characters, got: %s", volKey.Name)
+	}
+
+	_, err = gceDriver.ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         ephemeralVolumeID,
+		TargetPath:       targetPath,
+		VolumeCapability: stdVolCap,
+		VolumeContext: map[string]string{
+			volumeContextKeyEphemeral:    "true",
+			volumeContextKeyPodName:      "pod",
+			volumeContextKeyPodNamespace: "ns",
+			"type":                       "pd-ssd",
+			"size":                       "20Gi",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error publishing the volume: %v", err)
+	}
+	disk, err := cloudProvider.GetDisk(context.Background(), volKey)
+	if err != nil {
+		t.Fatalf("Expected disk %s to be created, got: %v", volKey.Name, err)
+	}
+	if disk.GetSizeGb() != 20 || !strings.HasSuffix(disk.GetType(), "pd-ssd") {
+		t.Errorf("Expected a 20 GB pd-ssd disk, got: %d GB %s", disk.GetSizeGb(), disk.GetType())
+	}
+	description := map[string]string{}
+	if err := json.Unmarshal([]byte(disk.GetDescription()), &description); err != nil || description[diskDescriptionKeyEphemeralVolumeID] != ephemeralVolumeID {
+		t.Errorf("Expected the description to contain the volume ID, got: %s", disk.GetDescription())
+	}
+	if attached, err := gceDriver.ns.ephemeralDiskAttached(context.Background(), volKey); err != nil || !attached {
+		t.Errorf("Expected disk %s to be attached, got: %v, %v", volKey.Name, attached, err)
+	}
+	if len(fakeMounter.MountPoints) != 1 || fakeMounter.MountPoints[0].Path != targetPath || fakeMounter.MountPoints[0].Type != "ext4" {
+		t.Errorf("Expected the device mounted at %s, got mounts: %+v", targetPath, fakeMounter.MountPoints)
+	}
+	marker, err := readEphemeralMarker(targetPath)
+	if err != nil || marker == nil || marker.VolumeID != ephemeralVolumeID || !strings.HasSuffix(marker.DiskVolumeID, "/disks/"+volKey.Name) {
+		t.Errorf("Expected a marker recording disk %s, got: %+v, %v", volKey.Name, marker, err)
+	}
+
+	_, err = gceDriver.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   ephemeralVolumeID,
+		TargetPath: targetPath,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error unpublishing the volume: %v", err)
+	}
+	if len(fakeMounter.MountPoints) != 0 {
+		t.Errorf("Expected the device to be unmounted, got mounts: %+v", fakeMounter.MountPoints)
+	}
+	if attached, err := gceDriver.ns.ephemeralDiskAttached(context.Background(), volKey); err != nil || attached {
+		t.Errorf("Expected disk %s to be detached, got: %v, %v", volKey.Name, attached, err)
+	}
+	if _, err := cloudProvider.GetDisk(context.Background(), volKey); !gce.IsGCEDiskNotFound(err) {
+		t.Errorf("Expected disk %s to be deleted, got: %v", volKey.Name, err)
+	}
+	if _, err := os.Stat(ephemeralMarkerPath(targetPath)); !os.IsNotExist(err) {
+		t.Errorf("Expected the marker to be removed, got: %v", err)
+	}
+
+	// Unpublishing again succeeds without a disk
+	_, err = gceDriver.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   ephemeralVolumeID,
+		TargetPath: targetPath,
+	})
+	if err != nil {
+		t.Errorf("Unexpected error unpublishing the volume again: %v", err)
+	}
+}
+
+func TestUnpublishVolumeWithoutEphemeralMarker(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "ephemeral-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	targetPath := filepath.Join(tmpDir, "target")
+	if err := os.Mkdir(targetPath, 0750); err != nil {
+		t.Fatalf("Failed to create target path: %v", err)
+	}
+
+	fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+	gceDriver, cloudProvider := newEphemeralTestDriver(t, fakeMounter)
+	volKey := gceDriver.ns.ephemeralDiskKey(ephemeralVolumeID)
+	if err := cloudProvider.InsertDisk(context.Background(), volKey, DiskTypeStandard, defaultEphemeralSizeBytes, &csi.CapacityRange{}, nil, "", "", "", nil, false, ""); err != nil {
+		t.Fatalf("Failed to create disk: %v", err)
+	}
+
+	// Volume IDs that are not disk IDs do not make volumes ephemeral
+	_, err = gceDriver.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   ephemeralVolumeID,
+		TargetPath: targetPath,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error unpublishing the volume: %v", err)
+	}
+	if _, err := cloudProvider.GetDisk(context.Background(), volKey); err != nil {
+		t.Errorf("Expected disk %s not to be deleted, got: %v", volKey.Name, err)
+	}
+
+	// Markers of other volumes are rejected
+	if err := writeEphemeralMarker(targetPath, &ephemeralMarker{VolumeID: "other-volume", DiskVolumeID: "projects/" + metadataservice.FakeProject + "/zones/" + metadataservice.FakeZone + "/disks/" + volKey.Name}); err != nil {
+		t.Fatalf("Failed to write marker: %v", err)
+	}
+	_, err = gceDriver.ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   ephemeralVolumeID,
+		TargetPath: targetPath,
+	})
+	if status.Code(err) != codes.Internal {
+		t.Errorf("Expected error code: %v, got: %v. err : %v", codes.Internal, status.Code(err), err)
+	}
+	if _, err := cloudProvider.GetDisk(context.Background(), volKey); err != nil {
+		t.Errorf("Expected disk %s not to be deleted, got: %v", volKey.Name, err)
+	}
+}
+
+func TestEphemeralVolumePublishInvalid(t *testing.T) {
+	blockVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: stdVolCap.AccessMode,
+	}
+	testCases := []struct {
+		name          string
+		disabled      bool
+		volumeCap     *csi.VolumeCapability
+		volumeContext map[string]string
+	}{
+		{
+			name:      "ephemeral volumes disabled",
+			disabled:  true,
+			volumeCap: stdVolCap,
+		},
+		{
+			name:      "block volume",
+			volumeCap: blockVolCap,
+		},
+		{
+			name:          "invalid size",
+			volumeCap:     stdVolCap,
+			volumeContext: map[string]string{"size": "10GB"},
+		},
+		{
+			name:          "unknown attribute",
+			volumeCap:     stdVolCap,
+			volumeContext: map[string]string{"replication-type": "regional-pd"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+		gceDriver, _ := newEphemeralTestDriver(t, fakeMounter)
+		if tc.disabled {
+			gceDriver.ns.CloudProvider = nil
+		}
+		volumeContext := map[string]string{volumeContextKeyEphemeral: "true"}
+		for k, v := range tc.volumeContext {
+			volumeContext[k] = v
+		}
+
+		_, err := gceDriver.ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+			VolumeId:         ephemeralVolumeID,
+			TargetPath:       defaultTargetPath,
+			VolumeCapability: tc.volumeCap,
+			VolumeContext:    volumeContext,
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", codes.InvalidArgument, status.Code(err), err)
+		}
+	}
+}
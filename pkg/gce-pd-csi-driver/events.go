@@ -0,0 +1,336 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+)
+
+const (
+	// Reasons of the events of failed operations
+	eventReasonProvisioningFailed = "ProvisioningFailed"
+	eventReasonAttachFailed       = "AttachFailed"
+	eventReasonMountFailed        = "MountFailed"
+
+	eventTypeWarning = "Warning"
+
+	// Keys of the volume context of NodePublishVolume set when the CSIDriver
+	// object of the driver has podInfoOnMount set
+	volumeContextKeyPodName      = "csi.storage.k8s.io/pod.name"
+	volumeContextKeyPodNamespace = "csi.storage.k8s.io/pod.namespace"
+
+	// Events of cluster scoped objects are posted in this namespace
+	defaultEventNamespace = "default"
+
+	// Timeout of posting a single event, including looking up its object
+	eventRequestTimeout = 10 * time.Second
+	// Number of events queued for posting before further events are dropped,
+	// so that a slow API server does not slow down RPCs
+	eventQueueSize = 100
+	// Identical events of an object are posted at most once per interval,
+	// as the CO retries failed operations
+	eventDedupInterval = 5 * time.Minute
+)
+
+// ObjectReference identifies the Kubernetes object an event is about
+type ObjectReference struct {
+	Kind string
+	// Namespace is empty for cluster scoped objects
+	Namespace string
+	Name      string
+}
+
+// EventRecorder posts Kubernetes events
+type EventRecorder interface {
+	// Event posts an event about the object. It must not block.
+	Event(object ObjectReference, eventType, reason, message string)
+}
+
+type queuedEvent struct {
+	object    ObjectReference
+	eventType string
+	reason    string
+	message   string
+	time      time.Time
+}
+
+// kubeEventRecorder posts events with the Kubernetes API of the cluster the
+// driver runs in. Events are posted asynchronously and identical events of an
+// object are deduplicated.
+type kubeEventRecorder struct {
+	host      string
+	tokenFile string
+	client    *http.Client
+	component string
+	// nodeName is the host reported as the source of the events
+	nodeName string
+
+	queue chan queuedEvent
+	mux   sync.Mutex
+	// posted is when each event was last posted, by object, reason and
+	// message
+	posted map[string]time.Time
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// NewInClusterEventRecorder returns an EventRecorder that authenticates to the
+// Kubernetes API with the service account of the driver pod. Events are
+// posted by a goroutine that runs until stopCh is closed.
+func NewInClusterEventRecorder(component, nodeName string, stopCh <-chan struct{}) (EventRecorder, error) {
+	host, client, err := newInClusterClient(eventRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	r := newKubeEventRecorder(host, filepath.Join(serviceAccountDir, "token"), client, component, nodeName)
+	go r.run(stopCh)
+	return r, nil
+}
+
+func newKubeEventRecorder(host, tokenFile string, client *http.Client, component, nodeName string) *kubeEventRecorder {
+	return &kubeEventRecorder{
+		host:      host,
+		tokenFile: tokenFile,
+		client:    client,
+		component: component,
+		nodeName:  nodeName,
+		queue:     make(chan queuedEvent, eventQueueSize),
+		posted:    map[string]time.Time{},
+		now:       time.Now,
+	}
+}
+
+func (k *kubeEventRecorder) Event(object ObjectReference, eventType, reason, message string) {
+	now := k.now()
+	key := strings.Join([]string{object.Kind, object.Namespace, object.Name, reason, message}, "/")
+	k.mux.Lock()
+	for key, posted := range k.posted {
+		if now.Sub(posted) > eventDedupInterval {
+			delete(k.posted, key)
+		}
+	}
+	if _, ok := k.posted[key]; ok {
+		k.mux.Unlock()
+		klog.V(5).Infof("Skipping event %s of %s %s/%s, it was posted recently", reason, object.Kind, object.Namespace, object.Name)
+		return
+	}
+	k.posted[key] = now
+	k.mux.Unlock()
+
+	select {
+	case k.queue <- queuedEvent{object: object, eventType: eventType, reason: reason, message: message, time: now}:
+	default:
+		klog.Warningf("Event queue is full, dropping event %s of %s %s/%s: %s", reason, object.Kind, object.Namespace, object.Name, message)
+	}
+}
+
+// run posts the queued events until stopCh is closed
+func (k *kubeEventRecorder) run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event := <-k.queue:
+			ctx, cancel := context.WithTimeout(context.Background(), eventRequestTimeout)
+			if err := k.post(ctx, event); err != nil {
+				klog.Warningf("Failed to post event %s of %s %s/%s: %v", event.reason, event.object.Kind, event.object.Namespace, event.object.Name, err)
+			}
+			cancel()
+		}
+	}
+}
+
+// post creates the event. The object is looked up for its UID, which clients
+// such as kubectl describe use to find the events of an object.
+func (k *kubeEventRecorder) post(ctx context.Context, event queuedEvent) error {
+	uid, err := k.objectUID(ctx, event.object)
+	if err != nil {
+		// The event is still useful without the UID
+		klog.V(4).Infof("Failed to look up %s %s/%s: %v", event.object.Kind, event.object.Namespace, event.object.Name, err)
+	}
+	namespace := event.object.Namespace
+	if namespace == "" {
+		namespace = defaultEventNamespace
+	}
+	timestamp := event.time.UTC().Format(time.RFC3339)
+	body, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"generateName": event.object.Name + ".",
+			"namespace":    namespace,
+		},
+		"involvedObject": map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       event.object.Kind,
+			"namespace":  event.object.Namespace,
+			"name":       event.object.Name,
+			"uid":        uid,
+		},
+		"type":    event.eventType,
+		"reason":  event.reason,
+		"message": event.message,
+		"source": map[string]interface{}{
+			"component": k.component,
+			"host":      k.nodeName,
+		},
+		"firstTimestamp":     timestamp,
+		"lastTimestamp":      timestamp,
+		"count":              1,
+		"reportingComponent": k.component,
+		"reportingInstance":  k.nodeName,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := k.do(ctx, http.MethodPost, fmt.Sprintf("/api/v1/namespaces/%s/events", url.PathEscape(namespace)), body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, respBody)
+	}
+	return nil
+}
+
+// objectUID returns the UID of the object
+func (k *kubeEventRecorder) objectUID(ctx context.Context, object ObjectReference) (string, error) {
+	var objectPath string
+	switch object.Kind {
+	case "PersistentVolumeClaim":
+		objectPath = fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", url.PathEscape(object.Namespace), url.PathEscape(object.Name))
+	case "Pod":
+		objectPath = fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", url.PathEscape(object.Namespace), url.PathEscape(object.Name))
+	case "Node":
+		objectPath = fmt.Sprintf("/api/v1/nodes/%s", url.PathEscape(object.Name))
+	default:
+		return "", fmt.Errorf("unsupported kind %s", object.Kind)
+	}
+	resp, err := k.do(ctx, http.MethodGet, objectPath, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var obj struct {
+		Metadata struct {
+			UID string `json:"uid"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return "", err
+	}
+	return obj.Metadata.UID, nil
+}
+
+func (k *kubeEventRecorder) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	// The token is read on every request since it is rotated
+	token, err := ioutil.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %v", err)
+	}
+	req, err := http.NewRequest(method, k.host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return k.client.Do(req.WithContext(ctx))
+}
+
+// newEventInterceptor returns an interceptor that posts a warning event when
+// provisioning, attaching or mounting a volume fails: on the
+// PersistentVolumeClaim of CreateVolume, if the external-provisioner passes
+// it, on the Pod of NodePublishVolume, if the CO passes it, and on the Node
+// otherwise. nodeName is the name of the Node of the node service.
+func newEventInterceptor(recorder EventRecorder, nodeName string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		switch status.Code(err) {
+		case codes.Aborted, codes.Canceled:
+			// The operation is in progress or was abandoned by the CO
+			return resp, err
+		}
+		if object, reason, volume, ok := eventObject(req, nodeName); ok {
+			msg := fmt.Sprintf("%s of volume %s failed: %s", path.Base(info.FullMethod), volume, status.Convert(err).Message())
+			recorder.Event(object, eventTypeWarning, reason, msg)
+		}
+		return resp, err
+	}
+}
+
+// eventObject returns the object and reason of the event of the failed
+// request, the volume the request is about and false if no event is posted
+// for the request
+func eventObject(req interface{}, nodeName string) (ObjectReference, string, string, bool) {
+	nodeObject := func(name string) (ObjectReference, bool) {
+		return ObjectReference{Kind: "Node", Name: name}, name != ""
+	}
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		name, namespace := r.GetParameters()[common.ParameterKeyPVCName], r.GetParameters()[common.ParameterKeyPVCNamespace]
+		if name == "" || namespace == "" {
+			return ObjectReference{}, "", "", false
+		}
+		return ObjectReference{Kind: "PersistentVolumeClaim", Namespace: namespace, Name: name}, eventReasonProvisioningFailed, r.GetName(), true
+	case *csi.ControllerPublishVolumeRequest:
+		_, instanceName, err := common.NodeIDToZoneAndName(r.GetNodeId())
+		if err != nil {
+			return ObjectReference{}, "", "", false
+		}
+		object, ok := nodeObject(instanceName)
+		return object, eventReasonAttachFailed, r.GetVolumeId(), ok
+	case *csi.NodeStageVolumeRequest:
+		object, ok := nodeObject(nodeName)
+		return object, eventReasonMountFailed, r.GetVolumeId(), ok
+	case *csi.NodePublishVolumeRequest:
+		name, namespace := r.GetVolumeContext()[volumeContextKeyPodName], r.GetVolumeContext()[volumeContextKeyPodNamespace]
+		if name != "" && namespace != "" {
+			return ObjectReference{Kind: "Pod", Namespace: namespace, Name: name}, eventReasonMountFailed, r.GetVolumeId(), true
+		}
+		object, ok := nodeObject(nodeName)
+		return object, eventReasonMountFailed, r.GetVolumeId(), ok
+	default:
+		return ObjectReference{}, "", "", false
+	}
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+)
+
+type recordedEvent struct {
+	object  ObjectReference
+	reason  string
+	message string
+}
+
+type fakeEventRecorder struct {
+	events []recordedEvent
+}
+
+func (f *fakeEventRecorder) Event(object ObjectReference, eventType, reason, message string) {
+	f.events = append(f.events, recordedEvent{object: object, reason: reason, message: message})
+}
+
+func TestEventInterceptor(t *testing.T) {
+	quotaErr := status.Error(codes.ResourceExhausted, "Quota 'SSD_TOTAL_GB' exceeded in region us-central1")
+	testCases := []struct {
+		name     string
+		method   string
+		req      interface{}
+		err      error
+		expEvent *recordedEvent
+	}{
+		{
+			name:   "create volume failed",
+			method: "CreateVolume",
+			req: &csi.CreateVolumeRequest{
+				Name: "pvc-1",
+				Parameters: map[string]string{
+					common.ParameterKeyPVCName:      "claim",
+					common.ParameterKeyPVCNamespace: "ns",
+				},
+			},
+			err: quotaErr,
+			expEvent: &recordedEvent{
+				object:  ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "ns", Name: "claim"},
+				reason:  eventReasonProvisioningFailed,
+				message: "CreateVolume of volume pvc-1 failed: Quota 'SSD_TOTAL_GB' exceeded in region us-central1",
+			},
+		},
+		{
+			name:   "create volume succeeded",
+			method: "CreateVolume",
+			req: &csi.CreateVolumeRequest{
+				Name: "pvc-1",
+				Parameters: map[string]string{
+					common.ParameterKeyPVCName:      "claim",
+					common.ParameterKeyPVCNamespace: "ns",
+				},
+			},
+		},
+		{
+			name:   "create volume without claim",
+			method: "CreateVolume",
+			req:    &csi.CreateVolumeRequest{Name: "pvc-1"},
+			err:    quotaErr,
+		},
+		{
+			name:   "create volume in progress",
+			method: "CreateVolume",
+			req: &csi.CreateVolumeRequest{
+				Name: "pvc-1",
+				Parameters: map[string]string{
+					common.ParameterKeyPVCName:      "claim",
+					common.ParameterKeyPVCNamespace: "ns",
+				},
+			},
+			err: status.Error(codes.Aborted, "operation in progress"),
+		},
+		{
+			name:   "attach failed",
+			method: "ControllerPublishVolume",
+			req: &csi.ControllerPublishVolumeRequest{
+				VolumeId: "projects/p/zones/z/disks/d",
+				NodeId:   "projects/p/zones/z/instances/node-1",
+			},
+			err: status.Error(codes.NotFound, "Could not find disk"),
+			expEvent: &recordedEvent{
+				object:  ObjectReference{Kind: "Node", Name: "node-1"},
+				reason:  eventReasonAttachFailed,
+				message: "ControllerPublishVolume of volume projects/p/zones/z/disks/d failed: Could not find disk",
+			},
+		},
+		{
+			name:   "attach to invalid node",
+			method: "ControllerPublishVolume",
+			req:    &csi.ControllerPublishVolumeRequest{VolumeId: "projects/p/zones/z/disks/d", NodeId: "node-1"},
+			err:    status.Error(codes.InvalidArgument, "invalid node ID"),
+		},
+		{
+			name:   "stage failed",
+			method: "NodeStageVolume",
+			req:    &csi.NodeStageVolumeRequest{VolumeId: "projects/p/zones/z/disks/d"},
+			err:    status.Error(codes.Internal, "mount failed"),
+			expEvent: &recordedEvent{
+				object:  ObjectReference{Kind: "Node", Name: "this-node"},
+				reason:  eventReasonMountFailed,
+				message: "NodeStageVolume of volume projects/p/zones/z/disks/d failed: mount failed",
+			},
+		},
+		{
+			name:   "publish failed with pod info",
+			method: "NodePublishVolume",
+			req: &csi.NodePublishVolumeRequest{
+				VolumeId: "projects/p/zones/z/disks/d",
+				VolumeContext: map[string]string{
+					volumeContextKeyPodName:      "pod",
+					volumeContextKeyPodNamespace: "ns",
+				},
+			},
+			err: status.Error(codes.Internal, "mount failed"),
+			expEvent: &recordedEvent{
+				object:  ObjectReference{Kind: "Pod", Namespace: "ns", Name: "pod"},
+				reason:  eventReasonMountFailed,
+				message: "NodePublishVolume of volume projects/p/zones/z/disks/d failed: mount failed",
+			},
+		},
+		{
+			name:   "detach failed",
+			method: "ControllerUnpublishVolume",
+			req:    &csi.ControllerUnpublishVolumeRequest{VolumeId: "projects/p/zones/z/disks/d", NodeId: "projects/p/zones/z/instances/node-1"},
+			err:    status.Error(codes.Internal, "detach failed"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		recorder := &fakeEventRecorder{}
+		interceptor := newEventInterceptor(recorder, "this-node")
+		info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/" + tc.method}
+		_, err := interceptor(context.Background(), tc.req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, tc.err
+		})
+		if err != tc.err {
+			t.Errorf("Expected error %v to be returned, got: %v", tc.err, err)
+		}
+		var expEvents []recordedEvent
+		if tc.expEvent != nil {
+			expEvents = []recordedEvent{*tc.expEvent}
+		}
+		if !reflect.DeepEqual(recorder.events, expEvents) {
+			t.Errorf("Expected events %+v, got: %+v", expEvents, recorder.events)
+		}
+	}
+}
+
+func TestKubeEventRecorder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "events-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tokenFile := filepath.Join(tmpDir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	var mux sync.Mutex
+	var posted []map[string]interface{}
+	var postedPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v1/namespaces/ns/persistentvolumeclaims/claim":
+			w.Write([]byte(`{"metadata": {"name": "claim", "uid": "claim-uid"}}`))
+		case r.Method == http.MethodPost:
+			event := map[string]interface{}{}
+			if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+				t.Errorf("Failed to decode event: %v", err)
+			}
+			mux.Lock()
+			posted = append(posted, event)
+			postedPaths = append(postedPaths, r.URL.Path)
+			mux.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	recorder := newKubeEventRecorder(server.URL, tokenFile, server.Client(), "pd.csi.storage.gke.io", "node-1")
+	recorder.now = func() time.Time { return now }
+	claim := ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "ns", Name: "claim"}
+	node := ObjectReference{Kind: "Node", Name: "node-1"}
+
+	recorder.Event(claim, eventTypeWarning, eventReasonProvisioningFailed, "quota exceeded")
+	// Deduplicated
+	recorder.Event(claim, eventTypeWarning, eventReasonProvisioningFailed, "quota exceeded")
+	recorder.Event(node, eventTypeWarning, eventReasonMountFailed, "mount failed")
+	now = now.Add(eventDedupInterval + time.Second)
+	recorder.Event(claim, eventTypeWarning, eventReasonProvisioningFailed, "quota exceeded")
+
+	if len(recorder.queue) != 3 {
+		t.Fatalf("Expected 3 queued events, got: %d", len(recorder.queue))
+	}
+	for len(recorder.queue) > 0 {
+		if err := recorder.post(context.Background(), <-recorder.queue); err != nil {
+			t.Errorf("Unexpected error posting event: %v", err)
+		}
+	}
+
+	expPaths := []string{"/api/v1/namespaces/ns/events", "/api/v1/namespaces/default/events", "/api/v1/namespaces/ns/events"}
+	if !reflect.DeepEqual(postedPaths, expPaths) {
+		t.Errorf("Expected events posted to %v, got: %v", expPaths, postedPaths)
+	}
+	if len(posted) == 0 {
+		return
+	}
+	event := posted[0]
+	involved, _ := event["involvedObject"].(map[string]interface{})
+	if involved["kind"] != "PersistentVolumeClaim" || involved["name"] != "claim" || involved["uid"] != "claim-uid" {
+		t.Errorf("Expected the event to involve the claim with its UID, got: %v", involved)
+	}
+	if event["reason"] != eventReasonProvisioningFailed || event["message"] != "quota exceeded" || event["type"] != eventTypeWarning {
+		t.Errorf("Unexpected event: %v", event)
+	}
+	source, _ := event["source"].(map[string]interface{})
+	if source["component"] != "pd.csi.storage.gke.io" || source["host"] != "node-1" {
+		t.Errorf("Unexpected event source: %v", source)
+	}
+}
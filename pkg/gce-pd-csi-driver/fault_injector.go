@@ -0,0 +1,148 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// maxCode is the highest valid GRPC status code
+const maxCode = codes.Unauthenticated
+
+// FaultRule describes the fault injected into RPCs of a single method. It is
+// intended for testing only.
+type FaultRule struct {
+	// Code is returned instead of calling the method, codes.OK injects no
+	// failure
+	Code codes.Code
+	// Every injects the failure into every Nth call of the method, e.g. 3
+	// fails the third, sixth, ... call. Values below 1 are treated as 1.
+	Every int
+	// Latency is added before each call of the method
+	Latency time.Duration
+}
+
+// faultInjector is an interceptor injecting failures and latencies into RPCs
+// according to the configured rules
+type faultInjector struct {
+	rules map[string]FaultRule
+
+	mux   sync.Mutex
+	calls map[string]int
+}
+
+func newFaultInjector(rules map[string]FaultRule) *faultInjector {
+	return &faultInjector{
+		rules: rules,
+		calls: map[string]int{},
+	}
+}
+
+func (f *faultInjector) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := path.Base(info.FullMethod)
+	rule, ok := f.rules[method]
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	f.mux.Lock()
+	f.calls[method]++
+	call := f.calls[method]
+	f.mux.Unlock()
+
+	if rule.Latency > 0 {
+		klog.V(4).Infof("Injecting %v latency into %s call %d", rule.Latency, method, call)
+		select {
+		case <-time.After(rule.Latency):
+		case <-ctx.Done():
+			return nil, contextErrorToStatus(ctx.Err(), "request ended while injecting latency")
+		}
+	}
+
+	every := rule.Every
+	if every < 1 {
+		every = 1
+	}
+	if rule.Code != codes.OK && call%every == 0 {
+		klog.Warningf("Injecting %v failure into %s call %d", rule.Code, method, call)
+		return nil, status.Errorf(rule.Code, "injected failure for %s call %d", method, call)
+	}
+
+	return handler(ctx, req)
+}
+
+// ParseFaultRules parses a semicolon separated list of fault rules of the form
+// method:key=value,key=value where key is one of code, every or latency, e.g.
+// "ControllerPublishVolume:code=Unavailable,every=3;NodeStageVolume:latency=5s"
+func ParseFaultRules(s string) (map[string]FaultRule, error) {
+	rules := map[string]FaultRule{}
+	if s == "" {
+		return rules, nil
+	}
+	for _, ruleStr := range strings.Split(s, ";") {
+		parts := strings.SplitN(ruleStr, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid fault rule %q, expected method:key=value,...", ruleStr)
+		}
+		method := parts[0]
+		rule := FaultRule{Every: 1}
+		for _, pair := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid option %q in fault rule for %s, expected key=value", pair, method)
+			}
+			var err error
+			switch kv[0] {
+			case "code":
+				rule.Code, err = parseCode(kv[1])
+			case "every":
+				rule.Every, err = strconv.Atoi(kv[1])
+				if err == nil && rule.Every < 1 {
+					err = fmt.Errorf("must be at least 1")
+				}
+			case "latency":
+				rule.Latency, err = time.ParseDuration(kv[1])
+			default:
+				err = fmt.Errorf("unknown option")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid option %q in fault rule for %s: %v", pair, method, err)
+			}
+		}
+		rules[method] = rule
+	}
+	return rules, nil
+}
+
+// parseCode returns the GRPC status code with the given name, e.g. Unavailable
+func parseCode(name string) (codes.Code, error) {
+	for c := codes.OK; c <= maxCode; c++ {
+		if strings.EqualFold(c.String(), name) {
+			return c, nil
+		}
+	}
+	return codes.OK, fmt.Errorf("unknown status code %q", name)
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFaultInjector(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rules    map[string]FaultRule
+		method   string
+		expCodes []codes.Code
+	}{
+		{
+			name:     "no rules",
+			method:   controllerPublishMethod,
+			expCodes: []codes.Code{codes.OK, codes.OK, codes.OK},
+		},
+		{
+			name: "fail every third call",
+			rules: map[string]FaultRule{
+				"ControllerPublishVolume": {Code: codes.Unavailable, Every: 3},
+			},
+			method:   controllerPublishMethod,
+			expCodes: []codes.Code{codes.OK, codes.OK, codes.Unavailable, codes.OK, codes.OK, codes.Unavailable},
+		},
+		{
+			name: "fail every call",
+			rules: map[string]FaultRule{
+				"NodeStageVolume": {Code: codes.Internal},
+			},
+			method:   nodeStageMethod,
+			expCodes: []codes.Code{codes.Internal, codes.Internal},
+		},
+		{
+			name: "other method unaffected",
+			rules: map[string]FaultRule{
+				"NodeStageVolume": {Code: codes.Internal, Every: 1},
+			},
+			method:   nodePublishMethod,
+			expCodes: []codes.Code{codes.OK, codes.OK},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		f := newFaultInjector(tc.rules)
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		}
+		for i, expCode := range tc.expCodes {
+			_, err := f.intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+			if status.Code(err) != expCode {
+				t.Errorf("Call %d: expected error code: %v, got: %v", i+1, expCode, status.Code(err))
+			}
+		}
+	}
+}
+
+func TestFaultInjectorLatency(t *testing.T) {
+	f := newFaultInjector(map[string]FaultRule{
+		"NodeStageVolume": {Latency: time.Hour},
+	})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := f.intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: nodeStageMethod}, handler)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Expected error code: %v, got: %v", codes.DeadlineExceeded, status.Code(err))
+	}
+}
+
+func TestParseFaultRules(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rules    string
+		expRules map[string]FaultRule
+		expErr   bool
+	}{
+		{
+			name:     "empty",
+			expRules: map[string]FaultRule{},
+		},
+		{
+			name:  "multiple rules",
+			rules: "ControllerPublishVolume:code=Unavailable,every=3;NodeStageVolume:latency=5s",
+			expRules: map[string]FaultRule{
+				"ControllerPublishVolume": {Code: codes.Unavailable, Every: 3},
+				"NodeStageVolume":         {Every: 1, Latency: 5 * time.Second},
+			},
+		},
+		{
+			name:  "case insensitive code",
+			rules: "CreateVolume:code=resourceexhausted",
+			expRules: map[string]FaultRule{
+				"CreateVolume": {Code: codes.ResourceExhausted, Every: 1},
+			},
+		},
+		{
+			name:   "missing method",
+			rules:  "code=Unavailable",
+			expErr: true,
+		},
+		{
+			name:   "unknown code",
+			rules:  "CreateVolume:code=Broken",
+			expErr: true,
+		},
+		{
+			name:   "invalid every",
+			rules:  "CreateVolume:code=Internal,every=0",
+			expErr: true,
+		},
+		{
+			name:   "invalid latency",
+			rules:  "CreateVolume:latency=5",
+			expErr: true,
+		},
+		{
+			name:   "unknown option",
+			rules:  "CreateVolume:probability=0.5",
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		rules, err := ParseFaultRules(tc.rules)
+		if err == nil && tc.expErr {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expErr {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(rules, tc.expRules) {
+			t.Errorf("Got rules %+v, expected %+v", rules, tc.expRules)
+		}
+	}
+}
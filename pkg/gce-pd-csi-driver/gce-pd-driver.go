@@ -16,6 +16,8 @@ package gceGCEDriver
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -31,6 +33,8 @@ import (
 type GCEDriver struct {
 	name          string
 	vendorVersion string
+	// manifest holds build metadata returned in GetPluginInfo
+	manifest map[string]string
 
 	ids *GCEIdentityServer
 	ns  *GCENodeServer
@@ -39,20 +43,32 @@ type GCEDriver struct {
 	vcap  []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
 	nscap []*csi.NodeServiceCapability
+
+	// server is the running GRPC server, set once Run has started serving
+	server    NonBlockingGRPCServer
+	serverMux sync.Mutex
+	// stopping is set by Stop, so that a server started by Run afterwards
+	// is stopped right away, with stopGracePeriod
+	stopping        bool
+	stopGracePeriod time.Duration
 }
 
 func GetGCEDriver() *GCEDriver {
 	return &GCEDriver{}
 }
 
-func (gceDriver *GCEDriver) SetupGCEDriver(cloudProvider gce.GCECompute, mounter *mount.SafeFormatAndMount,
-	deviceUtils mountmanager.DeviceUtils, meta metadataservice.MetadataService, name, vendorVersion string) error {
+// SetupGCEDriver configures the driver with the given servers. A nil
+// controllerServer or nodeServer disables that service, which lets the same
+// binary run as a controller-only Deployment or node-only DaemonSet. The
+// manifest is returned as-is in GetPluginInfo and may be nil.
+func (gceDriver *GCEDriver) SetupGCEDriver(name, vendorVersion string, manifest map[string]string, identityServer *GCEIdentityServer, controllerServer *GCEControllerServer, nodeServer *GCENodeServer) error {
 	if name == "" {
 		return fmt.Errorf("Driver name missing")
 	}
 
 	gceDriver.name = name
 	gceDriver.vendorVersion = vendorVersion
+	gceDriver.manifest = manifest
 
 	// Adding Capabilities
 	vcam := []csi.VolumeCapability_AccessMode_Mode{
@@ -60,25 +76,29 @@ func (gceDriver *GCEDriver) SetupGCEDriver(cloudProvider gce.GCECompute, mounter
 		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
 	}
 	gceDriver.AddVolumeCapabilityAccessModes(vcam)
-	csc := []csi.ControllerServiceCapability_RPC_Type{
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
-		csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
-		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	if controllerServer != nil {
+		csc := []csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+			csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
+			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		}
+		gceDriver.AddControllerServiceCapabilities(csc)
 	}
-	gceDriver.AddControllerServiceCapabilities(csc)
-	ns := []csi.NodeServiceCapability_RPC_Type{
-		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+	if nodeServer != nil {
+		ns := []csi.NodeServiceCapability_RPC_Type{
+			csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+			csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		}
+		gceDriver.AddNodeServiceCapabilities(ns)
 	}
-	gceDriver.AddNodeServiceCapabilities(ns)
 
 	// Set up RPC Servers
-	gceDriver.ids = NewIdentityServer(gceDriver)
-	gceDriver.ns = NewNodeServer(gceDriver, mounter, deviceUtils, meta)
-	gceDriver.cs = NewControllerServer(gceDriver, cloudProvider, meta)
+	gceDriver.ids = identityServer
+	gceDriver.ns = nodeServer
+	gceDriver.cs = controllerServer
 
 	return nil
 }
@@ -140,27 +160,70 @@ func NewNodeServer(gceDriver *GCEDriver, mounter *mount.SafeFormatAndMount, devi
 		DeviceUtils:     deviceUtils,
 		MetadataService: meta,
 		volumeLocks:     common.NewVolumeLocks(),
+		deviceCache:     newDeviceCache(),
 	}
 }
 
 func NewControllerServer(gceDriver *GCEDriver, cloudProvider gce.GCECompute, meta metadataservice.MetadataService) *GCEControllerServer {
 	return &GCEControllerServer{
-		Driver:          gceDriver,
-		CloudProvider:   cloudProvider,
-		MetadataService: meta,
-		volumeLocks:     common.NewVolumeLocks(),
+		Driver:            gceDriver,
+		CloudProvider:     cloudProvider,
+		MetadataService:   meta,
+		volumeLocks:       common.NewVolumeLocks(),
+		volumeResponses:   common.NewResponseCache(createResponseCacheTTL, createResponseCacheEntries),
+		snapshotResponses: common.NewResponseCache(createResponseCacheTTL, createResponseCacheEntries),
+		instances:         newInstanceCache(instanceCacheTTL),
 	}
 }
 
-func (gceDriver *GCEDriver) Run(endpoint string) {
+func (gceDriver *GCEDriver) Run(endpoint string, opts ServerOptions) {
 	klog.V(4).Infof("Driver: %v", gceDriver.name)
 
 	//Start the nonblocking GRPC
-	s := NewNonBlockingGRPCServer()
-	// TODO(#34): Only start specific servers based on a flag.
-	// In the future have this only run specific combinations of servers depending on which version this is.
-	// The schema for that was in util. basically it was just s.start but with some nil servers.
+	s := NewNonBlockingGRPCServer(opts)
+	// Only the services that were set up are registered, a nil server is skipped.
+	// Explicitly pass typed nils for disabled services, a nil pointer wrapped in
+	// the csi server interfaces would otherwise be registered.
+	var cs csi.ControllerServer
+	if gceDriver.cs != nil {
+		cs = gceDriver.cs
+	}
+	var ns csi.NodeServer
+	if gceDriver.ns != nil {
+		ns = gceDriver.ns
+	}
+	s.Start(endpoint, gceDriver.ids, cs, ns)
+
+	gceDriver.serverMux.Lock()
+	gceDriver.server = s
+	stopping, gracePeriod := gceDriver.stopping, gceDriver.stopGracePeriod
+	gceDriver.serverMux.Unlock()
 
-	s.Start(endpoint, gceDriver.ids, gceDriver.cs, gceDriver.ns)
+	if stopping {
+		klog.Infof("Driver was stopped while starting, stopping the server")
+		s.GracefulStopWithTimeout(gracePeriod)
+	}
 	s.Wait()
 }
+
+// Stop stops the driver from accepting new RPCs and waits up to gracePeriod
+// for in-flight RPCs (e.g. attach, format and mount) to complete before
+// forcefully stopping the server. Every CSI operation is idempotent, so an
+// operation interrupted after the grace period is safely retried by the CO
+// once the driver restarts. If Run has not started the server yet, it is
+// stopped as soon as it starts.
+func (gceDriver *GCEDriver) Stop(gracePeriod time.Duration) {
+	gceDriver.serverMux.Lock()
+	gceDriver.stopping = true
+	gceDriver.stopGracePeriod = gracePeriod
+	s := gceDriver.server
+	gceDriver.serverMux.Unlock()
+
+	if s == nil {
+		klog.Infof("Driver server is not running yet, it will be stopped once started")
+		return
+	}
+
+	klog.Infof("Stopping driver, waiting up to %v for in-flight operations to complete", gracePeriod)
+	s.GracefulStopWithTimeout(gracePeriod)
+}
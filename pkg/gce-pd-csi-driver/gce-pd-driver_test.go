@@ -15,7 +15,12 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
@@ -44,9 +49,82 @@ func initBlockingGCEDriver(t *testing.T, cloudDisks []*gce.CloudDisk, readyToExe
 func initGCEDriverWithCloudProvider(t *testing.T, cloudProvider gce.GCECompute) *GCEDriver {
 	vendorVersion := "test-vendor"
 	gceDriver := GetGCEDriver()
-	err := gceDriver.SetupGCEDriver(cloudProvider, nil, nil, metadataservice.NewFakeService(), driver, vendorVersion)
+	identityServer := NewIdentityServer(gceDriver)
+	controllerServer := NewControllerServer(gceDriver, cloudProvider, metadataservice.NewFakeService())
+	err := gceDriver.SetupGCEDriver(driver, vendorVersion, nil, identityServer, controllerServer, nil)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
 	}
 	return gceDriver
 }
+
+func TestRunAndStop(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "gce-pd-driver-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	testCases := []struct {
+		name     string
+		endpoint string
+	}{
+		{
+			name:     "unix socket",
+			endpoint: fmt.Sprintf("unix:%s", filepath.Join(tmpDir, "csi.sock")),
+		},
+		{
+			name:     "tcp",
+			endpoint: "tcp://127.0.0.1:0",
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, nil)
+
+		stopped := make(chan struct{})
+		go func() {
+			gceDriver.Run(tc.endpoint, DefaultServerOptions())
+			close(stopped)
+		}()
+
+		// Wait for the driver to start serving
+		for i := 0; ; i++ {
+			gceDriver.serverMux.Lock()
+			running := gceDriver.server != nil
+			gceDriver.serverMux.Unlock()
+			if running {
+				break
+			}
+			if i >= 100 {
+				t.Fatalf("Driver did not start serving on %s", tc.endpoint)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		gceDriver.Stop(time.Second)
+
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Run did not return after Stop")
+		}
+	}
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	gceDriver := initGCEDriver(t, nil)
+	// A termination signal can arrive before the server is started
+	gceDriver.Stop(time.Second)
+
+	stopped := make(chan struct{})
+	go func() {
+		gceDriver.Run("tcp://127.0.0.1:0", DefaultServerOptions())
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after an earlier Stop")
+	}
+}
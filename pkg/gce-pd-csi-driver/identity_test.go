@@ -18,15 +18,17 @@ import (
 	"testing"
 
 	"context"
+	"reflect"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
 )
 
 func TestGetPluginInfo(t *testing.T) {
 	vendorVersion := "test-vendor"
 	gceDriver := GetGCEDriver()
-	err := gceDriver.SetupGCEDriver(nil, nil, nil, metadataservice.NewFakeService(), driver, vendorVersion)
+	manifest := map[string]string{"gitCommit": "test-commit"}
+	identityServer := NewIdentityServer(gceDriver)
+	err := gceDriver.SetupGCEDriver(driver, vendorVersion, manifest, identityServer, nil, nil)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
 	}
@@ -44,11 +46,16 @@ func TestGetPluginInfo(t *testing.T) {
 	if respVer != vendorVersion {
 		t.Fatalf("Vendor version expected: %v, got: %v", vendorVersion, respVer)
 	}
+
+	if !reflect.DeepEqual(resp.GetManifest(), manifest) {
+		t.Fatalf("Manifest expected: %v, got: %v", manifest, resp.GetManifest())
+	}
 }
 
 func TestGetPluginCapabilities(t *testing.T) {
 	gceDriver := GetGCEDriver()
-	err := gceDriver.SetupGCEDriver(nil, nil, nil, metadataservice.NewFakeService(), driver, "test-vendor")
+	identityServer := NewIdentityServer(gceDriver)
+	err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, identityServer, nil, nil)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
 	}
@@ -80,7 +87,8 @@ func TestGetPluginCapabilities(t *testing.T) {
 
 func TestProbe(t *testing.T) {
 	gceDriver := GetGCEDriver()
-	err := gceDriver.SetupGCEDriver(nil, nil, nil, metadataservice.NewFakeService(), driver, "test-vendor")
+	identityServer := NewIdentityServer(gceDriver)
+	err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, identityServer, nil, nil)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
 	}
@@ -90,3 +98,54 @@ func TestProbe(t *testing.T) {
 		t.Fatalf("Probe returned unexpected error: %v", err)
 	}
 }
+
+func TestGetPluginCapabilitiesControllerService(t *testing.T) {
+	testCases := []struct {
+		name             string
+		controllerServer bool
+	}{
+		{
+			name:             "controller service running",
+			controllerServer: true,
+		},
+		{
+			name:             "node service only",
+			controllerServer: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := GetGCEDriver()
+		identityServer := NewIdentityServer(gceDriver)
+		var controllerServer *GCEControllerServer
+		var nodeServer *GCENodeServer
+		if tc.controllerServer {
+			controllerServer = NewControllerServer(gceDriver, nil, nil)
+		} else {
+			nodeServer = NewNodeServer(gceDriver, nil, nil, nil)
+		}
+		err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, identityServer, controllerServer, nodeServer)
+		if err != nil {
+			t.Fatalf("Failed to setup GCE Driver: %v", err)
+		}
+
+		resp, err := gceDriver.ids.GetPluginCapabilities(context.Background(), &csi.GetPluginCapabilitiesRequest{})
+		if err != nil {
+			t.Fatalf("GetPluginCapabilities returned unexpected error: %v", err)
+		}
+
+		found := false
+		for _, capability := range resp.GetCapabilities() {
+			if capability.GetService().GetType() == csi.PluginCapability_Service_CONTROLLER_SERVICE {
+				found = true
+			}
+		}
+		if found != tc.controllerServer {
+			t.Errorf("Expected controller service advertised: %v, got: %v", tc.controllerServer, found)
+		}
+
+		if tc.controllerServer == (len(gceDriver.nscap) != 0) || tc.controllerServer != (len(gceDriver.cscap) != 0) {
+			t.Errorf("Expected only capabilities of the running services, got controller: %v, node: %v", gceDriver.cscap, gceDriver.nscap)
+		}
+	}
+}
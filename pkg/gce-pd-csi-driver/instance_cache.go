@@ -0,0 +1,137 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"sync"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+type instanceCacheEntry struct {
+	instance *gce.CloudInstance
+	added    time.Time
+}
+
+// instanceCache caches the instances of nodes looked up by
+// ControllerPublishVolume and ControllerUnpublishVolume for a short TTL, so
+// that bursts of attaches to the same node don't read the instance for every
+// volume. The attaches and detaches of the driver are recorded in the cached
+// instance, but disks may also be attached or detached by others, so callers
+// only rely on a cached instance to decide that an attach or detach is
+// needed.
+type instanceCache struct {
+	ttl     time.Duration
+	mux     sync.Mutex
+	entries map[string]instanceCacheEntry
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+func newInstanceCache(ttl time.Duration) *instanceCache {
+	return &instanceCache{
+		ttl:     ttl,
+		entries: map[string]instanceCacheEntry{},
+		now:     time.Now,
+	}
+}
+
+// get returns the unexpired instance cached for the node. The instance must
+// not be modified.
+func (c *instanceCache) get(nodeID string) (*gce.CloudInstance, bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry, ok := c.entries[nodeID]
+	if !ok {
+		return nil, false
+	}
+	if c.now().Sub(entry.added) > c.ttl {
+		delete(c.entries, nodeID)
+		return nil, false
+	}
+	return entry.instance, true
+}
+
+// add caches the instance of the node. Expired instances of other nodes are
+// removed, so that the cache does not grow with deleted nodes.
+func (c *instanceCache) add(nodeID string, instance *gce.CloudInstance) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.ttl <= 0 {
+		return
+	}
+	now := c.now()
+	for id, entry := range c.entries {
+		if now.Sub(entry.added) > c.ttl {
+			delete(c.entries, id)
+		}
+	}
+	c.entries[nodeID] = instanceCacheEntry{instance: instance, added: now}
+}
+
+// diskAttached records that the disk was attached to the cached instance of
+// the node, unless the instance was looked up after the attach
+func (c *instanceCache) diskAttached(nodeID string, disk *compute.AttachedDisk) {
+	c.update(nodeID, func(instance *compute.Instance) {
+		for _, d := range instance.Disks {
+			if d.DeviceName == disk.DeviceName {
+				return
+			}
+		}
+		instance.Disks = append(instance.Disks, disk)
+	})
+}
+
+// diskDetached records that the disk with the device name was detached from
+// the cached instance of the node
+func (c *instanceCache) diskDetached(nodeID, deviceName string) {
+	c.update(nodeID, func(instance *compute.Instance) {
+		disks := []*compute.AttachedDisk{}
+		for _, disk := range instance.Disks {
+			if disk.DeviceName != deviceName {
+				disks = append(disks, disk)
+			}
+		}
+		instance.Disks = disks
+	})
+}
+
+// update replaces the cached instance of the node with a copy modified by
+// modify, as the cached instance may still be used by other requests
+func (c *instanceCache) update(nodeID string, modify func(instance *compute.Instance)) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	entry, ok := c.entries[nodeID]
+	if !ok {
+		return
+	}
+	instanceCopy := *entry.instance.Instance
+	instanceCopy.Disks = append([]*compute.AttachedDisk{}, entry.instance.Disks...)
+	modify(&instanceCopy)
+	entry.instance = &gce.CloudInstance{Instance: &instanceCopy, EnableConfidentialCompute: entry.instance.EnableConfidentialCompute}
+	c.entries[nodeID] = entry
+}
+
+// remove removes the instance cached for the node, e.g. after an attach or
+// detach failed and its disks are unknown
+func (c *instanceCache) remove(nodeID string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.entries, nodeID)
+}
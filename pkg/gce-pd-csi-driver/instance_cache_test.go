@@ -0,0 +1,121 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+func TestInstanceCache(t *testing.T) {
+	testCases := []struct {
+		name string
+		// setup runs after the instance of node-1 with disk-1 was added
+		setup     func(c *instanceCache, now *time.Time)
+		expCached bool
+		expDisks  []string
+	}{
+		{
+			name:      "cached instance",
+			expCached: true,
+			expDisks:  []string{"disk-1"},
+		},
+		{
+			name:  "expired instance",
+			setup: func(c *instanceCache, now *time.Time) { *now = now.Add(2 * time.Minute) },
+		},
+		{
+			name:  "removed instance",
+			setup: func(c *instanceCache, now *time.Time) { c.remove("node-1") },
+		},
+		{
+			name: "disk attached",
+			setup: func(c *instanceCache, now *time.Time) {
+				c.diskAttached("node-1", &compute.AttachedDisk{DeviceName: "disk-2"})
+				c.diskAttached("node-1", &compute.AttachedDisk{DeviceName: "disk-1"})
+			},
+			expCached: true,
+			expDisks:  []string{"disk-1", "disk-2"},
+		},
+		{
+			name:      "disk detached",
+			setup:     func(c *instanceCache, now *time.Time) { c.diskDetached("node-1", "disk-1") },
+			expCached: true,
+			expDisks:  []string{},
+		},
+		{
+			name: "other node",
+			setup: func(c *instanceCache, now *time.Time) {
+				c.diskAttached("node-2", &compute.AttachedDisk{DeviceName: "disk-2"})
+				c.remove("node-2")
+			},
+			expCached: true,
+			expDisks:  []string{"disk-1"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		now := time.Now()
+		c := newInstanceCache(time.Minute)
+		c.now = func() time.Time { return now }
+		instance := &compute.Instance{Name: "node-1", Disks: []*compute.AttachedDisk{{DeviceName: "disk-1"}}}
+		c.add("node-1", &gce.CloudInstance{Instance: instance, EnableConfidentialCompute: true})
+		if tc.setup != nil {
+			tc.setup(c, &now)
+		}
+
+		cached, ok := c.get("node-1")
+		if ok != tc.expCached {
+			t.Errorf("Expected cached: %v, got: %v", tc.expCached, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		disks := []string{}
+		for _, disk := range cached.Disks {
+			disks = append(disks, disk.DeviceName)
+		}
+		if !reflect.DeepEqual(disks, tc.expDisks) {
+			t.Errorf("Expected disks %v, got: %v", tc.expDisks, disks)
+		}
+		if !cached.EnableConfidentialCompute {
+			t.Errorf("Expected the cached instance to be a Confidential VM")
+		}
+		if len(instance.Disks) != 1 {
+			t.Errorf("Expected the added instance to be unmodified, got disks: %v", instance.Disks)
+		}
+	}
+}
+
+func TestInstanceCacheRemovesExpired(t *testing.T) {
+	now := time.Now()
+	c := newInstanceCache(time.Minute)
+	c.now = func() time.Time { return now }
+	c.add("node-1", &gce.CloudInstance{Instance: &compute.Instance{Name: "node-1"}})
+	now = now.Add(2 * time.Minute)
+	c.add("node-2", &gce.CloudInstance{Instance: &compute.Instance{Name: "node-2"}})
+	if _, ok := c.entries["node-1"]; ok {
+		t.Errorf("Expected the expired instance to be removed")
+	}
+	if _, ok := c.get("node-2"); !ok {
+		t.Errorf("Expected node-2 to be cached")
+	}
+}
@@ -19,16 +19,20 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"context"
 
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog"
 	"k8s.io/kubernetes/pkg/util/mount"
 	"k8s.io/kubernetes/pkg/util/resizefs"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
 	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
 )
@@ -42,10 +46,59 @@ type GCENodeServer struct {
 	// A map storing all volumes with ongoing operations so that additional operations
 	// for that same volume (as defined by VolumeID) return an Aborted error
 	volumeLocks *common.VolumeLocks
+
+	// Verified device paths of volumes, invalidated on NodeUnstageVolume
+	deviceCache *deviceCache
+
+	// read_ahead_kb set on the devices of staged volumes without the
+	// read-ahead-kb volume attribute. 0 keeps the kernel default.
+	ReadAheadKB int64
+
+	// Maximum duration of the filesystem check of NodeStageVolume, after
+	// which staging fails with DeadlineExceeded. 0 only limits the check by
+	// the deadline of the request.
+	FsckTimeout time.Duration
+
+	// If set, devices that already contain a filesystem other than the
+	// requested fstype are mounted as the requested fstype instead of failing
+	// NodeStageVolume with FailedPrecondition
+	AllowFsTypeMismatch bool
+
+	// If set, the filesystem of a device that fails to mount is repaired
+	// once with e2fsck or xfs_repair before mounting it again, e.g. after an
+	// unclean detach
+	RepairFilesystemOnMountFailure bool
+
+	// If set, the xfs filesystems of devices staged read-write are checked
+	// with xfs_repair -n before mounting them, as fsck checks ext4
+	// filesystems. NodeStageVolume fails for corrupted filesystems, unless
+	// RepairXFSFilesystems is set to repair them with xfs_repair.
+	CheckXFSFilesystems  bool
+	RepairXFSFilesystems bool
+
+	// Overrides the volume limit of the machine type reported by
+	// NodeGetInfo if it is lower, reserving attachments for disks not
+	// managed by the driver. 0 reports the limit of the machine type.
+	MaxVolumesPerNode int64
+
+	// Creates, attaches and deletes the disks of CSI ephemeral inline
+	// volumes. Ephemeral inline volumes are rejected if it is nil.
+	CloudProvider gce.GCECompute
 }
 
 var _ csi.NodeServer = &GCENodeServer{}
 
+// filesystemRepairTimeout bounds the duration of filesystem checks and
+// repairs, in addition to the deadline of the NodeStageVolume call
+const filesystemRepairTimeout = 10 * time.Minute
+
+// filesystemRepairLogFormat is the format of the line logged with the outcome
+// of every filesystem repair after a failed mount, which alerts match on.
+// The outcome is one of repaired, repair-failed or mount-failed.
+const filesystemRepairLogFormat = "Filesystem repair outcome=%s device=%s fstype=%s err=%v"
+
+// TODO(#276) add metrics around filesystem repairs once the driver integrates with Prometheus.
+
 // The constants are used to map from the machine type to the limit of
 // persistent disks that can be attached to an instance. Please refer to gcloud doc
 // https://cloud.google.com/compute/docs/disks/#pdnumberlimits
@@ -55,7 +108,7 @@ const (
 )
 
 func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	klog.V(4).Infof("NodePublishVolume called with req: %#v", req)
+	klog.V(4).Infof("NodePublishVolume called with req: %v", protosanitizer.StripSecrets(req))
 
 	// Validate Arguments
 	targetPath := req.GetTargetPath()
@@ -66,6 +119,9 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Volume ID must be provided")
 	}
+	if isEphemeralVolume(req.GetVolumeContext()) {
+		return ns.publishEphemeralVolume(ctx, req)
+	}
 	if len(stagingTargetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Staging Target Path must be provided")
 	}
@@ -137,7 +193,7 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 			partition = part
 		}
 
-		sourcePath, err = ns.getDevicePath(volumeID, partition)
+		sourcePath, err = ns.getDevicePath(ctx, volumeID, partition)
 		if err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Error when getting device path: %v", err))
 		}
@@ -154,6 +210,9 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodePublishVolume volume capability must specify either mount or block mode"))
 	}
 
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
 	err = ns.Mounter.Interface.Mount(sourcePath, targetPath, fstype, options)
 	if err != nil {
 		notMnt, mntErr := ns.Mounter.Interface.IsLikelyNotMountPoint(targetPath)
@@ -187,7 +246,7 @@ func (ns *GCENodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePub
 }
 
 func (ns *GCENodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	klog.V(4).Infof("NodeUnpublishVolume called with args: %v", req)
+	klog.V(4).Infof("NodeUnpublishVolume called with req: %v", protosanitizer.StripSecrets(req))
 
 	// Validate Arguments
 	targetPath := req.GetTargetPath()
@@ -204,16 +263,20 @@ func (ns *GCENodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeU
 	}
 	defer ns.volumeLocks.Release(volumeID)
 
-	err := mount.CleanupMountPoint(targetPath, ns.Mounter.Interface, false /* bind mount */)
+	err := cleanupMountPoint(ctx, targetPath, ns.Mounter.Interface)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Unmount failed: %v\nUnmounting arguments: %s\n", err, targetPath))
 	}
 
+	if err := ns.unpublishEphemeralVolume(ctx, volumeID, targetPath); err != nil {
+		return nil, status.Error(cloudErrorCode(err, codes.Internal), fmt.Sprintf("NodeUnpublishVolume failed to delete disk of ephemeral volume %s: %v", volumeID, err))
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	klog.V(4).Infof("NodeStageVolume called with req: %#v", req)
+	klog.V(4).Infof("NodeStageVolume called with req: %v", protosanitizer.StripSecrets(req))
 
 	// Validate Arguments
 	volumeID := req.GetVolumeId()
@@ -242,7 +305,7 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 
 	volumeKey, err := common.VolumeIDToKey(volumeID)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume Volume ID is invalid: %v", err))
 	}
 
 	// Part 1: Get device path of attached device
@@ -252,13 +315,52 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 		partition = part
 	}
 
-	devicePath, err := ns.getDevicePath(volumeID, partition)
+	devicePath, err := ns.getDevicePath(ctx, volumeID, partition)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Error when getting device path: %v", err))
 	}
 
 	klog.V(4).Infof("Successfully found attached GCE PD %q at device path %s.", volumeKey.Name, devicePath)
 
+	luksEncryption := false
+	if v, ok := req.GetVolumeContext()[common.VolumeAttributeLUKSEncryption]; ok {
+		luksEncryption, err = strconv.ParseBool(v)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume invalid volume attribute %q: %v", common.VolumeAttributeLUKSEncryption, err))
+		}
+	}
+	if luksEncryption {
+		if volumeCapability.GetBlock() != nil {
+			return nil, status.Error(codes.InvalidArgument, "NodeStageVolume LUKS encryption is not supported for block volumes")
+		}
+		key := req.GetSecrets()[common.SecretKeyLUKSKey]
+		if len(key) == 0 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume LUKS encrypted volumes need the secret key %q", common.SecretKeyLUKSKey))
+		}
+		mapperName, err := getLUKSMapperName(volumeKey)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		devicePath, err = ns.DeviceUtils.OpenLUKSDevice(ctx, devicePath, mapperName, []byte(key))
+		if err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to open LUKS device of volume %s: %v", volumeID, err))
+		}
+		klog.V(4).Infof("Opened LUKS device of GCE PD %q at %s", volumeKey.Name, devicePath)
+	}
+
+	readAheadKB := ns.ReadAheadKB
+	if v, ok := req.GetVolumeContext()[common.VolumeAttributeReadAheadKB]; ok {
+		readAheadKB, err = common.ParseReadAheadKB(v)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume invalid volume attribute %q: %v", common.VolumeAttributeReadAheadKB, err))
+		}
+	}
+	if readAheadKB > 0 {
+		if err := ns.setReadAhead(devicePath, readAheadKB); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	// Part 2: Check if mount already exists at targetpath
 	notMnt, err := ns.Mounter.Interface.IsLikelyNotMountPoint(stagingTargetPath)
 	if err != nil {
@@ -299,8 +401,41 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 		// Noop for Block NodeStageVolume
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
+	if req.GetPublishContext()[common.PublishContextKeyReadOnly] == "true" && !hasReadOnlyOption(options) {
+		// Mounting the device of a disk attached read only read-write fails
+		options = append(options, "ro")
+	}
 
+	if err := checkContext(ctx); err != nil {
+		return nil, err
+	}
+	format, err := ns.checkFsType(devicePath, fstype)
+	if err != nil {
+		return nil, err
+	}
+	if format == "xfs" && ns.CheckXFSFilesystems && !hasReadOnlyOption(options) {
+		if err := ns.checkXFS(ctx, devicePath); err != nil {
+			return nil, err
+		}
+	}
+	ext4FormatArgs, err := getExt4FormatArgs(req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("NodeStageVolume invalid volume attributes: %v", err))
+	}
+	if err := ns.checkFilesystem(ctx, devicePath, options); err != nil {
+		return nil, err
+	}
+	if len(ext4FormatArgs) > 0 {
+		if fstype != "ext4" {
+			klog.Warningf("Ignoring ext4 format options of volume %s with fstype %q", volumeID, fstype)
+		} else if err := ns.formatExt4(devicePath, ext4FormatArgs, options); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to format device (%q) as ext4 with options %v: %v", devicePath, ext4FormatArgs, err))
+		}
+	}
 	err = ns.Mounter.FormatAndMount(devicePath, stagingTargetPath, fstype, options)
+	if err != nil && ns.RepairFilesystemOnMountFailure {
+		err = ns.repairAndMount(ctx, devicePath, stagingTargetPath, fstype, options, err)
+	}
 	if err != nil {
 		return nil, status.Error(codes.Internal,
 			fmt.Sprintf("Failed to format and mount device from (%q) to (%q) with fstype (%q) and options (%q): %v",
@@ -311,7 +446,7 @@ func (ns *GCENodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStage
 }
 
 func (ns *GCENodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	klog.V(4).Infof("NodeUnstageVolume called with req: %#v", req)
+	klog.V(4).Infof("NodeUnstageVolume called with req: %v", protosanitizer.StripSecrets(req))
 
 	// Validate arguments
 	volumeID := req.GetVolumeId()
@@ -328,15 +463,29 @@ func (ns *GCENodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUns
 	}
 	defer ns.volumeLocks.Release(volumeID)
 
-	err := mount.CleanupMountPoint(stagingTargetPath, ns.Mounter.Interface, false /* bind mount */)
+	err := cleanupMountPoint(ctx, stagingTargetPath, ns.Mounter.Interface)
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeUnstageVolume failed to unmount at path %s: %v", stagingTargetPath, err))
 	}
+	if err := ns.closeLUKSDevice(ctx, volumeID); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeUnstageVolume failed to close LUKS device of volume %s: %v", volumeID, err))
+	}
+	// Links left behind by previously detached disks must neither be
+	// flushed nor used by the disk attached next to the same device
+	if err := ns.removeStaleDevicePaths(ctx, volumeID); err != nil {
+		klog.Errorf("Failed to remove stale device paths of volume %s: %v", volumeID, err)
+	}
+	// The disk is detached after unstaging, it must not have dirty pages left
+	if err := ns.flushDevice(ctx, volumeID); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeUnstageVolume failed to flush device of volume %s: %v", volumeID, err))
+	}
+	// The disk is detached after unstaging, its device may be reused
+	ns.deviceCache.remove(volumeID)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
 func (ns *GCENodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	klog.V(4).Infof("NodeGetCapabilities called with req: %#v", req)
+	klog.V(4).Infof("NodeGetCapabilities called with req: %v", protosanitizer.StripSecrets(req))
 
 	return &csi.NodeGetCapabilitiesResponse{
 		Capabilities: ns.Driver.nscap,
@@ -344,7 +493,7 @@ func (ns *GCENodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeG
 }
 
 func (ns *GCENodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	klog.V(4).Infof("NodeGetInfo called with req: %#v", req)
+	klog.V(4).Infof("NodeGetInfo called with req: %v", protosanitizer.StripSecrets(req))
 
 	top := &csi.Topology{
 		Segments: map[string]string{common.TopologyKeyZone: ns.MetadataService.GetZone()},
@@ -387,11 +536,21 @@ func (ns *GCENodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpa
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("ControllerExpandVolume volume ID is invalid: %v", err))
 	}
 
-	devicePath, err := ns.getDevicePath(volumeID, "")
+	devicePath, err := ns.getDevicePath(ctx, volumeID, "")
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("ControllerExpandVolume error when getting device path for %s: %v", volumeID, err))
 	}
 
+	mapperName, err := getLUKSMapperName(volKey)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if open, err := ns.DeviceUtils.IsLUKSDeviceOpen(mapperName); err != nil {
+		return nil, status.Error(codes.Internal, fmt.Sprintf("ControllerExpandVolume error checking LUKS device of %s: %v", volumeID, err))
+	} else if open {
+		return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("ControllerExpandVolume expansion of LUKS encrypted volume %s is not supported", volumeID))
+	}
+
 	// TODO(#328): Use requested size in resize if provided
 	resizer := resizefs.NewResizeFs(ns.Mounter)
 	_, err = resizer.Resize(devicePath, volumePath)
@@ -446,10 +605,21 @@ func (ns *GCENodeServer) GetVolumeLimits() (int64, error) {
 	} else {
 		volumeLimits = volumeLimit16
 	}
+	if ns.MaxVolumesPerNode > 0 {
+		if ns.MaxVolumesPerNode > volumeLimits {
+			klog.Warningf("Ignoring max volumes per node %d, it exceeds the limit %d of machine type %s", ns.MaxVolumesPerNode, volumeLimits, machineType)
+		} else {
+			volumeLimits = ns.MaxVolumesPerNode
+		}
+	}
 	return volumeLimits, nil
 }
 
-func (ns *GCENodeServer) getDevicePath(volumeID string, partition string) (string, error) {
+func (ns *GCENodeServer) getDevicePath(ctx context.Context, volumeID string, partition string) (string, error) {
+	if devicePath, ok := ns.deviceCache.get(volumeID, partition); ok {
+		klog.V(5).Infof("Using cached device path %s of volume %s", devicePath, volumeID)
+		return devicePath, nil
+	}
 	volumeKey, err := common.VolumeIDToKey(volumeID)
 	if err != nil {
 		return "", err
@@ -460,7 +630,7 @@ func (ns *GCENodeServer) getDevicePath(volumeID string, partition string) (strin
 	}
 
 	devicePaths := ns.DeviceUtils.GetDiskByIdPaths(deviceName, partition)
-	devicePath, err := ns.DeviceUtils.VerifyDevicePath(devicePaths)
+	devicePath, err := ns.DeviceUtils.VerifyDevicePath(ctx, devicePaths)
 
 	if err != nil {
 		return "", fmt.Errorf("error verifying GCE PD (%q) is attached: %v", volumeKey.Name, err)
@@ -468,9 +638,238 @@ func (ns *GCENodeServer) getDevicePath(volumeID string, partition string) (strin
 	if devicePath == "" {
 		return "", fmt.Errorf("unable to find device path out of attempted paths: %v", devicePaths)
 	}
+	ns.deviceCache.add(volumeID, partition, devicePath)
 	return devicePath, nil
 }
 
+// removeStaleDevicePaths removes the device paths of the volume that link to
+// the device of another disk
+func (ns *GCENodeServer) removeStaleDevicePaths(ctx context.Context, volumeID string) error {
+	volumeKey, err := common.VolumeIDToKey(volumeID)
+	if err != nil {
+		return err
+	}
+	deviceName, err := common.GetDeviceName(volumeKey)
+	if err != nil {
+		return fmt.Errorf("error getting device name: %v", err)
+	}
+	return ns.DeviceUtils.RemoveStaleDiskByIdPaths(ctx, deviceName, ns.DeviceUtils.GetDiskByIdPaths(deviceName, ""))
+}
+
+// getLUKSMapperName returns the name the LUKS device of the volume is opened
+// with
+func getLUKSMapperName(volumeKey *meta.Key) (string, error) {
+	deviceName, err := common.GetDeviceName(volumeKey)
+	if err != nil {
+		return "", fmt.Errorf("error getting device name: %v", err)
+	}
+	return "luks-" + deviceName, nil
+}
+
+// closeLUKSDevice closes the LUKS device of the volume, if it is encrypted
+func (ns *GCENodeServer) closeLUKSDevice(ctx context.Context, volumeID string) error {
+	volumeKey, err := common.VolumeIDToKey(volumeID)
+	if err != nil {
+		return err
+	}
+	mapperName, err := getLUKSMapperName(volumeKey)
+	if err != nil {
+		return err
+	}
+	return ns.DeviceUtils.CloseLUKSDevice(ctx, mapperName)
+}
+
+// flushDevice writes the buffered data of the volume's device to the disk.
+// Volumes whose device can't be found are not attached and have nothing to
+// flush, neither have devices which disappear while flushing because the disk
+// was detached out of band.
+func (ns *GCENodeServer) flushDevice(ctx context.Context, volumeID string) error {
+	devicePath, err := ns.getDevicePath(ctx, volumeID, "")
+	if err != nil {
+		klog.Warningf("Not flushing device of volume %s, it was not found: %v", volumeID, err)
+		return nil
+	}
+	if output, err := ns.Mounter.Exec.Run("sync"); err != nil {
+		return fmt.Errorf("sync failed: output: %s, err: %v", string(output), err)
+	}
+	if output, err := ns.Mounter.Exec.Run("blockdev", "--flushbufs", devicePath); err != nil {
+		if exists, existsErr := ns.Mounter.Interface.ExistsPath(devicePath); existsErr == nil && !exists {
+			klog.Warningf("Not flushing device %s of volume %s, it was removed: %v", devicePath, volumeID, err)
+			return nil
+		}
+		return fmt.Errorf("error flushing buffers of device %s: output: %s, err: %v", devicePath, string(output), err)
+	}
+	return nil
+}
+
+// getExt4FormatArgs returns the mkfs.ext4 arguments tuning the filesystem
+// according to the volume attributes, or none if the volume has no tuning
+func getExt4FormatArgs(volumeContext map[string]string) ([]string, error) {
+	args := []string{}
+	if v, ok := volumeContext[common.VolumeAttributeExt4ReservedBlocksPercentage]; ok {
+		percentage, err := common.ParseReservedBlocksPercentage(v)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, fmt.Sprintf("-m%d", percentage))
+	}
+	if v, ok := volumeContext[common.VolumeAttributeExt4LazyInit]; ok {
+		lazyInit, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q for volume attribute %q: %v", v, common.VolumeAttributeExt4LazyInit, err)
+		}
+		// Without lazy initialization the inode tables and journal are
+		// written by mkfs instead of in the background after mounting
+		init := "0"
+		if lazyInit {
+			init = "1"
+		}
+		args = append(args, "-E", fmt.Sprintf("lazy_itable_init=%s,lazy_journal_init=%s", init, init))
+	}
+	return args, nil
+}
+
+// formatExt4 formats the device as ext4 with the given mkfs arguments, unless
+// it is already formatted. FormatAndMount formats without the arguments.
+func (ns *GCENodeServer) formatExt4(devicePath string, args []string, mountOptions []string) error {
+	if hasReadOnlyOption(mountOptions) {
+		// Read only volumes are never formatted
+		return nil
+	}
+	format, err := ns.Mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return fmt.Errorf("error checking format of device %s: %v", devicePath, err)
+	}
+	if format != "" {
+		return nil
+	}
+	args = append(append([]string{"-F"}, args...), devicePath)
+	klog.Infof("Device %s is unformatted, formatting as ext4 with args %v", devicePath, args)
+	if output, err := ns.Mounter.Exec.Run("mkfs.ext4", args...); err != nil {
+		return fmt.Errorf("mkfs.ext4 failed: output: %s, err: %v", string(output), err)
+	}
+	return nil
+}
+
+// checkFilesystem checks the existing filesystem of the device with fsck
+// before FormatAndMount does, which can't be interrupted and blocks staging
+// for as long as checking a large filesystem takes. FormatAndMount's own
+// check of the then clean filesystem completes quickly. Read only volumes
+// are not checked.
+func (ns *GCENodeServer) checkFilesystem(ctx context.Context, devicePath string, mountOptions []string) error {
+	if hasReadOnlyOption(mountOptions) {
+		return nil
+	}
+	format, err := ns.Mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("Failed to check format of device %s: %v", devicePath, err))
+	}
+	if format == "" {
+		return nil
+	}
+	if ns.FsckTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ns.FsckTimeout)
+		defer cancel()
+	}
+	err = ns.DeviceUtils.CheckFilesystem(ctx, devicePath)
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return contextErrorToStatus(err, fmt.Sprintf("Filesystem check of device %s did not complete: %v", devicePath, err))
+	}
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("Failed to check filesystem of device %s: %v", devicePath, err))
+	}
+	return nil
+}
+
+// checkFsType returns FailedPrecondition if the device already contains a
+// filesystem other than fstype, which FormatAndMount would otherwise try to
+// mount as fstype. Unformatted devices are formatted as fstype later on.
+func (ns *GCENodeServer) checkFsType(devicePath, fstype string) (string, error) {
+	format, err := ns.Mounter.GetDiskFormat(devicePath)
+	if err != nil {
+		return "", status.Error(codes.Internal, fmt.Sprintf("Failed to check format of device %s: %v", devicePath, err))
+	}
+	if format == "" || format == fstype {
+		return format, nil
+	}
+	if ns.AllowFsTypeMismatch {
+		klog.Warningf("Device %s contains filesystem %q, mounting it as the requested fstype %q", devicePath, format, fstype)
+		return format, nil
+	}
+	return "", status.Error(codes.FailedPrecondition, fmt.Sprintf("Device %s already contains filesystem %q, not the requested fstype %q", devicePath, format, fstype))
+}
+
+// checkXFS checks the xfs filesystem of the device and repairs it if it is
+// corrupted and RepairXFSFilesystems is set
+func (ns *GCENodeServer) checkXFS(ctx context.Context, devicePath string) error {
+	checkCtx, cancel := context.WithTimeout(ctx, filesystemRepairTimeout)
+	defer cancel()
+	corrupted, err := ns.DeviceUtils.CheckXFSFilesystem(checkCtx, devicePath)
+	if err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("Failed to check xfs filesystem of device %s: %v", devicePath, err))
+	}
+	if !corrupted {
+		return nil
+	}
+	if !ns.RepairXFSFilesystems {
+		return status.Error(codes.Internal, fmt.Sprintf("xfs filesystem of device %s is corrupted, it must be repaired with xfs_repair before it is mounted", devicePath))
+	}
+	klog.Warningf("Repairing corrupted xfs filesystem of device %s", devicePath)
+	if err := ns.DeviceUtils.RepairFilesystem(checkCtx, devicePath, "xfs"); err != nil {
+		return status.Error(codes.Internal, fmt.Sprintf("Failed to repair corrupted xfs filesystem of device %s: %v", devicePath, err))
+	}
+	klog.Infof("Repaired xfs filesystem of device %s", devicePath)
+	return nil
+}
+
+// repairAndMount repairs the filesystem of the device after mounting it
+// failed with mountErr and mounts it again. Read only volumes and unformatted
+// devices are never repaired, mountErr is returned for them.
+func (ns *GCENodeServer) repairAndMount(ctx context.Context, devicePath, stagingTargetPath, fstype string, options []string, mountErr error) error {
+	if hasReadOnlyOption(options) {
+		return mountErr
+	}
+	format, err := ns.Mounter.GetDiskFormat(devicePath)
+	if err != nil || format != fstype {
+		return mountErr
+	}
+	repairCtx, cancel := context.WithTimeout(ctx, filesystemRepairTimeout)
+	defer cancel()
+	klog.Warningf("Mounting device %s failed: %v. Repairing its %s filesystem", devicePath, mountErr, fstype)
+	if err := ns.DeviceUtils.RepairFilesystem(repairCtx, devicePath, fstype); err != nil {
+		klog.Errorf(filesystemRepairLogFormat, "repair-failed", devicePath, fstype, err)
+		return fmt.Errorf("%v. Repairing the filesystem failed: %v", mountErr, err)
+	}
+	if err := ns.Mounter.FormatAndMount(devicePath, stagingTargetPath, fstype, options); err != nil {
+		klog.Errorf(filesystemRepairLogFormat, "mount-failed", devicePath, fstype, err)
+		return err
+	}
+	klog.Infof(filesystemRepairLogFormat, "repaired", devicePath, fstype, nil)
+	return nil
+}
+
+func hasReadOnlyOption(options []string) bool {
+	for _, option := range options {
+		if option == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+// setReadAhead sets the read_ahead_kb of the device. blockdev sets the
+// read-ahead of the whole disk for partitions.
+func (ns *GCENodeServer) setReadAhead(devicePath string, readAheadKB int64) error {
+	// blockdev takes the read-ahead in 512-byte sectors
+	sectors := strconv.FormatInt(readAheadKB*2, 10)
+	if output, err := ns.Mounter.Exec.Run("blockdev", "--setra", sectors, devicePath); err != nil {
+		return fmt.Errorf("error setting read-ahead of device %s to %d KB: output: %s, err: %v", devicePath, readAheadKB, string(output), err)
+	}
+	klog.V(4).Infof("Set read-ahead of device %s to %d KB", devicePath, readAheadKB)
+	return nil
+}
+
 func (ns *GCENodeServer) getBlockSizeBytes(devicePath string) (int64, error) {
 	output, err := ns.Mounter.Exec.Run("blockdev", "--getsize64", devicePath)
 	if err != nil {
@@ -18,19 +18,23 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
 	utilexec "k8s.io/utils/exec"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	metadataservice "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/metadata"
 	mountmanager "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/mount-manager"
 )
 
-const defaultVolumeID = "project/test001/zones/c1/disks/testDisk"
+const defaultVolumeID = "projects/test001/zones/c1/disks/testDisk"
 const defaultTargetPath = "/mnt/test"
 const defaultStagingPath = "/staging"
 
@@ -44,7 +48,8 @@ func getTestGCEDriverWithCustomMounter(t *testing.T, mounter *mount.SafeFormatAn
 
 func getCustomTestGCEDriver(t *testing.T, mounter *mount.SafeFormatAndMount, deviceUtils mountmanager.DeviceUtils, metaService metadataservice.MetadataService) *GCEDriver {
 	gceDriver := GetGCEDriver()
-	err := gceDriver.SetupGCEDriver(nil, mounter, deviceUtils, metaService, driver, "test-vendor")
+	nodeServer := NewNodeServer(gceDriver, mounter, deviceUtils, metaService)
+	err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, nil, nil, nodeServer)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
 	}
@@ -53,7 +58,8 @@ func getCustomTestGCEDriver(t *testing.T, mounter *mount.SafeFormatAndMount, dev
 
 func getTestBlockingGCEDriver(t *testing.T, readyToExecute chan chan struct{}) *GCEDriver {
 	gceDriver := GetGCEDriver()
-	err := gceDriver.SetupGCEDriver(nil, mountmanager.NewFakeSafeBlockingMounter(readyToExecute), mountmanager.NewFakeDeviceUtils(), metadataservice.NewFakeService(), driver, "test-vendor")
+	nodeServer := NewNodeServer(gceDriver, mountmanager.NewFakeSafeBlockingMounter(readyToExecute), mountmanager.NewFakeDeviceUtils(), metadataservice.NewFakeService())
+	err := gceDriver.SetupGCEDriver(driver, "test-vendor", nil, nil, nil, nodeServer)
 	if err != nil {
 		t.Fatalf("Failed to setup GCE Driver: %v", err)
 	}
@@ -67,9 +73,10 @@ func TestNodeGetVolumeLimits(t *testing.T) {
 	req := &csi.NodeGetInfoRequest{}
 
 	testCases := []struct {
-		name           string
-		machineType    string
-		expVolumeLimit int64
+		name              string
+		machineType       string
+		maxVolumesPerNode int64
+		expVolumeLimit    int64
 	}{
 		{
 			name:           "Predifined standard machine",
@@ -96,11 +103,24 @@ func TestNodeGetVolumeLimits(t *testing.T) {
 			machineType:    "custom-2-4096",
 			expVolumeLimit: volumeLimit128,
 		},
+		{
+			name:              "Lower max volumes per node",
+			machineType:       "n1-standard-1",
+			maxVolumesPerNode: 100,
+			expVolumeLimit:    100,
+		},
+		{
+			name:              "Higher max volumes per node",
+			machineType:       "f1-micro",
+			maxVolumesPerNode: 100,
+			expVolumeLimit:    volumeLimit16,
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Logf("Test case: %s", tc.name)
 		metadataservice.SetMachineType(tc.machineType)
+		ns.MaxVolumesPerNode = tc.maxVolumesPerNode
 		res, err := ns.NodeGetInfo(context.Background(), req)
 		if err != nil {
 			t.Fatalf("Failed to get node info: %v", err)
@@ -257,7 +277,7 @@ func TestNodeUnpublishVolume(t *testing.T) {
 func TestNodeStageVolume(t *testing.T) {
 	gceDriver := getTestGCEDriver(t)
 	ns := gceDriver.ns
-	volumeID := "project/test001/zones/c1/disks/testDisk"
+	volumeID := "projects/test001/zones/c1/disks/testDisk"
 	blockCap := &csi.VolumeCapability_Block{
 		Block: &csi.VolumeCapability_BlockVolume{},
 	}
@@ -341,10 +361,682 @@ func TestNodeStageVolume(t *testing.T) {
 	}
 }
 
+func TestNodeStageVolumeContextDone(t *testing.T) {
+	gceDriver := getTestGCEDriver(t)
+	ns := gceDriver.ns
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          defaultVolumeID,
+		StagingTargetPath: defaultStagingPath,
+		VolumeCapability:  stdVolCap,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ns.NodeStageVolume(ctx, req)
+	if status.Code(err) != codes.Canceled {
+		t.Fatalf("Expected error code: %v, got: %v. err : %v", codes.Canceled, status.Code(err), err)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = ns.NodeStageVolume(ctx, req)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Expected error code: %v, got: %v. err : %v", codes.DeadlineExceeded, status.Code(err), err)
+	}
+}
+
+func TestNodeStageVolumeReadAhead(t *testing.T) {
+	blockVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+	testCases := []struct {
+		name          string
+		readAheadKB   int64
+		volumeContext map[string]string
+		expCommands   []string
+		expErrCode    codes.Code
+	}{
+		{
+			name:        "kernel default",
+			expCommands: []string{},
+		},
+		{
+			name:        "node default",
+			readAheadKB: 1024,
+			expCommands: []string{"blockdev --setra 2048 /dev/disk/fake-path"},
+		},
+		{
+			name:          "volume attribute overrides node default",
+			readAheadKB:   1024,
+			volumeContext: map[string]string{common.VolumeAttributeReadAheadKB: "4096"},
+			expCommands:   []string{"blockdev --setra 8192 /dev/disk/fake-path"},
+		},
+		{
+			name:          "volume attribute keeps kernel default",
+			readAheadKB:   1024,
+			volumeContext: map[string]string{common.VolumeAttributeReadAheadKB: "0"},
+			expCommands:   []string{},
+		},
+		{
+			name:          "invalid volume attribute",
+			volumeContext: map[string]string{common.VolumeAttributeReadAheadKB: "lots"},
+			expCommands:   []string{},
+			expErrCode:    codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		commands := []string{}
+		execCallback := func(cmd string, args ...string) ([]byte, error) {
+			commands = append(commands, strings.Join(append([]string{cmd}, args...), " "))
+			return nil, nil
+		}
+		mounter := mountmanager.NewFakeSafeMounterWithCustomExec(mount.NewFakeExec(execCallback))
+		gceDriver := getTestGCEDriverWithCustomMounter(t, mounter)
+		gceDriver.ns.ReadAheadKB = tc.readAheadKB
+
+		_, err := gceDriver.ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+			VolumeCapability:  blockVolCap,
+			VolumeContext:     tc.volumeContext,
+		})
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if !reflect.DeepEqual(commands, tc.expCommands) {
+			t.Errorf("Expected commands %v, got: %v", tc.expCommands, commands)
+		}
+	}
+}
+
+func TestNodeStageVolumeExt4Format(t *testing.T) {
+	testCases := []struct {
+		name          string
+		volumeContext map[string]string
+		volumeCap     *csi.VolumeCapability
+		formatted     bool
+		expMkfsArgs   []string
+		expErrCode    codes.Code
+	}{
+		{
+			name:      "no tuning",
+			volumeCap: stdVolCap,
+		},
+		{
+			name: "reserved blocks and eager init",
+			volumeContext: map[string]string{
+				common.VolumeAttributeExt4ReservedBlocksPercentage: "1",
+				common.VolumeAttributeExt4LazyInit:                 "false",
+			},
+			volumeCap:   stdVolCap,
+			expMkfsArgs: []string{"-F", "-m1", "-E", "lazy_itable_init=0,lazy_journal_init=0", "/dev/disk/fake-path"},
+		},
+		{
+			name: "lazy init",
+			volumeContext: map[string]string{
+				common.VolumeAttributeExt4LazyInit: "true",
+			},
+			volumeCap:   stdVolCap,
+			expMkfsArgs: []string{"-F", "-E", "lazy_itable_init=1,lazy_journal_init=1", "/dev/disk/fake-path"},
+		},
+		{
+			name: "already formatted",
+			volumeContext: map[string]string{
+				common.VolumeAttributeExt4ReservedBlocksPercentage: "1",
+			},
+			volumeCap: stdVolCap,
+			formatted: true,
+		},
+		{
+			name: "other filesystem",
+			volumeContext: map[string]string{
+				common.VolumeAttributeExt4ReservedBlocksPercentage: "1",
+			},
+			volumeCap: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"},
+				},
+				AccessMode: stdVolCap.AccessMode,
+			},
+		},
+		{
+			name: "invalid reserved blocks percentage",
+			volumeContext: map[string]string{
+				common.VolumeAttributeExt4ReservedBlocksPercentage: "90",
+			},
+			volumeCap:  stdVolCap,
+			expErrCode: codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		var mkfsArgs []string
+		execCallback := func(cmd string, args ...string) ([]byte, error) {
+			switch cmd {
+			case "blkid":
+				if tc.formatted {
+					return []byte("DEVNAME=/dev/sdb\nTYPE=ext4"), nil
+				}
+				return nil, utilexec.CodeExitError{
+					Err:  errors.New("this is an exit error"),
+					Code: 2,
+				}
+			case "mkfs.ext4":
+				mkfsArgs = args
+			}
+			return nil, nil
+		}
+		mounter := mountmanager.NewFakeSafeMounterWithCustomExec(mount.NewFakeExec(execCallback))
+		gceDriver := getTestGCEDriverWithCustomMounter(t, mounter)
+
+		_, err := gceDriver.ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+			VolumeCapability:  tc.volumeCap,
+			VolumeContext:     tc.volumeContext,
+		})
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if !reflect.DeepEqual(mkfsArgs, tc.expMkfsArgs) {
+			t.Errorf("Expected mkfs.ext4 args %v, got: %v", tc.expMkfsArgs, mkfsArgs)
+		}
+	}
+}
+
+func TestNodeStageVolumeFsTypeMismatch(t *testing.T) {
+	xfsVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"},
+		},
+		AccessMode: stdVolCap.AccessMode,
+	}
+	testCases := []struct {
+		name       string
+		volumeCap  *csi.VolumeCapability
+		format     string
+		allow      bool
+		expMounted bool
+		expErrCode codes.Code
+	}{
+		{
+			name:       "unformatted",
+			volumeCap:  xfsVolCap,
+			expMounted: true,
+		},
+		{
+			name:       "matching filesystem",
+			volumeCap:  xfsVolCap,
+			format:     "xfs",
+			expMounted: true,
+		},
+		{
+			name:       "matching default filesystem",
+			volumeCap:  stdVolCap,
+			format:     "ext4",
+			expMounted: true,
+		},
+		{
+			name:       "other filesystem",
+			volumeCap:  xfsVolCap,
+			format:     "ext4",
+			expErrCode: codes.FailedPrecondition,
+		},
+		{
+			name:       "other filesystem than default",
+			volumeCap:  stdVolCap,
+			format:     "xfs",
+			expErrCode: codes.FailedPrecondition,
+		},
+		{
+			name:       "other filesystem allowed",
+			volumeCap:  xfsVolCap,
+			format:     "ext4",
+			allow:      true,
+			expMounted: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		execCallback := func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "blkid" {
+				if tc.format == "" {
+					return nil, utilexec.CodeExitError{
+						Err:  errors.New("this is an exit error"),
+						Code: 2,
+					}
+				}
+				return []byte("DEVNAME=/dev/sdb\nTYPE=" + tc.format), nil
+			}
+			return nil, nil
+		}
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+		mounter := mountmanager.NewCustomFakeSafeMounter(fakeMounter, mount.NewFakeExec(execCallback))
+		gceDriver := getTestGCEDriverWithCustomMounter(t, mounter)
+		gceDriver.ns.AllowFsTypeMismatch = tc.allow
+
+		_, err := gceDriver.ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+			VolumeCapability:  tc.volumeCap,
+		})
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if mounted := len(fakeMounter.MountPoints) > 0; mounted != tc.expMounted {
+			t.Errorf("Expected device mounted: %v, got: %v", tc.expMounted, mounted)
+		}
+	}
+}
+
+// corruptMounter fails the first failedMounts mounts, as mounting a corrupted
+// filesystem does
+type corruptMounter struct {
+	*mount.FakeMounter
+	failedMounts int
+	mounts       int
+}
+
+func (m *corruptMounter) Mount(source string, target string, fstype string, options []string) error {
+	m.mounts++
+	if m.mounts <= m.failedMounts {
+		return errors.New("mount: wrong fs type, bad option, bad superblock")
+	}
+	return m.FakeMounter.Mount(source, target, fstype, options)
+}
+
+func TestNodeStageVolumeRepairFilesystem(t *testing.T) {
+	roVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{MountFlags: []string{"ro"}},
+		},
+		AccessMode: stdVolCap.AccessMode,
+	}
+	testCases := []struct {
+		name         string
+		volumeCap    *csi.VolumeCapability
+		repair       bool
+		failedMounts int
+		expRepaired  []string
+		expErrCode   codes.Code
+	}{
+		{
+			name:      "mount succeeded",
+			volumeCap: stdVolCap,
+			repair:    true,
+		},
+		{
+			name:         "repair disabled",
+			volumeCap:    stdVolCap,
+			failedMounts: 1,
+			expErrCode:   codes.Internal,
+		},
+		{
+			name:         "repaired",
+			volumeCap:    stdVolCap,
+			repair:       true,
+			failedMounts: 1,
+			expRepaired:  []string{"/dev/disk/fake-path"},
+		},
+		{
+			name:         "mount failed after repair",
+			volumeCap:    stdVolCap,
+			repair:       true,
+			failedMounts: 2,
+			expRepaired:  []string{"/dev/disk/fake-path"},
+			expErrCode:   codes.Internal,
+		},
+		{
+			name:         "read only volume",
+			volumeCap:    roVolCap,
+			repair:       true,
+			failedMounts: 1,
+			expErrCode:   codes.Internal,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		execCallback := func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "blkid" {
+				return []byte("DEVNAME=/dev/sdb\nTYPE=ext4"), nil
+			}
+			return nil, nil
+		}
+		fakeMounter := &corruptMounter{
+			FakeMounter:  &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}},
+			failedMounts: tc.failedMounts,
+		}
+		mounter := mountmanager.NewCustomFakeSafeMounter(fakeMounter, mount.NewFakeExec(execCallback))
+		deviceUtils := mountmanager.NewFakeDeviceUtils()
+		gceDriver := getCustomTestGCEDriver(t, mounter, deviceUtils, metadataservice.NewFakeService())
+		gceDriver.ns.RepairFilesystemOnMountFailure = tc.repair
+
+		_, err := gceDriver.ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+			VolumeCapability:  tc.volumeCap,
+		})
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if repaired := deviceUtils.RepairedDevices(); !reflect.DeepEqual(repaired, tc.expRepaired) {
+			t.Errorf("Expected repaired devices %v, got: %v", tc.expRepaired, repaired)
+		}
+	}
+}
+
+func TestNodeStageVolumeCheckXFS(t *testing.T) {
+	xfsVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"},
+		},
+		AccessMode: stdVolCap.AccessMode,
+	}
+	roXFSVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs", MountFlags: []string{"ro"}},
+		},
+		AccessMode: stdVolCap.AccessMode,
+	}
+	testCases := []struct {
+		name        string
+		volumeCap   *csi.VolumeCapability
+		check       bool
+		repair      bool
+		corrupted   bool
+		expRepaired []string
+		expErrCode  codes.Code
+	}{
+		{
+			name:      "check disabled",
+			volumeCap: xfsVolCap,
+			corrupted: true,
+		},
+		{
+			name:      "clean filesystem",
+			volumeCap: xfsVolCap,
+			check:     true,
+		},
+		{
+			name:       "corrupted filesystem",
+			volumeCap:  xfsVolCap,
+			check:      true,
+			corrupted:  true,
+			expErrCode: codes.Internal,
+		},
+		{
+			name:        "corrupted filesystem repaired",
+			volumeCap:   xfsVolCap,
+			check:       true,
+			repair:      true,
+			corrupted:   true,
+			expRepaired: []string{"/dev/disk/fake-path"},
+		},
+		{
+			name:      "read only volume",
+			volumeCap: roXFSVolCap,
+			check:     true,
+			corrupted: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		execCallback := func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "blkid" {
+				return []byte("DEVNAME=/dev/sdb\nTYPE=xfs"), nil
+			}
+			return nil, nil
+		}
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+		mounter := mountmanager.NewCustomFakeSafeMounter(fakeMounter, mount.NewFakeExec(execCallback))
+		deviceUtils := mountmanager.NewFakeDeviceUtils()
+		deviceUtils.SetCorrupted("/dev/disk/fake-path", tc.corrupted)
+		gceDriver := getCustomTestGCEDriver(t, mounter, deviceUtils, metadataservice.NewFakeService())
+		gceDriver.ns.CheckXFSFilesystems = tc.check
+		gceDriver.ns.RepairXFSFilesystems = tc.repair
+
+		_, err := gceDriver.ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+			VolumeCapability:  tc.volumeCap,
+		})
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if repaired := deviceUtils.RepairedDevices(); !reflect.DeepEqual(repaired, tc.expRepaired) {
+			t.Errorf("Expected repaired devices %v, got: %v", tc.expRepaired, repaired)
+		}
+		if mounted := len(fakeMounter.MountPoints) > 0; mounted != (err == nil) {
+			t.Errorf("Expected device mounted: %v, got: %v", err == nil, mounted)
+		}
+	}
+}
+
+func TestNodeStageVolumeReadOnly(t *testing.T) {
+	testCases := []struct {
+		name           string
+		publishContext map[string]string
+		mountFlags     []string
+		expOptions     []string
+	}{
+		{
+			name:       "read write",
+			expOptions: []string{"defaults"},
+		},
+		{
+			name:           "attached read only",
+			publishContext: map[string]string{common.PublishContextKeyReadOnly: "true"},
+			expOptions:     []string{"ro", "defaults"},
+		},
+		{
+			name:           "attached read only with ro mount flag",
+			publishContext: map[string]string{common.PublishContextKeyReadOnly: "true"},
+			mountFlags:     []string{"ro"},
+			expOptions:     []string{"ro", "defaults"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+		mounter := mountmanager.NewCustomFakeSafeMounter(fakeMounter, mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "blkid" {
+				return []byte("DEVNAME=/dev/sdb\nTYPE=ext4"), nil
+			}
+			return nil, nil
+		}))
+		gceDriver := getTestGCEDriverWithCustomMounter(t, mounter)
+
+		_, err := gceDriver.ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+			PublishContext:    tc.publishContext,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: tc.mountFlags},
+				},
+				AccessMode: stdVolCap.AccessMode,
+			},
+		})
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			continue
+		}
+		if len(fakeMounter.MountPoints) != 1 || !reflect.DeepEqual(fakeMounter.MountPoints[0].Opts, tc.expOptions) {
+			t.Errorf("Expected the device mounted with options %v, got mounts: %+v", tc.expOptions, fakeMounter.MountPoints)
+		}
+	}
+}
+
+func TestNodeStageVolumeLUKS(t *testing.T) {
+	blockVolCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: stdVolCap.AccessMode,
+	}
+	luksContext := map[string]string{common.VolumeAttributeLUKSEncryption: "true"}
+	luksSecrets := map[string]string{common.SecretKeyLUKSKey: "passphrase"}
+	testCases := []struct {
+		name          string
+		volumeContext map[string]string
+		secrets       map[string]string
+		volumeCap     *csi.VolumeCapability
+		expDevice     string
+		expErrCode    codes.Code
+	}{
+		{
+			name:      "unencrypted",
+			volumeCap: stdVolCap,
+			expDevice: "/dev/disk/fake-path",
+		},
+		{
+			name:          "encrypted",
+			volumeContext: luksContext,
+			secrets:       luksSecrets,
+			volumeCap:     stdVolCap,
+			expDevice:     "/dev/mapper/luks-testDisk",
+		},
+		{
+			name:          "encrypted without key",
+			volumeContext: luksContext,
+			volumeCap:     stdVolCap,
+			expErrCode:    codes.InvalidArgument,
+		},
+		{
+			name:          "encrypted block volume",
+			volumeContext: luksContext,
+			secrets:       luksSecrets,
+			volumeCap:     blockVolCap,
+			expErrCode:    codes.InvalidArgument,
+		},
+		{
+			name:          "invalid volume attribute",
+			volumeContext: map[string]string{common.VolumeAttributeLUKSEncryption: "maybe"},
+			secrets:       luksSecrets,
+			volumeCap:     stdVolCap,
+			expErrCode:    codes.InvalidArgument,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+		mounter := mountmanager.NewCustomFakeSafeMounter(fakeMounter, mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) { return nil, nil }))
+		deviceUtils := mountmanager.NewFakeDeviceUtils()
+		gceDriver := getCustomTestGCEDriver(t, mounter, deviceUtils, metadataservice.NewFakeService())
+
+		_, err := gceDriver.ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+			VolumeCapability:  tc.volumeCap,
+			VolumeContext:     tc.volumeContext,
+			Secrets:           tc.secrets,
+		})
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if err != nil {
+			continue
+		}
+		if len(fakeMounter.MountPoints) != 1 || fakeMounter.MountPoints[0].Device != tc.expDevice {
+			t.Errorf("Expected %s to be mounted, got mounts: %v", tc.expDevice, fakeMounter.MountPoints)
+		}
+
+		_, err = gceDriver.ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+		})
+		if err != nil {
+			t.Errorf("NodeUnstageVolume got unexpected error: %v", err)
+		}
+		if open, _ := deviceUtils.IsLUKSDeviceOpen("luks-testDisk"); open {
+			t.Errorf("Expected LUKS device to be closed after NodeUnstageVolume")
+		}
+	}
+}
+
+func TestNodeStageVolumeCheckFilesystem(t *testing.T) {
+	testCases := []struct {
+		name         string
+		formatted    bool
+		mountFlags   []string
+		slowCheck    bool
+		expChecked   []string
+		expErrCode   codes.Code
+		expMountsLen int
+	}{
+		{
+			name:         "unformatted",
+			expMountsLen: 1,
+		},
+		{
+			name:         "formatted",
+			formatted:    true,
+			expChecked:   []string{"/dev/disk/fake-path"},
+			expMountsLen: 1,
+		},
+		{
+			name:         "read only",
+			formatted:    true,
+			mountFlags:   []string{"ro"},
+			expMountsLen: 1,
+		},
+		{
+			name:       "check timed out",
+			formatted:  true,
+			slowCheck:  true,
+			expChecked: []string{"/dev/disk/fake-path"},
+			expErrCode: codes.DeadlineExceeded,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		execCallback := func(cmd string, args ...string) ([]byte, error) {
+			if cmd == "blkid" && tc.formatted {
+				return []byte("DEVNAME=/dev/sdb\nTYPE=ext4"), nil
+			}
+			return nil, nil
+		}
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+		mounter := mountmanager.NewCustomFakeSafeMounter(fakeMounter, mount.NewFakeExec(execCallback))
+		deviceUtils := mountmanager.NewFakeDeviceUtils()
+		if tc.slowCheck {
+			deviceUtils.BlockFilesystemChecks()
+		}
+		gceDriver := getCustomTestGCEDriver(t, mounter, deviceUtils, metadataservice.NewFakeService())
+		gceDriver.ns.FsckTimeout = 10 * time.Millisecond
+
+		_, err := gceDriver.ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: tc.mountFlags},
+				},
+				AccessMode: stdVolCap.AccessMode,
+			},
+		})
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if checked := deviceUtils.CheckedDevices(); !reflect.DeepEqual(checked, tc.expChecked) {
+			t.Errorf("Expected checked devices %v, got: %v", tc.expChecked, checked)
+		}
+		if len(fakeMounter.MountPoints) != tc.expMountsLen {
+			t.Errorf("Expected %d mounts, got: %v", tc.expMountsLen, fakeMounter.MountPoints)
+		}
+	}
+}
+
 func TestNodeExpandVolume(t *testing.T) {
 	// TODO: Add tests/functionality for non-existant volume
 	var resizedBytes int64 = 2000000000
-	volumeID := "project/test001/zones/c1/disks/testDisk"
+	volumeID := "projects/test001/zones/c1/disks/testDisk"
 	testCases := []struct {
 		name         string
 		req          *csi.NodeExpandVolumeRequest
@@ -497,6 +1189,133 @@ func TestNodeUnstageVolume(t *testing.T) {
 	}
 }
 
+func TestNodeUnstageVolumeFlushesDevice(t *testing.T) {
+	testCases := []struct {
+		name        string
+		flushErr    error
+		deviceGone  bool
+		expCommands []string
+		expErrCode  codes.Code
+	}{
+		{
+			name:        "device flushed",
+			expCommands: []string{"sync", "blockdev --flushbufs /dev/disk/fake-path"},
+		},
+		{
+			name:        "flush failed",
+			flushErr:    errors.New("flush failed"),
+			expCommands: []string{"sync", "blockdev --flushbufs /dev/disk/fake-path"},
+			expErrCode:  codes.Internal,
+		},
+		{
+			name:        "device detached out of band",
+			flushErr:    errors.New("blockdev: cannot open /dev/disk/fake-path: No such device or address"),
+			deviceGone:  true,
+			expCommands: []string{"sync", "blockdev --flushbufs /dev/disk/fake-path"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		commands := []string{}
+		execCallback := func(cmd string, args ...string) ([]byte, error) {
+			commands = append(commands, strings.Join(append([]string{cmd}, args...), " "))
+			if cmd == "blockdev" {
+				return nil, tc.flushErr
+			}
+			return nil, nil
+		}
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+		if !tc.deviceGone {
+			fakeMounter.Filesystem = map[string]mount.FileType{"/dev/disk/fake-path": mount.FileTypeBlockDev}
+		}
+		mounter := mountmanager.NewCustomFakeSafeMounter(fakeMounter, mount.NewFakeExec(execCallback))
+		gceDriver := getTestGCEDriverWithCustomMounter(t, mounter)
+
+		_, err := gceDriver.ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+		})
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+		if !reflect.DeepEqual(commands, tc.expCommands) {
+			t.Errorf("Expected commands %v, got: %v", tc.expCommands, commands)
+		}
+	}
+}
+
+func TestNodeUnstageVolumeDevicePath(t *testing.T) {
+	const (
+		googleLink = "/dev/disk/by-id/google-testDisk"
+		scsiLink   = "/dev/disk/by-id/scsi-0Google_PersistentDisk_testDisk"
+	)
+	testCases := []struct {
+		name          string
+		links         map[string]string
+		expGoogleLink bool
+		expCommands   []string
+	}{
+		{
+			name:          "device path of the disk",
+			links:         map[string]string{googleLink: "../../sdc", scsiLink: "../../sdc"},
+			expGoogleLink: true,
+			expCommands:   []string{"sync", "blockdev --flushbufs " + googleLink},
+		},
+		{
+			name:        "stale device path of a detached disk",
+			links:       map[string]string{googleLink: "../../sdb", scsiLink: "../../sdc"},
+			expCommands: []string{"sync", "blockdev --flushbufs " + scsiLink},
+		},
+		{
+			name:        "disk already detached",
+			links:       map[string]string{googleLink: "../../sdb"},
+			expCommands: []string{},
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("Test case: %s", tc.name)
+		fs := mountmanager.NewFakeDeviceFS()
+		fs.AddDevice("/dev/sdb")
+		fs.AddDevice("/dev/sdc")
+		for link, target := range tc.links {
+			fs.AddLink(link, target)
+		}
+		// Identifiers of page 0x83 as printed by scsi_id
+		ids := map[string]string{
+			"/dev/sdb": "0Google  PersistentDisk  otherDisk\n",
+			"/dev/sdc": "0Google  PersistentDisk  testDisk\n",
+		}
+		exec := mountmanager.NewFakeDeviceExec(func(input []byte, cmd string, args ...string) ([]byte, int, error) {
+			if cmd == "/lib/udev/scsi_id" {
+				return []byte(ids[strings.TrimPrefix(args[2], "--device=")]), 0, nil
+			}
+			return nil, 0, nil
+		})
+		commands := []string{}
+		execCallback := func(cmd string, args ...string) ([]byte, error) {
+			commands = append(commands, strings.Join(append([]string{cmd}, args...), " "))
+			return nil, nil
+		}
+		fakeMounter := &mount.FakeMounter{MountPoints: []mount.MountPoint{}, Log: []mount.FakeAction{}}
+		mounter := mountmanager.NewCustomFakeSafeMounter(fakeMounter, mount.NewFakeExec(execCallback))
+		gceDriver := getCustomTestGCEDriver(t, mounter, mountmanager.NewCustomDeviceUtils(exec, fs), metadataservice.NewFakeService())
+
+		_, err := gceDriver.ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+			VolumeId:          defaultVolumeID,
+			StagingTargetPath: defaultStagingPath,
+		})
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if fs.Exists(googleLink) != tc.expGoogleLink {
+			t.Errorf("Expected %s to exist: %v", googleLink, tc.expGoogleLink)
+		}
+		if !reflect.DeepEqual(commands, tc.expCommands) {
+			t.Errorf("Expected commands %v, got: %v", tc.expCommands, commands)
+		}
+	}
+}
+
 func TestNodeGetCapabilities(t *testing.T) {
 	gceDriver := getTestGCEDriver(t)
 	ns := gceDriver.ns
@@ -0,0 +1,283 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+)
+
+const (
+	// Mounted into every pod that uses a service account
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// Timeout of a single request listing PersistentVolumes
+	pvRequestTimeout = 30 * time.Second
+	// Number of PersistentVolumes listed per request
+	pvListPageSize = 500
+)
+
+// PersistentVolumeRef identifies a PersistentVolume and the disk it
+// references
+type PersistentVolumeRef struct {
+	Name string
+	// DiskName is the name of the disk of the CSI volume handle or of the
+	// in-tree GCE PD volume source, if any
+	DiskName string
+}
+
+// PVLister lists the PersistentVolumes of the cluster
+type PVLister interface {
+	ListPVs(ctx context.Context) ([]PersistentVolumeRef, error)
+}
+
+// OrphanedDiskCollector finds disks created by the driver whose
+// PersistentVolume no longer exists, e.g. because provisioning was
+// interrupted after the disk was created, and logs them. Orphaned disks are
+// never deleted: the PersistentVolume of a disk may have been deleted on
+// purpose to retain it, which can't be told apart once it is gone.
+type OrphanedDiskCollector struct {
+	cs  *GCEControllerServer
+	pvs PVLister
+	// minAge is the age below which disks are never orphaned, so that disks
+	// whose PersistentVolume is still being created are skipped
+	minAge time.Duration
+}
+
+func NewOrphanedDiskCollector(cs *GCEControllerServer, pvs PVLister, minAge time.Duration) *OrphanedDiskCollector {
+	return &OrphanedDiskCollector{
+		cs:     cs,
+		pvs:    pvs,
+		minAge: minAge,
+	}
+}
+
+// Run collects orphaned disks every interval until stopCh is closed
+func (c *OrphanedDiskCollector) Run(interval time.Duration, stopCh <-chan struct{}) {
+	klog.Infof("Collecting orphaned disks every %v", interval)
+	wait.Until(func() {
+		if _, err := c.collect(context.Background()); err != nil {
+			klog.Errorf("Failed to collect orphaned disks: %v", err)
+		}
+	}, interval, stopCh)
+}
+
+// collect logs the orphaned disks and returns their names
+func (c *OrphanedDiskCollector) collect(ctx context.Context) ([]string, error) {
+	disks, err := c.cs.CloudProvider.ListDisks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list disks: %v", err)
+	}
+	pvs, err := c.pvs.ListPVs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PersistentVolumes: %v", err)
+	}
+	pvNames := map[string]bool{}
+	referencedDisks := map[string]bool{}
+	for _, pv := range pvs {
+		pvNames[pv.Name] = true
+		if pv.DiskName != "" {
+			referencedDisks[pv.DiskName] = true
+		}
+	}
+
+	orphaned := []string{}
+	for _, disk := range disks {
+		pvName, ok := c.getOrphanCandidatePVName(disk, time.Now())
+		if !ok || pvNames[pvName] {
+			continue
+		}
+		// Disks may be imported by PersistentVolumes of other names, e.g.
+		// after the original one was deleted to retain the disk
+		if referencedDisks[disk.Name] {
+			continue
+		}
+		klog.Warningf("Disk %s was created for PersistentVolume %s, which no longer exists, and no other PersistentVolume references it. The disk is orphaned and can be deleted unless it is retained on purpose", disk.SelfLink, pvName)
+		orphaned = append(orphaned, disk.Name)
+	}
+	return orphaned, nil
+}
+
+// getOrphanCandidatePVName returns the name of the PersistentVolume the disk
+// was created for, if the disk was created by the driver in this cluster, is
+// not attached to any instance and is older than the minimum age
+func (c *OrphanedDiskCollector) getOrphanCandidatePVName(disk *compute.Disk, now time.Time) (string, bool) {
+	description := map[string]string{}
+	if err := json.Unmarshal([]byte(disk.Description), &description); err != nil {
+		// Not created by the driver
+		return "", false
+	}
+	if description[common.DiskDescriptionKeyCreatedBy] != c.cs.Driver.name || description[common.DiskDescriptionKeyClusterID] != c.cs.ClusterID {
+		return "", false
+	}
+	pvName := description[common.DiskDescriptionKeyPVName]
+	if pvName == "" || len(disk.Users) > 0 {
+		return "", false
+	}
+	created, err := time.Parse(time.RFC3339, disk.CreationTimestamp)
+	if err != nil {
+		klog.Warningf("Disk %s has invalid creation timestamp %q: %v", disk.Name, disk.CreationTimestamp, err)
+		return "", false
+	}
+	if now.Sub(created) < c.minAge {
+		return "", false
+	}
+	return pvName, true
+}
+
+// kubePVLister lists PersistentVolumes with the Kubernetes API of the
+// cluster the driver runs in
+type kubePVLister struct {
+	host      string
+	tokenFile string
+	client    *http.Client
+}
+
+// NewInClusterPVLister returns a PVLister that authenticates to the
+// Kubernetes API with the service account of the driver pod
+func NewInClusterPVLister() (PVLister, error) {
+	host, client, err := newInClusterClient(pvRequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &kubePVLister{
+		host:      host,
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		client:    client,
+	}, nil
+}
+
+// newInClusterClient returns the address of the Kubernetes API of the cluster
+// the driver runs in and a client trusting its CA. Requests must authenticate
+// with the token in serviceAccountDir.
+func newInClusterClient(timeout time.Duration) (string, *http.Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", nil, fmt.Errorf("not running in a Kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+	caFile := filepath.Join(serviceAccountDir, "ca.crt")
+	ca, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read CA certificate %s: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return "", nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return "https://" + net.JoinHostPort(host, port), &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}, nil
+}
+
+// pvList is the subset of a PersistentVolumeList the collector needs
+type pvList struct {
+	Metadata struct {
+		Continue string `json:"continue"`
+	} `json:"metadata"`
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Spec struct {
+			CSI *struct {
+				VolumeHandle string `json:"volumeHandle"`
+			} `json:"csi"`
+			GCEPersistentDisk *struct {
+				PDName string `json:"pdName"`
+			} `json:"gcePersistentDisk"`
+		} `json:"spec"`
+	} `json:"items"`
+}
+
+func (k *kubePVLister) ListPVs(ctx context.Context) ([]PersistentVolumeRef, error) {
+	refs := []PersistentVolumeRef{}
+	continueToken := ""
+	for {
+		list, err := k.listPage(ctx, continueToken)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			ref := PersistentVolumeRef{Name: item.Metadata.Name}
+			switch {
+			case item.Spec.CSI != nil:
+				// Volume handles are volume IDs, of any driver. Only their
+				// last element is compared so that underspecified IDs and
+				// self links match as well.
+				handle := item.Spec.CSI.VolumeHandle
+				ref.DiskName = handle[strings.LastIndex(handle, "/")+1:]
+			case item.Spec.GCEPersistentDisk != nil:
+				ref.DiskName = item.Spec.GCEPersistentDisk.PDName
+			}
+			refs = append(refs, ref)
+		}
+		if list.Metadata.Continue == "" {
+			return refs, nil
+		}
+		continueToken = list.Metadata.Continue
+	}
+}
+
+func (k *kubePVLister) listPage(ctx context.Context, continueToken string) (*pvList, error) {
+	// The token is read on every request since it is rotated
+	token, err := ioutil.ReadFile(k.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %v", err)
+	}
+	query := url.Values{"limit": []string{strconv.Itoa(pvListPageSize)}}
+	if continueToken != "" {
+		query.Set("continue", continueToken)
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/api/v1/persistentvolumes?%s", k.host, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("unexpected status %s listing PersistentVolumes: %s", resp.Status, body)
+	}
+	list := &pvList{}
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return nil, fmt.Errorf("failed to decode PersistentVolumes: %v", err)
+	}
+	return list, nil
+}
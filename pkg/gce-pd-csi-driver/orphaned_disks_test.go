@@ -0,0 +1,194 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-cloud-provider/pkg/cloud/meta"
+	compute "google.golang.org/api/compute/v1"
+
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+)
+
+type fakePVLister struct {
+	pvs []PersistentVolumeRef
+}
+
+func (f *fakePVLister) ListPVs(ctx context.Context) ([]PersistentVolumeRef, error) {
+	return f.pvs, nil
+}
+
+func TestCollectOrphanedDisks(t *testing.T) {
+	clusterID := "test-cluster"
+	old := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+	description := func(createdBy, cluster, pvName string) string {
+		b, _ := json.Marshal(map[string]string{
+			common.DiskDescriptionKeyCreatedBy: createdBy,
+			common.DiskDescriptionKeyClusterID: cluster,
+			common.DiskDescriptionKeyPVName:    pvName,
+		})
+		return string(b)
+	}
+	newDisk := func(diskName, desc, created string, users []string) *gce.CloudDisk {
+		return gce.ZonalCloudDisk(&compute.Disk{
+			Name:              diskName,
+			Description:       desc,
+			CreationTimestamp: created,
+			Users:             users,
+			SelfLink:          fmt.Sprintf("projects/%s/zones/%s/disks/%s", project, zone, diskName),
+		})
+	}
+
+	testCases := []struct {
+		name        string
+		disk        *gce.CloudDisk
+		pvs         []PersistentVolumeRef
+		expOrphaned bool
+	}{
+		{
+			name:        "orphaned disk",
+			disk:        newDisk("disk", description(driver, clusterID, "pv"), old, nil),
+			expOrphaned: true,
+		},
+		{
+			name: "disk with existing pv",
+			disk: newDisk("disk", description(driver, clusterID, "pv"), old, nil),
+			pvs:  []PersistentVolumeRef{{Name: "pv", DiskName: "disk"}},
+		},
+		{
+			name: "disk imported by other pv",
+			disk: newDisk("disk", description(driver, clusterID, "pv"), old, nil),
+			pvs:  []PersistentVolumeRef{{Name: "static-pv", DiskName: "disk"}},
+		},
+		{
+			name:        "other disks referenced",
+			disk:        newDisk("disk", description(driver, clusterID, "pv"), old, nil),
+			pvs:         []PersistentVolumeRef{{Name: "other-pv", DiskName: "other-disk"}, {Name: "nfs-pv"}},
+			expOrphaned: true,
+		},
+		{
+			name: "disk of other driver",
+			disk: newDisk("disk", description("other-driver", clusterID, "pv"), old, nil),
+		},
+		{
+			name: "disk of other cluster",
+			disk: newDisk("disk", description(driver, "other-cluster", "pv"), old, nil),
+		},
+		{
+			name: "disk without pv name",
+			disk: newDisk("disk", description(driver, clusterID, ""), old, nil),
+		},
+		{
+			name: "disk without json description",
+			disk: newDisk("disk", "manually created", old, nil),
+		},
+		{
+			name: "attached disk",
+			disk: newDisk("disk", description(driver, clusterID, "pv"), old, []string{"instance"}),
+		},
+		{
+			name: "recently created disk",
+			disk: newDisk("disk", description(driver, clusterID, "pv"), time.Now().Format(time.RFC3339), nil),
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		gceDriver := initGCEDriver(t, []*gce.CloudDisk{tc.disk})
+		gceDriver.cs.ClusterID = clusterID
+		collector := NewOrphanedDiskCollector(gceDriver.cs, &fakePVLister{pvs: tc.pvs}, time.Hour)
+
+		orphaned, err := collector.collect(context.Background())
+		if err != nil {
+			t.Fatalf("collect did not expect error, but got %v", err)
+		}
+		if (len(orphaned) > 0) != tc.expOrphaned {
+			t.Errorf("Expected disk orphaned: %v, got orphaned disks: %v", tc.expOrphaned, orphaned)
+		}
+
+		// Orphaned disks are only logged
+		if _, err := gceDriver.cs.CloudProvider.GetDisk(context.Background(), meta.ZonalKey(tc.disk.GetName(), zone)); err != nil {
+			t.Errorf("Expected disk to be kept, got: %v", err)
+		}
+	}
+}
+
+func TestKubePVLister(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "orphaned-disks-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tokenFile := filepath.Join(tmpDir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("test-token\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	pages := map[string]string{
+		"": `{"metadata": {"continue": "page2"}, "items": [
+			{"metadata": {"name": "csi-pv"}, "spec": {"csi": {"driver": "pd.csi.storage.gke.io", "volumeHandle": "projects/p/zones/z/disks/disk-1"}}},
+			{"metadata": {"name": "nfs-pv"}, "spec": {"nfs": {"server": "nfs", "path": "/"}}}]}`,
+		"page2": `{"metadata": {}, "items": [
+			{"metadata": {"name": "in-tree-pv"}, "spec": {"gcePersistentDisk": {"pdName": "disk-2"}}}]}`,
+	}
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		page, ok := pages[r.URL.Query().Get("continue")]
+		if failing || r.URL.Path != "/api/v1/persistentvolumes" || r.URL.Query().Get("limit") == "" || !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(page))
+	}))
+	defer server.Close()
+
+	lister := &kubePVLister{
+		host:      server.URL,
+		tokenFile: tokenFile,
+		client:    server.Client(),
+	}
+	pvs, err := lister.ListPVs(context.Background())
+	if err != nil {
+		t.Fatalf("ListPVs got unexpected error: %v", err)
+	}
+	expPVs := []PersistentVolumeRef{
+		{Name: "csi-pv", DiskName: "disk-1"},
+		{Name: "nfs-pv"},
+		{Name: "in-tree-pv", DiskName: "disk-2"},
+	}
+	if !reflect.DeepEqual(pvs, expPVs) {
+		t.Errorf("Expected PersistentVolumes %+v, got: %+v", expPVs, pvs)
+	}
+
+	failing = true
+	if _, err := lister.ListPVs(context.Background()); err == nil {
+		t.Errorf("Expected error listing PersistentVolumes, got none")
+	}
+}
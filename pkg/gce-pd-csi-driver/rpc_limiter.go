@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog"
+)
+
+// identityServicePrefix is the method prefix of the CSI identity service.
+// Identity RPCs are cheap and Probe is used for liveness, so they are never
+// limited.
+const identityServicePrefix = "/csi.v1.Identity/"
+
+// rpcLimiter rejects RPCs with Aborted once the number of in-flight RPCs
+// overall or of a single method reaches its limit. Rejecting instead of
+// queueing lets the CO back off and retry, e.g. when every pod on a node is
+// staged at once after a reboot.
+type rpcLimiter struct {
+	all     chan struct{}
+	methods map[string]chan struct{}
+}
+
+// newRPCLimiter returns a limiter allowing maxRPCs concurrent RPCs overall and
+// methodLimits[method] concurrent RPCs of the given method name, e.g.
+// NodeStageVolume. A limit of 0 means unlimited.
+func newRPCLimiter(maxRPCs int, methodLimits map[string]int) *rpcLimiter {
+	l := &rpcLimiter{
+		methods: map[string]chan struct{}{},
+	}
+	if maxRPCs > 0 {
+		l.all = make(chan struct{}, maxRPCs)
+	}
+	for method, limit := range methodLimits {
+		if limit > 0 {
+			l.methods[method] = make(chan struct{}, limit)
+		}
+	}
+	return l
+}
+
+func tryAcquire(sem chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
+}
+
+func (l *rpcLimiter) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, identityServicePrefix) {
+		return handler(ctx, req)
+	}
+
+	method := path.Base(info.FullMethod)
+	methodSem := l.methods[method]
+	if !tryAcquire(methodSem) {
+		klog.Warningf("Rejecting %s, %d requests of this method are already in progress", method, cap(methodSem))
+		return nil, status.Errorf(codes.Aborted, "too many concurrent %s requests, retry later", method)
+	}
+	defer release(methodSem)
+
+	if !tryAcquire(l.all) {
+		klog.Warningf("Rejecting %s, %d requests are already in progress", method, cap(l.all))
+		return nil, status.Error(codes.Aborted, "too many concurrent requests, retry later")
+	}
+	defer release(l.all)
+
+	return handler(ctx, req)
+}
+
+// limitableMethods returns the names of the methods of the CSI controller and
+// node services, the RPCs that can be limited
+func limitableMethods() map[string]bool {
+	methods := map[string]bool{}
+	for _, service := range []reflect.Type{
+		reflect.TypeOf((*csi.ControllerServer)(nil)).Elem(),
+		reflect.TypeOf((*csi.NodeServer)(nil)).Elem(),
+	} {
+		for i := 0; i < service.NumMethod(); i++ {
+			methods[service.Method(i).Name] = true
+		}
+	}
+	return methods
+}
+
+// ParseMethodLimits parses a comma separated list of method=limit pairs,
+// e.g. "NodeStageVolume=10,ControllerPublishVolume=5". Methods must be CSI
+// controller or node methods, a misspelled method would silently be left
+// unlimited.
+func ParseMethodLimits(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	if s == "" {
+		return limits, nil
+	}
+	methods := limitableMethods()
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid method limit %q, expected method=limit", pair)
+		}
+		if !methods[kv[0]] {
+			return nil, fmt.Errorf("unknown method %q, expected a CSI controller or node method, e.g. NodeStageVolume", kv[0])
+		}
+		limit, err := strconv.Atoi(kv[1])
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid limit for method %s: %q", kv[0], kv[1])
+		}
+		limits[kv[0]] = limit
+	}
+	return limits, nil
+}
@@ -0,0 +1,221 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	nodeStageMethod         = "/csi.v1.Node/NodeStageVolume"
+	nodePublishMethod       = "/csi.v1.Node/NodePublishVolume"
+	probeMethod             = "/csi.v1.Identity/Probe"
+	controllerPublishMethod = "/csi.v1.Controller/ControllerPublishVolume"
+)
+
+// startBlockingRPC runs an RPC through the limiter whose handler blocks until
+// release is closed and returns a channel with the RPC's error. It returns
+// once the RPC was either admitted or rejected.
+func startBlockingRPC(l *rpcLimiter, method string, release chan struct{}) chan error {
+	admitted := make(chan struct{})
+	errCh := make(chan error, 1)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		close(admitted)
+		<-release
+		return nil, nil
+	}
+	go func() {
+		_, err := l.intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		errCh <- err
+	}()
+	select {
+	case <-admitted:
+	case err := <-errCh:
+		errCh <- err
+	}
+	return errCh
+}
+
+func TestRPCLimiter(t *testing.T) {
+	testCases := []struct {
+		name         string
+		maxRPCs      int
+		methodLimits map[string]int
+		inFlight     []string
+		method       string
+		expAborted   bool
+	}{
+		{
+			name:     "unlimited",
+			inFlight: []string{nodeStageMethod, nodeStageMethod, nodeStageMethod},
+			method:   nodeStageMethod,
+		},
+		{
+			name:       "overall limit reached",
+			maxRPCs:    2,
+			inFlight:   []string{nodeStageMethod, nodePublishMethod},
+			method:     controllerPublishMethod,
+			expAborted: true,
+		},
+		{
+			name:     "overall limit not reached",
+			maxRPCs:  2,
+			inFlight: []string{nodeStageMethod},
+			method:   nodeStageMethod,
+		},
+		{
+			name:         "method limit reached",
+			methodLimits: map[string]int{"NodeStageVolume": 1},
+			inFlight:     []string{nodeStageMethod},
+			method:       nodeStageMethod,
+			expAborted:   true,
+		},
+		{
+			name:         "other method not limited",
+			methodLimits: map[string]int{"NodeStageVolume": 1},
+			inFlight:     []string{nodeStageMethod, nodePublishMethod},
+			method:       nodePublishMethod,
+		},
+		{
+			name:       "identity not limited",
+			maxRPCs:    1,
+			inFlight:   []string{nodeStageMethod},
+			method:     probeMethod,
+			expAborted: false,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		l := newRPCLimiter(tc.maxRPCs, tc.methodLimits)
+		release := make(chan struct{})
+		var errChs []chan error
+		for _, m := range tc.inFlight {
+			errChs = append(errChs, startBlockingRPC(l, m, release))
+		}
+
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, nil
+		}
+		_, err := l.intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: tc.method}, handler)
+		if tc.expAborted && status.Code(err) != codes.Aborted {
+			t.Errorf("Expected Aborted error, got: %v", err)
+		}
+		if !tc.expAborted && err != nil {
+			t.Errorf("Did not expect error but got: %v", err)
+		}
+
+		close(release)
+		for _, errCh := range errChs {
+			if err := <-errCh; err != nil {
+				t.Errorf("In-flight RPC returned unexpected error: %v", err)
+			}
+		}
+	}
+}
+
+func TestRPCLimiterReleases(t *testing.T) {
+	l := newRPCLimiter(1, map[string]int{"NodeStageVolume": 1})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.Internal, "failed")
+	}
+	for i := 0; i < 3; i++ {
+		_, err := l.intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: nodeStageMethod}, handler)
+		if status.Code(err) != codes.Internal {
+			t.Fatalf("Expected Internal error from handler on call %d, got: %v", i, err)
+		}
+	}
+}
+
+func TestParseMethodLimits(t *testing.T) {
+	testCases := []struct {
+		name      string
+		limits    string
+		expLimits map[string]int
+		expErr    bool
+	}{
+		{
+			name:      "empty",
+			limits:    "",
+			expLimits: map[string]int{},
+		},
+		{
+			name:      "multiple methods",
+			limits:    "NodeStageVolume=10,ControllerPublishVolume=5",
+			expLimits: map[string]int{"NodeStageVolume": 10, "ControllerPublishVolume": 5},
+		},
+		{
+			name:      "node and controller methods",
+			limits:    "NodeGetVolumeStats=2,ControllerExpandVolume=1,CreateSnapshot=3",
+			expLimits: map[string]int{"NodeGetVolumeStats": 2, "ControllerExpandVolume": 1, "CreateSnapshot": 3},
+		},
+		{
+			name:   "unknown method",
+			limits: "NodeStageVolume=10,NodeStage=5",
+			expErr: true,
+		},
+		{
+			name:   "lower case method",
+			limits: "nodestagevolume=10",
+			expErr: true,
+		},
+		{
+			name:   "identity method",
+			limits: "Probe=1",
+			expErr: true,
+		},
+		{
+			name:   "missing limit",
+			limits: "NodeStageVolume",
+			expErr: true,
+		},
+		{
+			name:   "missing method",
+			limits: "=10",
+			expErr: true,
+		},
+		{
+			name:   "negative limit",
+			limits: "NodeStageVolume=-1",
+			expErr: true,
+		},
+		{
+			name:   "non numeric limit",
+			limits: "NodeStageVolume=ten",
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		limits, err := ParseMethodLimits(tc.limits)
+		if err == nil && tc.expErr {
+			t.Errorf("Expected error but got none")
+		}
+		if err != nil {
+			if !tc.expErr {
+				t.Errorf("Did not expect error but got: %v", err)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(limits, tc.expLimits) {
+			t.Errorf("Got limits %v, expected %v", limits, tc.expLimits)
+		}
+	}
+}
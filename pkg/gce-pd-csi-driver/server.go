@@ -16,14 +16,15 @@ package gceGCEDriver
 
 import (
 	"net"
-	"net/url"
 	"os"
 	"sync"
+	"time"
 
 	"google.golang.org/grpc"
 	"k8s.io/klog"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	common "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 )
 
 // Defines Non blocking GRPC server interfaces
@@ -34,25 +35,68 @@ type NonBlockingGRPCServer interface {
 	Wait()
 	// Stops the service gracefully
 	Stop()
+	// Stops the service gracefully, forcefully stopping it if in-flight
+	// RPCs have not completed within the timeout
+	GracefulStopWithTimeout(timeout time.Duration)
 	// Stops the service forcefully
 	ForceStop()
 }
 
-func NewNonBlockingGRPCServer() NonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{}
+// ServerOptions configures the GRPC server started by the driver
+type ServerOptions struct {
+	// SocketMode is the file mode set on a unix socket endpoint, 0 leaves
+	// the mode the socket was created with
+	SocketMode os.FileMode
+	// SocketUID and SocketGID are the owner set on a unix socket endpoint,
+	// -1 leaves the respective id unchanged
+	SocketUID int
+	SocketGID int
+	// MaxConcurrentRPCs limits the number of RPCs served at once, 0 means
+	// unlimited. Identity RPCs are not limited.
+	MaxConcurrentRPCs int
+	// MethodConcurrencyLimits limits the number of RPCs served at once per
+	// method name, e.g. NodeStageVolume. Methods without a limit, or with a
+	// limit of 0, are only subject to MaxConcurrentRPCs.
+	MethodConcurrencyLimits map[string]int
+	// RPCTimeout bounds the duration of every RPC unless the caller set an
+	// earlier deadline, 0 only enforces the caller's deadline
+	RPCTimeout time.Duration
+	// FaultRules injects failures and latencies into RPCs by method name.
+	// For testing only.
+	FaultRules map[string]FaultRule
+	// EventRecorder, if set, posts Kubernetes events about failed
+	// provisioning, attach and mount operations
+	EventRecorder EventRecorder
+	// NodeName is the name of the Node of the node service, which events
+	// about failed mounts are posted on
+	NodeName string
+}
+
+// DefaultServerOptions returns options that leave the endpoint as created
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{
+		SocketUID: -1,
+		SocketGID: -1,
+	}
+}
+
+func NewNonBlockingGRPCServer(opts ServerOptions) NonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{opts: opts}
 }
 
 // NonBlocking server
 type nonBlockingGRPCServer struct {
 	wg     sync.WaitGroup
 	server *grpc.Server
+	opts   ServerOptions
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	listener := s.setup(endpoint, ids, cs, ns)
 
 	s.wg.Add(1)
 
-	go s.serve(endpoint, ids, cs, ns)
+	go s.serve(listener)
 
 	return
 }
@@ -69,35 +113,66 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 	s.server.Stop()
 }
 
-func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
-	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
+func (s *nonBlockingGRPCServer) GracefulStopWithTimeout(timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		// GracefulStop stops accepting new connections and RPCs and blocks
+		// until all pending RPCs have finished
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		klog.V(4).Infof("All in-flight RPCs completed, server stopped gracefully")
+	case <-time.After(timeout):
+		klog.Warningf("In-flight RPCs did not complete within %v, forcefully stopping server", timeout)
+		s.server.Stop()
 	}
+}
 
-	u, err := url.Parse(endpoint)
+// setup creates the listener for the endpoint and the GRPC server with all
+// given services registered
+func (s *nonBlockingGRPCServer) setup(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) net.Listener {
+	limiter := newRPCLimiter(s.opts.MaxConcurrentRPCs, s.opts.MethodConcurrencyLimits)
+	interceptors := []grpc.UnaryServerInterceptor{logGRPC}
+	if s.opts.EventRecorder != nil {
+		interceptors = append(interceptors, newEventInterceptor(s.opts.EventRecorder, s.opts.NodeName))
+	}
+	interceptors = append(interceptors, newTimeoutInterceptor(s.opts.RPCTimeout), limiter.intercept)
+	if len(s.opts.FaultRules) > 0 {
+		klog.Warningf("Fault injection is enabled, RPCs will fail according to rules: %+v", s.opts.FaultRules)
+		interceptors = append(interceptors, newFaultInjector(s.opts.FaultRules).intercept)
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(chainUnaryInterceptors(interceptors...)),
+	}
 
+	scheme, addr, err := common.ParseEndpoint(endpoint)
 	if err != nil {
 		klog.Fatal(err.Error())
 	}
 
-	var addr string
-	if u.Scheme == "unix" {
-		addr = u.Path
+	if scheme == "unix" {
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
 			klog.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
 		}
-	} else if u.Scheme == "tcp" {
-		addr = u.Host
-	} else {
-		klog.Fatalf("%v endpoint scheme not supported", u.Scheme)
+	} else if s.opts.SocketMode != 0 || s.opts.SocketUID != -1 || s.opts.SocketGID != -1 {
+		klog.Warningf("Socket mode and ownership are only applied to unix socket endpoints, ignoring them for %v", endpoint)
 	}
 
-	klog.V(4).Infof("Start listening with scheme %v, addr %v", u.Scheme, addr)
-	listener, err := net.Listen(u.Scheme, addr)
+	klog.V(4).Infof("Start listening with scheme %v, addr %v", scheme, addr)
+	listener, err := net.Listen(scheme, addr)
 	if err != nil {
 		klog.Fatalf("Failed to listen: %v", err)
 	}
 
+	if scheme == "unix" {
+		if err := setSocketPermissions(addr, s.opts); err != nil {
+			klog.Fatalf("Failed to set permissions on socket %s: %v", addr, err)
+		}
+	}
+
 	server := grpc.NewServer(opts...)
 	s.server = server
 
@@ -111,10 +186,35 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		csi.RegisterNodeServer(server, ns)
 	}
 
+	return listener
+}
+
+// setSocketPermissions applies the configured mode and ownership to the unix
+// socket at addr
+func setSocketPermissions(addr string, opts ServerOptions) error {
+	if opts.SocketUID != -1 || opts.SocketGID != -1 {
+		klog.V(4).Infof("Setting owner of socket %s to uid %d, gid %d", addr, opts.SocketUID, opts.SocketGID)
+		if err := os.Chown(addr, opts.SocketUID, opts.SocketGID); err != nil {
+			return err
+		}
+	}
+	if opts.SocketMode != 0 {
+		klog.V(4).Infof("Setting mode of socket %s to %v", addr, opts.SocketMode)
+		if err := os.Chmod(addr, opts.SocketMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *nonBlockingGRPCServer) serve(listener net.Listener) {
+	defer s.wg.Done()
+
 	klog.V(4).Infof("Listening for connections on address: %#v", listener.Addr())
 
-	if err := server.Serve(listener); err != nil {
+	// The server is stopped before serving if the driver was stopped while
+	// starting
+	if err := s.server.Serve(listener); err != nil && err != grpc.ErrServerStopped {
 		klog.Fatalf("Failed to serve: %v", err)
 	}
-
 }
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSetSocketPermissions(t *testing.T) {
+	testCases := []struct {
+		name         string
+		opts         ServerOptions
+		expectedMode os.FileMode
+	}{
+		{
+			name:         "default options leave socket unchanged",
+			opts:         DefaultServerOptions(),
+			expectedMode: 0755,
+		},
+		{
+			name: "mode set",
+			opts: ServerOptions{
+				SocketMode: 0660,
+				SocketUID:  -1,
+				SocketGID:  -1,
+			},
+			expectedMode: 0660,
+		},
+		{
+			name: "owner and mode set",
+			opts: ServerOptions{
+				SocketMode: 0600,
+				SocketUID:  os.Getuid(),
+				SocketGID:  os.Getgid(),
+			},
+			expectedMode: 0600,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		tmpDir, err := ioutil.TempDir("", "server-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		addr := filepath.Join(tmpDir, "csi.sock")
+		if err := ioutil.WriteFile(addr, nil, 0755); err != nil {
+			t.Fatalf("Failed to create file %s: %v", addr, err)
+		}
+		if err := os.Chmod(addr, 0755); err != nil {
+			t.Fatalf("Failed to chmod file %s: %v", addr, err)
+		}
+
+		err = setSocketPermissions(addr, tc.opts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		fi, err := os.Stat(addr)
+		if err != nil {
+			t.Fatalf("Failed to stat file %s: %v", addr, err)
+		}
+		if fi.Mode().Perm() != tc.expectedMode {
+			t.Errorf("Expected mode %v, got %v", tc.expectedMode, fi.Mode().Perm())
+		}
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+var (
+	// Backoff of unmount retries while the mount point is busy, e.g. because
+	// the processes of a terminating pod have not exited yet
+	unmountBackoff = wait.Backoff{
+		Duration: 500 * time.Millisecond,
+		Factor:   2,
+		Steps:    5,
+	}
+
+	procPath = "/proc"
+)
+
+// cleanupMountPoint unmounts and removes the mount point. Unmounts failing
+// because the mount point is busy are retried with backoff, logging the
+// processes holding the mount point, before the error is returned. Mount
+// points that were already unmounted, e.g. because the disk was detached out
+// of band, are only removed.
+func cleanupMountPoint(ctx context.Context, mountPath string, mounter mount.Interface) error {
+	var lastErr error
+	err := wait.ExponentialBackoff(unmountBackoff, func() (bool, error) {
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+		lastErr = mount.CleanupMountPoint(mountPath, mounter, false /* bind mount */)
+		if lastErr == nil {
+			return true, nil
+		}
+		if isNotMountedError(lastErr) {
+			klog.Warningf("Mount point %s was already unmounted, removing it: %v", mountPath, lastErr)
+			if err := os.Remove(mountPath); err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+			return true, nil
+		}
+		if !isBusyError(lastErr) {
+			return false, lastErr
+		}
+		holders, err := findMountHolders(mountPath)
+		if err != nil {
+			klog.Warningf("Mount point %s is busy, failed to find the processes holding it: %v", mountPath, err)
+		} else {
+			klog.Warningf("Mount point %s is busy, held by processes: %v", mountPath, holders)
+		}
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("mount point still busy after %d attempts: %v", unmountBackoff.Steps, lastErr)
+	}
+	return err
+}
+
+// isBusyError returns whether the unmount failed because the mount point is
+// in use. umount only reports this in its output.
+func isBusyError(err error) bool {
+	if err == syscall.EBUSY {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "target is busy") || strings.Contains(msg, "device is busy") || strings.Contains(msg, "device or resource busy")
+}
+
+// isNotMountedError returns whether the unmount failed because nothing is
+// mounted at the mount point anymore. umount only reports this in its output.
+func isNotMountedError(err error) bool {
+	return strings.Contains(strings.ToLower(err.Error()), "not mounted")
+}
+
+// findMountHolders returns the processes whose working directory, root,
+// executable or open files are below the mount path, formatted as "pid (comm)"
+func findMountHolders(mountPath string) ([]string, error) {
+	entries, err := ioutil.ReadDir(procPath)
+	if err != nil {
+		return nil, err
+	}
+	holders := []string{}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		pidDir := filepath.Join(procPath, entry.Name())
+		if !holdsPath(pidDir, mountPath) {
+			continue
+		}
+		comm, err := ioutil.ReadFile(filepath.Join(pidDir, "comm"))
+		if err != nil {
+			// The process may have exited in the meantime
+			comm = []byte("unknown")
+		}
+		holders = append(holders, fmt.Sprintf("%s (%s)", entry.Name(), strings.TrimSpace(string(comm))))
+	}
+	return holders, nil
+}
+
+func holdsPath(pidDir, mountPath string) bool {
+	links := []string{
+		filepath.Join(pidDir, "cwd"),
+		filepath.Join(pidDir, "root"),
+		filepath.Join(pidDir, "exe"),
+	}
+	// Errors are ignored, the process may have exited in the meantime
+	fds, _ := ioutil.ReadDir(filepath.Join(pidDir, "fd"))
+	for _, fd := range fds {
+		links = append(links, filepath.Join(pidDir, "fd", fd.Name()))
+	}
+	for _, link := range links {
+		target, err := os.Readlink(link)
+		if err != nil {
+			continue
+		}
+		if target == mountPath || strings.HasPrefix(target, mountPath+"/") {
+			return true
+		}
+	}
+	return false
+}
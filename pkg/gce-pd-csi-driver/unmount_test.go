@@ -0,0 +1,160 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gceGCEDriver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// busyMounter fails the first busyUnmounts unmounts with unmountErr
+type busyMounter struct {
+	*mount.FakeMounter
+	busyUnmounts int
+	unmountErr   error
+	unmounts     int
+}
+
+func (m *busyMounter) Unmount(target string) error {
+	m.unmounts++
+	if m.unmounts <= m.busyUnmounts {
+		return m.unmountErr
+	}
+	return m.FakeMounter.Unmount(target)
+}
+
+func TestCleanupMountPoint(t *testing.T) {
+	defer func(backoff wait.Backoff) { unmountBackoff = backoff }(unmountBackoff)
+	unmountBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+
+	busyErr := errors.New("Unmount failed: exit status 32\nOutput: umount: /mnt/test: target is busy.\n")
+	testCases := []struct {
+		name         string
+		busyUnmounts int
+		unmountErr   error
+		expUnmounts  int
+		expErr       bool
+	}{
+		{
+			name:        "unmounted",
+			expUnmounts: 1,
+		},
+		{
+			name:         "unmounted after busy",
+			busyUnmounts: 2,
+			unmountErr:   busyErr,
+			expUnmounts:  3,
+		},
+		{
+			name:         "busy after all retries",
+			busyUnmounts: 3,
+			unmountErr:   busyErr,
+			expUnmounts:  3,
+			expErr:       true,
+		},
+		{
+			name:         "already unmounted",
+			busyUnmounts: 1,
+			unmountErr:   errors.New("Unmount failed: exit status 32\nOutput: umount: /mnt/test: not mounted.\n"),
+			expUnmounts:  1,
+		},
+		{
+			name:         "other errors are not retried",
+			busyUnmounts: 1,
+			unmountErr:   errors.New("Unmount failed: exit status 1"),
+			expUnmounts:  1,
+			expErr:       true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		tmpDir, err := ioutil.TempDir("", "unmount-test")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		mounter := &busyMounter{
+			FakeMounter:  &mount.FakeMounter{MountPoints: []mount.MountPoint{{Device: "/dev/sda", Path: tmpDir}}},
+			busyUnmounts: tc.busyUnmounts,
+			unmountErr:   tc.unmountErr,
+		}
+
+		err = cleanupMountPoint(context.Background(), tmpDir, mounter)
+		if (err != nil) != tc.expErr {
+			t.Errorf("Expected error: %v, got: %v", tc.expErr, err)
+		}
+		if mounter.unmounts != tc.expUnmounts {
+			t.Errorf("Expected %d unmounts, got: %d", tc.expUnmounts, mounter.unmounts)
+		}
+		if _, err := os.Stat(tmpDir); !tc.expErr && !os.IsNotExist(err) {
+			t.Errorf("Expected mount point %s to be removed, got: %v", tmpDir, err)
+		}
+	}
+}
+
+func TestFindMountHolders(t *testing.T) {
+	defer func(path string) { procPath = path }(procPath)
+	tmpDir, err := ioutil.TempDir("", "unmount-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	procPath = filepath.Join(tmpDir, "proc")
+	mountPath := "/var/lib/kubelet/pods/pod/volumes/pv/mount"
+
+	// Process 1 has its working directory in the mount, 2 has a file in the
+	// mount open, 3 only has a file in a sibling directory open
+	links := map[string]string{
+		"1/cwd":  mountPath,
+		"1/root": "/",
+		"2/cwd":  "/",
+		"2/fd/3": mountPath + "/data.db",
+		"3/cwd":  "/",
+		"3/fd/3": mountPath + "-other/data.db",
+	}
+	for link, target := range links {
+		path := filepath.Join(procPath, link)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatalf("Failed to create link %s: %v", link, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(procPath, "1", "comm"), []byte("sh\n"), 0644); err != nil {
+		t.Fatalf("Failed to write comm: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(procPath, "sys"), 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+
+	holders, err := findMountHolders(mountPath)
+	if err != nil {
+		t.Fatalf("findMountHolders got unexpected error: %v", err)
+	}
+	expHolders := []string{"1 (sh)", "2 (unknown)"}
+	if !reflect.DeepEqual(holders, expHolders) {
+		t.Errorf("Expected holders %v, got: %v", expHolders, holders)
+	}
+}
@@ -17,13 +17,20 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"context"
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/proto"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog"
 )
 
@@ -63,6 +70,92 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	return resp, err
 }
 
+// newTimeoutInterceptor returns an interceptor that bounds every RPC by
+// timeout unless the caller already set an earlier deadline. A timeout of 0
+// only enforces the caller's deadline. RPCs failing after their context ended
+// are reported as DeadlineExceeded or Canceled instead of the error returned
+// by the interrupted operation.
+func newTimeoutInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		resp, err := handler(ctx, req)
+		if err != nil && ctx.Err() != nil {
+			if code := status.Code(err); code != codes.DeadlineExceeded && code != codes.Canceled {
+				return nil, contextErrorToStatus(ctx.Err(), err.Error())
+			}
+		}
+		return resp, err
+	}
+}
+
+// checkContext returns a DeadlineExceeded or Canceled status error if the
+// context is done. It is called before starting operations that cannot be
+// interrupted once started, such as formatting and mounting a disk.
+func checkContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return contextErrorToStatus(err, "request ended before the operation was started")
+	}
+	return nil
+}
+
+func contextErrorToStatus(ctxErr error, msg string) error {
+	if ctxErr == context.Canceled {
+		return status.Error(codes.Canceled, msg)
+	}
+	return status.Error(codes.DeadlineExceeded, msg)
+}
+
+// chainUnaryInterceptors combines the interceptors into one, the first
+// interceptor being the outermost
+func chainUnaryInterceptors(interceptors ...grpc.UnaryServerInterceptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		chained := handler
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, next := interceptors[i], chained
+			chained = func(ctx context.Context, req interface{}) (interface{}, error) {
+				return interceptor(ctx, req, info, next)
+			}
+		}
+		return chained(ctx, req)
+	}
+}
+
+// requestFingerprint identifies a create request by its content. The secrets
+// are replaced by their hash, so that requests with different secrets are
+// told apart without keeping the secrets in memory.
+func requestFingerprint(req proto.Message) string {
+	req = proto.Clone(req)
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		r.Secrets = hashSecrets(r.Secrets)
+	case *csi.CreateSnapshotRequest:
+		r.Secrets = hashSecrets(r.Secrets)
+	}
+	return proto.CompactTextString(req)
+}
+
+// hashSecrets returns the SHA-256 hash of the secrets, or nil if there are
+// none
+func hashSecrets(secrets map[string]string) map[string]string {
+	if len(secrets) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(secrets))
+	for k := range secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%q=%q\n", k, secrets[k])
+	}
+	return map[string]string{"sha256": hex.EncodeToString(h.Sum(nil))}
+}
+
 func validateVolumeCapabilities(vcs []*csi.VolumeCapability) error {
 	isMnt := false
 	isBlk := false
@@ -105,6 +198,16 @@ func validateVolumeCapability(vc *csi.VolumeCapability) error {
 	return nil
 }
 
+// isReadOnlyAccessMode returns whether volumes with the access mode can only
+// be read, so that their disk is attached read only
+func isReadOnlyAccessMode(am *csi.VolumeCapability_AccessMode) bool {
+	switch am.GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
 func validateAccessMode(am *csi.VolumeCapability_AccessMode) error {
 	if am == nil {
 		return errors.New("access mode is nil")
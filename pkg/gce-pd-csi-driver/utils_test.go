@@ -18,9 +18,16 @@ limitations under the License.
 package gceGCEDriver
 
 import (
+	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -166,3 +173,112 @@ func TestValidateVolumeCapabilities(t *testing.T) {
 	}
 
 }
+
+func TestTimeoutInterceptor(t *testing.T) {
+	testCases := []struct {
+		name       string
+		timeout    time.Duration
+		ctxTimeout time.Duration
+		handlerErr error
+		expErrCode codes.Code
+	}{
+		{
+			name: "no timeout, success",
+		},
+		{
+			name:       "no timeout, error is unchanged",
+			handlerErr: status.Error(codes.NotFound, "not found"),
+			expErrCode: codes.NotFound,
+		},
+		{
+			name:       "timeout exceeded",
+			timeout:    10 * time.Millisecond,
+			handlerErr: errors.New("interrupted"),
+			expErrCode: codes.DeadlineExceeded,
+		},
+		{
+			name:       "caller deadline exceeded",
+			ctxTimeout: 10 * time.Millisecond,
+			handlerErr: status.Error(codes.Internal, "interrupted"),
+			expErrCode: codes.DeadlineExceeded,
+		},
+		{
+			name:       "caller deadline earlier than timeout",
+			timeout:    time.Hour,
+			ctxTimeout: 10 * time.Millisecond,
+			handlerErr: status.Error(codes.Internal, "interrupted"),
+			expErrCode: codes.DeadlineExceeded,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		ctx := context.Background()
+		if tc.ctxTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, tc.ctxTimeout)
+			defer cancel()
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			if tc.handlerErr == nil {
+				return nil, nil
+			}
+			if tc.timeout == 0 && tc.ctxTimeout == 0 {
+				return nil, tc.handlerErr
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+				t.Errorf("Context was not done")
+			}
+			return nil, tc.handlerErr
+		}
+		_, err := newTimeoutInterceptor(tc.timeout)(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodeStageVolume"}, handler)
+		if status.Code(err) != tc.expErrCode {
+			t.Errorf("Expected error code: %v, got: %v. err : %v", tc.expErrCode, status.Code(err), err)
+		}
+	}
+}
+
+func TestRequestFingerprint(t *testing.T) {
+	req := &csi.CreateVolumeRequest{
+		Name:    "test-name",
+		Secrets: map[string]string{"key": "secret-value", "other-key": "other-secret-value"},
+	}
+	fingerprint := requestFingerprint(req)
+	if strings.Contains(fingerprint, "secret-value") {
+		t.Errorf("Expected the fingerprint not to contain the secrets, got: %s", fingerprint)
+	}
+	if req.Secrets["key"] != "secret-value" {
+		t.Errorf("Expected the secrets of the request to be unchanged, got: %v", req.Secrets)
+	}
+
+	testCases := []struct {
+		name     string
+		secrets  map[string]string
+		expEqual bool
+	}{
+		{
+			name:     "same secrets",
+			secrets:  map[string]string{"other-key": "other-secret-value", "key": "secret-value"},
+			expEqual: true,
+		},
+		{
+			name:    "different secret value",
+			secrets: map[string]string{"key": "secret-value", "other-key": "different-value"},
+		},
+		{
+			name:    "swapped secret values",
+			secrets: map[string]string{"key": "other-secret-value", "other-key": "secret-value"},
+		},
+		{
+			name: "no secrets",
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		other := &csi.CreateVolumeRequest{Name: "test-name", Secrets: tc.secrets}
+		if equal := requestFingerprint(other) == fingerprint; equal != tc.expEqual {
+			t.Errorf("Expected fingerprints to be equal: %v, got: %v", tc.expEqual, equal)
+		}
+	}
+}
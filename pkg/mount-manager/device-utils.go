@@ -15,12 +15,18 @@ limitations under the License.
 package mountmanager
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog"
@@ -33,6 +39,11 @@ const (
 	diskPartitionSuffix  = "-part"
 	diskSDPath           = "/dev/sd"
 	diskSDPattern        = "/dev/sd*"
+	diskNvmePath         = "/dev/nvme"
+	// Programs the udev rules of GCE images identify SCSI and NVMe disks
+	// with, from the host's /lib/udev mounted into the container
+	scsiIdPath       = "/lib/udev/scsi_id"
+	googleNvmeIdPath = "/lib/udev/google_nvme_id"
 	// How many times to retry for a consistent read of /proc/mounts.
 	maxListTries = 3
 	// Number of fields per line in /proc/mounts as per the fstab man page.
@@ -43,9 +54,27 @@ const (
 	procMountInfoPath = "/proc/self/mountinfo"
 	// 'fsck' found errors and corrected them
 	fsckErrorsCorrected = 1
+	// 'fsck' corrected errors and the system should be rebooted, which does
+	// not apply to unmounted filesystems
+	fsckErrorsCorrectedReboot = 2
 	// 'fsck' found errors but exited without correcting them
 	fsckErrorsUncorrected = 4
 	defaultMountCommand   = "mount"
+	// Interval at which running filesystem checks are logged
+	fsckProgressInterval = 30 * time.Second
+	// Printed by xfs_repair -n for filesystems with a dirty log, whose
+	// inconsistencies are only resolved by replaying the log on mount
+	xfsDirtyLogAlert = "metadata changes in a log which is being ignored"
+	// Directory of the devices opened with cryptsetup
+	diskMapperPath = "/dev/mapper/"
+)
+
+var (
+	// Identifier of page 0x83 of GCE SCSI disks, e.g.
+	// "0Google  PersistentDisk  my-disk"
+	scsiDeviceNameRegex = regexp.MustCompile(`^0Google\s+\S+\s+(\S+)\s*$`)
+	// Device name google_nvme_id prints for GCE NVMe disks
+	nvmeDeviceNameRegex = regexp.MustCompile(`(?m)^ID_SERIAL_SHORT=(\S+)\s*$`)
 )
 
 // DeviceUtils are a collection of methods that act on the devices attached
@@ -56,17 +85,122 @@ type DeviceUtils interface {
 	GetDiskByIdPaths(deviceName string, partition string) []string
 
 	// VerifyDevicePath returns the first of the list of device paths that
-	// exists on the machine, or an empty string if none exists
-	VerifyDevicePath(devicePaths []string) (string, error)
+	// exists on the machine, or an empty string if none exists. Commands
+	// run to refresh the devices are killed once ctx is done.
+	VerifyDevicePath(ctx context.Context, devicePaths []string) (string, error)
+
+	// RemoveStaleDiskByIdPaths removes the device paths of the given
+	// Persistent Disk that don't link to it anymore. udev may miss the
+	// removal of a detached disk, leaving its links pointing to the
+	// "/dev/sd*" device that is reused by the next attached disk.
+	RemoveStaleDiskByIdPaths(ctx context.Context, deviceName string, devicePaths []string) error
+
+	// OpenLUKSDevice opens the LUKS encrypted device with the key as
+	// "/dev/mapper/{name}" and returns the mapped path. Devices without any
+	// data are formatted with LUKS first, devices with unencrypted data are
+	// never formatted.
+	OpenLUKSDevice(ctx context.Context, devicePath string, name string, key []byte) (string, error)
+
+	// CloseLUKSDevice closes "/dev/mapper/{name}" if it is open
+	CloseLUKSDevice(ctx context.Context, name string) error
+
+	// IsLUKSDeviceOpen returns whether "/dev/mapper/{name}" is open
+	IsLUKSDeviceOpen(name string) (bool, error)
+
+	// CheckFilesystem checks and repairs the filesystem of the device with
+	// fsck -a, logging its output while it runs. The check is killed once
+	// ctx is done and ctx.Err() is returned.
+	CheckFilesystem(ctx context.Context, devicePath string) error
+
+	// RepairFilesystem repairs the unmounted ext2, ext3, ext4 or xfs
+	// filesystem of the device with e2fsck or xfs_repair, answering yes to
+	// every fix. The repair is killed once ctx is done.
+	RepairFilesystem(ctx context.Context, devicePath string, fstype string) error
+
+	// CheckXFSFilesystem checks the unmounted xfs filesystem of the device
+	// with xfs_repair -n, without modifying it, and returns whether it is
+	// corrupted. The check is killed once ctx is done.
+	CheckXFSFilesystem(ctx context.Context, devicePath string) (bool, error)
+}
+
+// DeviceExec runs the commands DeviceUtils manage devices with, e.g. udevadm
+// and cryptsetup
+type DeviceExec interface {
+	// Run runs the command with the input on stdin, if any, and kills it
+	// once ctx is done. It returns the combined output and the exit code of
+	// the command. Errors are only returned if the command could not be run.
+	Run(ctx context.Context, input []byte, cmd string, args ...string) ([]byte, int, error)
+}
+
+// DeviceFS accesses the device files DeviceUtils manage, e.g. the
+// "/dev/disk/by-id/" links
+type DeviceFS interface {
+	Glob(pattern string) ([]string, error)
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	EvalSymlinks(path string) (string, error)
+	Remove(path string) error
 }
 
 type deviceUtils struct {
+	exec DeviceExec
+	fs   DeviceFS
 }
 
 var _ DeviceUtils = &deviceUtils{}
 
 func NewDeviceUtils() *deviceUtils {
-	return &deviceUtils{}
+	return NewCustomDeviceUtils(&osDeviceExec{}, &osDeviceFS{})
+}
+
+// NewCustomDeviceUtils returns DeviceUtils running the commands and accessing
+// the device files through the given implementations, e.g. fakes to test
+// without root or real devices
+func NewCustomDeviceUtils(exec DeviceExec, fs DeviceFS) *deviceUtils {
+	return &deviceUtils{exec: exec, fs: fs}
+}
+
+type osDeviceExec struct{}
+
+var _ DeviceExec = &osDeviceExec{}
+
+func (e *osDeviceExec) Run(ctx context.Context, input []byte, name string, args ...string) ([]byte, int, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	if input != nil {
+		cmd.Stdin = bytes.NewReader(input)
+	}
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return output, 0, nil
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return output, exitErr.Sys().(syscall.WaitStatus).ExitStatus(), nil
+	}
+	return output, 0, fmt.Errorf("failed to run %s: %v", name, err)
+}
+
+type osDeviceFS struct{}
+
+var _ DeviceFS = &osDeviceFS{}
+
+func (f *osDeviceFS) Glob(pattern string) ([]string, error) {
+	return filepath.Glob(pattern)
+}
+
+func (f *osDeviceFS) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (f *osDeviceFS) Lstat(path string) (os.FileInfo, error) {
+	return os.Lstat(path)
+}
+
+func (f *osDeviceFS) EvalSymlinks(path string) (string, error) {
+	return filepath.EvalSymlinks(path)
+}
+
+func (f *osDeviceFS) Remove(path string) error {
+	return os.Remove(path)
 }
 
 // Returns list of all /dev/disk/by-id/* paths for given PD.
@@ -86,21 +220,24 @@ func (m *deviceUtils) GetDiskByIdPaths(deviceName string, partition string) []st
 }
 
 // Returns the first path that exists, or empty string if none exist.
-func (m *deviceUtils) VerifyDevicePath(devicePaths []string) (string, error) {
-	sdBefore, err := filepath.Glob(diskSDPattern)
+func (m *deviceUtils) VerifyDevicePath(ctx context.Context, devicePaths []string) (string, error) {
+	sdBefore, err := m.fs.Glob(diskSDPattern)
 	if err != nil {
 		// Seeing this error means that the diskSDPattern is malformed.
 		klog.Errorf("Error filepath.Glob(\"%s\"): %v\r\n", diskSDPattern, err)
 	}
 	sdBeforeSet := sets.NewString(sdBefore...)
 	// TODO(#69): Verify udevadm works as intended in driver
-	if err := udevadmChangeToNewDrives(sdBeforeSet); err != nil {
+	if err := m.udevadmChangeToNewDrives(ctx, sdBeforeSet); err != nil {
 		// udevadm errors should not block disk detachment, log and continue
 		klog.Errorf("udevadmChangeToNewDrives failed with: %v", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 
 	for _, path := range devicePaths {
-		if pathExists, err := pathExists(path); err != nil {
+		if pathExists, err := m.pathExists(path); err != nil {
 			return "", fmt.Errorf("Error checking if path exists: %v", err)
 		} else if pathExists {
 			return path, nil
@@ -110,19 +247,278 @@ func (m *deviceUtils) VerifyDevicePath(devicePaths []string) (string, error) {
 	return "", nil
 }
 
+func (m *deviceUtils) RemoveStaleDiskByIdPaths(ctx context.Context, deviceName string, devicePaths []string) error {
+	for _, path := range devicePaths {
+		info, err := m.fs.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Error checking device path %s: %v", path, err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		drive, err := m.fs.EvalSymlinks(path)
+		if err != nil {
+			// The linked device no longer exists
+			klog.Warningf("Removing device path %s, its device no longer exists: %v", path, err)
+			if err := m.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Error removing stale device path %s: %v", path, err)
+			}
+			continue
+		}
+		driveDeviceName, err := m.getDriveDeviceName(ctx, drive)
+		if err != nil {
+			return err
+		}
+		if driveDeviceName == "" || driveDeviceName == deviceName {
+			continue
+		}
+		klog.Warningf("Removing device path %s, it links to %s of disk %q instead of %q", path, drive, driveDeviceName, deviceName)
+		if err := m.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing stale device path %s: %v", path, err)
+		}
+		// Recreate the links of the disk the device now belongs to, in
+		// case the stale link replaced one of them
+		if err := m.udevadmChangeToDrive(ctx, drive); err != nil {
+			klog.Errorf("Failed to refresh links of %s: %v", drive, err)
+		}
+	}
+	return nil
+}
+
+func (m *deviceUtils) OpenLUKSDevice(ctx context.Context, devicePath string, name string, key []byte) (string, error) {
+	mapperPath := path.Join(diskMapperPath, name)
+	if open, err := m.IsLUKSDeviceOpen(name); err != nil {
+		return "", err
+	} else if open {
+		return mapperPath, nil
+	}
+
+	isLUKS, err := m.runExitCode(ctx, nil, "cryptsetup", "isLuks", devicePath)
+	if err != nil {
+		return "", err
+	}
+	if isLUKS != 0 {
+		// blkid exits with 2 if the device has no signature at all
+		empty, err := m.runExitCode(ctx, nil, "blkid", "-p", devicePath)
+		if err != nil {
+			return "", err
+		}
+		if empty != 2 {
+			return "", fmt.Errorf("device %s contains data that is not LUKS encrypted, refusing to format it", devicePath)
+		}
+		klog.Infof("Device %s is empty, formatting it with LUKS", devicePath)
+		if code, err := m.runExitCode(ctx, key, "cryptsetup", "luksFormat", "--batch-mode", "--type", "luks2", "--key-file", "-", devicePath); err != nil {
+			return "", err
+		} else if code != 0 {
+			return "", fmt.Errorf("cryptsetup luksFormat of %s failed with exit code %d", devicePath, code)
+		}
+	}
+
+	if code, err := m.runExitCode(ctx, key, "cryptsetup", "luksOpen", "--key-file", "-", devicePath, name); err != nil {
+		return "", err
+	} else if code != 0 {
+		return "", fmt.Errorf("cryptsetup luksOpen of %s failed with exit code %d", devicePath, code)
+	}
+	return mapperPath, nil
+}
+
+func (m *deviceUtils) CloseLUKSDevice(ctx context.Context, name string) error {
+	if open, err := m.IsLUKSDeviceOpen(name); err != nil || !open {
+		return err
+	}
+	if code, err := m.runExitCode(ctx, nil, "cryptsetup", "luksClose", name); err != nil {
+		return err
+	} else if code != 0 {
+		return fmt.Errorf("cryptsetup luksClose of %s failed with exit code %d", name, code)
+	}
+	return nil
+}
+
+func (m *deviceUtils) IsLUKSDeviceOpen(name string) (bool, error) {
+	return m.pathExists(path.Join(diskMapperPath, name))
+}
+
+func (m *deviceUtils) CheckFilesystem(ctx context.Context, devicePath string) error {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %v", err)
+	}
+	defer reader.Close()
+	// fsck is not run with DeviceExec, which only returns the output once
+	// the command exited
+	cmd := exec.Command("fsck", "-a", devicePath)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	// fsck runs the filesystem specific checker as a child process, its
+	// process group is killed to stop both
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	started := time.Now()
+	err = cmd.Start()
+	writer.Close()
+	if err != nil {
+		if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+			klog.Warningf("fsck not found, not checking the filesystem of device %s", devicePath)
+			return nil
+		}
+		return fmt.Errorf("failed to run fsck: %v", err)
+	}
+
+	// The output is read until every process holding the pipe exited, which
+	// are not waited for if the check is killed
+	outputDone := make(chan []string, 1)
+	go func() {
+		lines := []string{}
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			klog.Infof("fsck of %s: %s", devicePath, scanner.Text())
+			lines = append(lines, scanner.Text())
+		}
+		outputDone <- lines
+	}()
+	waitDone := make(chan error, 1)
+	go func() {
+		waitDone <- cmd.Wait()
+	}()
+
+	klog.Infof("Checking the filesystem of device %s with fsck", devicePath)
+	ticker := time.NewTicker(fsckProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			klog.Infof("fsck of %s still running after %v", devicePath, time.Since(started).Round(time.Second))
+		case <-ctx.Done():
+			if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+				klog.Errorf("Failed to kill fsck of %s: %v", devicePath, err)
+			}
+			<-waitDone
+			klog.Warningf("fsck of %s killed after %v: %v", devicePath, time.Since(started).Round(time.Second), ctx.Err())
+			return ctx.Err()
+		case err := <-waitDone:
+			output := strings.Join(<-outputDone, "\n")
+			klog.Infof("fsck of %s completed after %v", devicePath, time.Since(started).Round(time.Second))
+			if err == nil {
+				return nil
+			}
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok {
+				return fmt.Errorf("fsck of %s failed: %v", devicePath, err)
+			}
+			switch code := exitErr.Sys().(syscall.WaitStatus).ExitStatus(); {
+			case code == fsckErrorsCorrected:
+				klog.Infof("Device %s has errors which were corrected by fsck", devicePath)
+			case code == fsckErrorsUncorrected:
+				return fmt.Errorf("fsck found errors on device %s but could not correct them: %s", devicePath, output)
+			default:
+				klog.Warningf("fsck of %s exited with %d", devicePath, code)
+			}
+			return nil
+		}
+	}
+}
+
+func (m *deviceUtils) RepairFilesystem(ctx context.Context, devicePath string, fstype string) error {
+	switch fstype {
+	case "ext2", "ext3", "ext4":
+		output, code, err := m.exec.Run(ctx, nil, "e2fsck", "-y", devicePath)
+		if err != nil {
+			return err
+		}
+		if code != 0 && code != fsckErrorsCorrected && code != fsckErrorsCorrectedReboot {
+			return fmt.Errorf("e2fsck of %s failed with exit code %d: %s", devicePath, code, string(output))
+		}
+		klog.Infof("e2fsck of %s exited with %d: %s", devicePath, code, string(output))
+	case "xfs":
+		// xfs_repair refuses to repair filesystems with a dirty log, which
+		// is only replayed by mounting. Zeroing the log with -L loses the
+		// metadata changes in it, so that is left to the administrator.
+		output, code, err := m.exec.Run(ctx, nil, "xfs_repair", devicePath)
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("xfs_repair of %s failed with exit code %d: %s", devicePath, code, string(output))
+		}
+		klog.Infof("xfs_repair of %s succeeded: %s", devicePath, string(output))
+	default:
+		return fmt.Errorf("repairing %s filesystems is not supported", fstype)
+	}
+	return nil
+}
+
+func (m *deviceUtils) CheckXFSFilesystem(ctx context.Context, devicePath string) (bool, error) {
+	output, code, err := m.exec.Run(ctx, nil, "xfs_repair", "-n", devicePath)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case code == 0:
+		return false, nil
+	case strings.Contains(string(output), xfsDirtyLogAlert):
+		klog.Warningf("Filesystem of %s has a dirty log, skipping the check until it is replayed on mount: %s", devicePath, string(output))
+		return false, nil
+	case code == 1:
+		klog.Errorf("xfs_repair -n found corruption in the filesystem of %s: %s", devicePath, string(output))
+		return true, nil
+	default:
+		return false, fmt.Errorf("xfs_repair -n of %s failed with exit code %d: %s", devicePath, code, string(output))
+	}
+}
+
+// runExitCode runs the command with the input on stdin and returns its exit
+// code. Errors are only returned if the command could not be run.
+func (m *deviceUtils) runExitCode(ctx context.Context, input []byte, name string, args ...string) (int, error) {
+	output, code, err := m.exec.Run(ctx, input, name, args...)
+	if err != nil {
+		return 0, err
+	}
+	if code != 0 {
+		klog.V(4).Infof("%s %v exited with %d: %s", name, args, code, string(output))
+	}
+	return code, nil
+}
+
+// getDriveDeviceName returns the device name of the GCE disk of the drive,
+// as identified by the udev rules creating its "/dev/disk/by-id/google-*"
+// link, or an empty string if it is not a GCE disk
+func (m *deviceUtils) getDriveDeviceName(ctx context.Context, drive string) (string, error) {
+	var output []byte
+	var code int
+	var err error
+	var regex *regexp.Regexp
+	if strings.HasPrefix(drive, diskNvmePath) {
+		output, code, err = m.exec.Run(ctx, nil, googleNvmeIdPath, "-d", drive)
+		regex = nvmeDeviceNameRegex
+	} else {
+		output, code, err = m.exec.Run(ctx, nil, scsiIdPath, "--page=0x83", "--whitelisted", fmt.Sprintf("--device=%s", drive))
+		regex = scsiDeviceNameRegex
+	}
+	if err != nil || code != 0 {
+		return "", fmt.Errorf("getDriveDeviceName: identifying drive %q failed with exit code %d, error %v, output: %s", drive, code, err, string(output))
+	}
+	match := regex.FindStringSubmatch(string(output))
+	if match == nil {
+		return "", nil
+	}
+	return match[1], nil
+}
+
 // Triggers the application of udev rules by calling "udevadm trigger
 // --action=change" for newly created "/dev/sd*" drives (exist only in
 // after set). This is workaround for Issue #7972. Once the underlying
 // issue has been resolved, this may be removed.
-func udevadmChangeToNewDrives(sdBeforeSet sets.String) error {
-	sdAfter, err := filepath.Glob(diskSDPattern)
+func (m *deviceUtils) udevadmChangeToNewDrives(ctx context.Context, sdBeforeSet sets.String) error {
+	sdAfter, err := m.fs.Glob(diskSDPattern)
 	if err != nil {
 		return fmt.Errorf("Error filepath.Glob(\"%s\"): %v\r\n", diskSDPattern, err)
 	}
 
 	for _, sd := range sdAfter {
 		if !sdBeforeSet.Has(sd) {
-			return udevadmChangeToDrive(sd)
+			return m.udevadmChangeToDrive(ctx, sd)
 		}
 	}
 
@@ -132,11 +528,11 @@ func udevadmChangeToNewDrives(sdBeforeSet sets.String) error {
 // Calls "udevadm trigger --action=change" on the specified drive.
 // drivePath must be the block device path to trigger on, in the format "/dev/sd*", or a symlink to it.
 // This is workaround for Issue #7972. Once the underlying issue has been resolved, this may be removed.
-func udevadmChangeToDrive(drivePath string) error {
+func (m *deviceUtils) udevadmChangeToDrive(ctx context.Context, drivePath string) error {
 	klog.V(5).Infof("udevadmChangeToDrive: drive=%q", drivePath)
 
 	// Evaluate symlink, if any
-	drive, err := filepath.EvalSymlinks(drivePath)
+	drive, err := m.fs.EvalSymlinks(drivePath)
 	if err != nil {
 		return fmt.Errorf("udevadmChangeToDrive: filepath.EvalSymlinks(%q) failed with %v.", drivePath, err)
 	}
@@ -148,20 +544,25 @@ func udevadmChangeToDrive(drivePath string) error {
 	}
 
 	// Call "udevadm trigger --action=change --property-match=DEVNAME=/dev/sd..."
-	_, err = exec.Command(
+	_, code, err := m.exec.Run(
+		ctx,
+		nil,
 		"udevadm",
 		"trigger",
 		"--action=change",
-		fmt.Sprintf("--property-match=DEVNAME=%s", drive)).CombinedOutput()
+		fmt.Sprintf("--property-match=DEVNAME=%s", drive))
 	if err != nil {
 		return fmt.Errorf("udevadmChangeToDrive: udevadm trigger failed for drive %q with %v.", drive, err)
 	}
+	if code != 0 {
+		return fmt.Errorf("udevadmChangeToDrive: udevadm trigger failed for drive %q with exit code %d.", drive, code)
+	}
 	return nil
 }
 
 // PathExists returns true if the specified path exists.
-func pathExists(path string) (bool, error) {
-	_, err := os.Stat(path)
+func (m *deviceUtils) pathExists(path string) (bool, error) {
+	_, err := m.fs.Stat(path)
 	if err == nil {
 		return true, nil
 	} else if os.IsNotExist(err) {
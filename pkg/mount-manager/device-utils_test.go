@@ -0,0 +1,410 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mountmanager
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testDeviceName = "test-disk"
+	googleLink     = "/dev/disk/by-id/google-test-disk"
+	scsiLink       = "/dev/disk/by-id/scsi-0Google_PersistentDisk_test-disk"
+)
+
+// newIdExec returns an exec answering scsi_id and google_nvme_id with the
+// identifiers of the drives, as they print them for GCE disks, and recording
+// the commands run
+func newIdExec(ids map[string]string, cmds *[]string) *FakeDeviceExec {
+	return NewFakeDeviceExec(func(input []byte, cmd string, args ...string) ([]byte, int, error) {
+		*cmds = append(*cmds, strings.Join(append([]string{cmd}, args...), " "))
+		switch cmd {
+		case scsiIdPath:
+			drive := strings.TrimPrefix(args[2], "--device=")
+			if id, ok := ids[drive]; ok {
+				return []byte(id + "\n"), 0, nil
+			}
+			return nil, 1, nil
+		case googleNvmeIdPath:
+			if id, ok := ids[args[1]]; ok {
+				return []byte(id), 0, nil
+			}
+			return []byte("google_nvme_id: failed to identify device\n"), 1, nil
+		}
+		return nil, 0, nil
+	})
+}
+
+func TestVerifyDevicePath(t *testing.T) {
+	testCases := []struct {
+		name    string
+		devices []string
+		links   map[string]string
+		expPath string
+	}{
+		{
+			name:    "first path",
+			devices: []string{"/dev/sdb"},
+			links:   map[string]string{googleLink: "../../sdb", scsiLink: "../../sdb"},
+			expPath: googleLink,
+		},
+		{
+			name:    "second path",
+			devices: []string{"/dev/sdb"},
+			links:   map[string]string{scsiLink: "../../sdb"},
+			expPath: scsiLink,
+		},
+		{
+			name:    "link to missing device",
+			links:   map[string]string{googleLink: "../../sdb"},
+			expPath: "",
+		},
+		{
+			name:    "no path",
+			devices: []string{"/dev/sdb"},
+			expPath: "",
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		fs := NewFakeDeviceFS()
+		for _, device := range tc.devices {
+			fs.AddDevice(device)
+		}
+		for link, target := range tc.links {
+			fs.AddLink(link, target)
+		}
+		cmds := []string{}
+		deviceUtils := NewCustomDeviceUtils(newIdExec(nil, &cmds), fs)
+
+		path, err := deviceUtils.VerifyDevicePath(context.Background(), deviceUtils.GetDiskByIdPaths(testDeviceName, ""))
+		if err != nil {
+			t.Errorf("got unexpected error: %v", err)
+			continue
+		}
+		if path != tc.expPath {
+			t.Errorf("expected path %q, got: %q", tc.expPath, path)
+		}
+	}
+}
+
+func TestRemoveStaleDiskByIdPaths(t *testing.T) {
+	testCases := []struct {
+		name     string
+		devices  []string
+		links    map[string]string
+		ids      map[string]string
+		expLinks []string
+		expCmds  []string
+		expErr   bool
+	}{
+		{
+			name:     "links to the disk",
+			devices:  []string{"/dev/sdb"},
+			links:    map[string]string{googleLink: "../../sdb", scsiLink: "../../sdb"},
+			ids:      map[string]string{"/dev/sdb": "0Google  PersistentDisk  test-disk"},
+			expLinks: []string{googleLink, scsiLink},
+			expCmds: []string{
+				"/lib/udev/scsi_id --page=0x83 --whitelisted --device=/dev/sdb",
+				"/lib/udev/scsi_id --page=0x83 --whitelisted --device=/dev/sdb",
+			},
+		},
+		{
+			name:     "link to a missing device",
+			links:    map[string]string{googleLink: "../../sdb"},
+			expLinks: []string{},
+			expCmds:  []string{},
+		},
+		{
+			name:    "link to the device of another disk",
+			devices: []string{"/dev/sdb", "/dev/sdc"},
+			links:   map[string]string{googleLink: "../../sdb", scsiLink: "../../sdc"},
+			ids: map[string]string{
+				"/dev/sdb": "0Google  PersistentDisk  other-disk",
+				"/dev/sdc": "0Google  PersistentDisk  test-disk",
+			},
+			expLinks: []string{scsiLink},
+			expCmds: []string{
+				"/lib/udev/scsi_id --page=0x83 --whitelisted --device=/dev/sdb",
+				"udevadm trigger --action=change --property-match=DEVNAME=/dev/sdb",
+				"/lib/udev/scsi_id --page=0x83 --whitelisted --device=/dev/sdc",
+			},
+		},
+		{
+			name:     "link to a local SSD",
+			devices:  []string{"/dev/sdb"},
+			links:    map[string]string{googleLink: "../../sdb"},
+			ids:      map[string]string{"/dev/sdb": "0Google  EphemeralDisk   local-ssd-0"},
+			expLinks: []string{},
+			expCmds: []string{
+				"/lib/udev/scsi_id --page=0x83 --whitelisted --device=/dev/sdb",
+				"udevadm trigger --action=change --property-match=DEVNAME=/dev/sdb",
+			},
+		},
+		{
+			name:     "link to a device of another vendor",
+			devices:  []string{"/dev/sdb"},
+			links:    map[string]string{googleLink: "../../sdb"},
+			ids:      map[string]string{"/dev/sdb": "36000c29f4c2b3a1e0a8f3d5b7e9c1d2f"},
+			expLinks: []string{googleLink},
+			expCmds:  []string{"/lib/udev/scsi_id --page=0x83 --whitelisted --device=/dev/sdb"},
+		},
+		{
+			name:     "NVMe links to the disk",
+			devices:  []string{"/dev/nvme0n2"},
+			links:    map[string]string{googleLink: "../../nvme0n2"},
+			ids:      map[string]string{"/dev/nvme0n2": "ID_SERIAL_SHORT=test-disk\nID_SERIAL=Google_PersistentDisk_test-disk\n"},
+			expLinks: []string{googleLink},
+			expCmds:  []string{"/lib/udev/google_nvme_id -d /dev/nvme0n2"},
+		},
+		{
+			name:     "NVMe link to the device of another disk",
+			devices:  []string{"/dev/nvme0n2"},
+			links:    map[string]string{googleLink: "../../nvme0n2"},
+			ids:      map[string]string{"/dev/nvme0n2": "ID_SERIAL_SHORT=other-disk\nID_SERIAL=Google_PersistentDisk_other-disk\n"},
+			expLinks: []string{},
+			expCmds:  []string{"/lib/udev/google_nvme_id -d /dev/nvme0n2"},
+		},
+		{
+			name:     "unidentified device",
+			devices:  []string{"/dev/nvme0n2"},
+			links:    map[string]string{googleLink: "../../nvme0n2"},
+			expLinks: []string{googleLink},
+			expCmds:  []string{"/lib/udev/google_nvme_id -d /dev/nvme0n2"},
+			expErr:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		fs := NewFakeDeviceFS()
+		for _, device := range tc.devices {
+			fs.AddDevice(device)
+		}
+		for link, target := range tc.links {
+			fs.AddLink(link, target)
+		}
+		cmds := []string{}
+		deviceUtils := NewCustomDeviceUtils(newIdExec(tc.ids, &cmds), fs)
+
+		err := deviceUtils.RemoveStaleDiskByIdPaths(context.Background(), testDeviceName, deviceUtils.GetDiskByIdPaths(testDeviceName, ""))
+		if (err != nil) != tc.expErr {
+			t.Errorf("expected error: %v, got: %v", tc.expErr, err)
+		}
+		links := []string{}
+		for _, link := range []string{googleLink, scsiLink} {
+			if fs.Exists(link) {
+				links = append(links, link)
+			}
+		}
+		if !reflect.DeepEqual(links, tc.expLinks) {
+			t.Errorf("expected links %v, got: %v", tc.expLinks, links)
+		}
+		if !reflect.DeepEqual(cmds, tc.expCmds) {
+			t.Errorf("expected commands %v, got: %v", tc.expCmds, cmds)
+		}
+	}
+}
+
+func TestOpenLUKSDevice(t *testing.T) {
+	const devicePath = "/dev/disk/by-id/google-test-disk"
+	testCases := []struct {
+		name    string
+		open    bool
+		codes   map[string]int
+		expCmds []string
+		expErr  bool
+	}{
+		{
+			name:    "already open",
+			open:    true,
+			expCmds: []string{},
+		},
+		{
+			name:    "LUKS device",
+			expCmds: []string{"cryptsetup isLuks", "cryptsetup luksOpen"},
+		},
+		{
+			name:    "empty device",
+			codes:   map[string]int{"cryptsetup isLuks": 1, "blkid -p": 2},
+			expCmds: []string{"cryptsetup isLuks", "blkid -p", "cryptsetup luksFormat", "cryptsetup luksOpen"},
+		},
+		{
+			name:    "device with unencrypted data",
+			codes:   map[string]int{"cryptsetup isLuks": 1},
+			expCmds: []string{"cryptsetup isLuks", "blkid -p"},
+			expErr:  true,
+		},
+		{
+			name:    "wrong key",
+			codes:   map[string]int{"cryptsetup luksOpen": 2},
+			expCmds: []string{"cryptsetup isLuks", "cryptsetup luksOpen"},
+			expErr:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		fs := NewFakeDeviceFS()
+		if tc.open {
+			fs.AddDevice("/dev/mapper/luks-test-disk")
+		}
+		cmds := []string{}
+		exec := NewFakeDeviceExec(func(input []byte, cmd string, args ...string) ([]byte, int, error) {
+			name := cmd + " " + args[0]
+			cmds = append(cmds, name)
+			if (args[0] == "luksFormat" || args[0] == "luksOpen") && string(input) != "key" {
+				t.Errorf("expected the key on stdin of %s, got: %q", name, input)
+			}
+			return nil, tc.codes[name], nil
+		})
+		deviceUtils := NewCustomDeviceUtils(exec, fs)
+
+		mapperPath, err := deviceUtils.OpenLUKSDevice(context.Background(), devicePath, "luks-test-disk", []byte("key"))
+		if (err != nil) != tc.expErr {
+			t.Errorf("expected error: %v, got: %v", tc.expErr, err)
+		}
+		if err == nil && mapperPath != "/dev/mapper/luks-test-disk" {
+			t.Errorf("expected mapper path /dev/mapper/luks-test-disk, got: %s", mapperPath)
+		}
+		if !reflect.DeepEqual(cmds, tc.expCmds) {
+			t.Errorf("expected commands %v, got: %v", tc.expCmds, cmds)
+		}
+	}
+}
+
+func TestRepairFilesystem(t *testing.T) {
+	const devicePath = "/dev/disk/by-id/google-test-disk"
+	testCases := []struct {
+		name    string
+		fstype  string
+		code    int
+		expCmds []string
+		expErr  bool
+	}{
+		{
+			name:    "ext4 without errors",
+			fstype:  "ext4",
+			expCmds: []string{"e2fsck -y " + devicePath},
+		},
+		{
+			name:    "ext4 errors corrected",
+			fstype:  "ext4",
+			code:    fsckErrorsCorrected,
+			expCmds: []string{"e2fsck -y " + devicePath},
+		},
+		{
+			name:    "ext3 errors corrected with reboot",
+			fstype:  "ext3",
+			code:    fsckErrorsCorrectedReboot,
+			expCmds: []string{"e2fsck -y " + devicePath},
+		},
+		{
+			name:    "ext4 errors uncorrected",
+			fstype:  "ext4",
+			code:    fsckErrorsUncorrected,
+			expCmds: []string{"e2fsck -y " + devicePath},
+			expErr:  true,
+		},
+		{
+			name:    "xfs",
+			fstype:  "xfs",
+			expCmds: []string{"xfs_repair " + devicePath},
+		},
+		{
+			name:    "xfs with dirty log",
+			fstype:  "xfs",
+			code:    2,
+			expCmds: []string{"xfs_repair " + devicePath},
+			expErr:  true,
+		},
+		{
+			name:    "unsupported filesystem",
+			fstype:  "btrfs",
+			expCmds: []string{},
+			expErr:  true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		cmds := []string{}
+		exec := NewFakeDeviceExec(func(input []byte, cmd string, args ...string) ([]byte, int, error) {
+			cmds = append(cmds, strings.Join(append([]string{cmd}, args...), " "))
+			return nil, tc.code, nil
+		})
+		deviceUtils := NewCustomDeviceUtils(exec, NewFakeDeviceFS())
+
+		err := deviceUtils.RepairFilesystem(context.Background(), devicePath, tc.fstype)
+		if (err != nil) != tc.expErr {
+			t.Errorf("expected error: %v, got: %v", tc.expErr, err)
+		}
+		if !reflect.DeepEqual(cmds, tc.expCmds) {
+			t.Errorf("expected commands %v, got: %v", tc.expCmds, cmds)
+		}
+	}
+}
+
+func TestCheckXFSFilesystem(t *testing.T) {
+	const devicePath = "/dev/disk/by-id/google-test-disk"
+	testCases := []struct {
+		name         string
+		code         int
+		output       string
+		expCorrupted bool
+		expErr       bool
+	}{
+		{
+			name: "clean filesystem",
+		},
+		{
+			name:         "corrupted filesystem",
+			code:         1,
+			output:       "agi unlinked bucket 3 is 67 in ag 0 (inode=67)\nwould rebuild directory inode 128\n",
+			expCorrupted: true,
+		},
+		{
+			name:   "dirty log",
+			code:   1,
+			output: "ALERT: The filesystem has valuable metadata changes in a log which is being ignored because the -n option was used.\n",
+		},
+		{
+			name:   "check failed",
+			code:   2,
+			output: "fatal error -- couldn't initialize XFS library\n",
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		cmds := []string{}
+		exec := NewFakeDeviceExec(func(input []byte, cmd string, args ...string) ([]byte, int, error) {
+			cmds = append(cmds, strings.Join(append([]string{cmd}, args...), " "))
+			return []byte(tc.output), tc.code, nil
+		})
+		deviceUtils := NewCustomDeviceUtils(exec, NewFakeDeviceFS())
+
+		corrupted, err := deviceUtils.CheckXFSFilesystem(context.Background(), devicePath)
+		if (err != nil) != tc.expErr {
+			t.Errorf("expected error: %v, got: %v", tc.expErr, err)
+		}
+		if corrupted != tc.expCorrupted {
+			t.Errorf("expected corrupted: %v, got: %v", tc.expCorrupted, corrupted)
+		}
+		if expCmds := []string{"xfs_repair -n " + devicePath}; !reflect.DeepEqual(cmds, expCmds) {
+			t.Errorf("expected commands %v, got: %v", expCmds, cmds)
+		}
+	}
+}
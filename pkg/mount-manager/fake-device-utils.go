@@ -14,13 +14,34 @@ limitations under the License.
 
 package mountmanager
 
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
 type fakeDeviceUtils struct {
+	mux sync.Mutex
+	// LUKS devices opened by name
+	luksDevices map[string]string
+	// Devices whose filesystem was checked
+	checkedDevices []string
+	// Whether filesystem checks run until their context is done
+	blockFilesystemChecks bool
+	// Devices whose filesystem was repaired
+	repairedDevices []string
+	// Devices whose filesystem is corrupted
+	corruptDevices map[string]bool
 }
 
 var _ DeviceUtils = &fakeDeviceUtils{}
 
 func NewFakeDeviceUtils() *fakeDeviceUtils {
-	return &fakeDeviceUtils{}
+	return &fakeDeviceUtils{luksDevices: map[string]string{}, corruptDevices: map[string]bool{}}
 }
 
 // Returns list of all /dev/disk/by-id/* paths for given PD.
@@ -30,7 +51,249 @@ func (m *fakeDeviceUtils) GetDiskByIdPaths(pdName string, partition string) []st
 }
 
 // Returns the first path that exists, or empty string if none exist.
-func (m *fakeDeviceUtils) VerifyDevicePath(devicePaths []string) (string, error) {
+func (m *fakeDeviceUtils) VerifyDevicePath(ctx context.Context, devicePaths []string) (string, error) {
 	// Return any random device path to use as mount source
 	return "/dev/disk/fake-path", nil
 }
+
+func (m *fakeDeviceUtils) RemoveStaleDiskByIdPaths(ctx context.Context, deviceName string, devicePaths []string) error {
+	return nil
+}
+
+func (m *fakeDeviceUtils) OpenLUKSDevice(ctx context.Context, devicePath string, name string, key []byte) (string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.luksDevices[name] = devicePath
+	return "/dev/mapper/" + name, nil
+}
+
+func (m *fakeDeviceUtils) CloseLUKSDevice(ctx context.Context, name string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	delete(m.luksDevices, name)
+	return nil
+}
+
+func (m *fakeDeviceUtils) IsLUKSDeviceOpen(name string) (bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	_, ok := m.luksDevices[name]
+	return ok, nil
+}
+
+func (m *fakeDeviceUtils) CheckFilesystem(ctx context.Context, devicePath string) error {
+	m.mux.Lock()
+	m.checkedDevices = append(m.checkedDevices, devicePath)
+	block := m.blockFilesystemChecks
+	m.mux.Unlock()
+	if block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+// CheckedDevices returns the devices whose filesystem was checked
+func (m *fakeDeviceUtils) CheckedDevices() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]string(nil), m.checkedDevices...)
+}
+
+// BlockFilesystemChecks makes filesystem checks run until their context is
+// done, as checks of large filesystems do
+func (m *fakeDeviceUtils) BlockFilesystemChecks() {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.blockFilesystemChecks = true
+}
+
+func (m *fakeDeviceUtils) RepairFilesystem(ctx context.Context, devicePath string, fstype string) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.repairedDevices = append(m.repairedDevices, devicePath)
+	delete(m.corruptDevices, devicePath)
+	return nil
+}
+
+func (m *fakeDeviceUtils) CheckXFSFilesystem(ctx context.Context, devicePath string) (bool, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.corruptDevices[devicePath], nil
+}
+
+// SetCorrupted sets whether the filesystem of the device is reported to be
+// corrupted, until it is repaired
+func (m *fakeDeviceUtils) SetCorrupted(devicePath string, corrupted bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.corruptDevices[devicePath] = corrupted
+}
+
+// RepairedDevices returns the devices whose filesystem was repaired, in order
+func (m *fakeDeviceUtils) RepairedDevices() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]string(nil), m.repairedDevices...)
+}
+
+// FakeDeviceExec runs the commands of DeviceUtils with a hook instead of
+// running them
+type FakeDeviceExec struct {
+	runHook deviceRunHook
+}
+
+type deviceRunHook func(input []byte, cmd string, args ...string) ([]byte, int, error)
+
+var _ DeviceExec = &FakeDeviceExec{}
+
+func NewFakeDeviceExec(run deviceRunHook) *FakeDeviceExec {
+	return &FakeDeviceExec{runHook: run}
+}
+
+func (e *FakeDeviceExec) Run(ctx context.Context, input []byte, cmd string, args ...string) ([]byte, int, error) {
+	if e.runHook != nil {
+		return e.runHook(input, cmd, args...)
+	}
+	return nil, 0, nil
+}
+
+// FakeDeviceFS holds the device files of DeviceUtils in memory, as devices
+// and links to them
+type FakeDeviceFS struct {
+	mux     sync.Mutex
+	devices map[string]bool
+	links   map[string]string
+}
+
+var _ DeviceFS = &FakeDeviceFS{}
+
+func NewFakeDeviceFS() *FakeDeviceFS {
+	return &FakeDeviceFS{
+		devices: map[string]bool{},
+		links:   map[string]string{},
+	}
+}
+
+// AddDevice adds a device, e.g. "/dev/sdb"
+func (f *FakeDeviceFS) AddDevice(path string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.devices[path] = true
+}
+
+// AddLink adds a link to the target, which may be relative to the directory
+// of the link as the "/dev/disk/by-id/" links created by udev
+func (f *FakeDeviceFS) AddLink(path, target string) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.links[path] = target
+}
+
+// Exists returns whether the device or link exists
+func (f *FakeDeviceFS) Exists(path string) bool {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	_, isLink := f.links[path]
+	return isLink || f.devices[path]
+}
+
+func (f *FakeDeviceFS) Glob(pattern string) ([]string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	matches := []string{}
+	for _, paths := range []map[string]bool{f.devices, f.linkSet()} {
+		for path := range paths {
+			match, err := filepath.Match(pattern, path)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				matches = append(matches, path)
+			}
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func (f *FakeDeviceFS) Stat(path string) (os.FileInfo, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	resolved, err := f.evalSymlinks(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return &fakeFileInfo{name: filepath.Base(resolved), mode: os.ModeDevice}, nil
+}
+
+func (f *FakeDeviceFS) Lstat(path string) (os.FileInfo, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if _, ok := f.links[path]; ok {
+		return &fakeFileInfo{name: filepath.Base(path), mode: os.ModeSymlink}, nil
+	}
+	if f.devices[path] {
+		return &fakeFileInfo{name: filepath.Base(path), mode: os.ModeDevice}, nil
+	}
+	return nil, &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+}
+
+func (f *FakeDeviceFS) EvalSymlinks(path string) (string, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.evalSymlinks(path)
+}
+
+func (f *FakeDeviceFS) Remove(path string) error {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if _, ok := f.links[path]; ok {
+		delete(f.links, path)
+		return nil
+	}
+	if f.devices[path] {
+		delete(f.devices, path)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: path, Err: os.ErrNotExist}
+}
+
+func (f *FakeDeviceFS) linkSet() map[string]bool {
+	set := map[string]bool{}
+	for path := range f.links {
+		set[path] = true
+	}
+	return set
+}
+
+// evalSymlinks follows the links from the path to a device
+func (f *FakeDeviceFS) evalSymlinks(path string) (string, error) {
+	// Bound the number of links followed, as the kernel does
+	for i := 0; i < 40; i++ {
+		if f.devices[path] {
+			return path, nil
+		}
+		target, ok := f.links[path]
+		if !ok {
+			return "", &os.PathError{Op: "lstat", Path: path, Err: os.ErrNotExist}
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return "", &os.PathError{Op: "lstat", Path: path, Err: syscall.ELOOP}
+}
+
+type fakeFileInfo struct {
+	name string
+	mode os.FileMode
+}
+
+func (i *fakeFileInfo) Name() string       { return i.name }
+func (i *fakeFileInfo) Size() int64        { return 0 }
+func (i *fakeFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *fakeFileInfo) ModTime() time.Time { return time.Time{} }
+func (i *fakeFileInfo) IsDir() bool        { return false }
+func (i *fakeFileInfo) Sys() interface{}   { return nil }
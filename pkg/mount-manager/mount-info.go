@@ -0,0 +1,178 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mountmanager
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+	utilio "k8s.io/utils/io"
+)
+
+const (
+	// Number of fields per line in mountinfo, excluding the optional fields,
+	// as per the proc man page.
+	minNumMountInfoFields = 10
+)
+
+// MountInfo is a mount of the mountinfo file
+type MountInfo struct {
+	// Unique ID of the mount
+	ID int
+	// ID of the parent mount
+	ParentID int
+	// "major:minor" of the device of the mounted filesystem
+	MajorMinor string
+	// Directory of the filesystem that is the root of the mount. It is not
+	// "/" for bind mounts of a subdirectory.
+	Root string
+	// Mount point relative to the root of the process
+	MountPoint string
+	// Per-mount options
+	MountOptions []string
+	// Propagation of the mount, e.g. "shared:1" or "master:1"
+	OptionalFields []string
+	// Type of the mounted filesystem
+	FsType string
+	// Mount source, e.g. the device
+	Source string
+	// Per-superblock options
+	SuperOptions []string
+}
+
+// ParseMountInfo parses a mountinfo file, e.g. /proc/self/mountinfo
+func ParseMountInfo(filename string) ([]MountInfo, error) {
+	content, err := utilio.ConsistentRead(filename, maxListTries)
+	if err != nil {
+		return nil, err
+	}
+	infos := []MountInfo{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "" {
+			continue
+		}
+		info, err := parseMountInfoLine(line)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func parseMountInfoLine(line string) (MountInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields) < minNumMountInfoFields {
+		return MountInfo{}, fmt.Errorf("wrong number of fields (expected at least %d, got %d): %s", minNumMountInfoFields, len(fields), line)
+	}
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return MountInfo{}, fmt.Errorf("invalid mount ID in %q: %v", line, err)
+	}
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return MountInfo{}, fmt.Errorf("invalid parent mount ID in %q: %v", line, err)
+	}
+	info := MountInfo{
+		ID:           id,
+		ParentID:     parentID,
+		MajorMinor:   fields[2],
+		Root:         unescapeMountInfoField(fields[3]),
+		MountPoint:   unescapeMountInfoField(fields[4]),
+		MountOptions: strings.Split(fields[5], ","),
+	}
+	// The optional fields are terminated by a "-"
+	i := 6
+	for ; i < len(fields) && fields[i] != "-"; i++ {
+		info.OptionalFields = append(info.OptionalFields, fields[i])
+	}
+	i++
+	if len(fields)-i != 3 {
+		return MountInfo{}, fmt.Errorf("expected 3 fields after the optional fields, got %d: %s", len(fields)-i, line)
+	}
+	info.FsType = fields[i]
+	info.Source = unescapeMountInfoField(fields[i+1])
+	info.SuperOptions = strings.Split(fields[i+2], ",")
+	return info, nil
+}
+
+// unescapeMountInfoField replaces the octal escapes of spaces, tabs, newlines
+// and backslashes in mountinfo paths
+func unescapeMountInfoField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// isMountPoint returns whether the path is a mount point in the given
+// mountinfo file. Unlike comparing the device of the path with its parent's,
+// this detects bind mounts within the same filesystem.
+func isMountPoint(mountInfoPath, path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, err
+	}
+	// Mount points are recorded with symlinks resolved
+	absPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+	absPath, err = filepath.Abs(absPath)
+	if err != nil {
+		return false, err
+	}
+	infos, err := ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse %s: %v", mountInfoPath, err)
+	}
+	for _, info := range infos {
+		if info.MountPoint == absPath {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// mountInfoMounter checks mount points with mountinfo instead of comparing
+// devices, which misses bind mounts such as those of kubelet paths
+type mountInfoMounter struct {
+	mount.Interface
+	mountInfoPath string
+}
+
+var _ mount.Interface = &mountInfoMounter{}
+
+func (m *mountInfoMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	mnt, err := isMountPoint(m.mountInfoPath, file)
+	if err != nil {
+		return true, err
+	}
+	return !mnt, nil
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mountmanager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseMountInfoLine(t *testing.T) {
+	testCases := []struct {
+		name    string
+		line    string
+		expInfo MountInfo
+		expErr  bool
+	}{
+		{
+			name: "shared mount",
+			line: "25 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,commit=30",
+			expInfo: MountInfo{
+				ID:             25,
+				ParentID:       1,
+				MajorMinor:     "8:1",
+				Root:           "/",
+				MountPoint:     "/",
+				MountOptions:   []string{"rw", "relatime"},
+				OptionalFields: []string{"shared:1"},
+				FsType:         "ext4",
+				Source:         "/dev/sda1",
+				SuperOptions:   []string{"rw", "commit=30"},
+			},
+		},
+		{
+			name: "bind mount without optional fields",
+			line: "130 25 8:16 /data /var/lib/kubelet/pods/a\\040b/mount rw - ext4 /dev/sdb rw",
+			expInfo: MountInfo{
+				ID:           130,
+				ParentID:     25,
+				MajorMinor:   "8:16",
+				Root:         "/data",
+				MountPoint:   "/var/lib/kubelet/pods/a b/mount",
+				MountOptions: []string{"rw"},
+				FsType:       "ext4",
+				Source:       "/dev/sdb",
+				SuperOptions: []string{"rw"},
+			},
+		},
+		{
+			name:   "too few fields",
+			line:   "25 1 8:1 / / rw - ext4",
+			expErr: true,
+		},
+		{
+			name:   "missing separator",
+			line:   "25 1 8:1 / / rw shared:1 master:2 ext4 /dev/sda1 rw",
+			expErr: true,
+		},
+		{
+			name:   "invalid mount ID",
+			line:   "a 1 8:1 / / rw - ext4 /dev/sda1 rw",
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		info, err := parseMountInfoLine(tc.line)
+		if err != nil {
+			if !tc.expErr {
+				t.Errorf("got unexpected error: %v", err)
+			}
+			continue
+		}
+		if tc.expErr {
+			t.Errorf("expected error, got none")
+		}
+		if !reflect.DeepEqual(info, tc.expInfo) {
+			t.Errorf("expected mount info %+v, got: %+v", tc.expInfo, info)
+		}
+	}
+}
+
+func TestIsMountPoint(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "mount-info-test")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpDir, err = filepath.EvalSymlinks(tmpDir)
+	if err != nil {
+		t.Fatalf("Failed to resolve temp dir: %v", err)
+	}
+	mounted := filepath.Join(tmpDir, "mounted")
+	notMounted := filepath.Join(tmpDir, "not-mounted")
+	for _, dir := range []string{mounted, notMounted} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+	link := filepath.Join(tmpDir, "link")
+	if err := os.Symlink(mounted, link); err != nil {
+		t.Fatalf("Failed to create link: %v", err)
+	}
+	// The mount is a bind mount within the same filesystem, which comparing
+	// devices doesn't detect
+	mountInfoPath := filepath.Join(tmpDir, "mountinfo")
+	mountInfo := fmt.Sprintf("25 1 8:1 / / rw shared:1 - ext4 /dev/sda1 rw\n130 25 8:1 %s %s rw shared:1 - ext4 /dev/sda1 rw\n", notMounted, mounted)
+	if err := ioutil.WriteFile(mountInfoPath, []byte(mountInfo), 0644); err != nil {
+		t.Fatalf("Failed to write mountinfo: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		path     string
+		expMount bool
+		expErr   bool
+	}{
+		{
+			name:     "bind mount",
+			path:     mounted,
+			expMount: true,
+		},
+		{
+			name:     "link to bind mount",
+			path:     link,
+			expMount: true,
+		},
+		{
+			name: "not mounted",
+			path: notMounted,
+		},
+		{
+			name:   "missing path",
+			path:   filepath.Join(tmpDir, "missing"),
+			expErr: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Logf("test case: %s", tc.name)
+		mnt, err := isMountPoint(mountInfoPath, tc.path)
+		if err != nil {
+			if !tc.expErr {
+				t.Errorf("got unexpected error: %v", err)
+			}
+			continue
+		}
+		if tc.expErr {
+			t.Errorf("expected error, got none")
+		}
+		if mnt != tc.expMount {
+			t.Errorf("expected mount point: %v, got: %v", tc.expMount, mnt)
+		}
+	}
+}
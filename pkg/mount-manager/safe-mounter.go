@@ -17,7 +17,10 @@ package mountmanager
 import "k8s.io/kubernetes/pkg/util/mount"
 
 func NewSafeMounter() *mount.SafeFormatAndMount {
-	realMounter := mount.New("")
+	realMounter := &mountInfoMounter{
+		Interface:     mount.New(""),
+		mountInfoPath: procMountInfoPath,
+	}
 	realExec := mount.NewOsExec()
 	return &mount.SafeFormatAndMount{
 		Interface: realMounter,
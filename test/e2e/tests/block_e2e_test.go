@@ -0,0 +1,117 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	testutils "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/e2e/utils"
+	remote "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/remote"
+)
+
+const (
+	// Size of the random data written to block volumes
+	blockDataSizeMb = 16
+)
+
+var _ = Describe("GCE PD CSI Driver Block Volumes", func() {
+	BeforeEach(func() {
+		// Reused instances are in distinct zones
+		if len(testContexts) < 2 && *reuseInstances != "" {
+			Skip("The reused instances are not in 2 zones")
+		}
+		Expect(len(testContexts)).To(BeNumerically(">", 1))
+	})
+
+	It("Should keep the data of a block volume republished after a reboot and on another instance", func() {
+		// The instances are in distinct zones, the volume is an RePD to be
+		// attached to both
+		zoneToContext, zones := getTestContextsInTwoZones()
+		firstContext := zoneToContext[zones[0]]
+		secondContext := zoneToContext[zones[1]]
+
+		p, _, _ := firstContext.Instance.GetIdentity()
+		region, err := common.GetRegionFromZones(zones)
+		Expect(err).To(BeNil(), "Failed to get region from zones")
+
+		// Create Disk
+		volName := testNamePrefix + string(uuid.NewUUID())
+		volID := createRegionalVolume(firstContext.Client, volName, zones)
+		defer deleteRegionalVolumeAndValidate(firstContext.Client, volID, p, region, volName)
+
+		volDir := filepath.Join("/tmp/", volName)
+		stageDir := filepath.Join(volDir, "stage")
+		publishDir := filepath.Join(volDir, "mount")
+
+		// Write to the device published on the first instance
+		publishBlockVolume(firstContext, volID, stageDir, publishDir)
+		checksum, err := testutils.WriteRandomBlockData(firstContext.Instance, publishDir, blockDataSizeMb)
+		Expect(err).To(BeNil(), "Failed to write block data: %v", err)
+
+		// A reboot drops the mounts while the disk stays attached, then the CO
+		// stages and publishes the volume again to the same paths
+		output, err := firstContext.Instance.SSH("umount", publishDir)
+		Expect(err).To(BeNil(), "Failed to unmount %s. Output: %v, error: %v", publishDir, output, err)
+		err = firstContext.Client.NodeStageBlockVolume(volID, stageDir)
+		Expect(err).To(BeNil(), "NodeStageBlockVolume after reboot failed with error: %v", err)
+		err = firstContext.Client.NodePublishBlockVolume(volID, stageDir, publishDir)
+		Expect(err).To(BeNil(), "NodePublishBlockVolume after reboot failed with error: %v", err)
+		readChecksum, err := testutils.GetBlockChecksum(firstContext.Instance, publishDir, blockDataSizeMb)
+		Expect(err).To(BeNil(), "Failed to read block data: %v", err)
+		Expect(readChecksum).To(Equal(checksum), "Block data changed after republishing")
+
+		unpublishBlockVolume(firstContext, volID, stageDir, publishDir)
+
+		// Read the device published on the second instance
+		publishBlockVolume(secondContext, volID, stageDir, publishDir)
+		defer unpublishBlockVolume(secondContext, volID, stageDir, publishDir)
+		readChecksum, err = testutils.GetBlockChecksum(secondContext.Instance, publishDir, blockDataSizeMb)
+		Expect(err).To(BeNil(), "Failed to read block data: %v", err)
+		Expect(readChecksum).To(Equal(checksum), "Block data differs on the other instance")
+	})
+})
+
+// publishBlockVolume attaches, stages and publishes the volume as a block
+// device on the instance of the test context
+func publishBlockVolume(testContext *remote.TestContext, volID, stageDir, publishDir string) {
+	client := testContext.Client
+	err := client.ControllerPublishVolume(volID, testContext.Instance.GetNodeID())
+	Expect(err).To(BeNil(), "ControllerPublishVolume failed with error: %v", err)
+	err = client.NodeStageBlockVolume(volID, stageDir)
+	Expect(err).To(BeNil(), "NodeStageBlockVolume failed with error: %v", err)
+	err = client.NodePublishBlockVolume(volID, stageDir, publishDir)
+	Expect(err).To(BeNil(), "NodePublishBlockVolume failed with error: %v", err)
+}
+
+// unpublishBlockVolume undoes publishBlockVolume
+func unpublishBlockVolume(testContext *remote.TestContext, volID, stageDir, publishDir string) {
+	client := testContext.Client
+	err := client.NodeUnpublishVolume(volID, publishDir)
+	Expect(err).To(BeNil(), "NodeUnpublishVolume failed with error: %v", err)
+	err = client.NodeUnstageVolume(volID, stageDir)
+	Expect(err).To(BeNil(), "NodeUnstageVolume failed with error: %v", err)
+	err = client.ControllerUnpublishVolume(volID, testContext.Instance.GetNodeID())
+	Expect(err).To(BeNil(), "ControllerUnpublishVolume failed with error: %v", err)
+	fp := filepath.Dir(stageDir)
+	err = testutils.RmAll(testContext.Instance, fp)
+	if err != nil {
+		klog.Errorf("Failed to rm file path %s: %v", fp, err)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	testutils "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/e2e/utils"
+	remote "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/remote"
+)
+
+const (
+	// Time after which the driver is killed once a call started, so it dies
+	// while the call is in flight
+	driverRestartDelay = time.Second
+)
+
+var _ = Describe("GCE PD CSI Driver Restarts", func() {
+	It("Should converge when the driver restarts during provisioning, attaching and mounting, without leaking disks or mounts", func() {
+		testContext := getRandomTestContext()
+
+		p, z, n := testContext.Instance.GetIdentity()
+		client := testContext.Client
+		instance := testContext.Instance
+
+		// Create Disk
+		volName := testNamePrefix + string(uuid.NewUUID())
+		var volID string
+		callWithDriverRestart(testContext, "CreateVolume", func() error {
+			var err error
+			volID, err = client.CreateVolume(volName, nil, defaultSizeGb, zoneTopology(z))
+			return err
+		})
+		defer func() {
+			// Delete Disk
+			callWithDriverRestart(testContext, "DeleteVolume", func() error {
+				return client.DeleteVolume(volID)
+			})
+			_, err := computeService.Disks.Get(p, z, volName).Do()
+			Expect(gce.IsGCEError(err, "notFound")).To(BeTrue(), "Expected disk to not be found")
+		}()
+
+		cloudDisk, err := computeService.Disks.Get(p, z, volName).Do()
+		Expect(err).To(BeNil(), "Could not get disk from cloud directly")
+		Expect(cloudDisk.Status).To(Equal(readyState))
+
+		// Attach Disk
+		callWithDriverRestart(testContext, "ControllerPublishVolume", func() error {
+			return client.ControllerPublishVolume(volID, instance.GetNodeID())
+		})
+		defer func() {
+			// Detach Disk
+			callWithDriverRestart(testContext, "ControllerUnpublishVolume", func() error {
+				return client.ControllerUnpublishVolume(volID, instance.GetNodeID())
+			})
+			Expect(countDiskAttachments(p, z, n, volName)).To(Equal(0), "Expected disk to be detached")
+		}()
+
+		Expect(countDiskAttachments(p, z, n, volName)).To(Equal(1), "Expected disk to be attached once")
+
+		// Stage Disk
+		volDir := filepath.Join("/tmp/", volName)
+		stageDir := filepath.Join(volDir, "stage")
+		callWithDriverRestart(testContext, "NodeStageVolume", func() error {
+			return client.NodeStageExt4Volume(volID, stageDir)
+		})
+		defer func() {
+			// Unstage Disk
+			callWithDriverRestart(testContext, "NodeUnstageVolume", func() error {
+				return client.NodeUnstageVolume(volID, stageDir)
+			})
+			Expect(countMounts(instance, volDir)).To(Equal(0), "Expected no mount to be leaked")
+			err := testutils.RmAll(instance, volDir)
+			if err != nil {
+				klog.Errorf("Failed to rm file path %s: %v", volDir, err)
+			}
+		}()
+		Expect(countMounts(instance, stageDir)).To(Equal(1), "Expected volume to be staged once")
+
+		// Mount Disk
+		publishDir := filepath.Join(volDir, "mount")
+		callWithDriverRestart(testContext, "NodePublishVolume", func() error {
+			return client.NodePublishVolume(volID, stageDir, publishDir)
+		})
+		defer func() {
+			// Unmount Disk
+			callWithDriverRestart(testContext, "NodeUnpublishVolume", func() error {
+				return client.NodeUnpublishVolume(volID, publishDir)
+			})
+		}()
+		Expect(countMounts(instance, publishDir)).To(Equal(1), "Expected volume to be published once")
+
+		// The volume is usable
+		err = testutils.ForceChmod(instance, volDir, "777")
+		Expect(err).To(BeNil(), "Chmod failed with error: %v", err)
+		testFileContents := "test"
+		testFile := filepath.Join(publishDir, "testfile")
+		err = testutils.WriteFile(instance, testFile, testFileContents)
+		Expect(err).To(BeNil(), "Failed to write file: %v", err)
+		readContents, err := testutils.ReadFile(instance, testFile)
+		Expect(err).To(BeNil(), "ReadFile failed with error: %v", err)
+		Expect(strings.TrimSpace(readContents)).To(Equal(testFileContents))
+	})
+})
+
+// callWithDriverRestart kills and restarts the driver of the test context
+// while the call is in flight, then retries the call as the CO would until it
+// succeeds
+func callWithDriverRestart(testContext *remote.TestContext, name string, call func() error) {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- call()
+	}()
+	time.Sleep(driverRestartDelay)
+	err := remote.RestartDriver(testContext)
+	Expect(err).To(BeNil(), "Failed to restart driver during %s: %v", name, err)
+	if err := <-errs; err != nil {
+		klog.Infof("%s interrupted by the driver restart failed: %v", name, err)
+	}
+
+	err = wait.Poll(5*time.Second, 5*time.Minute, func() (bool, error) {
+		err := call()
+		if err != nil {
+			klog.Warningf("%s failed after the driver restart, retrying: %v", name, err)
+			return false, nil
+		}
+		return true, nil
+	})
+	Expect(err).To(BeNil(), "%s did not succeed after the driver restart", name)
+}
+
+// countMounts returns the number of mounts of the instance under the path
+func countMounts(instance *remote.InstanceInfo, path string) int {
+	output, err := instance.SSHNoSudo("grep", "-c", path, "/proc/mounts", "||", "true")
+	Expect(err).To(BeNil(), "Failed to list mounts. Output: %v, error: %v", output, err)
+	n, err := strconv.Atoi(strings.TrimSpace(output))
+	Expect(err).To(BeNil(), "Failed to parse mount count %q", output)
+	return n
+}
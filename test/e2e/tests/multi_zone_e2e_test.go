@@ -18,12 +18,15 @@ import (
 	"fmt"
 	"path/filepath"
 	"strings"
+	"time"
 
 	csi "github.com/container-storage-interface/spec/lib/go/csi"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	compute "google.golang.org/api/compute/v1"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
 	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
@@ -33,6 +36,10 @@ import (
 
 var _ = Describe("GCE PD CSI Driver Multi-Zone", func() {
 	BeforeEach(func() {
+		// Reused instances are in distinct zones
+		if len(testContexts) < 2 && *reuseInstances != "" {
+			Skip("The reused instances are not in 2 zones")
+		}
 		Expect(len(testContexts)).To(BeNumerically(">", 1))
 	})
 
@@ -60,24 +67,7 @@ var _ = Describe("GCE PD CSI Driver Multi-Zone", func() {
 	It("Should successfully run through entire lifecycle of an RePD volume on instances in 2 zones", func() {
 		// Create new driver and client
 
-		Expect(testContexts).NotTo(BeEmpty())
-
-		zoneToContext := map[string]*remote.TestContext{}
-		zones := []string{}
-
-		for _, tc := range testContexts {
-			_, z, _ := tc.Instance.GetIdentity()
-			// Zone hasn't been seen before
-			if _, ok := zoneToContext[z]; !ok {
-				zoneToContext[z] = tc
-				zones = append(zones, z)
-			}
-			if len(zoneToContext) == 2 {
-				break
-			}
-		}
-
-		Expect(len(zoneToContext)).To(Equal(2), "Must have instances in exactly 2 zones")
+		zoneToContext, zones := getTestContextsInTwoZones()
 
 		controllerContext := zoneToContext[zones[0]]
 		controllerClient := controllerContext.Client
@@ -142,8 +132,176 @@ var _ = Describe("GCE PD CSI Driver Multi-Zone", func() {
 
 	})
 
+	It("Should fail over an RePD attached in one zone to the instance in the other zone with its data", func() {
+		zoneToContext, zones := getTestContextsInTwoZones()
+		failedContext := zoneToContext[zones[0]]
+		failoverContext := zoneToContext[zones[1]]
+		controllerClient := failedContext.Client
+
+		p, _, _ := failedContext.Instance.GetIdentity()
+		_, failoverZone, failoverName := failoverContext.Instance.GetIdentity()
+
+		region, err := common.GetRegionFromZones(zones)
+		Expect(err).To(BeNil(), "Failed to get region from zones")
+
+		// Create Disk
+		volName := testNamePrefix + string(uuid.NewUUID())
+		volID := createRegionalVolume(controllerClient, volName, zones)
+		defer deleteRegionalVolumeAndValidate(controllerClient, volID, p, region, volName)
+
+		cloudDisk, err := betaComputeService.RegionDisks.Get(p, region, volName).Do()
+		Expect(err).To(BeNil(), "Could not get disk from cloud directly")
+
+		// Attach the disk in the first zone and write to it
+		failedInstance := failedContext.Instance
+		err = controllerClient.ControllerPublishVolume(volID, failedInstance.GetNodeID())
+		Expect(err).To(BeNil(), "ControllerPublishVolume failed with error: %v", err)
+
+		stageDir := filepath.Join("/tmp/", volName, "stage")
+		err = failedContext.Client.NodeStageExt4Volume(volID, stageDir)
+		Expect(err).To(BeNil(), "NodeStageExt4Volume failed with error: %v", err)
+
+		publishDir := filepath.Join("/tmp/", volName, "mount")
+		err = failedContext.Client.NodePublishVolume(volID, stageDir, publishDir)
+		Expect(err).To(BeNil(), "NodePublishVolume failed with error: %v", err)
+		err = testutils.ForceChmod(failedInstance, filepath.Join("/tmp/", volName), "777")
+		Expect(err).To(BeNil(), "Chmod failed with error: %v", err)
+
+		testFileContents := "failover"
+		err = testutils.WriteFile(failedInstance, filepath.Join(publishDir, "testfile"), testFileContents)
+		Expect(err).To(BeNil(), "Failed to write file: %v", err)
+		// The data must reach the disk, the attachment is not cleanly torn
+		// down
+		output, err := failedInstance.SSH("sync")
+		Expect(err).To(BeNil(), "Failed to sync. Output: %v, error: %v", output, err)
+
+		// Fail the attachment as if the zone went down: the disk is force
+		// attached to the instance in the other zone while still attached
+		// and mounted in the first one, as done to recover from a zonal
+		// outage
+		volKey, err := common.VolumeIDToKey(volID)
+		Expect(err).To(BeNil(), "Failed to get key of volume %v", volID)
+		deviceName, err := common.GetDeviceName(volKey)
+		Expect(err).To(BeNil(), "Failed to get device name of volume %v", volID)
+		_, err = computeService.Instances.AttachDisk(p, failoverZone, failoverName, &compute.AttachedDisk{
+			DeviceName: deviceName,
+			Mode:       "READ_WRITE",
+			Source:     cloudDisk.SelfLink,
+		}).ForceAttach(true).Do()
+		Expect(err).To(BeNil(), "Failed to force attach disk to instance %v", failoverName)
+
+		err = wait.Poll(10*time.Second, 5*time.Minute, func() (bool, error) {
+			disk, err := betaComputeService.RegionDisks.Get(p, region, volName).Do()
+			if err != nil {
+				return false, err
+			}
+			return len(disk.Users) == 1 && strings.HasSuffix(disk.Users[0], "/instances/"+failoverName), nil
+		})
+		Expect(err).To(BeNil(), "Disk was not failed over to instance %v", failoverName)
+
+		// Detaching the failed attachment succeeds although the disk is gone
+		// from the instance
+		err = failedContext.Client.NodeUnpublishVolume(volID, publishDir)
+		if err != nil {
+			klog.Errorf("Failed to unpublish volume of failed attachment: %v", err)
+		}
+		err = failedContext.Client.NodeUnstageVolume(volID, stageDir)
+		if err != nil {
+			klog.Errorf("Failed to unstage volume of failed attachment: %v", err)
+		}
+		err = testutils.RmAll(failedInstance, filepath.Join("/tmp/", volName))
+		if err != nil {
+			klog.Errorf("Failed to rm file path: %v", err)
+		}
+		err = controllerClient.ControllerUnpublishVolume(volID, failedInstance.GetNodeID())
+		Expect(err).To(BeNil(), "ControllerUnpublishVolume of the failed attachment failed with error: %v", err)
+
+		// The driver picks up the disk in the other zone with the data written
+		// before the failure
+		failoverInstance := failoverContext.Instance
+		err = failoverContext.Client.ControllerPublishVolume(volID, failoverInstance.GetNodeID())
+		Expect(err).To(BeNil(), "ControllerPublishVolume of the force attached disk failed with error: %v", err)
+		defer func() {
+			err := failoverContext.Client.ControllerUnpublishVolume(volID, failoverInstance.GetNodeID())
+			Expect(err).To(BeNil(), "ControllerUnpublishVolume failed with error: %v", err)
+		}()
+
+		err = failoverContext.Client.NodeStageExt4Volume(volID, stageDir)
+		Expect(err).To(BeNil(), "NodeStageExt4Volume failed with error: %v", err)
+		defer func() {
+			err := failoverContext.Client.NodeUnstageVolume(volID, stageDir)
+			Expect(err).To(BeNil(), "NodeUnstageVolume failed with error: %v", err)
+			err = testutils.RmAll(failoverInstance, filepath.Join("/tmp/", volName))
+			if err != nil {
+				klog.Errorf("Failed to rm file path: %v", err)
+			}
+		}()
+
+		err = failoverContext.Client.NodePublishVolume(volID, stageDir, publishDir)
+		Expect(err).To(BeNil(), "NodePublishVolume failed with error: %v", err)
+		defer func() {
+			err := failoverContext.Client.NodeUnpublishVolume(volID, publishDir)
+			Expect(err).To(BeNil(), "NodeUnpublishVolume failed with error: %v", err)
+		}()
+
+		readContents, err := testutils.ReadFile(failoverInstance, filepath.Join(publishDir, "testfile"))
+		Expect(err).To(BeNil(), "ReadFile failed with error: %v", err)
+		Expect(strings.TrimSpace(readContents)).To(Equal(testFileContents))
+	})
+
 })
 
+// createRegionalVolume creates an RePD replicated in the 2 zones and returns
+// its volume ID
+func createRegionalVolume(client *remote.CsiClient, volName string, zones []string) string {
+	volID, err := client.CreateVolume(volName, map[string]string{
+		common.ParameterKeyReplicationType: "regional-pd",
+	}, defaultRepdSizeGb, &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{
+			{
+				Segments: map[string]string{common.TopologyKeyZone: zones[0]},
+			},
+			{
+				Segments: map[string]string{common.TopologyKeyZone: zones[1]},
+			},
+		},
+	})
+	Expect(err).To(BeNil(), "CreateVolume failed with error: %v", err)
+	return volID
+}
+
+func deleteRegionalVolumeAndValidate(client *remote.CsiClient, volID, project, region, volName string) {
+	err := client.DeleteVolume(volID)
+	Expect(err).To(BeNil(), "DeleteVolume failed")
+
+	_, err = betaComputeService.RegionDisks.Get(project, region, volName).Do()
+	Expect(gce.IsGCEError(err, "notFound")).To(BeTrue(), "Expected disk to not be found")
+}
+
+// getTestContextsInTwoZones returns test contexts of instances in 2 distinct
+// zones, and those zones
+func getTestContextsInTwoZones() (map[string]*remote.TestContext, []string) {
+	Expect(testContexts).NotTo(BeEmpty())
+
+	zoneToContext := map[string]*remote.TestContext{}
+	zones := []string{}
+
+	for _, tc := range testContexts {
+		_, z, _ := tc.Instance.GetIdentity()
+		// Zone hasn't been seen before
+		if _, ok := zoneToContext[z]; !ok {
+			zoneToContext[z] = tc
+			zones = append(zones, z)
+		}
+		if len(zoneToContext) == 2 {
+			break
+		}
+	}
+
+	Expect(len(zoneToContext)).To(Equal(2), "Must have instances in exactly 2 zones")
+	return zoneToContext, zones
+}
+
 func testAttachWriteReadDetach(volID string, volName string, instance *remote.InstanceInfo, client *remote.CsiClient, readOnly bool) error {
 	var err error
 
@@ -16,6 +16,7 @@ package tests
 
 import (
 	"path/filepath"
+	"strings"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -356,4 +357,116 @@ var _ = Describe("GCE PD CSI Driver", func() {
 		Expect(sizeGb).To(Equal(newSizeGb), "New size should be equal")
 
 	})
+
+	It("Should keep the data of an ext4 volume resized online repeatedly and not shrink it", func() {
+		testContext := getRandomTestContext()
+
+		p, z, _ := testContext.Instance.GetIdentity()
+		client := testContext.Client
+		instance := testContext.Instance
+
+		// Create Disk
+		volName := testNamePrefix + string(uuid.NewUUID())
+		volID, err := client.CreateVolume(volName, nil, defaultSizeGb,
+			&csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					{
+						Segments: map[string]string{common.TopologyKeyZone: z},
+					},
+				},
+			})
+		Expect(err).To(BeNil(), "CreateVolume failed with error: %v", err)
+
+		defer func() {
+			// Delete Disk
+			client.DeleteVolume(volID)
+			Expect(err).To(BeNil(), "DeleteVolume failed")
+
+			// Validate Disk Deleted
+			_, err = computeService.Disks.Get(p, z, volName).Do()
+			Expect(gce.IsGCEError(err, "notFound")).To(BeTrue(), "Expected disk to not be found")
+		}()
+
+		// Attach Disk
+		err = client.ControllerPublishVolume(volID, instance.GetNodeID())
+		Expect(err).To(BeNil(), "Controller publish volume failed")
+
+		defer func() {
+			// Detach Disk
+			err = client.ControllerUnpublishVolume(volID, instance.GetNodeID())
+			if err != nil {
+				klog.Errorf("Failed to detach disk: %v", err)
+			}
+		}()
+
+		// Stage Disk
+		stageDir := filepath.Join("/tmp/", volName, "stage")
+		err = client.NodeStageExt4Volume(volID, stageDir)
+		Expect(err).To(BeNil(), "Node Stage volume failed")
+
+		defer func() {
+			// Unstage Disk
+			err = client.NodeUnstageVolume(volID, stageDir)
+			if err != nil {
+				klog.Errorf("Failed to unstage volume: %v", err)
+			}
+			fp := filepath.Join("/tmp/", volName)
+			err = testutils.RmAll(instance, fp)
+			if err != nil {
+				klog.Errorf("Failed to rm file path %s: %v", fp, err)
+			}
+		}()
+
+		// Mount Disk
+		publishDir := filepath.Join("/tmp/", volName, "mount")
+		err = client.NodePublishVolume(volID, stageDir, publishDir)
+		Expect(err).To(BeNil(), "Node publish volume failed")
+
+		defer func() {
+			// Unmount Disk
+			err = client.NodeUnpublishVolume(volID, publishDir)
+			if err != nil {
+				klog.Errorf("NodeUnpublishVolume failed with error: %v", err)
+			}
+		}()
+
+		// Write a file
+		err = testutils.ForceChmod(instance, filepath.Join("/tmp/", volName), "777")
+		Expect(err).To(BeNil(), "Chmod failed")
+		testFile := filepath.Join(publishDir, "testfile")
+		testFileContents := "test"
+		err = testutils.WriteFile(instance, testFile, testFileContents)
+		Expect(err).To(BeNil(), "Failed to write file")
+
+		for _, newSizeGb := range []int64{10, 15} {
+			// Resize controller
+			err = client.ControllerExpandVolume(volID, newSizeGb)
+			Expect(err).To(BeNil(), "Controller expand volume to %vGb failed", newSizeGb)
+
+			// Verify cloud size
+			cloudDisk, err := computeService.Disks.Get(p, z, volName).Do()
+			Expect(err).To(BeNil(), "Get cloud disk failed")
+			Expect(cloudDisk.SizeGb).To(Equal(newSizeGb))
+
+			// Resize node
+			resp, err := client.NodeExpandVolume(volID, publishDir, newSizeGb)
+			Expect(err).To(BeNil(), "Node expand volume to %vGb failed", newSizeGb)
+			Expect(resp.CapacityBytes).To(Equal(common.GbToBytes(newSizeGb)))
+
+			// Verify fs size and data
+			sizeGb, err := testutils.GetFSSizeInGb(instance, publishDir)
+			Expect(err).To(BeNil(), "Failed to get FSSize in GB")
+			Expect(sizeGb).To(Equal(newSizeGb))
+			readContents, err := testutils.ReadFile(instance, testFile)
+			Expect(err).To(BeNil(), "ReadFile failed")
+			Expect(strings.TrimSpace(readContents)).To(Equal(testFileContents))
+		}
+
+		// Requesting a smaller size succeeds and leaves the disk as is
+		err = client.ControllerExpandVolume(volID, 10)
+		Expect(err).To(BeNil(), "Controller expand volume to a smaller size failed")
+		cloudDisk, err := computeService.Disks.Get(p, z, volName).Do()
+		Expect(err).To(BeNil(), "Get cloud disk failed")
+		Expect(cloudDisk.SizeGb).To(Equal(int64(15)))
+	})
 })
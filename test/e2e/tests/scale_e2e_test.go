@@ -0,0 +1,250 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog"
+	remote "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/remote"
+)
+
+const (
+	// Fraction of the operations of the scale test that may fail without
+	// failing the test, e.g. because of transient API errors
+	maxScaleErrorRate = 0.01
+	// File of the ARTIFACTS directory the results of the scale test are
+	// written to
+	scaleResultsFile = "scale_e2e_results.json"
+)
+
+var _ = Describe("GCE PD CSI Driver Scale", func() {
+	BeforeEach(func() {
+		if *scaleVolumes == 0 {
+			Skip("scale-volumes is unset")
+		}
+		Expect(*scaleWorkers).To(BeNumerically(">", 0), "scale-workers must be positive")
+		// The boot disk is attached to the instance too
+		Expect(int64(*scaleWorkers)).To(BeNumerically("<", defaultVolumeLimit), "scale-workers must be less than the volume limit of the instance")
+		Expect(*scaleCycles).To(BeNumerically(">=", 0), "scale-attach-cycles must not be negative")
+	})
+
+	It("Should create, attach, detach and delete volumes concurrently", func() {
+		testContext := getRandomTestContext()
+		_, z, _ := testContext.Instance.GetIdentity()
+
+		recorder := newScaleRecorder()
+		volNames := make(chan string)
+		var leaked []string
+		var leakedMu sync.Mutex
+		var wg sync.WaitGroup
+		start := time.Now()
+		for i := 0; i < *scaleWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for volName := range volNames {
+					if !scaleVolumeLifecycle(testContext, z, volName, recorder) {
+						leakedMu.Lock()
+						leaked = append(leaked, volName)
+						leakedMu.Unlock()
+					}
+				}
+			}()
+		}
+		for i := 0; i < *scaleVolumes; i++ {
+			volNames <- testNamePrefix + string(uuid.NewUUID())
+		}
+		close(volNames)
+		wg.Wait()
+
+		results := recorder.results(time.Since(start))
+		for _, op := range results.Operations {
+			klog.Infof("%s: %d calls, %d errors, p50 %v, p90 %v, p99 %v, max %v", op.Name, op.Count, op.Errors, op.P50, op.P90, op.P99, op.Max)
+		}
+		klog.Infof("Ran %d volumes with %d workers in %v", *scaleVolumes, *scaleWorkers, results.Duration)
+		if artifactsDir != "" {
+			data, err := json.MarshalIndent(results, "", "  ")
+			Expect(err).To(BeNil(), "Failed to marshal scale test results")
+			err = ioutil.WriteFile(filepath.Join(artifactsDir, scaleResultsFile), data, 0644)
+			Expect(err).To(BeNil(), "Failed to write scale test results")
+		}
+
+		Expect(leaked).To(BeEmpty(), "Volumes were not deleted")
+		Expect(results.ErrorRate).To(BeNumerically("<=", maxScaleErrorRate), "Error rate of the operations is too high")
+	})
+})
+
+// scaleVolumeLifecycle creates the volume, attaches and detaches it to the
+// instance of the test context scale-attach-cycles times and deletes it,
+// recording the latency of each operation. It returns whether the volume was
+// deleted.
+func scaleVolumeLifecycle(testContext *remote.TestContext, zone, volName string, recorder *scaleRecorder) bool {
+	client := testContext.Client
+	nodeID := testContext.Instance.GetNodeID()
+
+	var volID string
+	err := recorder.record("CreateVolume", func() error {
+		var err error
+		volID, err = client.CreateVolume(volName, nil, defaultSizeGb, zoneTopology(zone))
+		return err
+	})
+	if err != nil {
+		klog.Errorf("CreateVolume of %s failed: %v", volName, err)
+		// The disk may have been created
+		return false
+	}
+
+	for i := 0; i < *scaleCycles; i++ {
+		err = recorder.record("ControllerPublishVolume", func() error {
+			return client.ControllerPublishVolume(volID, nodeID)
+		})
+		if err != nil {
+			klog.Errorf("ControllerPublishVolume of %s failed: %v", volID, err)
+		}
+		// Detach also after a failed attach, which may have attached the disk
+		err = recorder.record("ControllerUnpublishVolume", func() error {
+			return client.ControllerUnpublishVolume(volID, nodeID)
+		})
+		if err != nil {
+			klog.Errorf("ControllerUnpublishVolume of %s failed: %v", volID, err)
+			break
+		}
+	}
+
+	err = recorder.record("DeleteVolume", func() error {
+		return client.DeleteVolume(volID)
+	})
+	if err != nil {
+		klog.Errorf("DeleteVolume of %s failed: %v", volID, err)
+		return false
+	}
+	return true
+}
+
+// scaleRecorder records the latencies and errors of the operations of the
+// scale test
+type scaleRecorder struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+}
+
+func newScaleRecorder() *scaleRecorder {
+	return &scaleRecorder{
+		latencies: map[string][]time.Duration{},
+		errors:    map[string]int{},
+	}
+}
+
+func (r *scaleRecorder) record(op string, f func() error) error {
+	start := time.Now()
+	err := f()
+	latency := time.Since(start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors[op]++
+	} else {
+		r.latencies[op] = append(r.latencies[op], latency)
+	}
+	return err
+}
+
+// scaleResults are the results of the scale test, written to the ARTIFACTS
+// directory
+type scaleResults struct {
+	Volumes    int
+	Workers    int
+	Duration   time.Duration
+	ErrorRate  float64
+	Operations []scaleOperationResults
+}
+
+// scaleOperationResults are the latency percentiles of the successful calls
+// of an operation, and the number of failed calls
+type scaleOperationResults struct {
+	Name   string
+	Count  int
+	Errors int
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+func (r *scaleRecorder) results(duration time.Duration) scaleResults {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ops := map[string]bool{}
+	for op := range r.latencies {
+		ops[op] = true
+	}
+	for op := range r.errors {
+		ops[op] = true
+	}
+	results := scaleResults{
+		Volumes:  *scaleVolumes,
+		Workers:  *scaleWorkers,
+		Duration: duration,
+	}
+	calls, errors := 0, 0
+	for op := range ops {
+		latencies := r.latencies[op]
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		opResults := scaleOperationResults{
+			Name:   op,
+			Count:  len(latencies) + r.errors[op],
+			Errors: r.errors[op],
+			P50:    percentile(latencies, 50),
+			P90:    percentile(latencies, 90),
+			P99:    percentile(latencies, 99),
+		}
+		if len(latencies) > 0 {
+			opResults.Max = latencies[len(latencies)-1]
+		}
+		results.Operations = append(results.Operations, opResults)
+		calls += opResults.Count
+		errors += opResults.Errors
+	}
+	sort.Slice(results.Operations, func(i, j int) bool { return results.Operations[i].Name < results.Operations[j].Name })
+	if calls > 0 {
+		results.ErrorRate = float64(errors) / float64(calls)
+	}
+	return results
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
@@ -16,14 +16,21 @@ package tests
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	cloudkms "cloud.google.com/go/kms/apiv1"
 	. "github.com/onsi/ginkgo"
+	"github.com/onsi/ginkgo/config"
+	"github.com/onsi/ginkgo/reporters"
 	. "github.com/onsi/gomega"
 	computebeta "google.golang.org/api/compute/v0.beta"
 	compute "google.golang.org/api/compute/v1"
@@ -37,6 +44,19 @@ var (
 	serviceAccount  = flag.String("service-account", "", "Service account to bring up instance with")
 	runInProw       = flag.Bool("run-in-prow", false, "If true, use a Boskos loaned project and special CI service accounts and ssh keys")
 	deleteInstances = flag.Bool("delete-instances", false, "Delete the instances after tests run")
+	machineType     = flag.String("machine-type", "", "Machine type of the instances, n1-standard-1 if unset. The PDs of newer machine families, e.g. c3-standard-4, are NVMe devices")
+	confidential    = flag.Bool("confidential-compute", false, "If true, the instances are Confidential VMs, whose PDs are NVMe devices. machine-type must support it, e.g. n2d-standard-2")
+	artifactsGCS    = flag.String("artifacts-gcs-path", "", "gs:// path the junit reports and the logs of the driver and of the instances are uploaded to once the tests are done, for runs outside Prow. They are written to ARTIFACTS, or a temporary directory if it is unset")
+	scaleVolumes    = flag.Int("scale-volumes", 0, "Number of volumes the scale test creates, attaches and deletes, recording the latency percentiles and error rates of the operations. The scale test is skipped if unset. Runs with hundreds of volumes need a longer test timeout")
+	scaleWorkers    = flag.Int("scale-workers", 10, "Number of volumes the scale test operates on concurrently, which is also the most volumes attached to the instance at a time")
+	scaleCycles     = flag.Int("scale-attach-cycles", 1, "Number of times the scale test attaches and detaches each volume")
+	stressCycles    = flag.Int("stress-attach-cycles", 0, "Number of times the attach stress test attaches, stages, unstages and detaches the same volume. The stress test is skipped if unset. Hundreds of cycles need a longer test timeout")
+	reuseInstances  = flag.String("reuse-instances", "", "Comma-separated list of zone/name of already set up instances to run the tests on instead of creating instances. The instances are never deleted. The multi-zone tests are skipped unless instances in 2 zones are given")
+
+	zones = []string{"us-central1-c", "us-central1-b"}
+
+	// Directory the junit report and the logs are written to, if any
+	artifactsDir string
 
 	testContexts       = []*remote.TestContext{}
 	computeService     *compute.Service
@@ -52,15 +72,89 @@ func TestE2E(t *testing.T) {
 
 	flag.Parse()
 	RegisterFailHandler(Fail)
-	RunSpecs(t, "Google Compute Engine Persistent Disk Container Storage Interface Driver Tests")
+
+	artifactsDir = os.Getenv("ARTIFACTS")
+	if artifactsDir == "" && *artifactsGCS != "" {
+		var err error
+		artifactsDir, err = ioutil.TempDir("", "gce-pd-e2e-artifacts")
+		if err != nil {
+			t.Fatalf("Failed to create artifacts dir: %v", err)
+		}
+		defer os.RemoveAll(artifactsDir)
+	}
+	if artifactsDir == "" {
+		RunSpecs(t, "Google Compute Engine Persistent Disk Container Storage Interface Driver Tests")
+		return
+	}
+
+	// Each parallel test process writes its own report
+	junitReporter := reporters.NewJUnitReporter(filepath.Join(artifactsDir, fmt.Sprintf("junit_e2e_%02d.xml", config.GinkgoConfig.ParallelNode)))
+	RunSpecsWithDefaultAndCustomReporters(t, "Google Compute Engine Persistent Disk Container Storage Interface Driver Tests", []Reporter{junitReporter})
+	if *artifactsGCS != "" {
+		if err := testutils.UploadArtifacts(artifactsDir, *artifactsGCS); err != nil {
+			t.Errorf("Failed to upload artifacts: %v", err)
+		}
+	}
+}
+
+// suiteConfig is passed from the first to all the parallel test processes
+// once the instances are set up
+type suiteConfig struct {
+	Project        string
+	ServiceAccount string
 }
 
-var _ = BeforeSuite(func() {
+// The first test process sets up a pool of instances in each zone, with one
+// instance per parallel test process, then each process runs the driver on
+// its own instances. Ginkgo shards the specs across the processes.
+var _ = SynchronizedBeforeSuite(func() []byte {
+	var err error
+	computeService, err = remote.GetComputeClient()
+	Expect(err).To(BeNil())
+
+	if *runInProw {
+		*project, *serviceAccount = testutils.SetupProwConfig("gce-project")
+	}
+
+	Expect(*project).ToNot(BeEmpty(), "Project should not be empty")
+	if *reuseInstances != "" {
+		Expect(*runInProw).To(BeFalse(), "Instances cannot be reused in Prow")
+		Expect(config.GinkgoConfig.ParallelTotal).To(Equal(1), "Instances can only be reused by a single test process")
+		klog.Infof("Running in project %v on instances %v\n\n", *project, *reuseInstances)
+		data, err := json.Marshal(suiteConfig{Project: *project})
+		Expect(err).To(BeNil())
+		return data
+	}
+	Expect(*serviceAccount).ToNot(BeEmpty(), "Service account should not be empty")
+
+	klog.Infof("Running in project %v with service account %v\n\n", *project, *serviceAccount)
+
+	poolSize := config.GinkgoConfig.ParallelTotal
+	errs := make(chan error, len(zones))
+	for _, zone := range zones {
+		go func(curZone string) {
+			klog.Infof("Setting up %d nodes in zone %s\n", poolSize, curZone)
+			_, err := remote.SetupInstancePool(*project, curZone, nodeNamePrefix(curZone), poolSize, instanceConfig(), computeService)
+			errs <- err
+		}(zone)
+	}
+	for range zones {
+		if err := <-errs; err != nil {
+			klog.Fatalf("Failed to setup instances: %v", err)
+		}
+	}
+
+	data, err := json.Marshal(suiteConfig{Project: *project, ServiceAccount: *serviceAccount})
+	Expect(err).To(BeNil())
+	return data
+}, func(data []byte) {
 	var err error
 	tcc := make(chan *remote.TestContext)
 	defer close(tcc)
 
-	zones := []string{"us-central1-c", "us-central1-b"}
+	cfg := suiteConfig{}
+	Expect(json.Unmarshal(data, &cfg)).To(Succeed())
+	*project, *serviceAccount = cfg.Project, cfg.ServiceAccount
 
 	rand.Seed(time.Now().UnixNano())
 
@@ -74,22 +168,29 @@ var _ = BeforeSuite(func() {
 	kmsClient, err = cloudkms.NewKeyManagementClient(context.Background())
 	Expect(err).To(BeNil())
 
-	if *runInProw {
-		*project, *serviceAccount = testutils.SetupProwConfig("gce-project")
+	// The instance of this test process in each zone, by zone
+	nodes := map[string]string{}
+	if *reuseInstances != "" {
+		nodes, err = parseInstances(*reuseInstances)
+		Expect(err).To(BeNil())
+	} else {
+		for _, zone := range zones {
+			nodes[zone] = remote.PoolInstanceName(nodeNamePrefix(zone), config.GinkgoConfig.ParallelNode-1, config.GinkgoConfig.ParallelTotal)
+		}
 	}
 
-	Expect(*project).ToNot(BeEmpty(), "Project should not be empty")
-	Expect(*serviceAccount).ToNot(BeEmpty(), "Service account should not be empty")
-
-	klog.Infof("Running in project %v with service account %v\n\n", *project, *serviceAccount)
-
-	for _, zone := range zones {
-		go func(curZone string) {
+	for zone, nodeID := range nodes {
+		go func(curZone, nodeID string) {
 			defer GinkgoRecover()
-			nodeID := fmt.Sprintf("gce-pd-csi-e2e-%s", curZone)
 			klog.Infof("Setting up node %s\n", nodeID)
 
-			i, err := remote.SetupInstance(*project, curZone, nodeID, *serviceAccount, computeService)
+			var i *remote.InstanceInfo
+			var err error
+			if *reuseInstances != "" {
+				i, err = remote.GetInstance(*project, curZone, nodeID, computeService)
+			} else {
+				i, err = remote.SetupInstance(*project, curZone, nodeID, instanceConfig(), computeService)
+			}
 			if err != nil {
 				klog.Fatalf("Failed to setup instance %v: %v", nodeID, err)
 			}
@@ -101,27 +202,76 @@ var _ = BeforeSuite(func() {
 				klog.Fatalf("Failed to set up Test Context for instance %v: %v", i.GetName(), err)
 			}
 			tcc <- testContext
-		}(zone)
+		}(zone, nodeID)
 	}
 
-	for i := 0; i < len(zones); i++ {
+	for i := 0; i < len(nodes); i++ {
 		tc := <-tcc
 		klog.Infof("Test Context for node %s set up\n", tc.Instance.GetName())
 		testContexts = append(testContexts, tc)
 	}
 })
 
-var _ = AfterSuite(func() {
-
+var _ = SynchronizedAfterSuite(func() {
 	for _, tc := range testContexts {
 		err := remote.TeardownDriverAndClient(tc)
+		// The logs are collected once the driver is stopped
+		if artifactsDir != "" {
+			if logsErr := remote.CollectLogs(tc, artifactsDir); logsErr != nil {
+				klog.Warningf("Failed to collect logs: %v", logsErr)
+			}
+		}
 		Expect(err).To(BeNil(), "Teardown Driver and Client failed with error")
-		if *deleteInstances {
+		if *deleteInstances && *reuseInstances == "" {
 			tc.Instance.DeleteInstance()
 		}
 	}
+}, func() {
+	// The project is released once all the processes are done with it
+	if *runInProw {
+		testutils.ReleaseProwConfig(*project)
+	}
 })
 
+// nodeNamePrefix returns the prefix of the names of the instances in the zone.
+// Instances of other machine types have other names, so that existing
+// instances are only reused if they have the same machine type.
+func nodeNamePrefix(zone string) string {
+	prefix := "gce-pd-csi-e2e-"
+	if *machineType != "" {
+		prefix += *machineType + "-"
+	}
+	if *confidential {
+		prefix += "cvm-"
+	}
+	return prefix + zone
+}
+
+func instanceConfig() *remote.InstanceConfig {
+	return &remote.InstanceConfig{
+		ServiceAccount:      *serviceAccount,
+		MachineType:         *machineType,
+		ConfidentialCompute: *confidential,
+	}
+}
+
+// parseInstances parses a comma-separated list of zone/name of instances into
+// the name of the instance in each zone
+func parseInstances(list string) (map[string]string, error) {
+	instances := map[string]string{}
+	for _, instance := range strings.Split(list, ",") {
+		parts := strings.Split(strings.TrimSpace(instance), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("instance %q is not of the form zone/name", instance)
+		}
+		if _, ok := instances[parts[0]]; ok {
+			return nil, fmt.Errorf("more than one instance in zone %s", parts[0])
+		}
+		instances[parts[0]] = parts[1]
+	}
+	return instances, nil
+}
+
 func getRandomTestContext() *remote.TestContext {
 	Expect(testContexts).ToNot(BeEmpty())
 	rn := rand.Intn(len(testContexts))
@@ -0,0 +1,256 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+	"sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/common"
+	gce "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/pkg/gce-cloud-provider/compute"
+	testutils "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/e2e/utils"
+	remote "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/remote"
+)
+
+var _ = Describe("GCE PD CSI Driver Snapshots", func() {
+	It("Should restore the data of a snapshot to volumes in the zone of the source and another zone", func() {
+		testContext := getRandomTestContext()
+
+		p, z, _ := testContext.Instance.GetIdentity()
+		client := testContext.Client
+		instance := testContext.Instance
+
+		// Create Disk
+		volName := testNamePrefix + string(uuid.NewUUID())
+		volID, err := client.CreateVolume(volName, nil, defaultSizeGb, zoneTopology(z))
+		Expect(err).To(BeNil(), "CreateVolume failed with error: %v", err)
+		defer deleteVolumeAndValidate(client, volID, p, z, volName)
+
+		// Write the data to snapshot
+		err = testAttachWriteReadDetach(volID, volName, instance, client, false /* readOnly */)
+		Expect(err).To(BeNil(), "Failed to go through volume lifecycle")
+
+		// Create Snapshot
+		snapshotName := testNamePrefix + string(uuid.NewUUID())
+		snapshotID, err := client.CreateSnapshot(snapshotName, volID, nil)
+		Expect(err).To(BeNil(), "CreateSnapshot failed with error: %v", err)
+		defer deleteSnapshotAndValidate(client, snapshotID, p, snapshotName)
+		err = waitForSnapshotReady(p, snapshotName)
+		Expect(err).To(BeNil(), "Could not wait for snapshot be ready")
+
+		// Restore the snapshot in the zone of the instance and read the data
+		restoredName := testNamePrefix + string(uuid.NewUUID())
+		restoredID, err := client.CreateVolumeFromSnapshot(restoredName, snapshotID, nil, defaultSizeGb, zoneTopology(z))
+		Expect(err).To(BeNil(), "CreateVolumeFromSnapshot failed with error: %v", err)
+		defer deleteVolumeAndValidate(client, restoredID, p, z, restoredName)
+		cloudDisk, err := computeService.Disks.Get(p, z, restoredName).Do()
+		Expect(err).To(BeNil(), "Could not get disk from cloud directly")
+		Expect(cloudDisk.SourceSnapshot).To(HaveSuffix(snapshotName))
+		contents, err := testReadFileFromVolume(restoredID, restoredName, instance, client, "testfile")
+		Expect(err).To(BeNil(), "Failed to read restored volume")
+		Expect(strings.TrimSpace(contents)).To(Equal("test"))
+
+		// Restore the snapshot in another zone of the region, reading the
+		// data if an instance runs there
+		otherZone, otherContext, err := getOtherZone(p, z)
+		Expect(err).To(BeNil(), "Failed to get another zone")
+		otherName := testNamePrefix + string(uuid.NewUUID())
+		otherID, err := client.CreateVolumeFromSnapshot(otherName, snapshotID, nil, defaultSizeGb, zoneTopology(otherZone))
+		Expect(err).To(BeNil(), "CreateVolumeFromSnapshot in zone %s failed with error: %v", otherZone, err)
+		defer deleteVolumeAndValidate(client, otherID, p, otherZone, otherName)
+		cloudDisk, err = computeService.Disks.Get(p, otherZone, otherName).Do()
+		Expect(err).To(BeNil(), "Could not get disk from cloud directly")
+		Expect(cloudDisk.Status).To(Equal(readyState))
+		Expect(cloudDisk.SourceSnapshot).To(HaveSuffix(snapshotName))
+		if otherContext != nil {
+			contents, err = testReadFileFromVolume(otherID, otherName, otherContext.Instance, otherContext.Client, "testfile")
+			Expect(err).To(BeNil(), "Failed to read restored volume in zone %s", otherZone)
+			Expect(strings.TrimSpace(contents)).To(Equal("test"))
+		}
+	})
+
+	It("Should delete a snapshot that is still being uploaded", func() {
+		testContext := getRandomTestContext()
+
+		p, z, _ := testContext.Instance.GetIdentity()
+		client := testContext.Client
+
+		// Create Disk
+		volName := testNamePrefix + string(uuid.NewUUID())
+		volID, err := client.CreateVolume(volName, nil, defaultSizeGb, zoneTopology(z))
+		Expect(err).To(BeNil(), "CreateVolume failed with error: %v", err)
+		defer deleteVolumeAndValidate(client, volID, p, z, volName)
+
+		// Create Snapshot and delete it without waiting for it to be ready
+		snapshotName := testNamePrefix + string(uuid.NewUUID())
+		snapshotID, err := client.CreateSnapshot(snapshotName, volID, nil)
+		Expect(err).To(BeNil(), "CreateSnapshot failed with error: %v", err)
+		snapshot, err := computeService.Snapshots.Get(p, snapshotName).Do()
+		Expect(err).To(BeNil(), "Could not get snapshot from cloud directly")
+		klog.Infof("Deleting snapshot %s in status %s", snapshotName, snapshot.Status)
+
+		// GCE may reject deleting a snapshot before it is uploaded, in which
+		// case DeleteSnapshot is retried as the CO would
+		err = wait.Poll(10*time.Second, 5*time.Minute, func() (bool, error) {
+			err := client.DeleteSnapshot(snapshotID)
+			if err != nil {
+				klog.Warningf("DeleteSnapshot failed, retrying: %v", err)
+				return false, nil
+			}
+			return true, nil
+		})
+		Expect(err).To(BeNil(), "DeleteSnapshot did not succeed")
+		_, err = computeService.Snapshots.Get(p, snapshotName).Do()
+		Expect(gce.IsGCEError(err, "notFound")).To(BeTrue(), "Expected snapshot to not be found")
+
+		// Restoring the deleted snapshot fails and the source is unaffected
+		restoredName := testNamePrefix + string(uuid.NewUUID())
+		_, err = client.CreateVolumeFromSnapshot(restoredName, snapshotID, nil, defaultSizeGb, zoneTopology(z))
+		Expect(err).ToNot(BeNil(), "CreateVolumeFromSnapshot of a deleted snapshot should fail")
+		Expect(status.Code(err)).To(Equal(codes.NotFound))
+		cloudDisk, err := computeService.Disks.Get(p, z, volName).Do()
+		Expect(err).To(BeNil(), "Could not get disk from cloud directly")
+		Expect(cloudDisk.Status).To(Equal(readyState))
+	})
+})
+
+func zoneTopology(zone string) *csi.TopologyRequirement {
+	return &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{
+			{
+				Segments: map[string]string{common.TopologyKeyZone: zone},
+			},
+		},
+	}
+}
+
+func deleteVolumeAndValidate(client *remote.CsiClient, volID, project, zone, volName string) {
+	err := client.DeleteVolume(volID)
+	Expect(err).To(BeNil(), "DeleteVolume failed")
+
+	_, err = computeService.Disks.Get(project, zone, volName).Do()
+	Expect(gce.IsGCEError(err, "notFound")).To(BeTrue(), "Expected disk to not be found")
+}
+
+func deleteSnapshotAndValidate(client *remote.CsiClient, snapshotID, project, snapshotName string) {
+	err := client.DeleteSnapshot(snapshotID)
+	Expect(err).To(BeNil(), "DeleteSnapshot failed")
+
+	_, err = computeService.Snapshots.Get(project, snapshotName).Do()
+	Expect(gce.IsGCEError(err, "notFound")).To(BeTrue(), "Expected snapshot to not be found")
+}
+
+func waitForSnapshotReady(project, snapshotName string) error {
+	return wait.Poll(10*time.Second, 3*time.Minute, func() (bool, error) {
+		snapshot, err := computeService.Snapshots.Get(project, snapshotName).Do()
+		if err != nil {
+			return false, err
+		}
+		return snapshot.Status == "READY", nil
+	})
+}
+
+// getOtherZone returns a zone of the region of the zone other than it,
+// preferring the zones of the test instances, and the test context of the
+// instance in the returned zone if there is one
+func getOtherZone(project, zone string) (string, *remote.TestContext, error) {
+	for _, tc := range testContexts {
+		_, z, _ := tc.Instance.GetIdentity()
+		if z != zone {
+			return z, tc, nil
+		}
+	}
+	region, err := common.GetRegionFromZones([]string{zone})
+	if err != nil {
+		return "", nil, err
+	}
+	cloudRegion, err := computeService.Regions.Get(project, region).Do()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, zoneURL := range cloudRegion.Zones {
+		if z := path.Base(zoneURL); z != zone {
+			return z, nil, nil
+		}
+	}
+	return "", nil, fmt.Errorf("region %s has no zone other than %s", region, zone)
+}
+
+// testReadFileFromVolume attaches, stages and publishes the volume on the
+// instance to read the file and cleans up after
+func testReadFileFromVolume(volID, volName string, instance *remote.InstanceInfo, client *remote.CsiClient, fileName string) (string, error) {
+	// Attach Disk
+	err := client.ControllerPublishVolume(volID, instance.GetNodeID())
+	if err != nil {
+		return "", fmt.Errorf("ControllerPublishVolume failed with error for disk %v on node %v: %v", volID, instance.GetNodeID(), err)
+	}
+	defer func() {
+		// Detach Disk
+		err := client.ControllerUnpublishVolume(volID, instance.GetNodeID())
+		if err != nil {
+			klog.Errorf("Failed to detach disk: %v", err)
+		}
+	}()
+
+	// Stage Disk
+	stageDir := filepath.Join("/tmp/", volName, "stage")
+	err = client.NodeStageExt4Volume(volID, stageDir)
+	if err != nil {
+		return "", fmt.Errorf("NodeStageExt4Volume failed with error: %v", err)
+	}
+	defer func() {
+		// Unstage Disk
+		err := client.NodeUnstageVolume(volID, stageDir)
+		if err != nil {
+			klog.Errorf("Failed to unstage volume: %v", err)
+		}
+		fp := filepath.Join("/tmp/", volName)
+		err = testutils.RmAll(instance, fp)
+		if err != nil {
+			klog.Errorf("Failed to rm file path %s: %v", fp, err)
+		}
+	}()
+
+	// Mount Disk
+	publishDir := filepath.Join("/tmp/", volName, "mount")
+	err = client.NodePublishVolume(volID, stageDir, publishDir)
+	if err != nil {
+		return "", fmt.Errorf("NodePublishVolume failed with error: %v", err)
+	}
+	defer func() {
+		// Unmount Disk
+		err := client.NodeUnpublishVolume(volID, publishDir)
+		if err != nil {
+			klog.Errorf("NodeUnpublishVolume failed with error: %v", err)
+		}
+	}()
+	err = testutils.ForceChmod(instance, filepath.Join("/tmp/", volName), "777")
+	if err != nil {
+		return "", fmt.Errorf("Chmod failed with error: %v", err)
+	}
+
+	return testutils.ReadFile(instance, filepath.Join(publishDir, fileName))
+}
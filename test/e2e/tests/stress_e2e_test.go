@@ -0,0 +1,110 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tests
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/klog"
+	testutils "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/e2e/utils"
+)
+
+var _ = Describe("GCE PD CSI Driver Attach Stress", func() {
+	BeforeEach(func() {
+		if *stressCycles == 0 {
+			Skip("stress-attach-cycles is unset")
+		}
+		Expect(*stressCycles).To(BeNumerically(">", 0), "stress-attach-cycles must be positive")
+	})
+
+	It("Should attach, stage, unstage and detach the same volume repeatedly", func() {
+		testContext := getRandomTestContext()
+
+		p, z, n := testContext.Instance.GetIdentity()
+		client := testContext.Client
+		instance := testContext.Instance
+
+		// Create Disk
+		volName := testNamePrefix + string(uuid.NewUUID())
+		volID, err := client.CreateVolume(volName, nil, defaultSizeGb, zoneTopology(z))
+		Expect(err).To(BeNil(), "CreateVolume failed with error: %v", err)
+		defer deleteVolumeAndValidate(client, volID, p, z, volName)
+
+		volDir := filepath.Join("/tmp/", volName)
+		stageDir := filepath.Join(volDir, "stage")
+		testFile := filepath.Join(stageDir, "testfile")
+		defer func() {
+			err := testutils.RmAll(instance, volDir)
+			if err != nil {
+				klog.Errorf("Failed to rm file path %s: %v", volDir, err)
+			}
+		}()
+
+		for i := 0; i < *stressCycles; i++ {
+			// Attach Disk
+			err = client.ControllerPublishVolume(volID, instance.GetNodeID())
+			Expect(err).To(BeNil(), "ControllerPublishVolume failed in cycle %d with error: %v", i, err)
+			Expect(countDiskAttachments(p, z, n, volName)).To(Equal(1), "Expected disk to be attached once in cycle %d", i)
+
+			// Stage Disk, which waits for the device of the disk to show up
+			err = client.NodeStageExt4Volume(volID, stageDir)
+			Expect(err).To(BeNil(), "NodeStageExt4Volume failed in cycle %d with error: %v", i, err)
+
+			// The staged device is the disk written in the previous cycle
+			if i == 0 {
+				err = testutils.ForceChmod(instance, volDir, "777")
+				Expect(err).To(BeNil(), "Chmod failed with error: %v", err)
+			} else {
+				readContents, err := testutils.ReadFile(instance, testFile)
+				Expect(err).To(BeNil(), "ReadFile failed in cycle %d with error: %v", i, err)
+				Expect(strings.TrimSpace(readContents)).To(Equal(fmt.Sprintf("cycle %d", i-1)), "Unexpected data in cycle %d", i)
+			}
+			err = testutils.WriteFile(instance, testFile, fmt.Sprintf("cycle %d", i))
+			Expect(err).To(BeNil(), "Failed to write file in cycle %d: %v", i, err)
+
+			// Unstage Disk
+			err = client.NodeUnstageVolume(volID, stageDir)
+			Expect(err).To(BeNil(), "NodeUnstageVolume failed in cycle %d with error: %v", i, err)
+
+			// Detach Disk
+			err = client.ControllerUnpublishVolume(volID, instance.GetNodeID())
+			Expect(err).To(BeNil(), "ControllerUnpublishVolume failed in cycle %d with error: %v", i, err)
+			Expect(countDiskAttachments(p, z, n, volName)).To(Equal(0), "Expected disk to be detached in cycle %d", i)
+
+			if (i+1)%10 == 0 {
+				klog.Infof("Completed %d of %d attach cycles of volume %s", i+1, *stressCycles, volID)
+			}
+		}
+	})
+})
+
+// countDiskAttachments returns the number of times the disk is attached to
+// the instance
+func countDiskAttachments(project, zone, instanceName, volName string) int {
+	cloudInstance, err := computeService.Instances.Get(project, zone, instanceName).Do()
+	Expect(err).To(BeNil(), "Could not get instance from cloud directly")
+	attachments := 0
+	for _, disk := range cloudInstance.Disks {
+		if strings.HasSuffix(disk.Source, "/disks/"+volName) {
+			attachments++
+		}
+	}
+	return attachments
+}
@@ -17,8 +17,9 @@ package utils
 import (
 	"context"
 	"fmt"
-	"math/rand"
+	"net"
 	"os"
+	"os/exec"
 	"path"
 	"strconv"
 	"strings"
@@ -33,12 +34,21 @@ import (
 	remote "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/remote"
 )
 
+const (
+	boskosHeartbeatInterval = 5 * time.Minute
+)
+
 var (
 	boskos = boskosclient.NewClient(os.Getenv("JOB_NAME"), "http://boskos")
+	// Closed to stop the heartbeat of the project leased by SetupProwConfig
+	boskosHeartbeatStop = make(chan struct{})
 )
 
 func GCEClientAndDriverSetup(instance *remote.InstanceInfo) (*remote.TestContext, error) {
-	port := fmt.Sprintf("%v", 1024+rand.Intn(10000))
+	port, err := getFreePort()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a free port for the SSH tunnel: %v", err)
+	}
 	goPath, ok := os.LookupEnv("GOPATH")
 	if !ok {
 		return nil, fmt.Errorf("Could not find environment variable GOPATH")
@@ -49,7 +59,8 @@ func GCEClientAndDriverSetup(instance *remote.InstanceInfo) (*remote.TestContext
 	endpoint := fmt.Sprintf("tcp://localhost:%s", port)
 
 	workspace := remote.NewWorkspaceDir("gce-pd-e2e-")
-	driverRunCmd := fmt.Sprintf("sh -c '/usr/bin/nohup %s/gce-pd-csi-driver --endpoint=%s> %s/prog.out 2> %s/prog.err < /dev/null &'",
+	// The output is appended to keep the logs of drivers restarted by the tests
+	driverRunCmd := fmt.Sprintf("sh -c '/usr/bin/nohup %s/gce-pd-csi-driver --endpoint=%s>> %s/prog.out 2>> %s/prog.err < /dev/null &'",
 		workspace, endpoint, workspace, workspace)
 
 	config := &remote.ClientConfig{
@@ -60,7 +71,7 @@ func GCEClientAndDriverSetup(instance *remote.InstanceInfo) (*remote.TestContext
 		Port:         port,
 	}
 
-	err := os.Setenv("GCE_PD_CSI_STAGING_VERSION", "latest")
+	err = os.Setenv("GCE_PD_CSI_STAGING_VERSION", "latest")
 	if err != nil {
 		return nil, err
 	}
@@ -68,6 +79,17 @@ func GCEClientAndDriverSetup(instance *remote.InstanceInfo) (*remote.TestContext
 	return remote.SetupNewDriverAndClient(instance, config)
 }
 
+// getFreePort returns a local port that is free, so that the SSH tunnels of
+// parallel test processes do not collide
+func getFreePort() (string, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port), nil
+}
+
 // getBoskosProject retries acquiring a boskos project until success or timeout
 func getBoskosProject(resourceType string) *common.Resource {
 	timer := time.NewTimer(30 * time.Minute)
@@ -101,10 +123,19 @@ func SetupProwConfig(resourceType string) (project, serviceAccount string) {
 	p := getBoskosProject(resourceType)
 	project = p.GetName()
 
+	// Heartbeat the lease until the project is released, Boskos reclaims
+	// projects whose lease isn't updated
 	go func(c *boskosclient.Client, proj string) {
-		for range time.Tick(time.Minute * 5) {
-			if err := c.UpdateOne(p.Name, "busy", nil); err != nil {
-				klog.Warningf("[Boskos] Update %s failed with %v", p.Name, err)
+		ticker := time.NewTicker(boskosHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-boskosHeartbeatStop:
+				return
+			case <-ticker.C:
+				if err := c.UpdateOne(proj, "busy", nil); err != nil {
+					klog.Warningf("[Boskos] Update %s failed with %v", proj, err)
+				}
 			}
 		}
 	}(boskos, p.Name)
@@ -134,6 +165,18 @@ func SetupProwConfig(resourceType string) (project, serviceAccount string) {
 	return project, serviceAccount
 }
 
+// ReleaseProwConfig stops the heartbeat of the project leased by
+// SetupProwConfig and returns it to Boskos as dirty, to be cleaned up before
+// it is leased again. It must be called once, after the project is no longer
+// used.
+func ReleaseProwConfig(project string) {
+	close(boskosHeartbeatStop)
+	klog.V(4).Infof("Releasing Boskos project %v", project)
+	if err := boskos.ReleaseOne(project, "dirty"); err != nil {
+		klog.Warningf("[Boskos] Release %s failed with %v", project, err)
+	}
+}
+
 func ForceChmod(instance *remote.InstanceInfo, filePath string, perms string) error {
 	originalumask, err := instance.SSHNoSudo("umask")
 	if err != nil {
@@ -195,6 +238,30 @@ func GetBlockSizeInGb(instance *remote.InstanceInfo, devicePath string) (int64,
 	return utilcommon.BytesToGb(n), nil
 }
 
+// WriteRandomBlockData writes sizeMb of random data to the start of the block
+// device, bypassing the page cache, and returns its md5 checksum
+func WriteRandomBlockData(instance *remote.InstanceInfo, devicePath string, sizeMb int) (string, error) {
+	output, err := instance.SSH("dd", "if=/dev/urandom", "of="+devicePath, "bs=1M", fmt.Sprintf("count=%d", sizeMb), "oflag=direct", "conv=fsync")
+	if err != nil {
+		return "", fmt.Errorf("failed to write to block device %s. Output: %v, error: %v", devicePath, output, err)
+	}
+	return GetBlockChecksum(instance, devicePath, sizeMb)
+}
+
+// GetBlockChecksum returns the md5 checksum of the first sizeMb of the block
+// device, read bypassing the page cache
+func GetBlockChecksum(instance *remote.InstanceInfo, devicePath string, sizeMb int) (string, error) {
+	output, err := instance.SSH("dd", "if="+devicePath, "bs=1M", fmt.Sprintf("count=%d", sizeMb), "iflag=direct", "status=none", "|", "md5sum")
+	if err != nil {
+		return "", fmt.Errorf("failed to read block device %s. Output: %v, error: %v", devicePath, output, err)
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("failed to parse checksum of block device %s from output: %v", devicePath, output)
+	}
+	return fields[0], nil
+}
+
 func RmAll(instance *remote.InstanceInfo, filePath string) error {
 	output, err := instance.SSH("rm", "-rf", filePath)
 	if err != nil {
@@ -202,3 +269,17 @@ func RmAll(instance *remote.InstanceInfo, filePath string) error {
 	}
 	return nil
 }
+
+// UploadArtifacts copies the files of the artifacts directory to the GCS path,
+// e.g. gs://bucket/run, keeping files uploaded there before
+func UploadArtifacts(artifactsDir, gcsPath string) error {
+	if !strings.HasPrefix(gcsPath, "gs://") {
+		return fmt.Errorf("artifacts GCS path %s does not start with gs://", gcsPath)
+	}
+	klog.Infof("Uploading artifacts in %s to %s", artifactsDir, gcsPath)
+	output, err := exec.Command("gsutil", "-m", "rsync", "-r", artifactsDir, gcsPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to upload artifacts to %s: %v, output: %s", gcsPath, err, output)
+	}
+	return nil
+}
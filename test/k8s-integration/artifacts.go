@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"k8s.io/klog"
+)
+
+// setupArtifactsDir makes sure ARTIFACTS is set for the reports and logs of
+// the test, and of the driver e2e tests it runs, to be uploaded to the
+// artifacts-gcs-path. Prow mounts ARTIFACTS, but runs outside of it may not
+// set it.
+func setupArtifactsDir() error {
+	if _, ok := os.LookupEnv("ARTIFACTS"); ok {
+		return nil
+	}
+	dir := generateUniqueTmpDir()
+	klog.Infof("ARTIFACTS is unset, writing the artifacts to %s", dir)
+	return os.Setenv("ARTIFACTS", dir)
+}
+
+// uploadArtifacts copies the ARTIFACTS directory to the artifacts-gcs-path
+func uploadArtifacts() error {
+	cmd := exec.Command("gsutil", "-m", "rsync", "-r", os.Getenv("ARTIFACTS"), *artifactsGCSPath)
+	err := runCommand("Uploading Artifacts", cmd)
+	if err != nil {
+		return fmt.Errorf("failed to upload artifacts to %s: %v", *artifactsGCSPath, err)
+	}
+	return nil
+}
+
+// withArtifactsUpload runs the test and uploads the artifacts it wrote, also
+// when it fails, if artifacts-gcs-path is set
+func withArtifactsUpload(run func() error) error {
+	if len(*artifactsGCSPath) == 0 {
+		return run()
+	}
+	runErr := run()
+	uploadErr := uploadArtifacts()
+	if runErr != nil {
+		if uploadErr != nil {
+			klog.Errorf("%v", uploadErr)
+		}
+		return runErr
+	}
+	return uploadErr
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Compute resources the tests may leak, by gcloud compute command group
+var leakableResources = []string{"instances", "disks", "snapshots"}
+
+// cleanupLeakedResources deletes the compute resources of the project created
+// since the start of the run, which must have been deleted by the tests or
+// the cluster teardown. The project must be leased to the run, as Boskos
+// projects are, since the resources are only recognized by their creation
+// time. Leaks are returned as an error even if they were deleted.
+func cleanupLeakedResources(since time.Time) error {
+	filter := fmt.Sprintf("creationTimestamp>=%s", since.UTC().Format(time.RFC3339))
+	leaked := []string{}
+	for _, resource := range leakableResources {
+		out, err := combinedOutput(exec.Command("gcloud", "compute", resource, "list", "--filter", filter, "--format", "value(uri())"))
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %s, err: %v", resource, out, err)
+		}
+		uris := strings.Fields(string(out))
+		if len(uris) == 0 {
+			continue
+		}
+		klog.Errorf("Found leaked %s, deleting them: %v", resource, uris)
+		leaked = append(leaked, uris...)
+		// Instances are deleted first, the disks attached to them can not be
+		// deleted before
+		out, err = combinedOutput(exec.Command("gcloud", append([]string{"compute", resource, "delete", "--quiet"}, uris...)...))
+		if err != nil {
+			klog.Errorf("failed to delete leaked %s: %s, err: %v", resource, out, err)
+		}
+	}
+	if len(leaked) != 0 {
+		return fmt.Errorf("tests leaked %d resources: %v", len(leaked), leaked)
+	}
+	return nil
+}
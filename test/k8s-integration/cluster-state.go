@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// collectClusterState writes the state of the cluster the driver depends on,
+// the nodes, events, CSI objects and kubelet logs, to the cluster-state
+// directory of the ARTIFACTS directory. Failures are logged, they must not
+// hide the failure being debugged.
+func collectClusterState() {
+	artifactsDir, ok := os.LookupEnv("ARTIFACTS")
+	if !ok {
+		artifactsDir = generateUniqueTmpDir()
+	}
+	stateDir := filepath.Join(artifactsDir, "cluster-state")
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		klog.Errorf("failed to create cluster state directory %s: %v", stateDir, err)
+		return
+	}
+
+	writeCommandOutput(filepath.Join(stateDir, "nodes.txt"), "kubectl", "describe", "nodes")
+	writeCommandOutput(filepath.Join(stateDir, "events.txt"), "kubectl", "get", "events", "--all-namespaces", "--sort-by=.lastTimestamp", "-o", "wide")
+	writeCommandOutput(filepath.Join(stateDir, "csinodes.yaml"), "kubectl", "get", "csinodes", "-o", "yaml")
+	writeCommandOutput(filepath.Join(stateDir, "volumeattachments.yaml"), "kubectl", "get", "volumeattachments", "-o", "yaml")
+	writeCommandOutput(filepath.Join(stateDir, "csidriver.yaml"), "kubectl", "get", "csidriver", driverName, "-o", "yaml")
+
+	// Kubelet logs are only available from the node instances. Windows nodes
+	// have no journal, their logs are skipped.
+	jsonPath := `jsonpath={range .items[*]}{.metadata.name} {.metadata.labels.failure-domain\.beta\.kubernetes\.io/zone}{"\n"}{end}`
+	out, err := combinedOutput(exec.Command("kubectl", "get", "nodes", "-o", jsonPath))
+	if err != nil {
+		klog.Errorf("failed to list nodes: %s, err: %v", out, err)
+	} else {
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) != 2 {
+				continue
+			}
+			node, zone := fields[0], fields[1]
+			writeCommandOutput(filepath.Join(stateDir, node+"-kubelet.log"), "gcloud", "compute", "ssh", node, "--zone", zone, "--quiet", "--ssh-flag=-oConnectTimeout=30", "--command", "sudo journalctl -u kubelet --no-pager")
+		}
+	}
+	klog.Infof("Collected cluster state in %s", stateDir)
+}
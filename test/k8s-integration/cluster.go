@@ -1,27 +1,161 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"k8s.io/klog"
 )
 
+type nodeImage struct {
+	// Environment of the cluster scripts bringing up GCE clusters
+	gceEnv map[string]string
+	// Image type of GKE node pools, empty if not supported on GKE
+	gkeImageType string
+	// Node OS distribution the e2e tests are run for
+	nodeOSDistro string
+}
+
+// Node images of the node-image-type flag
+var nodeImageTypes = map[string]nodeImage{
+	"cos_containerd": {
+		gceEnv:       map[string]string{"KUBE_NODE_OS_DISTRIBUTION": "gci", "KUBE_CONTAINER_RUNTIME": "containerd"},
+		gkeImageType: "COS_CONTAINERD",
+		nodeOSDistro: "cos",
+	},
+	"ubuntu_containerd": {
+		gceEnv:       map[string]string{"KUBE_NODE_OS_DISTRIBUTION": "ubuntu", "KUBE_CONTAINER_RUNTIME": "containerd"},
+		gkeImageType: "UBUNTU_CONTAINERD",
+		nodeOSDistro: "ubuntu",
+	},
+	// The cluster keeps Linux nodes for the system pods
+	"windows": {
+		gceEnv:       map[string]string{"NUM_WINDOWS_NODES": "3", "KUBE_WINDOWS_NODE_OS_DISTRIBUTION": "win2019"},
+		nodeOSDistro: "windows",
+	},
+}
+
+// getNodeOSDistro returns the node OS distribution of the node image type,
+// COS if the default image is used
+func getNodeOSDistro(imageType string) string {
+	if image, ok := nodeImageTypes[imageType]; ok {
+		return image.nodeOSDistro
+	}
+	return "cos"
+}
+
+// Output of failed cluster bringups that are worth retrying, e.g. because of
+// exceeded quota or stockouts in the zone
+var transientClusterUpErrors = []string{
+	"QUOTA_EXCEEDED",
+	"Quota exceeded",
+	"ZONE_RESOURCE_POOL_EXHAUSTED",
+	"does not have enough resources available",
+	"RESOURCE_EXHAUSTED",
+	"Internal error",
+	"try again later",
+}
+
+// clusterUp brings up the cluster of the deployment strategy. Bringups failing
+// because of transient errors are brought down and moved to the next fallback
+// zone, if any, or retried up to cluster-up-retries times.
+func clusterUp(k8sDir string) error {
+	for attempt := 0; ; {
+		var err error
+		switch *deploymentStrat {
+		case "gce":
+			err = clusterUpGCE(k8sDir, *gceZone)
+		case "gke":
+			err = clusterUpGKE(*gceZone, *gkeClusterRegion)
+		default:
+			return fmt.Errorf("deployment-strategy must be set to 'gce' or 'gke', but is: %s", *deploymentStrat)
+		}
+		if err == nil {
+			return nil
+		}
+		if !isTransientClusterUpError(err) || (len(fallbackGCEZones) == 0 && attempt >= *clusterUpRetries) {
+			return err
+		}
+		// Clean up the partially brought up cluster before retrying
+		if downErr := clusterDown(k8sDir); downErr != nil {
+			klog.Errorf("failed to cluster down after failed bringup: %v", downErr)
+		}
+		if len(fallbackGCEZones) != 0 {
+			klog.Warningf("Bringing up the cluster in zone %s failed because of a transient error, retrying in zone %s: %v", *gceZone, fallbackGCEZones[0], err)
+			*gceZone, fallbackGCEZones = fallbackGCEZones[0], fallbackGCEZones[1:]
+			continue
+		}
+		attempt++
+		klog.Warningf("Bringing up the cluster failed because of a transient error, retrying (retry %d of %d): %v", attempt, *clusterUpRetries, err)
+	}
+}
+
+func clusterDown(k8sDir string) error {
+	switch *deploymentStrat {
+	case "gce":
+		return clusterDownGCE(k8sDir)
+	case "gke":
+		return clusterDownGKE(*gceZone, *gkeClusterRegion)
+	default:
+		return fmt.Errorf("deployment-strategy must be set to 'gce' or 'gke', but is: %s", *deploymentStrat)
+	}
+}
+
+// isTransientClusterUpError returns whether the error of the bringup, which
+// runClusterUpCommand adds the transient errors of the output to, is transient
+func isTransientClusterUpError(err error) bool {
+	for _, transientErr := range transientClusterUpErrors {
+		if strings.Contains(err.Error(), transientErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// runClusterUpCommand runs the command bringing up the cluster. Its error
+// includes the first transient error of the output, if any.
+func runClusterUpCommand(action string, cmd *exec.Cmd) error {
+	var output bytes.Buffer
+	cmd.Stdout = io.MultiWriter(os.Stdout, &output)
+	cmd.Stderr = io.MultiWriter(os.Stderr, &output)
+	err := runCommandWithTimeout(action, cmd, *stepTimeout)
+	if err == nil {
+		return nil
+	}
+	for _, transientErr := range transientClusterUpErrors {
+		if strings.Contains(output.String(), transientErr) {
+			return fmt.Errorf("%v, output contains transient error %q", err, transientErr)
+		}
+	}
+	return err
+}
+
 func clusterDownGCE(k8sDir string) error {
-	cmd := exec.Command(filepath.Join(k8sDir, "hack", "e2e-internal", "e2e-down.sh"))
-	err := runCommand("Bringing Down E2E Cluster on GCE", cmd)
+	cmd, err := kubetest2Command("gce", "--repo-root", k8sDir, "--down")
+	if err != nil {
+		return err
+	}
+	err = runCommand("Bringing Down E2E Cluster on GCE", cmd)
 	if err != nil {
 		return fmt.Errorf("failed to bring down kubernetes e2e cluster on gce: %v", err)
 	}
 	return nil
 }
 
-func clusterDownGKE(gceZone string) error {
-	cmd := exec.Command("gcloud", "container", "clusters", "delete", gkeTestClusterName,
-		"--zone", gceZone, "--quiet")
-	err := runCommand("Bringing Down E2E Cluster on GKE", cmd)
+func clusterDownGKE(gceZone, gceRegion string) error {
+	args := append([]string{"--cluster-name", gkeTestClusterName, "--down"}, gkeLocationArgs(gceZone, gceRegion)...)
+	cmd, err := kubetest2Command("gke", args...)
+	if err != nil {
+		return err
+	}
+	err = runCommand("Bringing Down E2E Cluster on GKE", cmd)
 	if err != nil {
 		return fmt.Errorf("failed to bring down kubernetes e2e cluster on gke: %v", err)
 	}
@@ -62,31 +196,90 @@ func clusterUpGCE(k8sDir, gceZone string) error {
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command(filepath.Join(k8sDir, "hack", "e2e-internal", "e2e-up.sh"))
-	err = runCommand("Starting E2E Cluster on GCE", cmd)
+	if len(*nodeImageType) != 0 {
+		for k, v := range nodeImageTypes[*nodeImageType].gceEnv {
+			err = os.Setenv(k, v)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if *numNodes != 0 {
+		err = os.Setenv("NUM_NODES", strconv.Itoa(*numNodes))
+		if err != nil {
+			return err
+		}
+	}
+	if len(*nodeMachineType) != 0 {
+		err = os.Setenv("NODE_SIZE", *nodeMachineType)
+		if err != nil {
+			return err
+		}
+	}
+	// The deployer runs the cluster scripts of k8sDir, which read the
+	// environment set above
+	cmd, err := kubetest2Command("gce", "--repo-root", k8sDir, "--up")
+	if err != nil {
+		return err
+	}
+	err = runClusterUpCommand("Starting E2E Cluster on GCE", cmd)
 	if err != nil {
 		return fmt.Errorf("failed to bring up kubernetes e2e cluster on gce: %v", err)
 	}
 
+	if len(*gceNodeVersion) != 0 {
+		// The cluster scripts only bring up clusters with the same version
+		// on all machines, so the nodes are replaced afterwards
+		cmd = exec.Command(filepath.Join(k8sDir, "cluster", "gce", "upgrade.sh"), "-N", "-o", fmt.Sprintf("v%s", *gceNodeVersion))
+		cmd.Env = append(os.Environ(), "KUBERNETES_SKIP_CONFIRM=y")
+		err = runCommandWithTimeout("Changing Node Version of E2E Cluster on GCE", cmd, *stepTimeout)
+		if err != nil {
+			return fmt.Errorf("failed to change node version of kubernetes e2e cluster on gce to %s: %v", *gceNodeVersion, err)
+		}
+	}
+
 	return nil
 }
 
-func clusterUpGKE(gceZone string) error {
-	out, err := exec.Command("gcloud", "container", "clusters", "list", "--zone", gceZone,
-		"--filter", fmt.Sprintf("name=%s", gkeTestClusterName)).CombinedOutput()
+func clusterUpGKE(gceZone, gceRegion string) error {
+	listArgs := append([]string{"container", "clusters", "list", "--filter", fmt.Sprintf("name=%s", gkeTestClusterName)}, gkeLocationArgs(gceZone, gceRegion)...)
+	out, err := combinedOutput(exec.Command("gcloud", listArgs...))
 	if err != nil {
 		return fmt.Errorf("failed to check for previous test cluster: %v %s", err, out)
 	}
 	if len(out) > 0 {
 		klog.Infof("Detected previous cluster %s. Deleting so a new one can be created...", gkeTestClusterName)
-		err = clusterDownGKE(gceZone)
+		err = clusterDownGKE(gceZone, gceRegion)
 		if err != nil {
 			return err
 		}
 	}
-	cmd := exec.Command("gcloud", "container", "clusters", "create", gkeTestClusterName,
-		"--zone", gceZone, "--cluster-version", *gkeClusterVer, "--quiet")
-	err = runCommand("Staring E2E Cluster on GKE", cmd)
+	args := []string{"--cluster-name", gkeTestClusterName, "--up"}
+	if len(*gkeReleaseChan) != 0 {
+		// The cluster gets the default version of the channel
+		args = append(args, "--release-channel", *gkeReleaseChan)
+	} else {
+		args = append(args, "--version", *gkeClusterVer)
+	}
+	if len(*gkeNodeVersion) != 0 {
+		// The deployer has no flag for the node version
+		args = append(args, "--create-command", fmt.Sprintf("container clusters create --quiet --node-version=%s", *gkeNodeVersion))
+	}
+	if len(*nodeImageType) != 0 {
+		args = append(args, "--image-type", nodeImageTypes[*nodeImageType].gkeImageType)
+	}
+	if *numNodes != 0 {
+		args = append(args, "--num-nodes", strconv.Itoa(*numNodes))
+	}
+	if len(*nodeMachineType) != 0 {
+		args = append(args, "--machine-type", *nodeMachineType)
+	}
+	args = append(args, gkeLocationArgs(gceZone, gceRegion)...)
+	cmd, err := kubetest2Command("gke", args...)
+	if err != nil {
+		return err
+	}
+	err = runClusterUpCommand("Starting E2E Cluster on GKE", cmd)
 	if err != nil {
 		return fmt.Errorf("failed to bring up kubernetes e2e cluster on gke: %v", err)
 	}
@@ -94,6 +287,17 @@ func clusterUpGKE(gceZone string) error {
 	return nil
 }
 
+// enableGKEManagedDriver enables the GKE managed PD CSI driver addon of the
+// test cluster
+func enableGKEManagedDriver(gceZone, gceRegion string) error {
+	args := append([]string{"beta", "container", "clusters", "update", gkeTestClusterName, "--update-addons", "GcePersistentDiskCsiDriver=ENABLED"}, gkeLocationArgs(gceZone, gceRegion)...)
+	err := runCommandWithTimeout("Enabling GKE managed PD CSI driver", exec.Command("gcloud", args...), *stepTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to enable GKE managed PD CSI driver addon: %v", err)
+	}
+	return nil
+}
+
 func downloadKubernetesSource(pkgDir, k8sIoDir, kubeVersion string) error {
 	k8sDir := filepath.Join(k8sIoDir, "kubernetes")
 	/*
@@ -125,12 +329,12 @@ func downloadKubernetesSource(pkgDir, k8sIoDir, kubeVersion string) error {
 	} else {
 		vKubeVersion = "v" + kubeVersion
 	}
-	out, err := exec.Command("curl", "-L", fmt.Sprintf("https://github.com/kubernetes/kubernetes/archive/%s.tar.gz", vKubeVersion), "-o", kubeTarDir).CombinedOutput()
+	out, err := combinedOutput(exec.Command("curl", "-L", fmt.Sprintf("https://github.com/kubernetes/kubernetes/archive/%s.tar.gz", vKubeVersion), "-o", kubeTarDir))
 	if err != nil {
 		return fmt.Errorf("failed to curl kubernetes version %s: %s, err: %v", kubeVersion, out, err)
 	}
 
-	out, err = exec.Command("tar", "-C", k8sIoDir, "-xvf", kubeTarDir).CombinedOutput()
+	out, err = combinedOutput(exec.Command("tar", "-C", k8sIoDir, "-xvf", kubeTarDir))
 	if err != nil {
 		return fmt.Errorf("failed to untar %s: %s, err: %v", kubeTarDir, out, err)
 	}
@@ -149,3 +353,106 @@ func downloadKubernetesSource(pkgDir, k8sIoDir, kubeVersion string) error {
 
 	return nil
 }
+
+// downloadKubernetesRelease downloads the release artifacts of kubeVersion to
+// k8sIoDir/kubernetes: the cluster scripts, the server and client binaries
+// used by them and the test binaries, which are placed where building
+// Kubernetes from source puts them.
+func downloadKubernetesRelease(k8sIoDir, kubeVersion string) error {
+	k8sDir := filepath.Join(k8sIoDir, "kubernetes")
+	err := os.RemoveAll(k8sDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(k8sIoDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	releaseURL := fmt.Sprintf("https://dl.k8s.io/v%s", kubeVersion)
+	for _, tarball := range []string{"kubernetes.tar.gz", fmt.Sprintf("kubernetes-test-linux-%s.tar.gz", runtime.GOARCH)} {
+		tarballPath := filepath.Join(k8sIoDir, tarball)
+		out, err := combinedOutput(exec.Command("curl", "-fL", fmt.Sprintf("%s/%s", releaseURL, tarball), "-o", tarballPath))
+		if err != nil {
+			return fmt.Errorf("failed to curl %s of kubernetes version %s: %s, err: %v", tarball, kubeVersion, out, err)
+		}
+		out, err = combinedOutput(exec.Command("tar", "-C", k8sIoDir, "-xzf", tarballPath))
+		if err != nil {
+			return fmt.Errorf("failed to untar %s: %s, err: %v", tarballPath, out, err)
+		}
+	}
+
+	// The server binaries are needed by the cluster scripts to bring up a
+	// cluster, the client binaries by kubectl.sh
+	cmd := exec.Command(filepath.Join(k8sDir, "cluster", "get-kube-binaries.sh"))
+	cmd.Env = append(os.Environ(), "KUBERNETES_SKIP_CONFIRM=y")
+	err = runCommand("Downloading Kubernetes Binaries", cmd)
+	if err != nil {
+		return fmt.Errorf("failed to download kubernetes binaries: %v", err)
+	}
+
+	binDir := filepath.Join(k8sDir, k8sBuildBinDir)
+	err = os.MkdirAll(binDir, 0777)
+	if err != nil {
+		return err
+	}
+	for _, binary := range []string{"e2e.test", "ginkgo"} {
+		err = os.Symlink(filepath.Join(k8sDir, "test", "bin", binary), filepath.Join(binDir, binary))
+		if err != nil {
+			return fmt.Errorf("failed to link test binary %s: %v", binary, err)
+		}
+	}
+
+	klog.V(4).Infof("Successfully downloaded Kubernetes release v%s to %s", kubeVersion, k8sDir)
+
+	return nil
+}
+
+// gkeLocationArgs returns the arguments selecting the zone of a zonal or the
+// region of a regional cluster
+func gkeLocationArgs(gceZone, gceRegion string) []string {
+	if len(gceRegion) != 0 {
+		return []string{"--region", gceRegion}
+	}
+	return []string{"--zone", gceZone}
+}
+
+// kubetest2Command returns the command running the kubetest2 deployer with
+// the given arguments in the current project. Cluster logs are dumped to the
+// ARTIFACTS directory when the cluster is brought down.
+func kubetest2Command(deployer string, args ...string) (*exec.Cmd, error) {
+	if err := ensureKubetest2(deployer); err != nil {
+		return nil, err
+	}
+	project, err := combinedOutput(exec.Command("gcloud", "config", "get-value", "project"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gcloud project: %s, err: %v", project, err)
+	}
+	projectFlag := "--project"
+	if deployer == "gce" {
+		projectFlag = "--gcp-project"
+	}
+	args = append([]string{deployer, projectFlag, strings.TrimSpace(string(project))}, args...)
+	if artifactsDir, ok := os.LookupEnv("ARTIFACTS"); ok {
+		args = append(args, "--artifacts", artifactsDir)
+	}
+	return exec.Command("kubetest2", args...), nil
+}
+
+// ensureKubetest2 installs kubetest2 and the deployer if they are not found
+func ensureKubetest2(deployer string) error {
+	_, err := exec.LookPath("kubetest2")
+	if err == nil {
+		_, err = exec.LookPath("kubetest2-" + deployer)
+	}
+	if err == nil {
+		return nil
+	}
+	cmd := exec.Command("go", "get", "sigs.k8s.io/kubetest2@latest", fmt.Sprintf("sigs.k8s.io/kubetest2/kubetest2-%s@latest", deployer))
+	cmd.Env = append(os.Environ(), "GO111MODULE=on")
+	err = runCommand("Installing kubetest2", cmd)
+	if err != nil {
+		return fmt.Errorf("failed to install kubetest2: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var harnessConfigFile = flag.String("config", "", "yaml file with cluster, driver and test sections setting flags by name. Flags set on the command line take precedence")
+
+// harnessConfig is the config file alternative to the flags. Its sections
+// map flag names to values, e.g.
+//
+//	cluster:
+//	  deployment-strategy: gke
+//	  gce-zones: [us-central1-b, us-central1-c]
+//	test:
+//	  test-focus: External.Storage
+//
+// Lists are joined with commas.
+type harnessConfig struct {
+	Cluster map[string]interface{} `json:"cluster"`
+	Driver  map[string]interface{} `json:"driver"`
+	Test    map[string]interface{} `json:"test"`
+}
+
+// applyConfigFile sets the flags of the config file that were not set on the
+// command line, which take precedence
+func applyConfigFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	config := harnessConfig{}
+	err = yaml.UnmarshalStrict(data, &config)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	for _, section := range []map[string]interface{}{config.Cluster, config.Driver, config.Test} {
+		for name, value := range section {
+			if name == "config" {
+				return fmt.Errorf("config file %s can not set config", path)
+			}
+			if flag.Lookup(name) == nil {
+				return fmt.Errorf("config file %s sets unknown flag %s", path, name)
+			}
+			if setFlags[name] {
+				continue
+			}
+			err = flag.Set(name, configValue(value))
+			if err != nil {
+				return fmt.Errorf("config file %s sets invalid value %v of flag %s: %v", path, value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func configValue(value interface{}) string {
+	if list, ok := value.([]interface{}); ok {
+		values := make([]string, len(list))
+		for i, v := range list {
+			values[i] = fmt.Sprint(v)
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(value)
+}
@@ -8,7 +8,8 @@ import (
 )
 
 type driverConfig struct {
-	StorageClassFile string
+	StorageClassFile  string
+	SnapshotClassFile string
 }
 
 const (
@@ -19,7 +20,7 @@ const (
 
 // generateDriverConfigFile loads a testdriver config template and creates a file
 // with the test-specific configuration
-func generateDriverConfigFile(pkgDir, storageClassFile string) (string, error) {
+func generateDriverConfigFile(pkgDir, storageClassFile, snapshotClassFile string) (string, error) {
 	// Load template
 	t, err := template.ParseFiles(filepath.Join(pkgDir, testConfigDir, configTemplateFile))
 	if err != nil {
@@ -41,6 +42,9 @@ func generateDriverConfigFile(pkgDir, storageClassFile string) (string, error) {
 	params := driverConfig{
 		StorageClassFile: filepath.Join(pkgDir, testConfigDir, storageClassFile),
 	}
+	if len(snapshotClassFile) != 0 {
+		params.SnapshotClassFile = filepath.Join(pkgDir, testConfigDir, snapshotClassFile)
+	}
 
 	// Write config file
 	err = t.Execute(w, params)
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	testutils "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/e2e/utils"
+)
+
+const (
+	driverE2EPackage = "./test/e2e/tests"
+	// Timeout of the suite if the step timeout is unset, as in test/run-e2e.sh
+	driverE2EDefaultTimeout = "20m"
+)
+
+// runDriverE2ETests runs the test/e2e suite of the driver, which sets up its
+// own instances, in the project of gcloud or a Boskos project in Prow. With
+// ginkgo-procs the specs are sharded across that many processes.
+func runDriverE2ETests() error {
+	pkgDir, err := getPkgDir()
+	if err != nil {
+		return err
+	}
+
+	var project, serviceAccount string
+	if *inProw {
+		project, serviceAccount = testutils.SetupProwConfig(*boskosResourceType)
+		defer testutils.ReleaseProwConfig(project)
+	} else {
+		out, err := combinedOutput(exec.Command("gcloud", "config", "get-value", "project"))
+		if err != nil {
+			return fmt.Errorf("failed to get gcloud project: %s, err: %v", out, err)
+		}
+		project = strings.TrimSpace(string(out))
+		serviceAccount = *driverE2EServiceAccount
+	}
+
+	timeout := driverE2EDefaultTimeout
+	if *stepTimeout != 0 {
+		timeout = stepTimeout.String()
+	}
+	testArgs := []string{
+		fmt.Sprintf("--project=%s", project),
+		fmt.Sprintf("--service-account=%s", serviceAccount),
+		"--delete-instances=true",
+		"--logtostderr",
+	}
+	var cmd *exec.Cmd
+	if *ginkgoProcs > 1 {
+		// Only the ginkgo CLI shards the specs across processes, each of
+		// which runs the driver on its own instances
+		ginkgo, err := exec.LookPath("ginkgo")
+		if err != nil {
+			return fmt.Errorf("ginkgo is required in PATH to run the driver e2e tests with ginkgo-procs: %v", err)
+		}
+		args := append([]string{fmt.Sprintf("-nodes=%d", *ginkgoProcs), fmt.Sprintf("-timeout=%s", timeout), "-v", driverE2EPackage, "--"}, testArgs...)
+		cmd = exec.Command(ginkgo, args...)
+	} else {
+		args := append([]string{"test", "-timeout", timeout, "-v", driverE2EPackage}, testArgs...)
+		cmd = exec.Command("go", args...)
+	}
+	cmd.Dir = pkgDir
+	err = runCommand("Running Driver E2E Tests", cmd)
+	if err != nil {
+		return fmt.Errorf("failed to run driver e2e tests: %v", err)
+	}
+	return nil
+}
@@ -1,26 +1,120 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
+
+	"k8s.io/klog"
 )
 
+// autoOverlayName is the deploy-overlay-name picking the overlay from the
+// Kubernetes version of the cluster
+const autoOverlayName = "auto"
+
+// autoOverlays are the overlays picked by autoOverlayName with the minimum
+// Kubernetes version they support, newest first. The alpha overlay adds the
+// resizer, whose ExpandCSIVolumes feature is beta since 1.16.
+var autoOverlays = []struct {
+	minMajor, minMinor int
+	overlay            string
+}{
+	{1, 16, "alpha"},
+	{0, 0, "stable"},
+}
+
+var serverVersionRegexp = regexp.MustCompile(`^v(\d+)\.(\d+)`)
+
+// pickOverlay returns the overlay of autoOverlays for the Kubernetes version
+// of the cluster
+func pickOverlay() (string, error) {
+	if *dryRun {
+		overlay := autoOverlays[len(autoOverlays)-1].overlay
+		klog.Infof("Dry run, picking overlay %s without detecting the cluster version", overlay)
+		return overlay, nil
+	}
+	out, err := combinedOutput(exec.Command("kubectl", "version", "-o", "json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to get cluster version: %s, err: %v", out, err)
+	}
+	version := struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}{}
+	err = json.Unmarshal(out, &version)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse cluster version %s: %v", out, err)
+	}
+	match := serverVersionRegexp.FindStringSubmatch(version.ServerVersion.GitVersion)
+	if match == nil {
+		return "", fmt.Errorf("unexpected cluster version %q", version.ServerVersion.GitVersion)
+	}
+	// The regexp only matches numbers
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	for _, o := range autoOverlays {
+		if major > o.minMajor || (major == o.minMajor && minor >= o.minMinor) {
+			klog.Infof("Picked overlay %s for cluster version %s", o.overlay, version.ServerVersion.GitVersion)
+			return o.overlay, nil
+		}
+	}
+	return "", fmt.Errorf("no overlay supports cluster version %s", version.ServerVersion.GitVersion)
+}
+
+// sidecarImageFlags are the flags overriding the sidecar images of the
+// overlays, by the image name in the overlays
+var sidecarImageFlags = map[string]*string{
+	"gke.gcr.io/csi-provisioner": provisionerImage,
+	"gke.gcr.io/csi-attacher":    attacherImage,
+	"quay.io/k8scsi/csi-resizer": resizerImage,
+	"gke.gcr.io/csi-snapshotter": snapshotterImage,
+}
+
+// sidecarImageOverrides returns the kustomize image arguments of the sidecar
+// image flags, which are either images or tags of the overlay's images
+func sidecarImageOverrides() []string {
+	overrides := []string{}
+	for name, image := range sidecarImageFlags {
+		if len(*image) == 0 {
+			continue
+		}
+		if strings.Contains(*image, "/") {
+			overrides = append(overrides, fmt.Sprintf("%s=%s", name, *image))
+		} else {
+			overrides = append(overrides, fmt.Sprintf("%s:%s", name, *image))
+		}
+	}
+	return overrides
+}
+
 func getOverlayDir(pkgDir, deployOverlayName string) string {
 	return filepath.Join(pkgDir, "deploy", "kubernetes", "overlays", deployOverlayName)
 }
 
-func installDriver(goPath, pkgDir, stagingImage, stagingVersion, deployOverlayName string, doDriverBuild bool) error {
+func installDriver(pkgDir, stagingImage, stagingVersion, deployOverlayName string, doDriverBuild bool) error {
+	imageOverrides := sidecarImageOverrides()
 	if doDriverBuild {
+		imageOverrides = append(imageOverrides, fmt.Sprintf("%s=%s:%s", pdImagePlaceholder, stagingImage, stagingVersion))
+	}
+	if len(imageOverrides) != 0 {
 		// Install kustomize
-		out, err := exec.Command(filepath.Join(pkgDir, "deploy", "kubernetes", "install-kustomize.sh")).CombinedOutput()
+		installCmd := exec.Command(filepath.Join(pkgDir, "deploy", "kubernetes", "install-kustomize.sh"))
+		installCmd.Env = append(os.Environ(), fmt.Sprintf("GCE_PD_PKGDIR=%s", pkgDir))
+		out, err := combinedOutput(installCmd)
 		if err != nil {
 			return fmt.Errorf("failed to install kustomize: %s, err: %v", out, err)
 		}
 
-		// Edit ci kustomization to use given image tag
+		// Edit ci kustomization to use the built driver image and the
+		// overridden sidecar images
 		overlayDir := getOverlayDir(pkgDir, deployOverlayName)
 		err = os.Chdir(overlayDir)
 		if err != nil {
@@ -29,12 +123,8 @@ func installDriver(goPath, pkgDir, stagingImage, stagingVersion, deployOverlayNa
 
 		// TODO (#138): in a local environment this is going to modify the actual kustomize files.
 		// maybe a copy should be made instead
-		out, err = exec.Command(
-			filepath.Join(pkgDir, "bin", "kustomize"),
-			"edit",
-			"set",
-			"image",
-			fmt.Sprintf("%s=%s:%s", pdImagePlaceholder, stagingImage, stagingVersion)).CombinedOutput()
+		editArgs := append([]string{"edit", "set", "image"}, imageOverrides...)
+		out, err = combinedOutput(exec.Command(filepath.Join(pkgDir, "bin", "kustomize"), editArgs...))
 		if err != nil {
 			return fmt.Errorf("failed to edit kustomize: %s, err: %v", out, err)
 		}
@@ -45,7 +135,7 @@ func installDriver(goPath, pkgDir, stagingImage, stagingVersion, deployOverlayNa
 	defer removeDir(filepath.Dir(tmpSaFile))
 
 	// Need to copy it to name the file "cloud-sa.json"
-	out, err := exec.Command("cp", *saFile, tmpSaFile).CombinedOutput()
+	out, err := combinedOutput(exec.Command("cp", *saFile, tmpSaFile))
 	if err != nil {
 		return fmt.Errorf("error copying service account key: %s, err: %v", out, err)
 	}
@@ -54,39 +144,190 @@ func installDriver(goPath, pkgDir, stagingImage, stagingVersion, deployOverlayNa
 	// deploy driver
 	deployCmd := exec.Command(filepath.Join(pkgDir, "deploy", "kubernetes", "deploy-driver.sh"), "--skip-sa-check")
 	deployCmd.Env = append(os.Environ(),
-		fmt.Sprintf("GOPATH=%s", goPath),
+		fmt.Sprintf("GCE_PD_PKGDIR=%s", pkgDir),
 		fmt.Sprintf("GCE_PD_SA_DIR=%s", filepath.Dir(tmpSaFile)),
 		fmt.Sprintf("GCE_PD_DRIVER_VERSION=%s", deployOverlayName),
 	)
-	err = runCommand("Deploying driver", deployCmd)
+	err = runCommandWithTimeout("Deploying driver", deployCmd, *stepTimeout)
 	if err != nil {
 		return fmt.Errorf("failed to deploy driver: %v", err)
 	}
 
-	// TODO (#139): wait for driver to be running
-	time.Sleep(10 * time.Second)
-	statusCmd := exec.Command("kubectl", "describe", "pods", "-n", "default")
-	err = runCommand("Checking driver pods", statusCmd)
+	err = waitForDriver()
 	if err != nil {
-		return fmt.Errorf("failed to check driver pods: %v", err)
+		return fmt.Errorf("driver not ready: %v", err)
 	}
 
 	return nil
 }
 
-func deleteDriver(goPath, pkgDir, deployOverlayName string) error {
+// waitForDriver waits until the controller and node pods of the driver are
+// rolled out and the node pods registered the driver with their kubelet, so
+// the tests don't start before the driver is up
+func waitForDriver() error {
+	for _, workload := range []string{"statefulset/csi-gce-pd-controller", "daemonset/csi-gce-pd-node"} {
+		cmd := exec.Command("kubectl", "rollout", "status", workload, "-n", driverNamespace, fmt.Sprintf("--timeout=%v", driverReadyTimeout))
+		err := runCommand(fmt.Sprintf("Waiting for %s", workload), cmd)
+		if err != nil {
+			return fmt.Errorf("%s not rolled out: %v", workload, err)
+		}
+	}
+	if *dryRun {
+		return nil
+	}
+
+	// The deployment has no CSIDriver object, the registration is only
+	// visible in the CSINode objects of the nodes
+	out, err := combinedOutput(exec.Command("kubectl", "get", "daemonset", "csi-gce-pd-node", "-n", driverNamespace, "-o", "jsonpath={.status.desiredNumberScheduled}"))
+	if err != nil {
+		return fmt.Errorf("failed to get node daemonset: %s, err: %v", out, err)
+	}
+	numNodes, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return fmt.Errorf("unexpected number of driver nodes %q: %v", out, err)
+	}
+	jsonPath := `jsonpath={range .items[*]}{.metadata.name}{" "}{.spec.drivers[*].name}{"\n"}{end}`
+	registered := 0
+	for start := time.Now(); time.Since(start) < driverReadyTimeout; time.Sleep(5 * time.Second) {
+		out, err = combinedOutput(exec.Command("kubectl", "get", "csinodes", "-o", jsonPath))
+		if err != nil {
+			klog.Warningf("failed to list CSINodes: %s, err: %v", out, err)
+			continue
+		}
+		registered = 0
+		for _, line := range strings.Split(string(out), "\n") {
+			// Lines are the CSINode name followed by its drivers
+			fields := strings.Fields(line)
+			for i := 1; i < len(fields); i++ {
+				if fields[i] == driverName {
+					registered++
+				}
+			}
+		}
+		if registered >= numNodes {
+			klog.Infof("Driver %s is registered on %d nodes", driverName, registered)
+			return nil
+		}
+	}
+	return fmt.Errorf("driver %s registered on %d of %d nodes after %v", driverName, registered, numNodes, driverReadyTimeout)
+}
+
+func deleteDriver(pkgDir, deployOverlayName string) error {
 	deleteCmd := exec.Command(filepath.Join(pkgDir, "deploy", "kubernetes", "delete-driver.sh"))
 	deleteCmd.Env = append(os.Environ(),
-		fmt.Sprintf("GOPATH=%s", goPath),
+		fmt.Sprintf("GCE_PD_PKGDIR=%s", pkgDir),
 		fmt.Sprintf("GCE_PD_DRIVER_VERSION=%s", deployOverlayName),
 	)
 	err := runCommand("Deleting driver", deleteCmd)
 	if err != nil {
 		return fmt.Errorf("failed to delete driver: %v", err)
 	}
+	return waitForDriverGone()
+}
+
+// waitForDriverGone waits until the objects of the driver are deleted, so
+// later installs into the same cluster don't fail on leftovers. Pods still
+// terminating after driverGoneTimeout, e.g. on unreachable nodes, are force
+// deleted. The leftover objects are returned as an error.
+func waitForDriverGone() error {
+	leftovers, err := listDriverObjects()
+	for start := time.Now(); (err != nil || len(leftovers) != 0) && time.Since(start) < driverGoneTimeout; time.Sleep(5 * time.Second) {
+		leftovers, err = listDriverObjects()
+	}
+	if err != nil {
+		return err
+	}
+	for _, object := range leftovers {
+		if strings.HasPrefix(object, "pod/") {
+			cmd := exec.Command("kubectl", "delete", "pods", "-n", driverNamespace, "-l", driverPodSelector, "--grace-period=0", "--force", "--ignore-not-found")
+			err = runCommand("Force deleting driver pods", cmd)
+			if err != nil {
+				return fmt.Errorf("failed to force delete driver pods: %v", err)
+			}
+			leftovers, err = listDriverObjects()
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	if len(leftovers) != 0 {
+		return fmt.Errorf("objects left after deleting the driver: %v", leftovers)
+	}
+	return nil
+}
+
+// listDriverObjects returns the objects of the driver overlays, which carry
+// the driverPodSelector label, and the objects deploy-driver.sh creates, as
+// type/name
+func listDriverObjects() ([]string, error) {
+	cmds := []*exec.Cmd{
+		exec.Command("kubectl", "get", "statefulsets,daemonsets,pods,serviceaccounts,clusterroles,clusterrolebindings", "--all-namespaces", "-l", driverPodSelector, "-o", "name"),
+		exec.Command("kubectl", "get", "secret", "cloud-sa", "-n", driverNamespace, "--ignore-not-found", "-o", "name"),
+		exec.Command("kubectl", "get", "csidriver", driverName, "--ignore-not-found", "-o", "name"),
+	}
+	objects := []string{}
+	for _, cmd := range cmds {
+		out, err := combinedOutput(cmd)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list driver objects: %s, err: %v", out, err)
+		}
+		objects = append(objects, strings.Fields(string(out))...)
+	}
+	return objects, nil
+}
+
+// installSnapshotController installs the VolumeSnapshot CRDs and the snapshot
+// controller, which the csi-snapshotter sidecar of the driver relies on since
+// snapshots are beta
+func installSnapshotController() error {
+	for _, manifest := range snapshotControllerManifests() {
+		err := runCommand("Installing snapshot controller", exec.Command("kubectl", "apply", "-f", manifest))
+		if err != nil {
+			return fmt.Errorf("failed to apply %s: %v", manifest, err)
+		}
+	}
 	return nil
 }
 
+func deleteSnapshotController() error {
+	manifests := snapshotControllerManifests()
+	// Delete the controller before the CRDs it watches
+	for i := len(manifests) - 1; i >= 0; i-- {
+		err := runCommand("Deleting snapshot controller", exec.Command("kubectl", "delete", "--ignore-not-found", "-f", manifests[i]))
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %v", manifests[i], err)
+		}
+	}
+	return nil
+}
+
+func snapshotControllerManifests() []string {
+	baseURL := fmt.Sprintf("https://raw.githubusercontent.com/kubernetes-csi/external-snapshotter/%s", snapshotControllerVersion)
+	return []string{
+		baseURL + "/config/crd/snapshot.storage.k8s.io_volumesnapshotclasses.yaml",
+		baseURL + "/config/crd/snapshot.storage.k8s.io_volumesnapshotcontents.yaml",
+		baseURL + "/config/crd/snapshot.storage.k8s.io_volumesnapshots.yaml",
+		baseURL + "/deploy/kubernetes/snapshot-controller/rbac-snapshot-controller.yaml",
+		baseURL + "/deploy/kubernetes/snapshot-controller/setup-snapshot-controller.yaml",
+	}
+}
+
+// waitForGKEManagedDriver waits until the GKE managed driver is registered
+// with the cluster
+func waitForGKEManagedDriver() error {
+	var out []byte
+	var err error
+	for start := time.Now(); time.Since(start) < managedDriverTimeout; time.Sleep(10 * time.Second) {
+		out, err = combinedOutput(exec.Command("kubectl", "get", "csidriver", driverName))
+		if err == nil {
+			klog.Infof("GKE managed driver %s is registered", driverName)
+			return nil
+		}
+	}
+	return fmt.Errorf("GKE managed driver %s not registered after %v: %s, err: %v", driverName, managedDriverTimeout, out, err)
+}
+
 func pushImage(pkgDir, stagingImage, stagingVersion string) error {
 	err := os.Setenv("GCE_PD_CSI_STAGING_VERSION", stagingVersion)
 	if err != nil {
@@ -98,7 +339,8 @@ func pushImage(pkgDir, stagingImage, stagingVersion string) error {
 	}
 	cmd := exec.Command("make", "-C", pkgDir, "push-container",
 		fmt.Sprintf("GCE_PD_CSI_STAGING_VERSION=%s", stagingVersion),
-		fmt.Sprintf("GCE_PD_CSI_STAGING_IMAGE=%s", stagingImage))
+		fmt.Sprintf("GCE_PD_CSI_STAGING_IMAGE=%s", stagingImage),
+		fmt.Sprintf("GCE_PD_CSI_ARCH=%s", *arch))
 	err = runCommand("Pushing GCP Container", cmd)
 	if err != nil {
 		return fmt.Errorf("failed to run make command: err: %v", err)
@@ -114,3 +356,43 @@ func deleteImage(stagingImage, stagingVersion string) error {
 	}
 	return nil
 }
+
+// collectDriverLogs writes the logs, the logs of the previous containers and
+// the description of every driver pod in the namespace matching the selector
+// to the driver-logs directory of the ARTIFACTS directory. Failures are logged, they must not hide the failure
+// the logs are collected for.
+func collectDriverLogs(namespace, podSelector string) {
+	artifactsDir, ok := os.LookupEnv("ARTIFACTS")
+	if !ok {
+		artifactsDir = generateUniqueTmpDir()
+	}
+	logsDir := filepath.Join(artifactsDir, "driver-logs")
+	if err := os.MkdirAll(logsDir, 0755); err != nil {
+		klog.Errorf("failed to create driver logs directory %s: %v", logsDir, err)
+		return
+	}
+
+	out, err := combinedOutput(exec.Command("kubectl", "get", "pods", "-n", namespace, "-l", podSelector, "-o", "jsonpath={.items[*].metadata.name}"))
+	if err != nil {
+		klog.Errorf("failed to list driver pods: %s, err: %v", out, err)
+		return
+	}
+	for _, pod := range strings.Fields(string(out)) {
+		writeCommandOutput(filepath.Join(logsDir, pod+".log"), "kubectl", "logs", pod, "-n", namespace, "--all-containers")
+		// Only containers that restarted have previous logs
+		writeCommandOutput(filepath.Join(logsDir, pod+"-previous.log"), "kubectl", "logs", pod, "-n", namespace, "--all-containers", "--previous")
+		writeCommandOutput(filepath.Join(logsDir, pod+"-describe.txt"), "kubectl", "describe", "pod", pod, "-n", namespace)
+	}
+	klog.Infof("Collected driver logs in %s", logsDir)
+}
+
+func writeCommandOutput(file, name string, args ...string) {
+	out, err := combinedOutput(exec.Command(name, args...))
+	if err != nil {
+		klog.V(4).Infof("%s %v failed: %s, err: %v", name, args, out, err)
+		return
+	}
+	if err := ioutil.WriteFile(file, out, 0644); err != nil {
+		klog.Errorf("failed to write %s: %v", file, err)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/onsi/ginkgo/reporters"
+	"k8s.io/klog"
+)
+
+// mergeJUnitReports merges the junit reports the ginkgo processes of a test
+// run with the report prefix wrote to the artifacts directory into
+// junit_<reportPrefix>.xml. If prefixTests is set, the tests are named after
+// the run, so Testgrid shows the results of runs of the same tests apart.
+func mergeJUnitReports(artifactsDir, reportPrefix string, prefixTests bool) error {
+	// The e2e framework names the reports junit_<prefix><ginkgo node>.xml
+	files, err := filepath.Glob(filepath.Join(artifactsDir, fmt.Sprintf("junit_%s_*.xml", reportPrefix)))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	merged := reporters.JUnitTestSuite{Name: reportPrefix}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		suite := reporters.JUnitTestSuite{}
+		err = xml.Unmarshal(data, &suite)
+		if err != nil {
+			return fmt.Errorf("failed to parse junit report %s: %v", file, err)
+		}
+		for _, testCase := range suite.TestCases {
+			if prefixTests {
+				testCase.Name = fmt.Sprintf("[%s] %s", reportPrefix, testCase.Name)
+			}
+			merged.TestCases = append(merged.TestCases, testCase)
+		}
+		merged.Tests += suite.Tests
+		merged.Failures += suite.Failures
+		merged.Errors += suite.Errors
+		// The processes run in parallel
+		if suite.Time > merged.Time {
+			merged.Time = suite.Time
+		}
+	}
+
+	data, err := xml.MarshalIndent(merged, "", "  ")
+	if err != nil {
+		return err
+	}
+	mergedFile := filepath.Join(artifactsDir, fmt.Sprintf("junit_%s.xml", reportPrefix))
+	err = ioutil.WriteFile(mergedFile, append([]byte(xml.Header), data...), 0644)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			klog.Errorf("failed to remove merged junit report %s: %v", file, err)
+		}
+	}
+	klog.Infof("Merged %d junit reports into %s", len(files), mergedFile)
+	return nil
+}
@@ -17,10 +17,14 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	testutils "sigs.k8s.io/gcp-compute-persistent-disk-csi-driver/test/e2e/utils"
 
@@ -32,56 +36,211 @@ var (
 	// Kubernetes cluster flags
 	teardownCluster  = flag.Bool("teardown-cluster", true, "teardown the cluster after the e2e test")
 	teardownDriver   = flag.Bool("teardown-driver", true, "teardown the driver after the e2e test")
+	dryRun           = flag.Bool("dry-run", false, "print the external commands the test runs, with their arguments and the environment set by the test, instead of running them")
+	stepTimeout      = flag.Duration("timeout", 0, "timeout of each of the cluster bringup, the driver install and the test run, e.g. 1h. There is no timeout if unset")
+	clusterUpRetries = flag.Int("cluster-up-retries", 0, "number of times the cluster bringup is retried on transient failures such as quota or resource stockouts")
 	bringupCluster   = flag.Bool("bringup-cluster", true, "build kubernetes and bringup a cluster")
 	gceZone          = flag.String("gce-zone", "", "zone that the gce k8s cluster is created/found in")
+	gceZones         = flag.String("gce-zones", "", "comma separated zones one of which is picked at random to create the k8s cluster in, falling back to the next zones if bringing up the cluster fails because of transient errors such as stockouts. Mutually exclusive with gce-zone")
 	kubeVersion      = flag.String("kube-version", "", "version of Kubernetes to download and use for the cluster")
 	testVersion      = flag.String("test-version", "", "version of Kubernetes to download and use for tests")
+	gceNodeVersion   = flag.String("gce-node-version", "", "version of Kubernetes the nodes of the gce cluster are downgraded to after bringup, to test version skew with the control plane of kube-version")
 	kubeFeatureGates = flag.String("kube-feature-gates", "", "feature gates to set on new kubernetes cluster")
+	useKubeRelease   = flag.Bool("use-kube-release", false, "download the release artifacts of kube-version and test-version instead of building Kubernetes from source")
+	pkgDirFlag       = flag.String("pkg-dir", "", "directory of the driver repository. If unset it is the repository in GOPATH or, without GOPATH, the repository the test was built from")
+	useKubeconfig    = flag.String("use-kubeconfig", "", "kubeconfig of an existing cluster to deploy the driver to and run the tests against, implies deployment strategy 'existing'")
 	localK8sDir      = flag.String("local-k8s-dir", "", "local prebuilt kubernetes/kubernetes directory to use for cluster and test binaries")
-	deploymentStrat  = flag.String("deployment-strategy", "", "choose between deploying on gce or gke")
+	nodeImageType    = flag.String("node-image-type", "", "image type of the cluster nodes, one of cos_containerd, ubuntu_containerd or windows. Windows nodes are only supported with deployment strategy 'gce'. If unset the default image of the deployment strategy is used")
+	numNodes         = flag.Int("num-nodes", 0, "number of nodes of the new cluster, per zone for regional gke clusters. If unset the default of the deployment strategy is used")
+	nodeMachineType  = flag.String("node-machine-type", "", "machine type of the cluster nodes. If unset the default of the deployment strategy is used")
+	arch             = flag.String("arch", "amd64", "architecture of the cluster nodes and the driver image, one of amd64 or arm64. arm64 requires deployment strategy 'gke'")
+	platform         = flag.String("platform", "linux", "platform of the nodes the driver is tested on, one of linux or windows. Windows runs the tests not tagged LinuxOnly on a cluster with Windows nodes, deployed with the Windows overlay given by deploy-overlay-name")
+	deploymentStrat  = flag.String("deployment-strategy", "", "choose between deploying on gce or gke, or 'existing' to run the tests against the existing cluster of the kubeconfig")
+	gkeClusterRegion = flag.String("gke-cluster-region", "", "region that the regional gke cluster is created/found in, mutually exclusive with gce-zone")
 	gkeClusterVer    = flag.String("gke-cluster-version", "", "version of Kubernetes master and node for gke")
+	gkeNodeVersion   = flag.String("gke-node-version", "", "version of Kubernetes of the nodes of the gke cluster, to test version skew with the control plane of gke-cluster-version")
+	gkeEndpoint      = flag.String("gke-endpoint", "", "endpoint of the GKE API used to manage the cluster, e.g. of a staging environment. If unset the default endpoint of gcloud is used")
+	gkeReleaseChan   = flag.String("gke-release-channel", "", "GKE release channel the cluster is created from instead of a version, one of rapid, regular or stable")
 	// Test infrastructure flags
 	boskosResourceType = flag.String("boskos-resource-type", "gce-project", "name of the boskos resource type to reserve")
-	storageClassFile   = flag.String("storageclass-file", "", "name of storageclass yaml file to use for test relative to test/k8s-integration/config")
+	storageClassFile   = flag.String("storageclass-file", "", "comma separated names of storageclass yaml files to use for test relative to test/k8s-integration/config. The tests are run once per storageclass")
+	snapshotClassFile  = flag.String("snapshot-class-file", "", "name of snapshotclass yaml file to use for test relative to test/k8s-integration/config. If set, the VolumeSnapshot CRDs and the snapshot controller are installed and the snapshot tests are run")
 	inProw             = flag.Bool("run-in-prow", false, "is the test running in PROW")
 
 	// Driver flags
-	stagingImage      = flag.String("staging-image", "", "name of image to stage to")
-	saFile            = flag.String("service-account-file", "", "path of service account file")
-	deployOverlayName = flag.String("deploy-overlay-name", "", "which kustomize overlay to deploy the driver with")
-	doDriverBuild     = flag.Bool("do-driver-build", true, "building the driver from source")
+	stagingImage        = flag.String("staging-image", "", "name of image to stage to")
+	saFile              = flag.String("service-account-file", "", "path of service account file")
+	deployOverlayName   = flag.String("deploy-overlay-name", "", "which kustomize overlay to deploy the driver with, or 'auto' to pick the overlay from the Kubernetes version of the cluster")
+	useGKEManagedDriver = flag.Bool("use-gke-managed-driver", false, "test the GKE managed PD CSI driver addon instead of deploying the driver. The addon is enabled on clusters brought up by the test")
+	doDriverBuild       = flag.Bool("do-driver-build", true, "building the driver from source")
+	provisionerImage    = flag.String("provisioner-image", "", "csi-provisioner image, or tag of the image of the overlay, to deploy the driver with instead of the overlay's")
+	attacherImage       = flag.String("attacher-image", "", "csi-attacher image, or tag of the image of the overlay, to deploy the driver with instead of the overlay's")
+	resizerImage        = flag.String("resizer-image", "", "csi-resizer image, or tag of the image of the overlay, to deploy the driver with instead of the overlay's. Only overlays based on alpha have the resizer")
+	snapshotterImage    = flag.String("snapshotter-image", "", "csi-snapshotter image, or tag of the image of the overlay, to deploy the driver with instead of the overlay's. Only overlays based on alpha have the snapshotter")
 
 	// Test flags
-	migrationTest = flag.Bool("migration-test", false, "sets the flag on the e2e binary signalling migration")
-	testFocus     = flag.String("test-focus", "", "test focus for Kubernetes e2e")
+	migrationTest           = flag.Bool("migration-test", false, "sets the flag on the e2e binary signalling migration. With storageclass-file the migration tests run after the CSI tests, on the same cluster")
+	migrationTestFocus      = flag.String("migration-test-focus", "", "test focus of the migration tests when they run after the CSI tests of storageclass-file. If unset test-focus is used")
+	testFocus               = flag.String("test-focus", "", "test focus for Kubernetes e2e")
+	runSanity               = flag.Bool("run-sanity", false, "run csi-sanity against the driver deployed to a node instead of the Kubernetes e2e tests")
+	runDriverE2E            = flag.Bool("run-driver-e2e", false, "run the driver's test/e2e suite, which sets up its own instances, instead of bringing up a cluster and running the Kubernetes e2e tests")
+	driverE2EServiceAccount = flag.String("driver-e2e-service-account", "", "service account the instances of the driver e2e tests are brought up with. Ignored in Prow, which uses the default compute service account of the Boskos project")
+	sanityImage             = flag.String("sanity-image", "", "image of csi-sanity run by run-sanity")
+	testSkip                = flag.String("test-skip", "\\[Disruptive\\]|\\[Serial\\]|\\[Feature:.+\\]", "test skip regex for Kubernetes e2e, no tests are skipped if empty")
+	artifactsGCSPath        = flag.String("artifacts-gcs-path", "", "gs:// path the ARTIFACTS directory is uploaded to once the tests are done, e.g. the junit reports and the logs of the driver and of the driver e2e instances, for runs outside of Prow. A temporary directory is used if ARTIFACTS is unset")
+	ginkgoProcs             = flag.Int("ginkgo-procs", 0, "number of parallel ginkgo processes running the tests, 1 runs them serially. If unset ginkgo picks the number of processes, except for the driver e2e tests which run serially")
 )
 
 const (
 	pdImagePlaceholder = "gke.gcr.io/gcp-compute-persistent-disk-csi-driver"
-	k8sBuildBinDir     = "_output/dockerized/bin/linux/amd64"
 	gkeTestClusterName = "gcp-pd-csi-driver-test-cluster"
+	driverNamespace    = "default"
+	driverPodSelector  = "app=gcp-compute-persistent-disk-csi-driver"
+	driverName         = "pd.csi.storage.gke.io"
+	driverReadyTimeout = 5 * time.Minute
+	driverGoneTimeout  = 2 * time.Minute
+
+	managedDriverNamespace   = "kube-system"
+	managedDriverPodSelector = "k8s-app=gcp-compute-persistent-disk-csi-driver"
+	managedDriverTimeout     = 5 * time.Minute
+
+	snapshotControllerVersion = "v2.0.1"
+
+	// Time commands have to exit after they were interrupted on timeout
+	timeoutGracePeriod = 2 * time.Minute
 )
 
+// Zones the cluster bringup falls back to, in order, if bringing it up in
+// gce-zone fails because of transient errors
+var fallbackGCEZones []string
+
+// The test binaries run on the host of the test, whatever the architecture of
+// the cluster nodes
+var k8sBuildBinDir = filepath.Join("_output", "dockerized", "bin", "linux", runtime.GOARCH)
+
+// Environment the test was started with, commands printed in dry-run mode
+// show the variables set since
+var initialEnv = map[string]bool{}
+
 func init() {
 	flag.Set("logtostderr", "true")
+	for _, e := range os.Environ() {
+		initialEnv[e] = true
+	}
 }
 
 func main() {
 	flag.Parse()
 
-	if !*inProw {
-		ensureVariable(stagingImage, true, "staging-image is a required flag, please specify the name of image to stage to")
+	if len(*harnessConfigFile) != 0 {
+		err := applyConfigFile(*harnessConfigFile)
+		if err != nil {
+			klog.Fatalf("Failed to apply config file: %v", err)
+		}
+	}
+
+	if *dryRun && *inProw {
+		klog.Fatal("Cannot set dry-run when running in Prow, it leases a Boskos project.")
+	}
+
+	if len(*artifactsGCSPath) != 0 {
+		if *inProw {
+			klog.Fatal("Cannot set artifacts-gcs-path when running in Prow, it uploads the ARTIFACTS directory itself.")
+		}
+		if !strings.HasPrefix(*artifactsGCSPath, "gs://") {
+			klog.Fatalf("artifacts-gcs-path must be a gs:// path, but is: %s", *artifactsGCSPath)
+		}
+		err := setupArtifactsDir()
+		if err != nil {
+			klog.Fatalf("Failed to set up the artifacts directory: %v", err)
+		}
+	}
+
+	if *runDriverE2E {
+		if !*inProw {
+			ensureVariable(driverE2EServiceAccount, true, "driver-e2e-service-account is required when running the driver e2e tests outside of Prow")
+		}
+		ensureVariable(deploymentStrat, false, "Cannot set the deployment strategy when running the driver e2e tests, they set up their own instances.")
+		err := withArtifactsUpload(runDriverE2ETests)
+		if err != nil {
+			klog.Fatalf("Failed to run driver e2e tests: %v", err)
+		}
+		return
 	}
 
-	ensureVariable(saFile, true, "service-account-file is a required flag")
-	ensureVariable(deployOverlayName, true, "deploy-overlay-name is a required flag")
-	ensureVariable(testFocus, true, "test-focus is a required flag")
-	ensureVariable(gceZone, true, "gce-zone is a required flag")
+	if *useGKEManagedDriver {
+		if *deploymentStrat != "gke" && *deploymentStrat != "existing" {
+			klog.Fatal("use-gke-managed-driver requires deployment strategy 'gke' or 'existing'.")
+		}
+		ensureVariable(deployOverlayName, false, "Cannot set deploy-overlay-name when using the GKE managed driver.")
+		for _, image := range sidecarImageFlags {
+			ensureVariable(image, false, "Cannot override sidecar images when using the GKE managed driver.")
+		}
+		// The managed driver is deployed by GKE
+		*doDriverBuild = false
+	} else {
+		if !*inProw {
+			ensureVariable(stagingImage, true, "staging-image is a required flag, please specify the name of image to stage to")
+		}
+		ensureVariable(saFile, true, "service-account-file is a required flag")
+		ensureVariable(deployOverlayName, true, "deploy-overlay-name is a required flag")
+	}
+	if *runSanity {
+		ensureVariable(sanityImage, true, "sanity-image is required when running csi-sanity")
+		ensureFlag(doDriverBuild, true, "Cannot run csi-sanity without building the driver, its image runs the controller service.")
+		ensureVariable(storageClassFile, false, "Cannot set storageclass-file when running csi-sanity.")
+		ensureFlag(migrationTest, false, "Cannot set migration-test when running csi-sanity.")
+		// The driver is tested on a single node
+		if *bringupCluster && *numNodes == 0 {
+			*numNodes = 1
+		}
+	} else {
+		ensureVariable(testFocus, true, "test-focus is a required flag")
+		if !*migrationTest {
+			ensureVariable(storageClassFile, true, "One of storageclass-file and migration-test must be set")
+			ensureVariable(migrationTestFocus, false, "migration-test-focus set but not running migration tests")
+		} else if len(*migrationTestFocus) == 0 {
+			*migrationTestFocus = *testFocus
+		}
+	}
+	if len(*gceZones) != 0 {
+		ensureVariable(gceZone, false, "gce-zone and gce-zones cannot both be set")
+		if !*bringupCluster {
+			klog.Fatal("gce-zones set but not bringing up new cluster")
+		}
+		// Spread the runs across the zones by starting at a random zone
+		rand.Seed(time.Now().UnixNano())
+		zones := strings.Split(*gceZones, ",")
+		start := rand.Intn(len(zones))
+		zones = append(zones[start:], zones[:start]...)
+		*gceZone, fallbackGCEZones = zones[0], zones[1:]
+	}
 
-	if *migrationTest {
-		ensureVariable(storageClassFile, false, "storage-class-file and migration-test cannot both be set")
+	if len(*gkeClusterRegion) != 0 {
+		ensureVariable(gceZone, false, "gce-zone and gke-cluster-region cannot both be set")
+		if *deploymentStrat != "gke" {
+			klog.Fatal("gke-cluster-region requires deployment strategy 'gke'")
+		}
 	} else {
-		ensureVariable(storageClassFile, true, "One of storageclass-file and migration-test must be set")
+		ensureVariable(gceZone, true, "One of gce-zone and gke-cluster-region must be set")
+	}
+
+	if len(*useKubeconfig) != 0 {
+		if len(*deploymentStrat) == 0 {
+			*deploymentStrat = "existing"
+		} else if *deploymentStrat != "existing" {
+			klog.Fatal("Cannot set use-kubeconfig when not using deployment strategy 'existing'.")
+		}
+	}
+
+	if *deploymentStrat == "existing" {
+		// The cluster is neither brought up nor torn down
+		*bringupCluster = false
+		*teardownCluster = false
+		ensureVariable(kubeVersion, false, "Cannot set kube-version when using deployment strategy 'existing'.")
+		if len(*localK8sDir) == 0 {
+			ensureVariable(testVersion, true, "Must set either test-version or local k8s dir when using deployment strategy 'existing'.")
+		}
 	}
 
 	if !*bringupCluster {
@@ -90,49 +249,170 @@ func main() {
 
 	if *bringupCluster || *teardownCluster {
 		ensureVariable(deploymentStrat, true, "Must set the deployment strategy if bringing up or down cluster.")
-	} else {
+	} else if *deploymentStrat != "existing" {
 		ensureVariable(deploymentStrat, false, "Cannot set the deployment strategy if not bringing up or down cluster.")
 	}
 
+	if *ginkgoProcs < 0 {
+		klog.Fatalf("ginkgo-procs must not be negative, but is: %d", *ginkgoProcs)
+	}
+
+	if *clusterUpRetries < 0 {
+		klog.Fatalf("cluster-up-retries must not be negative, but is: %d", *clusterUpRetries)
+	}
+
+	if *numNodes < 0 {
+		klog.Fatalf("num-nodes must not be negative, but is: %d", *numNodes)
+	}
+	if (*numNodes != 0 || len(*nodeMachineType) != 0) && !*bringupCluster {
+		klog.Fatal("num-nodes or node-machine-type set but not bringing up new cluster")
+	}
+
+	switch *arch {
+	case "amd64":
+	case "arm64":
+		if *bringupCluster {
+			if *deploymentStrat != "gke" {
+				klog.Fatal("Architecture 'arm64' requires deployment strategy 'gke' when bringing up the cluster.")
+			}
+			// GKE only has arm64 nodes on T2A machines
+			if len(*nodeMachineType) == 0 {
+				*nodeMachineType = "t2a-standard-4"
+			}
+		}
+		if *platform != "linux" {
+			klog.Fatal("Architecture 'arm64' is only supported on platform 'linux'.")
+		}
+	default:
+		klog.Fatalf("arch must be one of amd64 or arm64, but is: %s", *arch)
+	}
+
+	switch *platform {
+	case "linux":
+		if *nodeImageType == "windows" {
+			klog.Fatal("Cannot set node-image-type to 'windows' when testing platform 'linux'.")
+		}
+	case "windows":
+		if *deployOverlayName == autoOverlayName {
+			klog.Fatal("Cannot pick the overlay automatically when testing platform 'windows', set deploy-overlay-name to the Windows overlay.")
+		}
+		if *bringupCluster {
+			if *deploymentStrat != "gce" {
+				klog.Fatal("Platform 'windows' requires deployment strategy 'gce' when bringing up the cluster.")
+			}
+			if len(*nodeImageType) == 0 {
+				*nodeImageType = "windows"
+			} else if *nodeImageType != "windows" {
+				klog.Fatalf("Cannot set node-image-type to %s when testing platform 'windows'.", *nodeImageType)
+			}
+		}
+	default:
+		klog.Fatalf("platform must be one of linux or windows, but is: %s", *platform)
+	}
+
+	if len(*nodeImageType) != 0 {
+		if !*bringupCluster {
+			klog.Fatal("node-image-type set but not bringing up new cluster")
+		}
+		if _, ok := nodeImageTypes[*nodeImageType]; !ok {
+			klog.Fatalf("node-image-type must be one of cos_containerd, ubuntu_containerd or windows, but is: %s", *nodeImageType)
+		}
+		if *deploymentStrat == "gke" && *nodeImageType == "windows" {
+			klog.Fatal("Cannot set node-image-type to 'windows' when using deployment strategy 'gke'.")
+		}
+	}
+
+	if len(*gceNodeVersion) != 0 || len(*gkeNodeVersion) != 0 {
+		if !*bringupCluster {
+			klog.Fatal("gce-node-version or gke-node-version set but not bringing up new cluster")
+		}
+	}
+	if *deploymentStrat != "gce" {
+		ensureVariable(gceNodeVersion, false, "Cannot set gce-node-version when not using deployment strategy 'gce'.")
+	}
+
+	if *deploymentStrat != "gke" {
+		ensureVariable(gkeNodeVersion, false, "Cannot set gke-node-version when not using deployment strategy 'gke'.")
+		ensureVariable(gkeReleaseChan, false, "Cannot set gke-release-channel when not using deployment strategy 'gke'.")
+		ensureVariable(gkeEndpoint, false, "Cannot set gke-endpoint when not using deployment strategy 'gke'.")
+	}
+
 	if *deploymentStrat == "gke" {
 		ensureFlag(migrationTest, false, "Cannot set deployment strategy to 'gke' for migration tests.")
 		ensureVariable(kubeVersion, false, "Cannot set kube-version when using deployment strategy 'gke'. Use gke-cluster-version.")
-		ensureVariable(gkeClusterVer, true, "Must set gke-cluster-version when using deployment strategy 'gke'.")
+		if len(*gkeReleaseChan) != 0 {
+			ensureVariable(gkeClusterVer, false, "Cannot set both gke-cluster-version and gke-release-channel.")
+			switch *gkeReleaseChan {
+			case "rapid", "regular", "stable":
+			default:
+				klog.Fatalf("gke-release-channel must be one of rapid, regular or stable, but is: %s", *gkeReleaseChan)
+			}
+		} else {
+			ensureVariable(gkeClusterVer, true, "Must set one of gke-cluster-version and gke-release-channel when using deployment strategy 'gke'.")
+		}
 		ensureVariable(kubeFeatureGates, false, "Cannot set feature gates when using deployment strategy 'gke'.")
 		if len(*localK8sDir) == 0 {
 			ensureVariable(testVersion, true, "Must set either test-version or local k8s dir when using deployment strategy 'gke'.")
 		}
 	}
 
+	if *useKubeRelease {
+		if *kubeVersion == "master" || *testVersion == "master" {
+			klog.Fatal("Cannot use-kube-release with version master, it has no release artifacts.")
+		}
+		ensureVariable(localK8sDir, false, "Cannot use-kube-release when using a local k8s dir.")
+	}
+
 	if len(*localK8sDir) != 0 {
 		ensureVariable(kubeVersion, false, "Cannot set a kube version when using a local k8s dir.")
 		ensureVariable(testVersion, false, "Cannot set a test version when using a local k8s dir.")
 	}
 
-	err := handle()
+	err := withArtifactsUpload(handle)
 	if err != nil {
 		klog.Fatalf("Failed to run integration test: %v", err)
 	}
 }
 
-func handle() error {
+func handle() (handleErr error) {
 	oldmask := syscall.Umask(0000)
 	defer syscall.Umask(oldmask)
 
 	stagingVersion := string(uuid.NewUUID())
 
-	goPath, ok := os.LookupEnv("GOPATH")
-	if !ok {
-		return fmt.Errorf("Could not find env variable GOPATH")
+	pkgDir, err := getPkgDir()
+	if err != nil {
+		return err
+	}
+
+	// gcloud and the kubetest2 GKE deployer, which runs gcloud, manage the
+	// cluster through the endpoint
+	if len(*gkeEndpoint) != 0 {
+		err := os.Setenv("CLOUDSDK_API_ENDPOINT_OVERRIDES_CONTAINER", *gkeEndpoint)
+		if err != nil {
+			return err
+		}
 	}
 
-	pkgDir := filepath.Join(goPath, "src", "sigs.k8s.io", "gcp-compute-persistent-disk-csi-driver")
+	// kubectl, the driver deployment and the tests all use the kubeconfig
+	if len(*useKubeconfig) != 0 {
+		kubeconfig, err := filepath.Abs(*useKubeconfig)
+		if err != nil {
+			return err
+		}
+		err = os.Setenv("KUBECONFIG", kubeconfig)
+		if err != nil {
+			return err
+		}
+	}
 
 	// If running in Prow, then acquire and set up a project through Boskos
 	if *inProw {
 		project, _ := testutils.SetupProwConfig(*boskosResourceType)
+		// Return the project to the pool after everything else is torn down
+		defer testutils.ReleaseProwConfig(project)
 
-		oldProject, err := exec.Command("gcloud", "config", "get-value", "project").CombinedOutput()
+		oldProject, err := combinedOutput(exec.Command("gcloud", "config", "get-value", "project"))
 		if err != nil {
 			return fmt.Errorf("failed to get gcloud project: %s, err: %v", oldProject, err)
 		}
@@ -148,6 +428,18 @@ func handle() error {
 			}
 		}()
 
+		// Look for leaked resources in the project after the cluster teardown,
+		// which is deferred later
+		if *teardownCluster {
+			runStart := time.Now()
+			defer func() {
+				leakErr := cleanupLeakedResources(runStart)
+				if leakErr != nil && handleErr == nil {
+					handleErr = leakErr
+				}
+			}()
+		}
+
 		if *doDriverBuild {
 			*stagingImage = fmt.Sprintf("gcr.io/%s/gcp-persistent-disk-csi-driver", project)
 		}
@@ -186,7 +478,12 @@ func handle() error {
 
 	// If kube version is set, then download and build Kubernetes for cluster creation
 	// Otherwise, either GKE or a prebuild local K8s dir is being used
-	if len(*kubeVersion) != 0 {
+	if len(*kubeVersion) != 0 && *useKubeRelease {
+		err := downloadKubernetesRelease(k8sParentDir, *kubeVersion)
+		if err != nil {
+			return fmt.Errorf("failed to download Kubernetes release: %v", err)
+		}
+	} else if len(*kubeVersion) != 0 {
 		err := downloadKubernetesSource(pkgDir, k8sParentDir, *kubeVersion)
 		if err != nil {
 			return fmt.Errorf("failed to download Kubernetes source: %v", err)
@@ -201,7 +498,12 @@ func handle() error {
 
 	// If test version is set, then download and build Kubernetes to run K8s tests
 	// Otherwise, either kube version is set (which implies GCE) or a local K8s dir is being used
-	if len(*testVersion) != 0 && *testVersion != *kubeVersion {
+	if len(*testVersion) != 0 && *testVersion != *kubeVersion && *useKubeRelease {
+		err := downloadKubernetesRelease(testParentDir, *testVersion)
+		if err != nil {
+			return fmt.Errorf("failed to download Kubernetes release: %v", err)
+		}
+	} else if len(*testVersion) != 0 && *testVersion != *kubeVersion {
 		err := downloadKubernetesSource(pkgDir, testParentDir, *testVersion)
 		if err != nil {
 			return fmt.Errorf("failed to download Kubernetes source: %v", err)
@@ -214,63 +516,104 @@ func handle() error {
 		testDir = k8sDir
 	}
 
+	// Defer the tear down of the cluster through GKE or GCE. It is deferred
+	// before the bringup so failed or timed out bringups are torn down too.
+	if *teardownCluster {
+		defer func() {
+			err := clusterDown(k8sDir)
+			if err != nil {
+				klog.Errorf("failed to cluster down: %v", err)
+			}
+		}()
+	}
+
 	// Create a cluster either through GKE or GCE
 	if *bringupCluster {
-		var err error = nil
-		switch *deploymentStrat {
-		case "gce":
-			err = clusterUpGCE(k8sDir, *gceZone)
-		case "gke":
-			err = clusterUpGKE(*gceZone)
-		default:
-			err = fmt.Errorf("deployment-strategy must be set to 'gce' or 'gke', but is: %s", *deploymentStrat)
-		}
+		err := clusterUp(k8sDir)
 		if err != nil {
 			return fmt.Errorf("failed to cluster up: %v", err)
 		}
 	}
 
-	// Defer the tear down of the cluster through GKE or GCE
-	if *teardownCluster {
-		defer func() {
-			switch *deploymentStrat {
-			case "gce":
-				err := clusterDownGCE(k8sDir)
-				if err != nil {
-					klog.Errorf("failed to cluster down: %v", err)
-				}
-			case "gke":
-				err := clusterDownGKE(*gceZone)
-				if err != nil {
-					klog.Errorf("failed to cluster down: %v", err)
-				}
-			default:
-				klog.Errorf("deployment-strategy must be set to 'gce' or 'gke', but is: %s", *deploymentStrat)
+	namespace, podSelector := driverNamespace, driverPodSelector
+	if *useGKEManagedDriver {
+		// Enable the managed driver on new clusters and wait for it to be
+		// registered. It is torn down with the cluster.
+		if *bringupCluster {
+			err = enableGKEManagedDriver(*gceZone, *gkeClusterRegion)
+			if err != nil {
+				return fmt.Errorf("failed to enable GKE managed driver: %v", err)
 			}
-		}()
-	}
-
-	// Install the driver and defer its teardown
-	err := installDriver(goPath, pkgDir, *stagingImage, stagingVersion, *deployOverlayName, *doDriverBuild)
-	if *teardownDriver {
-		defer func() {
-			// TODO (#140): collect driver logs
-			if teardownErr := deleteDriver(goPath, pkgDir, *deployOverlayName); teardownErr != nil {
-				klog.Errorf("failed to delete driver: %v", teardownErr)
+		}
+		namespace, podSelector = managedDriverNamespace, managedDriverPodSelector
+		err = waitForGKEManagedDriver()
+	} else {
+		overlayName := *deployOverlayName
+		if overlayName == autoOverlayName {
+			overlayName, err = pickOverlay()
+			if err != nil {
+				return fmt.Errorf("failed to pick overlay: %v", err)
 			}
-		}()
+		}
+		// Install the driver and defer its teardown
+		err = installDriver(pkgDir, *stagingImage, stagingVersion, overlayName, *doDriverBuild)
+		if *teardownDriver {
+			defer func() {
+				if teardownErr := deleteDriver(pkgDir, overlayName); teardownErr != nil {
+					klog.Errorf("failed to delete driver: %v", teardownErr)
+				}
+			}()
+		}
 	}
+	// Collect the driver logs and the cluster state before the driver is
+	// torn down if installing the driver or the tests failed
+	defer func() {
+		if err != nil {
+			collectDriverLogs(namespace, podSelector)
+			collectClusterState()
+		}
+	}()
 	if err != nil {
 		return fmt.Errorf("failed to install CSI Driver: %v", err)
 	}
 
+	// Install the snapshot controller for the snapshot tests and defer its
+	// teardown with the driver's
+	if len(*snapshotClassFile) != 0 {
+		err = installSnapshotController()
+		if *teardownDriver {
+			defer func() {
+				if teardownErr := deleteSnapshotController(); teardownErr != nil {
+					klog.Errorf("failed to delete snapshot controller: %v", teardownErr)
+				}
+			}()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to install snapshot controller: %v", err)
+		}
+	}
+
 	// Run the tests using the testDir kubernetes
-	if len(*storageClassFile) != 0 {
-		err = runCSITests(pkgDir, testDir, *testFocus, *storageClassFile, *gceZone)
-	} else if *migrationTest {
-		err = runMigrationTests(pkgDir, testDir, *testFocus, *gceZone)
+	if *runSanity {
+		err = runSanityTests(pkgDir, *sanityImage, fmt.Sprintf("%s:%s", *stagingImage, stagingVersion))
 	} else {
-		return fmt.Errorf("Did not run either CSI or Migration test")
+		// The CSI tests run first and the migration tests after them on the
+		// same cluster. The migration feature gates of the cluster don't
+		// affect the CSI tests, which don't use the in-tree plugin.
+		var csiErr, migrationErr error
+		if len(*storageClassFile) != 0 {
+			csiErr = runCSITestsForStorageClasses(pkgDir, testDir, *testFocus, strings.Split(*storageClassFile, ","), *snapshotClassFile, *gceZone, *gkeClusterRegion)
+		}
+		if *migrationTest {
+			migrationErr = runMigrationTests(pkgDir, testDir, *migrationTestFocus, *gceZone, *gkeClusterRegion)
+		}
+		if csiErr != nil && migrationErr != nil {
+			err = fmt.Errorf("CSI tests failed: %v, migration tests failed: %v", csiErr, migrationErr)
+		} else if csiErr != nil {
+			err = csiErr
+		} else {
+			err = migrationErr
+		}
 	}
 
 	if err != nil {
@@ -281,7 +624,7 @@ func handle() error {
 }
 
 func setEnvProject(project string) error {
-	out, err := exec.Command("gcloud", "config", "set", "project", project).CombinedOutput()
+	out, err := combinedOutput(exec.Command("gcloud", "config", "set", "project", project))
 	if err != nil {
 		return fmt.Errorf("failed to set gcloud project to %s: %s, err: %v", project, out, err)
 	}
@@ -293,49 +636,118 @@ func setEnvProject(project string) error {
 	return nil
 }
 
-func runMigrationTests(pkgDir, k8sDir, testFocus, gceZone string) error {
-	return runTestsWithConfig(pkgDir, k8sDir, gceZone, testFocus, "-storage.migratedPlugins=kubernetes.io/gce-pd")
+func runMigrationTests(pkgDir, k8sDir, testFocus, gceZone, gceRegion string) error {
+	err := runTestsWithConfig(pkgDir, k8sDir, gceZone, gceRegion, testFocus, "-storage.migratedPlugins=kubernetes.io/gce-pd", "migration")
+	mergeErr := mergeJUnitReports(os.Getenv("ARTIFACTS"), "migration", false)
+	if mergeErr != nil {
+		klog.Errorf("failed to merge junit reports: %v", mergeErr)
+	}
+	return err
 }
 
-func runCSITests(pkgDir, k8sDir, testFocus, storageClassFile, gceZone string) error {
-	testDriverConfigFile, err := generateDriverConfigFile(pkgDir, storageClassFile)
+// runCSITestsForStorageClasses runs the tests once per storageclass against
+// the same cluster. All storageclasses are tested even if some fail.
+func runCSITestsForStorageClasses(pkgDir, k8sDir, testFocus string, storageClassFiles []string, snapshotClassFile, gceZone, gceRegion string) error {
+	failed := []string{}
+	for _, storageClassFile := range storageClassFiles {
+		// The reports of the runs must not overwrite each other. The tests
+		// are only named after the storageclass if there are several, to
+		// keep the history of the tests of single storageclass jobs.
+		reportPrefix := strings.TrimSuffix(storageClassFile, filepath.Ext(storageClassFile))
+		err := runCSITests(pkgDir, k8sDir, testFocus, storageClassFile, snapshotClassFile, gceZone, gceRegion, reportPrefix)
+		mergeErr := mergeJUnitReports(os.Getenv("ARTIFACTS"), reportPrefix, len(storageClassFiles) > 1)
+		if mergeErr != nil {
+			klog.Errorf("failed to merge junit reports of storageclass %s: %v", storageClassFile, mergeErr)
+		}
+		if err != nil {
+			klog.Errorf("Tests with storageclass %s failed: %v", storageClassFile, err)
+			failed = append(failed, storageClassFile)
+		}
+	}
+	if len(failed) != 0 {
+		return fmt.Errorf("tests failed for storageclasses: %v", failed)
+	}
+	return nil
+}
+
+func runCSITests(pkgDir, k8sDir, testFocus, storageClassFile, snapshotClassFile, gceZone, gceRegion, reportPrefix string) error {
+	testDriverConfigFile, err := generateDriverConfigFile(pkgDir, storageClassFile, snapshotClassFile)
 	if err != nil {
 		return err
 	}
 	testConfigArg := fmt.Sprintf("-storage.testdriver=%s", testDriverConfigFile)
-	return runTestsWithConfig(pkgDir, k8sDir, gceZone, testFocus, testConfigArg)
+	return runTestsWithConfig(pkgDir, k8sDir, gceZone, gceRegion, testFocus, testConfigArg, reportPrefix)
 }
 
-func runTestsWithConfig(pkgDir, k8sDir, gceZone, testFocus, testConfigArg string) error {
+func runTestsWithConfig(pkgDir, k8sDir, gceZone, gceRegion, testFocus, testConfigArg, reportPrefix string) error {
 	err := os.Chdir(k8sDir)
 	if err != nil {
 		return err
 	}
 
-	homeDir, _ := os.LookupEnv("HOME")
-	os.Setenv("KUBECONFIG", filepath.Join(homeDir, ".kube/config"))
+	if len(*useKubeconfig) == 0 {
+		homeDir, _ := os.LookupEnv("HOME")
+		os.Setenv("KUBECONFIG", filepath.Join(homeDir, ".kube/config"))
+	}
 
 	artifactsDir, _ := os.LookupEnv("ARTIFACTS")
 	reportArg := fmt.Sprintf("-report-dir=%s", artifactsDir)
 
 	testFocusArg := fmt.Sprintf("-focus=%s", testFocus)
 
-	cmd := exec.Command(filepath.Join(k8sBuildBinDir, "ginkgo"),
-		"-p",
+	// Regional clusters span the zones of the region
+	locationArgs := []string{fmt.Sprintf("-gce-zone=%s", gceZone)}
+	if len(gceRegion) != 0 {
+		locationArgs = []string{fmt.Sprintf("-gce-region=%s", gceRegion), "-gce-multizone=true"}
+	}
+
+	skip := *testSkip
+	nodeOSDistro := getNodeOSDistro(*nodeImageType)
+	if *platform == "windows" {
+		skip = joinSkip(skip, "\\[LinuxOnly\\]")
+		nodeOSDistro = "windows"
+	}
+
+	// Ginkgo picks the parallelism with -p
+	parallelismArg := "-p"
+	if *ginkgoProcs != 0 {
+		parallelismArg = fmt.Sprintf("-nodes=%d", *ginkgoProcs)
+	}
+
+	args := []string{
+		parallelismArg,
 		testFocusArg,
-		"-skip=\\[Disruptive\\]|\\[Serial\\]|\\[Feature:.+\\]",
+	}
+	if len(skip) != 0 {
+		args = append(args, fmt.Sprintf("-skip=%s", skip))
+	}
+	args = append(args,
 		filepath.Join(k8sBuildBinDir, "e2e.test"),
 		"--",
 		reportArg,
 		"-provider=gce",
-		"-node-os-distro=cos",
-		fmt.Sprintf("-gce-zone=%s", gceZone),
-		testConfigArg)
+		fmt.Sprintf("-node-os-distro=%s", nodeOSDistro),
+	)
+	if len(reportPrefix) != 0 {
+		// Separate the prefix from the ginkgo node of the report names
+		args = append(args, fmt.Sprintf("-report-prefix=%s_", reportPrefix))
+	}
+	args = append(args, locationArgs...)
+	args = append(args, testConfigArg)
+	cmd := exec.Command(filepath.Join(k8sBuildBinDir, "ginkgo"), args...)
 
-	err = runCommand("Running Tests", cmd)
+	err = runCommandWithTimeout("Running Tests", cmd, *stepTimeout)
 	if err != nil {
 		return fmt.Errorf("failed to run tests on e2e cluster: %v", err)
 	}
 
 	return nil
 }
+
+// joinSkip adds the pattern to the skip regex of the tests
+func joinSkip(skip, pattern string) string {
+	if len(skip) == 0 {
+		return pattern
+	}
+	return skip + "|" + pattern
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	sanityPodTemplateFile = "sanity-pod-template.in"
+	sanityPodFile         = "sanity-pod.yaml"
+	sanityPodName         = "csi-sanity"
+	sanityContainerName   = "csi-sanity"
+	// Directory of the node socket of the deployed driver
+	nodePluginDir = "/var/lib/kubelet/plugins/pd.csi.storage.gke.io"
+)
+
+type sanityPodConfig struct {
+	PodName     string
+	NodeName    string
+	SanityImage string
+	DriverImage string
+	PluginDir   string
+}
+
+// runSanityTests runs csi-sanity in a pod against the node service of the
+// driver deployed to a node. The node service only serves node RPCs, so the
+// pod also runs a controller service of the driver image. The sanity output
+// is written to the ARTIFACTS directory.
+func runSanityTests(pkgDir, sanityImage, driverImage string) error {
+	out, err := combinedOutput(exec.Command("kubectl", "get", "pods", "-n", driverNamespace, "-l", driverPodSelector, "-o", "jsonpath={.items[*].spec.nodeName}"))
+	if err != nil {
+		return fmt.Errorf("failed to get nodes of driver pods: %s, err: %v", out, err)
+	}
+	nodes := strings.Fields(string(out))
+	if *dryRun {
+		nodes = []string{"NODE"}
+	}
+	if len(nodes) == 0 {
+		return fmt.Errorf("no driver pods found")
+	}
+
+	podFile, err := generateSanityPodFile(pkgDir, sanityPodConfig{
+		PodName:     sanityPodName,
+		NodeName:    nodes[0],
+		SanityImage: sanityImage,
+		DriverImage: driverImage,
+		PluginDir:   nodePluginDir,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to generate sanity pod: %v", err)
+	}
+	err = runCommand("Creating sanity pod", exec.Command("kubectl", "apply", "-n", driverNamespace, "-f", podFile))
+	if err != nil {
+		return fmt.Errorf("failed to create sanity pod: %v", err)
+	}
+	defer func() {
+		err := runCommand("Deleting sanity pod", exec.Command("kubectl", "delete", "pod", sanityPodName, "-n", driverNamespace, "--ignore-not-found"))
+		if err != nil {
+			klog.Errorf("failed to delete sanity pod: %v", err)
+		}
+	}()
+
+	exitCode, err := waitForSanityContainer()
+	writeSanityLogs()
+	if err != nil {
+		return err
+	}
+	if exitCode != "0" {
+		return fmt.Errorf("csi-sanity failed with exit code %s", exitCode)
+	}
+	return nil
+}
+
+// waitForSanityContainer waits until csi-sanity exits, the controller service
+// of the pod keeps running, and returns its exit code
+func waitForSanityContainer() (string, error) {
+	jsonPath := fmt.Sprintf("jsonpath={.status.containerStatuses[?(@.name==\"%s\")].state.terminated.exitCode}", sanityContainerName)
+	if *dryRun {
+		return "0", nil
+	}
+	timeout := *stepTimeout
+	if timeout == 0 {
+		timeout = time.Hour
+	}
+	for start := time.Now(); time.Since(start) < timeout; time.Sleep(10 * time.Second) {
+		out, err := combinedOutput(exec.Command("kubectl", "get", "pod", sanityPodName, "-n", driverNamespace, "-o", jsonPath))
+		if err != nil {
+			klog.Warningf("failed to get sanity pod status: %s, err: %v", out, err)
+			continue
+		}
+		if exitCode := strings.TrimSpace(string(out)); len(exitCode) != 0 {
+			return exitCode, nil
+		}
+	}
+	return "", fmt.Errorf("csi-sanity did not finish within %v", timeout)
+}
+
+func writeSanityLogs() {
+	artifactsDir, ok := os.LookupEnv("ARTIFACTS")
+	if !ok {
+		artifactsDir = generateUniqueTmpDir()
+	}
+	for _, container := range []string{sanityContainerName, "gce-pd-driver"} {
+		file := filepath.Join(artifactsDir, fmt.Sprintf("sanity-%s.log", container))
+		writeCommandOutput(file, "kubectl", "logs", sanityPodName, "-n", driverNamespace, "-c", container)
+	}
+	klog.Infof("Collected sanity logs in %s", artifactsDir)
+}
+
+func generateSanityPodFile(pkgDir string, config sanityPodConfig) (string, error) {
+	t, err := template.ParseFiles(filepath.Join(pkgDir, testConfigDir, sanityPodTemplateFile))
+	if err != nil {
+		return "", err
+	}
+	podFilePath := filepath.Join(pkgDir, testConfigDir, sanityPodFile)
+	f, err := os.Create(podFilePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	err = t.Execute(f, config)
+	if err != nil {
+		return "", err
+	}
+	return podFilePath, nil
+}
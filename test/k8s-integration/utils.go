@@ -5,28 +5,128 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"k8s.io/klog"
 )
 
+// combinedOutput runs the command and returns its combined output. In dry-run
+// mode the command is only printed and has no output.
+func combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	if *dryRun {
+		printDryRunCommand(cmd)
+		return nil, nil
+	}
+	return cmd.CombinedOutput()
+}
+
+// printDryRunCommand prints the command with its directory and the
+// environment set by the test, which the command would run with
+func printDryRunCommand(cmd *exec.Cmd) {
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	setEnv := []string{}
+	for _, e := range env {
+		if !initialEnv[e] {
+			setEnv = append(setEnv, e)
+		}
+	}
+	line := strings.Join(cmd.Args, " ")
+	if len(setEnv) != 0 {
+		line = strings.Join(setEnv, " ") + " " + line
+	}
+	if len(cmd.Dir) != 0 {
+		line = fmt.Sprintf("(cd %s && %s)", cmd.Dir, line)
+	}
+	fmt.Printf("[dry-run] %s\n", line)
+}
+
 func runCommand(action string, cmd *exec.Cmd) error {
-	cmd.Stdout = os.Stdout
+	return runCommandWithTimeout(action, cmd, 0)
+}
+
+// runCommandWithTimeout runs the command, interrupting it and its children if
+// it does not finish within the timeout so they can still write their reports.
+// They are killed if they do not exit within the timeout grace period.
+// There is no timeout if it is 0.
+func runCommandWithTimeout(action string, cmd *exec.Cmd, timeout time.Duration) error {
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
 	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if timeout != 0 {
+		// The children are signaled through the process group
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
 
 	fmt.Printf("%s\n", action)
+	if *dryRun {
+		printDryRunCommand(cmd)
+		return nil
+	}
 	fmt.Printf("%s\n", cmd.Args)
 
 	err := cmd.Start()
 	if err != nil {
 		return err
 	}
+	if timeout == 0 {
+		return cmd.Wait()
+	}
 
-	err = cmd.Wait()
-	if err != nil {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	select {
+	case err = <-done:
 		return err
+	case <-time.After(timeout):
+	}
+
+	klog.Errorf("%s timed out after %v, interrupting %v", action, timeout, cmd.Args)
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+	select {
+	case <-done:
+	case <-time.After(timeoutGracePeriod):
+		klog.Errorf("%v did not exit within %v, killing it", cmd.Args, timeoutGracePeriod)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+	}
+	return fmt.Errorf("%s timed out after %v", action, timeout)
+}
+
+// getPkgDir returns the directory of the driver repository: the pkg-dir flag,
+// the repository in GOPATH or the repository the test was built from
+func getPkgDir() (string, error) {
+	if len(*pkgDirFlag) != 0 {
+		return filepath.Abs(*pkgDirFlag)
+	}
+	if goPath, ok := os.LookupEnv("GOPATH"); ok {
+		dir := filepath.Join(goPath, "src", "sigs.k8s.io", "gcp-compute-persistent-disk-csi-driver")
+		if _, err := os.Stat(dir); err == nil {
+			return dir, nil
+		}
+	}
+	// This file is test/k8s-integration/utils.go of the repository
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		return "", fmt.Errorf("could not find the driver repository, set pkg-dir")
+	}
+	dir := filepath.Dir(filepath.Dir(filepath.Dir(file)))
+	if _, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("could not find the driver repository, set pkg-dir: %v", err)
 	}
-	return nil
+	return dir, nil
 }
 
 func generateUniqueTmpDir() string {
@@ -64,7 +164,7 @@ func shredFile(filePath string) {
 		return
 	}
 	klog.V(4).Infof("Shredding file %v", filePath)
-	out, err := exec.Command("shred", "--remove", filePath).CombinedOutput()
+	out, err := combinedOutput(exec.Command("shred", "--remove", filePath))
 	if err != nil {
 		klog.V(4).Infof("Failed to shred file %v: %v\nOutput:%v", filePath, err, out)
 	}
@@ -100,14 +100,30 @@ func (c *CsiClient) CloseConn() error {
 }
 
 func (c *CsiClient) CreateVolume(volName string, params map[string]string, sizeInGb int64, topReq *csipb.TopologyRequirement) (string, error) {
+	return c.createVolume(volName, params, sizeInGb, topReq, nil)
+}
+
+func (c *CsiClient) CreateVolumeFromSnapshot(volName, snapshotID string, params map[string]string, sizeInGb int64, topReq *csipb.TopologyRequirement) (string, error) {
+	content := &csipb.VolumeContentSource{
+		Type: &csipb.VolumeContentSource_Snapshot{
+			Snapshot: &csipb.VolumeContentSource_SnapshotSource{
+				SnapshotId: snapshotID,
+			},
+		},
+	}
+	return c.createVolume(volName, params, sizeInGb, topReq, content)
+}
+
+func (c *CsiClient) createVolume(volName string, params map[string]string, sizeInGb int64, topReq *csipb.TopologyRequirement, content *csipb.VolumeContentSource) (string, error) {
 	capRange := &csipb.CapacityRange{
 		RequiredBytes: common.GbToBytes(sizeInGb),
 	}
 	cvr := &csipb.CreateVolumeRequest{
-		Name:               volName,
-		VolumeCapabilities: stdVolCaps,
-		Parameters:         params,
-		CapacityRange:      capRange,
+		Name:                volName,
+		VolumeCapabilities:  stdVolCaps,
+		Parameters:          params,
+		CapacityRange:       capRange,
+		VolumeContentSource: content,
 	}
 	if topReq != nil {
 		cvr.AccessibilityRequirements = topReq
@@ -17,7 +17,9 @@ limitations under the License.
 package remote
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -40,6 +42,11 @@ const (
 	defaultMachine      = "n1-standard-1"
 	defaultFirewallRule = "default-allow-ssh"
 
+	defaultImageURL = "projects/debian-cloud/global/images/family/debian-9"
+	// Image of the instances whose PDs are NVMe devices, which needs a more
+	// recent kernel and guest environment
+	nvmeImageURL = "projects/debian-cloud/global/images/family/debian-12"
+
 	// timestampFormat is the timestamp format used in the e2e directory name.
 	timestampFormat = "20060102T150405"
 )
@@ -77,10 +84,38 @@ func CreateInstanceInfo(project, instanceZone, name string, cs *compute.Service)
 	}, nil
 }
 
+// InstanceConfig contains the parameters of the GCE Instances created for E2E
+// testing
+type InstanceConfig struct {
+	// Service account the instance is brought up with
+	ServiceAccount string
+	// Machine type of the instance, n1-standard-1 if unset. The PDs of the
+	// machine families in nvmeMachineFamilies are NVMe devices.
+	MachineType string
+	// Whether the instance is a Confidential VM, whose PDs are NVMe devices.
+	// The machine type must be of a family supporting it, e.g. n2d.
+	ConfidentialCompute bool
+}
+
+// nvmeMachineFamilies are the machine families whose PDs are only available
+// as NVMe devices. Their instances also need the gVNIC network interface.
+var nvmeMachineFamilies = []string{"c3", "c3d", "c4", "n4", "m3"}
+
+// usesNVMe returns whether the PDs of the instance are NVMe devices, and
+// whether the instance needs the gVNIC network interface
+func (c *InstanceConfig) usesNVMe() (nvme bool, gvnic bool) {
+	family := strings.Split(c.MachineType, "-")[0]
+	for _, f := range nvmeMachineFamilies {
+		if family == f {
+			return true, true
+		}
+	}
+	return c.ConfidentialCompute, false
+}
+
 // Provision a gce instance using image
-func (i *InstanceInfo) CreateOrGetInstance(serviceAccount string) error {
+func (i *InstanceInfo) CreateOrGetInstance(config *InstanceConfig) error {
 	var err error
-	var instance *compute.Instance
 	klog.V(4).Infof("Creating instance: %v", i.name)
 
 	myuuid := string(uuid.NewUUID())
@@ -90,10 +125,14 @@ func (i *InstanceInfo) CreateOrGetInstance(serviceAccount string) error {
 		return fmt.Errorf("Failed to create firewall rule: %v", err)
 	}
 
-	imageURL := "projects/debian-cloud/global/images/family/debian-9"
+	imageURL := defaultImageURL
+	nvme, gvnic := config.usesNVMe()
+	if nvme {
+		imageURL = nvmeImageURL
+	}
 	inst := &compute.Instance{
 		Name:        i.name,
-		MachineType: machineType(i.zone, ""),
+		MachineType: machineType(i.zone, config.MachineType),
 		NetworkInterfaces: []*compute.NetworkInterface{
 			{
 				AccessConfigs: []*compute.AccessConfig{
@@ -116,8 +155,20 @@ func (i *InstanceInfo) CreateOrGetInstance(serviceAccount string) error {
 		},
 	}
 
+	// The vendored API client does not support the fields for gVNIC and
+	// Confidential VMs
+	extraFields := map[string]interface{}{}
+	if gvnic {
+		extraFields["nicType"] = "GVNIC"
+	}
+	if config.ConfidentialCompute {
+		extraFields["confidentialInstanceConfig"] = map[string]interface{}{"enableConfidentialCompute": true}
+		// Confidential VMs cannot live migrate
+		inst.Scheduling = &compute.Scheduling{OnHostMaintenance: "TERMINATE"}
+	}
+
 	saObj := &compute.ServiceAccount{
-		Email:  serviceAccount,
+		Email:  config.ServiceAccount,
 		Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
 	}
 	inst.ServiceAccounts = []*compute.ServiceAccount{saObj}
@@ -132,7 +183,7 @@ func (i *InstanceInfo) CreateOrGetInstance(serviceAccount string) error {
 	}
 
 	if _, err := i.computeService.Instances.Get(i.project, i.zone, inst.Name).Do(); err != nil {
-		op, err := i.computeService.Instances.Insert(i.project, i.zone, inst).Do()
+		op, err := i.insertInstance(inst, extraFields)
 		klog.V(4).Infof("Inserted instance %v in project: %v, zone: %v", inst.Name, i.project, i.zone)
 		if err != nil {
 			ret := fmt.Sprintf("could not create instance %s: API error: %v", i.name, err)
@@ -147,11 +198,35 @@ func (i *InstanceInfo) CreateOrGetInstance(serviceAccount string) error {
 		klog.V(4).Infof("Compute service GOT instance %v, skipping instance creation", inst.Name)
 	}
 
+	err = i.waitForInstanceUp()
+	// If instance didn't reach running state in time, return with error now.
+	if err != nil {
+		return err
+	}
+
+	// Instance reached running state in time, make sure that cloud-init is complete
+	klog.V(2).Infof("Instance %v has been created successfully", i.name)
+	return nil
+}
+
+// GetExistingInstance waits for the existing instance to be available by SSH,
+// without creating it or changing it
+func (i *InstanceInfo) GetExistingInstance() error {
+	klog.V(4).Infof("Getting existing instance: %v", i.name)
+	if _, err := i.computeService.Instances.Get(i.project, i.zone, i.name).Do(); err != nil {
+		return fmt.Errorf("could not get instance %s: %v", i.name, err)
+	}
+	return i.waitForInstanceUp()
+}
+
+// waitForInstanceUp waits for the instance to be RUNNING and available by SSH
+// and fills in its external IP
+func (i *InstanceInfo) waitForInstanceUp() error {
 	then := time.Now()
-	err = wait.Poll(15*time.Second, 5*time.Minute, func() (bool, error) {
+	return wait.Poll(15*time.Second, 5*time.Minute, func() (bool, error) {
 		klog.V(2).Infof("Waiting for instance %v to come up. %v elapsed", i.name, time.Since(then))
 
-		instance, err = i.computeService.Instances.Get(i.project, i.zone, i.name).Do()
+		instance, err := i.computeService.Instances.Get(i.project, i.zone, i.name).Do()
 		if err != nil {
 			klog.Errorf("Failed to get instance %v: %v", i.name, err)
 			return false, nil
@@ -175,15 +250,65 @@ func (i *InstanceInfo) CreateOrGetInstance(serviceAccount string) error {
 		klog.V(4).Infof("Instance %v in state RUNNING and available by SSH", i.name)
 		return true, nil
 	})
+}
 
-	// If instance didn't reach running state in time, return with error now.
+// insertInstance inserts the instance with the extra fields. The nicType
+// field is set on the network interface of the instance, the other fields on
+// the instance.
+func (i *InstanceInfo) insertInstance(inst *compute.Instance, extraFields map[string]interface{}) (*compute.Operation, error) {
+	if len(extraFields) == 0 {
+		return i.computeService.Instances.Insert(i.project, i.zone, inst).Do()
+	}
+	instJSON, err := json.Marshal(inst)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(instJSON, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range extraFields {
+		if k == "nicType" {
+			for _, ni := range fields["networkInterfaces"].([]interface{}) {
+				ni.(map[string]interface{})[k] = v
+			}
+			continue
+		}
+		fields[k] = v
+	}
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
 	}
 
-	// Instance reached running state in time, make sure that cloud-init is complete
-	klog.V(2).Infof("Instance %v has been created successfully", i.name)
-	return nil
+	client, err := google.DefaultClient(context.Background(), compute.ComputeScope)
+	if err != nil {
+		return nil, err
+	}
+	url := i.computeService.BasePath + fmt.Sprintf("%s/zones/%s/instances", i.project, i.zone)
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer googleapi.CloseBody(resp)
+	if err := googleapi.CheckResponse(resp); err != nil {
+		return nil, err
+	}
+	op := &compute.Operation{}
+	if err := json.NewDecoder(resp.Body).Decode(op); err != nil {
+		return nil, fmt.Errorf("failed to decode insert instance operation: %v", err)
+	}
+	return op, nil
+}
+
+// GetSerialPortOutput returns the output of the serial console of the
+// instance, which holds the boot and kernel logs
+func (i *InstanceInfo) GetSerialPortOutput() (string, error) {
+	output, err := i.computeService.Instances.GetSerialPortOutput(i.project, i.zone, i.name).Do()
+	if err != nil {
+		return "", err
+	}
+	return output.Contents, nil
 }
 
 func (i *InstanceInfo) DeleteInstance() {
@@ -57,6 +57,12 @@ func (i *InstanceInfo) UploadAndRun(archivePath, remoteWorkspace, driverRunCmd s
 		return -1, fmt.Errorf("failed to extract test archive: %v, output: %q", err, output)
 	}
 
+	return i.runDriver(remoteWorkspace, driverRunCmd)
+}
+
+// runDriver starts the driver of the workspace on the instance and returns
+// its PID
+func (i *InstanceInfo) runDriver(remoteWorkspace, driverRunCmd string) (int, error) {
 	klog.V(4).Infof("Starting driver on %q", i.name)
 	// When the process is killed the driver should close the TCP endpoint, then we want to download the logs
 	output, err := i.SSH(driverRunCmd)
@@ -18,10 +18,16 @@ package remote
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	compute "google.golang.org/api/compute/v1"
 	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 )
 
@@ -31,6 +37,10 @@ type TestContext struct {
 	Instance *InstanceInfo
 	Client   *CsiClient
 	proc     *processes
+	// Workspace of the driver on the instance, which holds its logs
+	workspaceDir string
+	// Command starting the driver on the instance
+	runDriverCmd string
 }
 
 // ClientConfig contains all the parameters required to package a new
@@ -54,20 +64,67 @@ type processes struct {
 }
 
 // SetupInstance sets up the specified GCE Instance for E2E testing and returns a handle to the instance object for future use.
-func SetupInstance(instanceProject, instanceZone, instanceName, instanceServiceAccount string, cs *compute.Service) (*InstanceInfo, error) {
+func SetupInstance(instanceProject, instanceZone, instanceName string, config *InstanceConfig, cs *compute.Service) (*InstanceInfo, error) {
 	// Create the instance in the requisite zone
 	instance, err := CreateInstanceInfo(instanceProject, instanceZone, instanceName, cs)
 	if err != nil {
 		return nil, err
 	}
 
-	err = instance.CreateOrGetInstance(instanceServiceAccount)
+	err = instance.CreateOrGetInstance(config)
 	if err != nil {
 		return nil, err
 	}
 	return instance, nil
 }
 
+// GetInstance returns a handle to an existing GCE Instance that is already set
+// up for E2E testing, once it is available by SSH
+func GetInstance(instanceProject, instanceZone, instanceName string, cs *compute.Service) (*InstanceInfo, error) {
+	instance, err := CreateInstanceInfo(instanceProject, instanceZone, instanceName, cs)
+	if err != nil {
+		return nil, err
+	}
+
+	err = instance.GetExistingInstance()
+	if err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+// SetupInstancePool sets up a pool of size GCE Instances in the zone for E2E
+// testing in parallel. The instances are named namePrefix-<index>, or
+// namePrefix if the pool has a single instance.
+func SetupInstancePool(instanceProject, instanceZone, namePrefix string, size int, config *InstanceConfig, cs *compute.Service) ([]*InstanceInfo, error) {
+	instances := make([]*InstanceInfo, size)
+	errs := make([]error, size)
+	var wg sync.WaitGroup
+	for i := 0; i < size; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			instances[i], errs[i] = SetupInstance(instanceProject, instanceZone, PoolInstanceName(namePrefix, i, size), config, cs)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up instance %s: %v", PoolInstanceName(namePrefix, i, size), err)
+		}
+	}
+	return instances, nil
+}
+
+// PoolInstanceName returns the name of the instance at the index of a pool of
+// size instances set up by SetupInstancePool
+func PoolInstanceName(namePrefix string, index, size int) string {
+	if size == 1 {
+		return namePrefix
+	}
+	return fmt.Sprintf("%s-%d", namePrefix, index)
+}
+
 // SetupNewDriverAndClient gets the driver binary, runs it on the provided instance and connects
 // a CSI client to it through SHH tunnelling. It returns a TestContext with both a handle to the instance
 // that the driver is on and the CSI Client object to make CSI calls to the remote driver.
@@ -109,6 +166,8 @@ func SetupNewDriverAndClient(instance *InstanceInfo, config *ClientConfig) (*Tes
 			sshTunnel:    sshPID,
 			remoteDriver: driverPID,
 		},
+		workspaceDir: config.WorkspaceDir,
+		runDriverCmd: config.RunDriverCmd,
 	}, nil
 }
 
@@ -138,3 +197,55 @@ func TeardownDriverAndClient(context *TestContext) error {
 
 	return nil
 }
+
+// RestartDriver kills the driver process on the GCE instance without letting it
+// clean up, as if it crashed, and starts it again. The CSI Client reconnects
+// through the SSH tunnel once the driver is up.
+func RestartDriver(context *TestContext) error {
+	cmd := fmt.Sprintf("kill -9 %v", context.proc.remoteDriver)
+	output, err := context.Instance.SSH(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to kill driver on remote instance, got output %s: %v", output, err)
+	}
+	// The new driver can only listen on the endpoint once the killed one exited
+	err = wait.Poll(time.Second, time.Minute, func() (bool, error) {
+		_, err := context.Instance.SSH(fmt.Sprintf("kill -0 %v", context.proc.remoteDriver))
+		return err != nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("driver process %v did not exit after being killed: %v", context.proc.remoteDriver, err)
+	}
+
+	driverPID, err := context.Instance.runDriver(context.workspaceDir, context.runDriverCmd)
+	if err != nil {
+		return fmt.Errorf("failed to restart driver: %v", err)
+	}
+	context.proc.remoteDriver = driverPID
+	return nil
+}
+
+// CollectLogs copies the output of the driver and the serial console output of
+// the instance to the local directory, in files prefixed with the instance
+// name. Each file is attempted even if others fail.
+func CollectLogs(context *TestContext, dir string) error {
+	name := context.Instance.GetName()
+	errs := []string{}
+	for _, f := range []string{"prog.out", "prog.err"} {
+		remoteFile := fmt.Sprintf("%s:%s/%s", context.Instance.GetSSHTarget(), context.workspaceDir, f)
+		localFile := filepath.Join(dir, fmt.Sprintf("%s-driver-%s", name, f))
+		if output, err := runSSHCommand("scp", remoteFile, localFile); err != nil {
+			errs = append(errs, fmt.Sprintf("failed to copy %s: %v, output: %q", f, err, output))
+		}
+	}
+	serial, err := context.Instance.GetSerialPortOutput()
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%s-serial.log", name)), []byte(serial), 0644)
+	}
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("failed to save serial console output: %v", err))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to collect logs of instance %s: %s", name, strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -5,4 +5,14 @@ set -o errexit
 
 readonly PKGDIR=sigs.k8s.io/gcp-compute-persistent-disk-csi-driver
 
-ginkgo --v "test/e2e/tests" -- --project ${PROJECT} --service-account ${IAM_NAME} --v=4 --logtostderr
\ No newline at end of file
+# Each of the E2E_NODES parallel processes runs the driver on its own instances
+nodes=${E2E_NODES:-4}
+reuse_flags=""
+# REUSE_INSTANCES is a comma-separated list of zone/name of already set up
+# instances, which only a single process can run on
+if [ -n "${REUSE_INSTANCES:-}" ]; then
+  nodes=1
+  reuse_flags="--reuse-instances=${REUSE_INSTANCES}"
+fi
+
+ginkgo --v --nodes=${nodes} "test/e2e/tests" -- --project ${PROJECT} --service-account "${IAM_NAME:-}" ${reuse_flags} --v=4 --logtostderr
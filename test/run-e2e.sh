@@ -3,6 +3,7 @@
 set -e
 set -x
 
-readonly PKGDIR=sigs.k8s.io/gcp-compute-persistent-disk-csi-driver
+readonly PKGDIR=${GOPATH}/src/sigs.k8s.io/gcp-compute-persistent-disk-csi-driver
 
-go test --timeout 20m --v "${PKGDIR}/test/e2e/tests" --run-in-prow=true --delete-instances=true --logtostderr
\ No newline at end of file
+make -C ${PKGDIR} test-k8s-integration
+${PKGDIR}/bin/k8s-integration-test --run-in-prow=true --run-driver-e2e=true
@@ -1,10 +1,18 @@
 #!/bin/bash
 
 # Optional environment variables
-# GCE_PD_OVERLAY_NAME: which Kustomize overlay to deploy with
+# GCE_PD_OVERLAY_NAME: which Kustomize overlay to deploy with, or auto to pick
+#   it from the Kubernetes version of the cluster
 # GCE_PD_DO_DRIVER_BUILD: if set, don't build the driver from source and just
 #   use the driver version from the overlay
 # GCE_PD_BOSKOS_RESOURCE_TYPE: name of the boskos resource type to reserve
+# STORAGECLASS_FILES: comma separated storageclass files of test/k8s-integration/config
+#   to run the tests with, once per file
+# GKE_ENDPOINT: endpoint of the GKE API, e.g. of a staging environment
+# PLATFORM: platform of the nodes to test, linux or windows. Windows requires
+#   GCE_PD_OVERLAY_NAME to be an overlay deploying the Windows node DaemonSet
+# ARCH: architecture of the nodes and driver image, amd64 or arm64. arm64
+#   requires DEPLOYMENT_STRATEGY=gke
 
 set -o nounset
 set -o errexit
@@ -15,8 +23,14 @@ readonly boskos_resource_type="${GCE_PD_BOSKOS_RESOURCE_TYPE:-gce-project}"
 readonly do_driver_build="${GCE_PD_DO_DRIVER_BUILD:-true}"
 readonly deployment_strategy=${DEPLOYMENT_STRATEGY:-gce}
 readonly gke_cluster_version=${GKE_CLUSTER_VERSION:-latest}
+readonly gke_release_channel=${GKE_RELEASE_CHANNEL:-}
+readonly gke_endpoint=${GKE_ENDPOINT:-}
 readonly kube_version=${GCE_PD_KUBE_VERSION:-master}
 readonly test_version=${TEST_VERSION:-master}
+readonly use_kube_release=${USE_KUBE_RELEASE:-false}
+readonly storageclass_files=${STORAGECLASS_FILES:-sc-standard.yaml}
+readonly platform=${PLATFORM:-linux}
+readonly arch=${ARCH:-amd64}
 
 export GCE_PD_VERBOSITY=9
 
@@ -25,10 +39,17 @@ make -C ${PKGDIR} test-k8s-integration
 base_cmd="${PKGDIR}/bin/k8s-integration-test \
             --run-in-prow=true --deploy-overlay-name=${overlay_name} --service-account-file=${E2E_GOOGLE_APPLICATION_CREDENTIALS} \
             --do-driver-build=${do_driver_build} --boskos-resource-type=${boskos_resource_type} \
-            --storageclass-file=sc-standard.yaml --test-focus="External.Storage" --gce-zone="us-central1-b" \
-            --deployment-strategy=${deployment_strategy} --test-version=${test_version}"
+            --storageclass-file=${storageclass_files} --test-focus="External.Storage" --gce-zone="us-central1-b" \
+            --deployment-strategy=${deployment_strategy} --test-version=${test_version} \
+            --use-kube-release=${use_kube_release} --platform=${platform} --arch=${arch}"
 
-if [ "$deployment_strategy" = "gke" ]; then
+if [ "$deployment_strategy" = "gke" ] && [ -n "$gke_endpoint" ]; then
+  base_cmd="${base_cmd} --gke-endpoint=${gke_endpoint}"
+fi
+
+if [ "$deployment_strategy" = "gke" ] && [ -n "$gke_release_channel" ]; then
+  base_cmd="${base_cmd} --gke-release-channel=${gke_release_channel}"
+elif [ "$deployment_strategy" = "gke" ]; then
   base_cmd="${base_cmd} --gke-cluster-version=${gke_cluster_version}"
 else
   base_cmd="${base_cmd} --kube-version=${kube_version}"
@@ -50,7 +50,11 @@ func TestSanity(t *testing.T) {
 	deviceUtils := mountmanager.NewFakeDeviceUtils()
 
 	//Initialize GCE Driver
-	err = gceDriver.SetupGCEDriver(cloudProvider, mounter, deviceUtils, metadataservice.NewFakeService(), driverName, vendorVersion)
+	meta := metadataservice.NewFakeService()
+	identityServer := driver.NewIdentityServer(gceDriver)
+	controllerServer := driver.NewControllerServer(gceDriver, cloudProvider, meta)
+	nodeServer := driver.NewNodeServer(gceDriver, mounter, deviceUtils, meta)
+	err = gceDriver.SetupGCEDriver(driverName, vendorVersion, nil, identityServer, controllerServer, nodeServer)
 	if err != nil {
 		t.Fatalf("Failed to initialize GCE CSI Driver: %v", err)
 	}
@@ -74,7 +78,7 @@ func TestSanity(t *testing.T) {
 	}()
 
 	go func() {
-		gceDriver.Run(endpoint)
+		gceDriver.Run(endpoint, driver.DefaultServerOptions())
 	}()
 
 	// Run test